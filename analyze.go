@@ -0,0 +1,52 @@
+package migrate
+
+import (
+	"strings"
+)
+
+// analyzeDirective refreshes the planner statistics of the listed tables
+// after the file is applied, such as following a large backfill:
+//
+//	-- migrate:analyze users, orders
+const analyzeDirective = directivePrefix + "analyze"
+
+// Analyzer is implemented by Stores which can refresh a table's planner
+// statistics, such as with ANALYZE in Postgres. It's optional; without it,
+// analyze directives are skipped with a warning.
+type Analyzer interface {
+	Analyze(table string) error
+}
+
+// analyzeTables from an analyze directive line, separated by commas or
+// spaces.
+func analyzeTables(trimmed string) []string {
+	arg := strings.TrimPrefix(trimmed, analyzeDirective)
+	return strings.FieldsFunc(arg, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
+// analyze tables after f was applied. The migration is already recorded, so
+// failures are logged rather than returned: stale statistics slow queries
+// down but don't make the database inconsistent.
+func (m *Migrate) analyze(f *file, tables []string) {
+	if len(tables) == 0 {
+		return
+	}
+	a, ok := m.db.(Analyzer)
+	if !ok {
+		m.warnf("%s %s: store cannot analyze %s\n",
+			m.colorize(colorYellow, "warning"), f.Info.Name(),
+			strings.Join(tables, ", "))
+		return
+	}
+	for _, table := range tables {
+		m.debugf("> %s\n", m.colorize(colorDim, "analyze "+table))
+		m.record("analyze %s %s", f.Info.Name(), table)
+		if err := a.Analyze(table); err != nil {
+			m.warnf("%s %s: analyze %s: %s\n",
+				m.colorize(colorYellow, "warning"), f.Info.Name(),
+				table, err)
+		}
+	}
+}
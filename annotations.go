@@ -0,0 +1,56 @@
+package migrate
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// Annotations are key/value pairs describing the run which applied a
+// migration, such as a deploy ID, ticket, or operator, so the history links
+// back to the deployment system. They're recorded in the meta table as JSON.
+type Annotations map[string]string
+
+// WithAnnotations records a with every migration applied by this Migrate.
+// It may be passed multiple times; later values win for the same key.
+func WithAnnotations(a Annotations) Option {
+	return func(m *Migrate) {
+		if m.annotations == nil {
+			m.annotations = Annotations{}
+		}
+		for k, v := range a {
+			m.annotations[k] = v
+		}
+	}
+}
+
+// Value encodes a as JSON, or as an empty string if there are none.
+func (a Annotations) Value() (driver.Value, error) {
+	if len(a) == 0 {
+		return "", nil
+	}
+	byt, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	return string(byt), nil
+}
+
+// Scan annotations encoded by Value.
+func (a *Annotations) Scan(src interface{}) error {
+	var byt []byte
+	switch v := src.(type) {
+	case nil:
+	case string:
+		byt = []byte(v)
+	case []byte:
+		byt = v
+	default:
+		return fmt.Errorf("cannot scan %T into Annotations", src)
+	}
+	if len(byt) == 0 {
+		*a = nil
+		return nil
+	}
+	return json.Unmarshal(byt, a)
+}
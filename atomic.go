@@ -0,0 +1,169 @@
+package migrate
+
+import (
+	"fmt"
+	"strings"
+)
+
+// atomicDirective groups the statements between a begin and an end into one
+// transaction, even though the rest of the file runs statement by statement:
+//
+//	-- migrate:atomic begin
+//	UPDATE accounts SET balance = balance - 10 WHERE id = 1;
+//	UPDATE accounts SET balance = balance + 10 WHERE id = 2;
+//	-- migrate:atomic end
+//
+// None of the group is checkpointed until it commits, so a failed group is
+// executed again from its start. Groups can't contain COPY, LOAD DATA, or
+// blob statements, nor be used in files with an as directive.
+const atomicDirective = directivePrefix + "atomic"
+
+// Transactor is implemented by Stores which can execute several statements in
+// one transaction, for atomic groups and files executed in one transaction.
+// Files with an atomic directive fail on Stores without one.
+type Transactor interface {
+	// ExecAtomic executes cmds in order within a transaction, rolling
+	// back every statement if any fails. Databases which commit DDL
+	// implicitly, such as MySQL, may only roll back the rest.
+	ExecAtomic(cmds []string) error
+}
+
+// isAtomicDirective reports whether the trimmed line begins or ends an atomic
+// group.
+func isAtomicDirective(trimmed string) bool {
+	return trimmed == atomicDirective ||
+		strings.HasPrefix(trimmed, atomicDirective+" ")
+}
+
+// atomicGroups tracks the group opened by atomic directives while reading a
+// file. Groups are numbered from 1 in the order they're opened, and 0 is
+// outside of any group.
+type atomicGroups struct {
+	cur, n int
+}
+
+// directive updates the current group from the trimmed atomic directive.
+func (g *atomicGroups) directive(trimmed string) error {
+	arg := strings.TrimSpace(strings.TrimPrefix(trimmed, atomicDirective))
+	switch arg {
+	case "begin":
+		if g.cur != 0 {
+			return fmt.Errorf("nested %s begin", atomicDirective)
+		}
+		g.n++
+		g.cur = g.n
+	case "end":
+		if g.cur == 0 {
+			return fmt.Errorf("%s end without begin", atomicDirective)
+		}
+		g.cur = 0
+	default:
+		return fmt.Errorf("unknown %s %q: use begin or end",
+			atomicDirective, arg)
+	}
+	return nil
+}
+
+// close the file, reporting a group which was never ended.
+func (g *atomicGroups) close() error {
+	if g.cur != 0 {
+		return fmt.Errorf("%s begin without end", atomicDirective)
+	}
+	return nil
+}
+
+// atomicSection of a migration file, either within an atomic group or
+// between them.
+type atomicSection struct {
+	text  string
+	group int
+}
+
+// splitAtomic splits s at each atomic directive. Each section begins with the
+// terminator directive in effect on dbt, so it parses on its own.
+func splitAtomic(dbt DBType, s string) ([]atomicSection, error) {
+	var (
+		sections   []atomicSection
+		groups     atomicGroups
+		text       strings.Builder
+		terminator = ";"
+	)
+	for _, line := range strings.SplitAfter(s, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if t, ok := cutTerminatorDirective(dbt, trimmed); ok {
+			terminator = t
+		}
+		if !isAtomicDirective(trimmed) {
+			text.WriteString(line)
+			continue
+		}
+		sections = append(sections, atomicSection{
+			text:  text.String(),
+			group: groups.cur,
+		})
+		if err := groups.directive(trimmed); err != nil {
+			return nil, err
+		}
+		text.Reset()
+		if terminator != ";" {
+			text.WriteString(terminatorDirective + " " + terminator + "\n")
+		}
+	}
+	if err := groups.close(); err != nil {
+		return nil, err
+	}
+	sections = append(sections, atomicSection{text: text.String()})
+	return sections, nil
+}
+
+// checkAtomic confirms stmt can be executed in its atomic group, if any.
+func checkAtomic(stmt statement) error {
+	if stmt.group == 0 || batchable(stmt) {
+		return nil
+	}
+	if stmt.role != "" {
+		return fmt.Errorf("%s cannot be used with %s", atomicDirective,
+			asDirective)
+	}
+	return fmt.Errorf("%s group cannot contain COPY, LOAD DATA, or %s",
+		atomicDirective, blobDirective)
+}
+
+// groupLen is the number of statements at the start of stmts in the same
+// atomic group as the first, or 0 if it's not in one.
+func groupLen(stmts []statement) int {
+	if len(stmts) == 0 || stmts[0].group == 0 {
+		return 0
+	}
+	var n int
+	for n < len(stmts) && stmts[n].group == stmts[0].group {
+		n++
+	}
+	return n
+}
+
+// execAtomic executes stmts from f, the first of which is at index start, in
+// one transaction, then checkpoints each of them. Since a failed group is
+// rolled back, it's retried whole as configured by WithRetries.
+func (m *Migrate) execAtomic(f *file, stmts []statement, start int) error {
+	t, ok := m.db.(Transactor)
+	if !ok {
+		return fmt.Errorf("%s: store cannot execute %s groups",
+			f.Info.Name(), atomicDirective)
+	}
+	for _, stmt := range stmts {
+		if m.onlineSchemaChange(stmt.sql) {
+			return fmt.Errorf("%s: %s groups cannot contain schema changes on %s",
+				f.Info.Name(), atomicDirective, m.dbt)
+		}
+	}
+	kind := "atomic group"
+	if m.inTransaction(f) {
+		kind = "transaction"
+	}
+	return m.execJoined(f, stmts, start, kind, func(
+		cmds []string,
+	) error {
+		return m.retry(f, start, func() error { return t.ExecAtomic(cmds) })
+	})
+}
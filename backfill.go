@@ -0,0 +1,110 @@
+package migrate
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// BackfillFunc processes a batch of at most limit rows whose keys sort after
+// the given key, which is empty for the first batch. It returns the last key
+// processed, or an empty key once no rows remain. Batches should be
+// idempotent, such as an UPDATE bounded by key, since a crash after a batch
+// commits but before it's checkpointed runs it again.
+type BackfillFunc func(after string, limit int) (last string, err error)
+
+// maxBackfillKey is the longest key which fits in a checkpoint's checksum
+// column on every Store.
+const maxBackfillKey = 255
+
+// Backfill runs fn in batches of size rows until it reports that no rows
+// remain, checkpointing the last key after each batch in metacheckpoints. A
+// backfill which stopped, such as after a crash, resumes after its last
+// checkpointed batch, and one which completed is skipped. The namespace is
+// locked meanwhile, as when migrating, so replicas calling Backfill on startup
+// don't run the same batches; see Locker. The name identifies the backfill's
+// checkpoints, so it must be unique and stable across releases. This function
+// reports whether any batch ran.
+func (m *Migrate) Backfill(name string, size int, fn BackfillFunc) (bool, error) {
+	switch {
+	case m.readOnly:
+		return false, errors.New("cannot backfill: opened read-only by Inspect")
+	case !m.loaded:
+		return false, errors.New("must call Init before Backfill")
+	case size < 1:
+		return false, fmt.Errorf("invalid backfill size %d", size)
+	}
+	unlock, err := m.lock()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	m.lockFile(name)
+
+	// Backfills keep their checkpoints in their own namespace, since
+	// applying a migration deletes every checkpoint in its namespace.
+	// They're read under the lock, since another process may have just
+	// finished the backfill.
+	ns := m.namespace + ":backfill:" + name
+	done, err := m.tracker.GetMetaCheckpoints(ns, name+":done")
+	if err != nil {
+		return false, errors.Wrap(err, "get checkpoints")
+	}
+	if len(done) > 0 {
+		return false, nil
+	}
+	keys, err := m.tracker.GetMetaCheckpoints(ns, name)
+	if err != nil {
+		return false, errors.Wrap(err, "get checkpoints")
+	}
+	var after string
+	if len(keys) > 0 {
+		after = keys[len(keys)-1]
+	}
+	if after != "" {
+		m.infof("resuming backfill %s after %s\n", name, after)
+	}
+	for i := len(keys); ; i++ {
+		m.record("backfill %s [%d] after %q", name, i, after)
+		last, err := fn(after, size)
+		if err != nil {
+			return i > len(keys), &MigrationError{
+				File:  name,
+				Index: i,
+				Class: m.classifyError(err),
+				Err:   err,
+			}
+		}
+		if last == "" {
+			break
+		}
+		if len(last) > maxBackfillKey {
+			return true, fmt.Errorf("backfill %s: key %q exceeds %d bytes",
+				name, last, maxBackfillKey)
+		}
+		if last == after {
+			return true, fmt.Errorf("backfill %s: no progress after %q",
+				name, after)
+		}
+		err = m.tracker.InsertMetaCheckpoint(ns, name, last, last, i)
+		if err != nil {
+			return true, errors.Wrap(err, "insert checkpoint")
+		}
+		m.debugf("> %s\n", m.colorize(colorDim,
+			fmt.Sprintf("backfill %s through %s", name, last)))
+		after = last
+	}
+
+	// Replace the batches' checkpoints with one marking the backfill
+	// done. If this is interrupted, the backfill starts over, which
+	// idempotent batches allow.
+	if err = m.tracker.DeleteMetaCheckpoints(ns); err != nil {
+		return true, errors.Wrap(err, "delete checkpoints")
+	}
+	err = m.tracker.InsertMetaCheckpoint(ns, name+":done", "", "", 0)
+	if err != nil {
+		return true, errors.Wrap(err, "insert checkpoint")
+	}
+	m.infof("%s %s\n", m.colorize(colorGreen, "backfilled"), name)
+	return true, nil
+}
@@ -0,0 +1,104 @@
+package migrate
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Batcher is implemented by Stores which can execute several statements in
+// one round trip. It's optional; without it, statements are always executed
+// one at a time.
+type Batcher interface {
+	// ExecBatch executes cmds in order, stopping at the first failure.
+	// None of the statements are checkpointed until the batch succeeds,
+	// so ExecBatch should undo the earlier statements of a failed batch
+	// where the database allows it.
+	ExecBatch(cmds []string) error
+}
+
+// batchable reports whether stmt can be sent in a batch, since statements
+// with arguments or data can't be.
+func batchable(stmt statement) bool {
+	if len(stmt.blobs) > 0 || stmt.role != "" || isCopyStatement(stmt.sql) {
+		return false
+	}
+	_, ok := loadDataFilename(stmt.sql)
+	return !ok
+}
+
+// batchLen is the number of statements at the start of stmts to send in one
+// batch. It's 0 if batching is disabled or unsupported by the Store, or if
+// logging warnings, which are only reported for the last statement of a batch.
+// Statements in atomic groups are executed by their group instead, and online
+// schema changes on their own.
+func (m *Migrate) batchLen(stmts []statement) int {
+	if m.batchSize < 2 || m.warnings || m.dev {
+		return 0
+	}
+	if _, ok := m.db.(Batcher); !ok {
+		return 0
+	}
+	var n int
+	for n < len(stmts) && n < m.batchSize && batchable(stmts[n]) &&
+		stmts[n].group == 0 && !m.onlineSchemaChange(stmts[n].sql) {
+		n++
+	}
+	return n
+}
+
+// execBatch of stmts from f, the first of which is at index start, then
+// checkpoint each of them.
+func (m *Migrate) execBatch(f *file, stmts []statement, start int) error {
+	return m.execJoined(f, stmts, start, "batch", m.db.(Batcher).ExecBatch)
+}
+
+// execJoined executes stmts from f together with exec, logging them as the
+// kind of group they form, then checkpoints each of them.
+func (m *Migrate) execJoined(
+	f *file,
+	stmts []statement,
+	start int,
+	kind string,
+	exec func(cmds []string) error,
+) error {
+	cmds := make([]string, 0, len(stmts))
+	for _, stmt := range stmts {
+		m.logStatement(stmt.sql)
+		cmds = append(cmds, stmt.sql)
+	}
+	end := start + len(stmts) - 1
+	joined := strings.Join(cmds, ";\n")
+	m.record("exec %s [%d-%d]\n%s", f.Info.Name(), start, end,
+		m.redact(joined))
+	t := time.Now()
+	if err := exec(cmds); err != nil {
+		m.record("failed %s [%d-%d] after %s: %s", f.Info.Name(), start,
+			end, time.Since(t), m.redactError(err))
+		m.errorf("%s %d-%d\n",
+			m.colorize(colorRed, "failed on "+kind), start, end)
+		return &MigrationError{
+			File:  f.Info.Name(),
+			Index: start,
+			SQL:   m.redact(joined),
+			Class: m.classifyError(err),
+			Err: fmt.Errorf("%s of statements %d-%d: %w", kind, start,
+				end, err),
+		}
+	}
+	elapsed := time.Since(t)
+	m.record("ok %s [%d-%d] in %s", f.Info.Name(), start, end, elapsed)
+	m.emit(StatementExecuted{
+		Filename:   f.Info.Name(),
+		Index:      start,
+		SQL:        joined,
+		Statements: len(stmts),
+		Duration:   elapsed,
+	})
+	for i, cmd := range cmds {
+		if err := m.checkpoint(f, start+i, cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,596 @@
+// Package bigquery records migrations in a BigQuery dataset. BigQuery doesn't
+// support transactions around DDL, so every statement runs as its own job and
+// is checkpointed once it succeeds; a failed migration resumes after the last
+// statement which succeeded.
+package bigquery
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+
+	bq "cloud.google.com/go/bigquery"
+	"github.com/pkg/errors"
+	"github.com/thankful-ai/migrate"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// DB is a Store which keeps its meta tables in a dataset. Unqualified table
+// names in migrations refer to the same dataset.
+type DB struct {
+	projectID string
+	dataset   string
+	opts      []option.ClientOption
+
+	// prefix of the meta tables' names; see SetTablePrefix.
+	prefix string
+
+	client *bq.Client
+}
+
+// New Store for dataset in projectID. Credentials are found as described by
+// Google's Application Default Credentials unless given in opts.
+func New(projectID, dataset string, opts ...option.ClientOption) *DB {
+	return &DB{projectID: projectID, dataset: dataset, opts: opts}
+}
+
+func (db *DB) Open() error {
+	var err error
+	db.client, err = bq.NewClient(context.Background(), db.projectID,
+		db.opts...)
+	if err != nil {
+		return errors.Wrap(err, "new bigquery client")
+	}
+	return nil
+}
+
+func (db *DB) Close() error {
+	if db.client == nil {
+		return nil
+	}
+	return db.client.Close()
+}
+
+// SetTablePrefix prepends prefix to the names of the meta tables. See
+// migrate.WithTablePrefix.
+func (db *DB) SetTablePrefix(prefix string) { db.prefix = prefix }
+
+// meta prefixes the names of the meta tables in the query q.
+func (db *DB) meta(q string) string {
+	return migrate.PrefixMetaTables(db.prefix, q)
+}
+
+func (db *DB) Ping(ctx context.Context) error {
+	_, err := db.client.Dataset(db.dataset).Metadata(ctx)
+	return err
+}
+
+// result of a query job.
+type result int64
+
+func (r result) LastInsertId() (int64, error) {
+	return 0, errors.New("bigquery does not support LastInsertId")
+}
+
+func (r result) RowsAffected() (int64, error) { return int64(r), nil }
+
+// Exec query as a job and wait for it to finish. Arguments are bound to
+// positional ? parameters.
+func (db *DB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.ExecContext(context.Background(), query, args...)
+}
+
+// ExecContext is Exec, canceling the job once ctx is done.
+func (db *DB) ExecContext(
+	ctx context.Context,
+	query string,
+	args ...interface{},
+) (sql.Result, error) {
+	params := make([]bq.QueryParameter, 0, len(args))
+	for _, arg := range args {
+		params = append(params, bq.QueryParameter{Value: arg})
+	}
+	return db.execContext(ctx, query, params)
+}
+
+func (db *DB) newQuery(query string, params []bq.QueryParameter) *bq.Query {
+	q := db.client.Query(query)
+	q.DefaultProjectID = db.projectID
+	q.DefaultDatasetID = db.dataset
+	q.Parameters = params
+	return q
+}
+
+func (db *DB) exec(query string, params []bq.QueryParameter) (sql.Result, error) {
+	return db.execContext(context.Background(), query, params)
+}
+
+func (db *DB) execContext(
+	ctx context.Context,
+	query string,
+	params []bq.QueryParameter,
+) (sql.Result, error) {
+	job, err := db.newQuery(query, params).Run(ctx)
+	if err != nil {
+		return nil, err
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		// Jobs outlive the wait, so stop this one rather than leaving
+		// it to finish unobserved.
+		if ctx.Err() != nil {
+			_ = job.Cancel(context.Background())
+		}
+		return nil, err
+	}
+	if err = status.Err(); err != nil {
+		return nil, err
+	}
+	var rows int64
+	if s, ok := status.Statistics.Details.(*bq.QueryStatistics); ok {
+		rows = s.NumDMLAffectedRows
+	}
+	return result(rows), nil
+}
+
+// query calls fn with each row returned by query.
+func (db *DB) query(
+	query string,
+	params []bq.QueryParameter,
+	fn func([]bq.Value) error,
+) error {
+	it, err := db.newQuery(query, params).Read(context.Background())
+	if err != nil {
+		return err
+	}
+	for {
+		var row []bq.Value
+		err := it.Next(&row)
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(row); err != nil {
+			return err
+		}
+	}
+}
+
+// named parameters from alternating names and values.
+func named(pairs ...interface{}) []bq.QueryParameter {
+	params := make([]bq.QueryParameter, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		params = append(params, bq.QueryParameter{
+			Name:  pairs[i].(string),
+			Value: pairs[i+1],
+		})
+	}
+	return params
+}
+
+func (db *DB) CreateMetaIfNotExists() error {
+	q := db.meta(`CREATE TABLE IF NOT EXISTS meta (
+		namespace STRING NOT NULL,
+		filename STRING NOT NULL,
+		md5 STRING NOT NULL,
+		content STRING NOT NULL,
+		algorithm STRING NOT NULL,
+		variant STRING NOT NULL,
+		statements INT64 NOT NULL,
+		duration_ns INT64 NOT NULL,
+		createdat TIMESTAMP NOT NULL,
+		annotations STRING,
+		appliedat TIMESTAMP
+	)`)
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "create meta table")
+	}
+	return nil
+}
+
+func (db *DB) CreateMetaCheckpointsIfNotExists() error {
+	q := db.meta(`CREATE TABLE IF NOT EXISTS metacheckpoints (
+		namespace STRING NOT NULL,
+		filename STRING NOT NULL,
+		idx INT64 NOT NULL,
+		md5 STRING NOT NULL,
+		content STRING NOT NULL,
+		createdat TIMESTAMP NOT NULL
+	)`)
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "create metacheckpoints table")
+	}
+	return nil
+}
+
+func (db *DB) CreateMetaObjectsIfNotExists() error {
+	q := db.meta(`CREATE TABLE IF NOT EXISTS metaobjects (
+		namespace STRING NOT NULL,
+		filename STRING NOT NULL,
+		content STRING NOT NULL,
+		createdat TIMESTAMP NOT NULL
+	)`)
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "create metaobjects table")
+	}
+	return nil
+}
+
+func (db *DB) CreateMetaFailuresIfNotExists() error {
+	q := db.meta(`CREATE TABLE IF NOT EXISTS metafailures (
+		namespace STRING NOT NULL,
+		filename STRING NOT NULL,
+		idx INT64 NOT NULL,
+		error STRING NOT NULL,
+		createdat TIMESTAMP NOT NULL
+	)`)
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "create metafailures table")
+	}
+	return nil
+}
+
+func (db *DB) GetMetaFailures(namespace string) ([]migrate.Failure, error) {
+	failures := []migrate.Failure{}
+	q := db.meta(`
+	SELECT namespace, filename, idx, error, createdat FROM metafailures
+	WHERE namespace=@namespace
+	ORDER BY createdat`)
+	err := db.query(q, named("namespace", namespace), func(row []bq.Value) error {
+		failures = append(failures, migrate.Failure{
+			Namespace: row[0].(string),
+			Filename:  row[1].(string),
+			Index:     int(row[2].(int64)),
+			Error:     row[3].(string),
+			FailedAt:  row[4].(time.Time),
+		})
+		return nil
+	})
+	return failures, err
+}
+
+func (db *DB) InsertMetaFailure(f migrate.Failure) error {
+	q := db.meta(`
+		INSERT INTO metafailures (namespace, filename, idx, error, createdat)
+		VALUES (@namespace, @filename, @idx, @error, CURRENT_TIMESTAMP())`)
+	_, err := db.exec(q, named("namespace", f.Namespace,
+		"filename", f.Filename, "idx", f.Index, "error", f.Error))
+	return err
+}
+
+func (db *DB) GetMetaObjects(namespace string) ([]migrate.Object, error) {
+	objects := []migrate.Object{}
+	q := db.meta(`
+	SELECT namespace, filename, content FROM metaobjects
+	WHERE namespace=@namespace`)
+	err := db.query(q, named("namespace", namespace), func(row []bq.Value) error {
+		objects = append(objects, migrate.Object{
+			Namespace: row[0].(string),
+			Filename:  row[1].(string),
+			Content:   row[2].(string),
+		})
+		return nil
+	})
+	return objects, err
+}
+
+func (db *DB) UpsertMetaObject(o migrate.Object) error {
+	q := db.meta(`
+		MERGE metaobjects t
+		USING (SELECT @namespace AS namespace, @filename AS filename) s
+		ON t.namespace = s.namespace AND t.filename = s.filename
+		WHEN MATCHED THEN
+			UPDATE SET content=@content, createdat=CURRENT_TIMESTAMP()
+		WHEN NOT MATCHED THEN
+			INSERT (namespace, filename, content, createdat)
+			VALUES (@namespace, @filename, @content, CURRENT_TIMESTAMP())`)
+	_, err := db.exec(q, named("namespace", o.Namespace,
+		"filename", o.Filename, "content", o.Content))
+	return err
+}
+
+func (db *DB) GetMigrations(namespace string) ([]migrate.Migration, error) {
+	migrations := []migrate.Migration{}
+	q := db.meta(`
+	SELECT namespace, filename, content, md5, algorithm, variant,
+		statements, duration_ns, annotations, appliedat
+	FROM meta
+	WHERE namespace=@namespace
+	ORDER BY CAST(REGEXP_EXTRACT(filename, r'^\d+') AS INT64)`)
+	err := db.query(q, named("namespace", namespace), func(row []bq.Value) error {
+		mg := migrate.Migration{
+			Namespace:  row[0].(string),
+			Filename:   row[1].(string),
+			Content:    row[2].(string),
+			Checksum:   row[3].(string),
+			Algorithm:  row[4].(string),
+			Variant:    row[5].(string),
+			Statements: int(row[6].(int64)),
+			Duration:   time.Duration(row[7].(int64)),
+		}
+		if err := mg.Annotations.Scan(row[8]); err != nil {
+			return errors.Wrap(err, "scan annotations")
+		}
+		if t, ok := row[9].(time.Time); ok {
+			mg.AppliedAt = t.UTC()
+		}
+		migrations = append(migrations, mg)
+		return nil
+	})
+	return migrations, err
+}
+
+func (db *DB) GetMetaCheckpoints(namespace, filename string) ([]string, error) {
+	checkpoints := []string{}
+	q := db.meta(`
+	SELECT md5 FROM metacheckpoints
+	WHERE namespace=@namespace AND filename=@filename
+	ORDER BY idx`)
+	params := named("namespace", namespace, "filename", filename)
+	err := db.query(q, params, func(row []bq.Value) error {
+		checkpoints = append(checkpoints, row[0].(string))
+		return nil
+	})
+	return checkpoints, err
+}
+
+// migrationParams of m for inserting or updating it in meta.
+func migrationParams(m migrate.Migration) []bq.QueryParameter {
+	return named("namespace", m.Namespace, "filename", m.Filename,
+		"content", m.Content, "md5", m.Checksum,
+		"algorithm", m.Algorithm, "variant", m.Variant,
+		"statements", m.Statements, "duration_ns", int64(m.Duration),
+		"annotations", annotationsParam(m.Annotations),
+		"appliedat", m.AppliedAt)
+}
+
+// annotationsParam encodes a as a string, since BigQuery query parameters
+// don't use driver.Valuer.
+func annotationsParam(a migrate.Annotations) string {
+	v, _ := a.Value()
+	return v.(string)
+}
+
+func (db *DB) UpsertMigration(m migrate.Migration) error {
+	q := db.meta(`
+		MERGE meta t
+		USING (SELECT @namespace AS namespace, @filename AS filename) s
+		ON t.namespace = s.namespace AND t.filename = s.filename
+		WHEN MATCHED THEN
+			UPDATE SET content=@content, md5=@md5, algorithm=@algorithm,
+				variant=@variant, statements=@statements,
+				duration_ns=@duration_ns, annotations=@annotations,
+				appliedat=@appliedat
+		WHEN NOT MATCHED THEN
+			INSERT (namespace, filename, content, md5, algorithm,
+				variant, statements, duration_ns, annotations,
+				appliedat, createdat)
+			VALUES (@namespace, @filename, @content, @md5, @algorithm,
+				@variant, @statements, @duration_ns, @annotations,
+				@appliedat, CURRENT_TIMESTAMP())`)
+	_, err := db.exec(q, migrationParams(m))
+	return err
+}
+
+func (db *DB) InsertMetaCheckpoint(
+	namespace, filename, content, checksum string,
+	idx int,
+) error {
+	q := db.meta(`
+		INSERT INTO metacheckpoints
+			(namespace, filename, content, idx, md5, createdat)
+		VALUES (@namespace, @filename, @content, @idx, @md5,
+			CURRENT_TIMESTAMP())`)
+	_, err := db.exec(q, named("namespace", namespace,
+		"filename", filename, "content", content, "idx", idx,
+		"md5", checksum))
+	return err
+}
+
+func (db *DB) InsertMigration(m migrate.Migration) error {
+	q := db.meta(`
+		INSERT INTO meta
+			(namespace, filename, content, md5, algorithm, variant,
+			statements, duration_ns, annotations, appliedat,
+			createdat)
+		VALUES (@namespace, @filename, @content, @md5, @algorithm,
+			@variant, @statements, @duration_ns, @annotations,
+			@appliedat, CURRENT_TIMESTAMP())`)
+	_, err := db.exec(q, migrationParams(m))
+	return err
+}
+
+func (db *DB) DeleteMetaCheckpoints(namespace string) error {
+	q := db.meta(`DELETE FROM metacheckpoints WHERE namespace=@namespace`)
+	_, err := db.exec(q, named("namespace", namespace))
+	return err
+}
+
+// DeleteMigration removes filename from the history of namespace.
+func (db *DB) DeleteMigration(namespace, filename string) error {
+	q := db.meta(`
+	DELETE FROM meta WHERE namespace=@namespace AND filename=@filename`)
+	_, err := db.exec(q, named("namespace", namespace,
+		"filename", filename))
+	return err
+}
+
+func (db *DB) CreateMetaVersionIfNotExists(schemaVersion int) (int, error) {
+	exists, err := db.tableExists("metaversion")
+	if err != nil {
+		return 0, errors.Wrap(err, "metaversion exists")
+	}
+	if !exists {
+		q := db.meta(`
+		CREATE TABLE metaversion (version INT64 NOT NULL)`)
+		if _, err := db.Exec(q); err != nil {
+			return 0, errors.Wrap(err, "create metaversion table")
+		}
+	}
+	version, err := db.getVersion()
+	switch {
+	case err == sql.ErrNoRows:
+		if exists {
+			schemaVersion = 0
+		}
+		q := db.meta(`
+		INSERT INTO metaversion (version) VALUES (@version)`)
+		if _, err := db.exec(q, named("version", schemaVersion)); err != nil {
+			return 0, errors.Wrap(err, "insert version")
+		}
+		return schemaVersion, nil
+	case err != nil:
+		return 0, errors.Wrap(err, "get version")
+	}
+	return version, nil
+}
+
+// GetMetaVersion reports the current version without creating or modifying
+// anything. It returns 0 if the meta tables predate versioning and -1 if they
+// don't exist.
+func (db *DB) GetMetaVersion() (int, error) {
+	exists, err := db.tableExists("metaversion")
+	if err != nil {
+		return 0, errors.Wrap(err, "metaversion exists")
+	}
+	if !exists {
+		exists, err = db.tableExists("meta")
+		if err != nil {
+			return 0, errors.Wrap(err, "meta exists")
+		}
+		if exists {
+			return 0, nil
+		}
+		return -1, nil
+	}
+	version, err := db.getVersion()
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, nil
+	case err != nil:
+		return 0, errors.Wrap(err, "get version")
+	}
+	return version, nil
+}
+
+// getVersion from metaversion, returning sql.ErrNoRows if it's empty.
+func (db *DB) getVersion() (int, error) {
+	version := -1
+	q := db.meta(`SELECT version FROM metaversion`)
+	err := db.query(q, nil, func(row []bq.Value) error {
+		version = int(row[0].(int64))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if version < 0 {
+		return 0, sql.ErrNoRows
+	}
+	return version, nil
+}
+
+func (db *DB) tableExists(name string) (bool, error) {
+	_, err := db.client.Dataset(db.dataset).Table(db.meta(name)).Metadata(
+		context.Background())
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// setVersion of the meta tables.
+func (db *DB) setVersion(version int) error {
+	q := db.meta(`UPDATE metaversion SET version=@version WHERE TRUE`)
+	if _, err := db.exec(q, named("version", version)); err != nil {
+		return errors.Wrap(err, "update metaversion")
+	}
+	return nil
+}
+
+// UpgradeToV1 only records the version. BigQuery's meta tables were created
+// in the current format, so there's nothing to upgrade.
+func (db *DB) UpgradeToV1([]migrate.Migration) error { return db.setVersion(1) }
+
+// UpgradeToV2 only records the version; see UpgradeToV1.
+func (db *DB) UpgradeToV2() error { return db.setVersion(2) }
+
+// UpgradeToV3 only records the version; see UpgradeToV1.
+func (db *DB) UpgradeToV3() error { return db.setVersion(3) }
+
+// UpgradeToV4 only records the version; see UpgradeToV1.
+func (db *DB) UpgradeToV4() error { return db.setVersion(4) }
+
+// UpgradeToV5 only records the version; see UpgradeToV1.
+func (db *DB) UpgradeToV5() error { return db.setVersion(5) }
+
+// UpgradeToV6 records the annotations of the run which applied each
+// migration. BigQuery can only add nullable columns, so the column is
+// nullable in new meta tables too.
+func (db *DB) UpgradeToV6() error {
+	q := db.meta(`
+	ALTER TABLE meta ADD COLUMN IF NOT EXISTS annotations STRING`)
+	if _, err := db.exec(q, nil); err != nil {
+		return errors.Wrap(err, "add annotations column")
+	}
+	return db.setVersion(6)
+}
+
+// UpgradeToV7 only records the version. Migrate rewrites md5 checksums as
+// SHA-256 once it's verified them.
+func (db *DB) UpgradeToV7() error { return db.setVersion(7) }
+
+// UpgradeToV8 records when each migration was applied. Migrations applied
+// before use the time they were recorded. Like annotations, the column is
+// nullable.
+func (db *DB) UpgradeToV8() error {
+	q := db.meta(`
+	ALTER TABLE meta ADD COLUMN IF NOT EXISTS appliedat TIMESTAMP`)
+	if _, err := db.exec(q, nil); err != nil {
+		return errors.Wrap(err, "add appliedat column")
+	}
+	q = db.meta(`
+	UPDATE meta SET appliedat=createdat WHERE appliedat IS NULL`)
+	if _, err := db.exec(q, nil); err != nil {
+		return errors.Wrap(err, "update appliedat")
+	}
+	return db.setVersion(8)
+}
+
+// ClassifyError from a BigQuery job or API request.
+func (db *DB) ClassifyError(err error) migrate.ErrorClass {
+	var jobErr *bq.Error
+	if errors.As(err, &jobErr) {
+		switch jobErr.Reason {
+		case "accessDenied":
+			return migrate.ClassPermissionDenied
+		case "duplicate":
+			return migrate.ClassDuplicateObject
+		case "invalidQuery":
+			if strings.HasPrefix(jobErr.Message, "Syntax error") {
+				return migrate.ClassSyntax
+			}
+		}
+		return migrate.ClassUnknown
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case http.StatusForbidden:
+			return migrate.ClassPermissionDenied
+		case http.StatusConflict:
+			return migrate.ClassDuplicateObject
+		}
+	}
+	return migrate.ClassUnknown
+}
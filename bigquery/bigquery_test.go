@@ -0,0 +1,128 @@
+package bigquery
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	bq "cloud.google.com/go/bigquery"
+	"github.com/pkg/errors"
+	"github.com/thankful-ai/migrate"
+	"google.golang.org/api/googleapi"
+)
+
+func TestClassifyError(t *testing.T) {
+	db := &DB{}
+	tcs := []struct {
+		err  error
+		want migrate.ErrorClass
+	}{
+		{
+			err:  &bq.Error{Reason: "invalidQuery", Message: "Syntax error: Unexpected identifier"},
+			want: migrate.ClassSyntax,
+		},
+		{
+			err:  &bq.Error{Reason: "duplicate", Message: "Already Exists: Table p:d.users"},
+			want: migrate.ClassDuplicateObject,
+		},
+		{
+			err:  errors.Wrap(&googleapi.Error{Code: http.StatusForbidden}, "run"),
+			want: migrate.ClassPermissionDenied,
+		},
+		{
+			err:  errors.New("other"),
+			want: migrate.ClassUnknown,
+		},
+	}
+	for _, tc := range tcs {
+		if got := db.ClassifyError(tc.err); got != tc.want {
+			t.Errorf("%v: expected %s, got %s", tc.err, tc.want, got)
+		}
+	}
+}
+
+func TestMeta(t *testing.T) {
+	db := newDB(t)
+
+	v, err := db.GetMetaVersion()
+	check(t, err)
+	if v != -1 {
+		t.Fatalf("expected version -1, got %d", v)
+	}
+	check(t, db.CreateMetaIfNotExists())
+	check(t, db.CreateMetaCheckpointsIfNotExists())
+	v, err = db.CreateMetaVersionIfNotExists(5)
+	check(t, err)
+	if v != 5 {
+		t.Fatalf("expected version 5, got %d", v)
+	}
+
+	err = db.InsertMigration(migrate.Migration{
+		Filename:   "10.sql",
+		Content:    "SELECT 10;",
+		Checksum:   "abc",
+		Algorithm:  "sha256",
+		Statements: 1,
+		Duration:   time.Millisecond,
+	})
+	check(t, err)
+	err = db.UpsertMigration(migrate.Migration{
+		Filename:  "2.sql",
+		Content:   "SELECT 2;",
+		Checksum:  "def",
+		Algorithm: "sha256",
+	})
+	check(t, err)
+	ms, err := db.GetMigrations("")
+	check(t, err)
+	if len(ms) != 2 || ms[0].Filename != "2.sql" || ms[1].Filename != "10.sql" {
+		t.Fatalf("unexpected migrations %+v", ms)
+	}
+	if ms[1].Duration != time.Millisecond {
+		t.Fatalf("expected 1ms, got %s", ms[1].Duration)
+	}
+
+	check(t, db.InsertMetaCheckpoint("", "3.sql", "SELECT 3;", "ghi", 0))
+	mcs, err := db.GetMetaCheckpoints("", "3.sql")
+	check(t, err)
+	if len(mcs) != 1 || mcs[0] != "ghi" {
+		t.Fatalf("unexpected checkpoints %v", mcs)
+	}
+	check(t, db.DeleteMetaCheckpoints(""))
+	mcs, err = db.GetMetaCheckpoints("", "3.sql")
+	check(t, err)
+	if len(mcs) != 0 {
+		t.Fatalf("expected no checkpoints, got %v", mcs)
+	}
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newDB in a new dataset, which is deleted after the test. BigQuery can't be
+// run locally, so tests which need it are skipped unless BIGQUERY_PROJECT is
+// set.
+func newDB(t *testing.T) *DB {
+	t.Helper()
+	project := os.Getenv("BIGQUERY_PROJECT")
+	if project == "" {
+		t.Skip("missing BIGQUERY_PROJECT")
+	}
+	dataset := fmt.Sprintf("migrate_test_%d", time.Now().UnixNano())
+	db := New(project, dataset)
+	check(t, db.Open())
+	ctx := context.Background()
+	check(t, db.client.Dataset(dataset).Create(ctx, nil))
+	t.Cleanup(func() {
+		_ = db.client.Dataset(dataset).DeleteWithContents(ctx)
+		_ = db.Close()
+	})
+	return db
+}
@@ -0,0 +1,61 @@
+package clickhouse
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/thankful-ai/migrate"
+)
+
+func TestClassifyError(t *testing.T) {
+	db := &DB{}
+	tcs := []struct {
+		err  error
+		want migrate.ErrorClass
+	}{
+		{
+			err:  errors.New("code: 57, message: Table app.users already exists"),
+			want: migrate.ClassDuplicateObject,
+		},
+		{
+			err:  errors.Wrap(errors.New("code: 497, message: analyst: Not enough privileges. To execute this query, it's necessary to have the grant CREATE TABLE ON app.users"), "exec"),
+			want: migrate.ClassPermissionDenied,
+		},
+		{
+			err:  errors.New("code: 62, message: Syntax error: failed at position 8 ('TABEL')"),
+			want: migrate.ClassSyntax,
+		},
+		{
+			err:  errors.New("code: 210, message: Connection refused"),
+			want: migrate.ClassConnectionLost,
+		},
+		{
+			err:  errors.New("code: 60, message: Table app.missing does not exist"),
+			want: migrate.ClassUnknown,
+		},
+		{
+			err:  errors.New("other"),
+			want: migrate.ClassUnknown,
+		},
+	}
+	for _, tc := range tcs {
+		if got := db.ClassifyError(tc.err); got != tc.want {
+			t.Errorf("%v: expected %s, got %s", tc.err, tc.want, got)
+		}
+	}
+}
+
+func TestWithCluster(t *testing.T) {
+	db := New("clickhouse://localhost:9000/app")
+	if got := db.engine("id", "createdat"); got != `ENGINE = ReplacingMergeTree(createdat) ORDER BY (id)` {
+		t.Fatalf("unexpected engine %s", got)
+	}
+	db = New("clickhouse://localhost:9000/app", WithCluster("analytics"))
+	if got := db.onCluster(); got != " ON CLUSTER analytics" {
+		t.Fatalf("unexpected clause %q", got)
+	}
+	want := `ENGINE = ReplicatedReplacingMergeTree('/clickhouse/tables/{uuid}/{shard}', '{replica}', createdat) ORDER BY (id)`
+	if got := db.engine("id", "createdat"); got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
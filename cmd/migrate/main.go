@@ -1,51 +1,423 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/thankful-ai/migrate"
+	"github.com/thankful-ai/migrate/bigquery"
 	"github.com/thankful-ai/migrate/mysql"
+	"github.com/thankful-ai/migrate/mysqlparse"
+	"github.com/thankful-ai/migrate/pgparse"
 	"github.com/thankful-ai/migrate/postgres"
 	"github.com/thankful-ai/migrate/sqlite"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
+// ANSI escape codes for colorized output.
+const (
+	colorReset  = "\x1b[0m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+)
+
+// distributedConflictRetries is how many times to retry a statement which
+// failed because of a conflicting transaction or concurrent schema change,
+// which YugabyteDB and CockroachDB report far more often than Postgres.
+const distributedConflictRetries = 5
+
 func main() {
 	if err := run(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		msg := err.Error()
+		if useColor(os.Stderr) {
+			msg = colorRed + msg + colorReset
+		}
+		fmt.Fprintln(os.Stderr, msg)
 		os.Exit(1)
 	}
 }
 
+// printPending migrations and objects, as for a dry run.
+func printPending(m *migrate.Migrate) error {
+	pending := m.Pending()
+	objects, err := m.PendingObjects()
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 && len(objects) == 0 {
+		fmt.Println("up to date")
+		return nil
+	}
+	for _, p := range pending {
+		if p.Skip {
+			fmt.Printf("%s %s\n", colorize(colorYellow, "would skip"),
+				p.Filename)
+			continue
+		}
+		fmt.Printf("%s %s (%d statements)\n",
+			colorize(colorYellow, "would migrate"), p.Filename,
+			p.Statements)
+	}
+	for _, o := range objects {
+		fmt.Printf("%s objects/%s\n",
+			colorize(colorYellow, "would recreate"), o)
+	}
+	return nil
+}
+
+// printDryRun prints every statement which would be executed, grouped by file.
+func printDryRun(m *migrate.Migrate) error {
+	planned, err := m.DryRun()
+	if err != nil {
+		return err
+	}
+	objects, err := m.PendingObjects()
+	if err != nil {
+		return err
+	}
+	pending := m.Pending()
+	if len(pending) == 0 && len(objects) == 0 {
+		fmt.Println("up to date")
+		return nil
+	}
+	byFile := map[string][]migrate.PlannedStatement{}
+	for _, p := range planned {
+		byFile[p.Filename] = append(byFile[p.Filename], p)
+	}
+	for _, p := range pending {
+		if p.Skip {
+			fmt.Printf("%s %s\n", colorize(colorYellow, "would skip"),
+				p.Filename)
+			continue
+		}
+		fmt.Printf("%s %s\n", colorize(colorYellow, "would migrate"),
+			p.Filename)
+		for _, stmt := range byFile[p.Filename] {
+			fmt.Printf("  %s;\n",
+				strings.ReplaceAll(stmt.SQL, "\n", "\n  "))
+		}
+	}
+	for _, o := range objects {
+		fmt.Printf("%s objects/%s\n",
+			colorize(colorYellow, "would recreate"), o)
+	}
+	return nil
+}
+
+// verifyFiles checks the migrations in dir without a database, including
+// their syntax if there's a parser for dbt.
+func verifyFiles(
+	dir string,
+	dbt migrate.DBType,
+	namePattern, snapshot string,
+	naming migrate.Naming,
+	exts []string,
+) error {
+	opts := []migrate.Option{
+		migrate.WithDBType(dbt),
+		migrate.WithExtensions(exts...),
+		migrate.WithNaming(naming),
+	}
+	if namePattern != "" {
+		re, err := regexp.Compile(namePattern)
+		if err != nil {
+			return errors.Wrap(err, "compile -name-pattern")
+		}
+		opts = append(opts, migrate.WithFilenamePolicy(
+			migrate.MatchPattern(re)))
+	}
+	switch dbt {
+	case migrate.DBTypePostgres, migrate.DBTypeYugabyte,
+		migrate.DBTypeCockroach:
+		opts = append(opts, migrate.WithValidator(pgparse.Validator))
+	case migrate.DBTypeMySQL, migrate.DBTypeMariaDB:
+		opts = append(opts, migrate.WithValidator(mysqlparse.Validator))
+	}
+	m, err := migrate.Load(nil, dir, opts...)
+	if err != nil {
+		return err
+	}
+	if err = m.Verify(); err != nil {
+		return err
+	}
+	if snapshot != "" {
+		byt, err := ioutil.ReadFile(snapshot)
+		if err != nil {
+			return errors.Wrap(err, "read snapshot")
+		}
+		var snap migrate.Snapshot
+		if err = json.Unmarshal(byt, &snap); err != nil {
+			return errors.Wrap(err, "unmarshal snapshot")
+		}
+		err = migrate.VerifySnapshot(migrate.StdLogger{}, dbt, dir, snap,
+			opts...)
+		if err != nil {
+			return errors.Wrap(err, "verify snapshot")
+		}
+	}
+	fmt.Println(colorize(colorGreen, "verified"), len(m.Files),
+		"migrations")
+	return nil
+}
+
+// printReport of pending migrations in the given format, md or json.
+func printReport(m *migrate.Migrate, format string) error {
+	report, err := m.ChangeReport()
+	if err != nil {
+		return errors.Wrap(err, "change report")
+	}
+	if format == "md" {
+		fmt.Print(report.Markdown())
+		return nil
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	return enc.Encode(report)
+}
+
+// writeSlowest statements of the last run to path as json.
+func writeSlowest(m *migrate.Migrate, path string) error {
+	byt, err := json.MarshalIndent(m.SlowestStatements(), "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "marshal slowest statements")
+	}
+	if err = ioutil.WriteFile(path, append(byt, '\n'), 0o644); err != nil {
+		return errors.Wrap(err, "write slowest statements")
+	}
+	return nil
+}
+
+// useColor reports whether f is a terminal and the user hasn't disabled color
+// with NO_COLOR (https://no-color.org).
+func useColor(f *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	return terminal.IsTerminal(int(f.Fd()))
+}
+
+// colorize s if stdout supports color.
+func colorize(color, s string) string {
+	if !useColor(os.Stdout) {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// streamsFlag collects repeated -stream namespace=dir flags.
+type streamsFlag []migrate.Stream
+
+func (f *streamsFlag) String() string {
+	parts := make([]string, 0, len(*f))
+	for _, s := range *f {
+		parts = append(parts, s.Namespace+"="+s.Dir)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *streamsFlag) Set(v string) error {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return errors.New("must be namespace=dir")
+	}
+	*f = append(*f, migrate.Stream{Namespace: parts[0], Dir: parts[1]})
+	return nil
+}
+
+// sessionFlag collects repeated -session statements.
+type sessionFlag []string
+
+func (f *sessionFlag) String() string { return strings.Join(*f, "; ") }
+
+func (f *sessionFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// keyValuesFlag collects repeated key=value flags, such as -annotate.
+type keyValuesFlag map[string]string
+
+func (f keyValuesFlag) String() string {
+	parts := make([]string, 0, len(f))
+	for k, v := range f {
+		parts = append(parts, k+"="+v)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func (f keyValuesFlag) Set(v string) error {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return errors.New("must be key=value")
+	}
+	f[parts[0]] = parts[1]
+	return nil
+}
+
+// notifyInterrupt returns a channel which is closed on the first SIGINT or
+// SIGTERM, so migrating stops after the current statement is checkpointed. A
+// second signal exits immediately.
+func notifyInterrupt() <-chan struct{} {
+	done := make(chan struct{})
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		fmt.Fprintln(os.Stderr,
+			"stopping after the current statement; interrupt again to exit now")
+		close(done)
+		<-sigs
+		os.Exit(130)
+	}()
+	return done
+}
+
 func run() error {
 	migrationDir := flag.String("dir", ".", "migrations directory")
 	dbName := flag.String("db", "", "database name")
 	dbUser := flag.String("u", "", "database user")
 	dbHost := flag.String("h", "127.0.0.1", "database host")
 	dbPort := flag.Int("p", 0, "database port")
-	dbType := flag.String("t", "mysql", "type of database (mysql, mariadb, postgres, sqlite)")
+	dbType := flag.String("t", "mysql", "type of database (mysql, mariadb, postgres, yugabyte, cockroach, sqlite, bigquery)")
 	dry := flag.Bool("d", false, "dry run")
+	dryRun := flag.Bool("dry-run", false, "print each statement which would be executed, without executing anything")
 	sslKey := flag.String("ssl-key", "", "path to client key pem")
 	sslCert := flag.String("ssl-cert", "", "path to client cert pem")
 	sslCA := flag.String("ssl-ca", "", "path to server ca pem")
 	sslServerName := flag.String("ssl-server", "", "server name for ssl")
 	skip := flag.String("skip", "", "skip up to this filename (inclusive)")
 	pass := flag.String("pass", "", "password (optional flag, if not provided it will be requested)")
+	fips := flag.Bool("fips", false, "use only fips-approved checksums")
+	noCheckpointContent := flag.Bool("no-checkpoint-content", false, "record only the checksums of checkpointed statements, not their text")
+	slowest := flag.Int("slowest", 0, "after migrating, report this many of the slowest statements")
+	slowestFile := flag.String("slowest-file", "", "also write the -slowest report to this file as json")
+	dev := flag.Bool("dev", false, "local development only: reapply the last migration if it changed, and tolerate objects which already exist")
+	env := flag.String("env", "", "record the migrations listed for this environment in .migrateskip as applied without running them")
+	phase := flag.String("phase", "", "apply only the migrations of this deploy phase: pre (before new code is deployed) or post (after)")
+	to := flag.String("to", "", "only apply migrations up to and including this filename")
+	until := flag.String("until", "", "only apply timestamp-named migrations at or before this time (RFC 3339 or YYYY-MM-DD)")
+	namePattern := flag.String("name-pattern", "", "require pending migration filenames to match this regular expression")
+	rollback := flag.Int("rollback", 0, "roll back this many of the last applied migrations by running their .down files, then exit")
+	repair := flag.Bool("repair", false, "record new checksums for applied migrations whose files changed, such as by reformatting, then exit")
+	renumber := flag.String("renumber", "", "move this pending migration after all others by rewriting its number, then exit")
+	naming := flag.String("naming", "sequential", "how migrations are numbered: sequential (1_name.sql) or timestamp (YYYYMMDDHHMMSS_name.sql in UTC), which is required of pending migrations")
+	newFile := flag.String("new", "", "create an empty migration with this description, numbered after all others by -naming, then exit")
+	namespace := flag.String("namespace", "", "keep a separate migration history under this name")
+	tablePrefix := flag.String("table-prefix", "", "prepend this prefix to the names of the meta tables, such as deploy_")
+	lockWait := flag.Duration("lock-wait", 5*time.Minute, "wait this long for another run migrating the same database on mysql, mariadb, or postgres to finish")
+	fileTimeout := flag.Duration("file-timeout", 0, "stop after the current statement once a file has run this long, resuming from its checkpoint on the next run")
+	retries := flag.Int("retries", 0, "retry a statement up to this many times if it fails with a lock timeout or lost connection")
+	noTransactions := flag.Bool("no-transactions", false, "execute every migration file statement by statement, rather than each in one transaction on postgres and sqlite")
+	batch := flag.Int("batch", 1, "send up to this many statements per round trip, if supported by the database")
+	warnings := flag.Bool("warnings", false, "log warnings raised by each statement")
+	failTruncation := flag.Bool("fail-on-truncation", false, "fail if a statement truncates data (implies -warnings)")
+	busyTimeout := flag.Duration("busy-timeout", 0, "how long sqlite waits for other connections' locks (default 5s)")
+	at := flag.String("at", "", "wait until this time (RFC 3339) before migrating")
+	redact := flag.Bool("redact", false, "replace string and numeric literals with ? in logged statements, the -log-file transcript, and the -slowest report")
+	logFile := flag.String("log-file", "", "append a full transcript of executed statements to this file")
+	verify := flag.Bool("verify", false, "check migration filenames and syntax without a database, then exit")
+	exportSnapshot := flag.Bool("export-snapshot", false, "print the migration history as a JSON snapshot, then exit")
+	report := flag.String("report", "", "print a change report of pending migrations as md or json, then exit")
+	snapshot := flag.String("snapshot", "", "with -verify, also check the files against the history in this JSON snapshot")
+	ext := flag.String("ext", ".sql", "comma-separated extensions of migration files, such as .sql,.ddl")
 	version := flag.Bool("v", false, "print the version and exit")
+	var streams streamsFlag
+	flag.Var(&streams, "stream", "migrate namespace=dir in order, instead of -dir (repeatable)")
+	annotations := keyValuesFlag{}
+	flag.Var(annotations, "annotate", "record key=value with each migration applied, such as a deploy id (repeatable)")
+	vars := keyValuesFlag{}
+	flag.Var(vars, "var", "render {{.key}} in migration files as value, given as key=value (repeatable)")
+	var session sessionFlag
+	flag.Var(&session, "session", "execute this statement on each connection before migrating, such as \"SET lock_timeout = '5s'\" (repeatable)")
 	flag.Parse()
 
 	if *version {
 		fmt.Println("v1.0.0rc5")
 		return nil
 	}
+	var exts []string
+	for _, e := range strings.Split(*ext, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			exts = append(exts, e)
+		}
+	}
+
+	switch migrate.Naming(*naming) {
+	case migrate.NamingSequential, migrate.NamingTimestamp:
+	default:
+		return fmt.Errorf("unknown -naming %q: use sequential or timestamp",
+			*naming)
+	}
+
+	// Renumbering writes to the migration directory, so it must happen
+	// before we restrict access to it.
+	if *renumber != "" {
+		newName, err := migrate.Renumber(*migrationDir, *renumber,
+			exts...)
+		if err != nil {
+			return errors.Wrap(err, "renumber")
+		}
+		fmt.Println("renamed", *renumber, "to", newName)
+		return nil
+	}
+	if *newFile != "" {
+		name, err := migrate.NewFilename(*migrationDir, *newFile,
+			migrate.Naming(*naming), exts...)
+		if err != nil {
+			return errors.Wrap(err, "new")
+		}
+		fi, err := os.OpenFile(filepath.Join(*migrationDir, name),
+			os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err != nil {
+			return errors.Wrap(err, "new")
+		}
+		if err = fi.Close(); err != nil {
+			return errors.Wrap(err, "new")
+		}
+		fmt.Println("created", filepath.Join(*migrationDir, name))
+		return nil
+	}
+	if *verify {
+		return verifyFiles(*migrationDir, migrate.DBType(*dbType),
+			*namePattern, *snapshot, migrate.Naming(*naming), exts)
+	}
+
+	// Open the transcript before restricting our access to the filesystem
+	var transcript *os.File
+	if *logFile != "" {
+		var err error
+		transcript, err = os.OpenFile(*logFile,
+			os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return errors.Wrap(err, "open log file")
+		}
+		defer transcript.Close()
+	}
 
 	// Restrict this program to specific files (read-only) and greatly
 	// restrict its possible syscalls
 	paths := []string{*migrationDir}
+	for _, s := range streams {
+		paths = append(paths, s.Dir)
+	}
+	if creds := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); creds != "" &&
+		*dbType == "bigquery" {
+		paths = append(paths, creds)
+	}
 	if *sslKey != "" {
 		paths = append(paths, *sslKey, *sslCert, *sslCA)
 		fmt.Println(paths)
@@ -63,6 +435,46 @@ func run() error {
 	if *dry && *skip != "" {
 		return errors.New("cannot skip ahead with dry mode")
 	}
+	if len(streams) > 0 && (*dry || *skip != "" || *until != "" ||
+		*to != "" || *namespace != "" || *exportSnapshot || *report != "") {
+		return errors.New("-stream cannot be combined with -d, -skip, -until, -to, -namespace, -export-snapshot, or -report")
+	}
+	if *phase != "" && (*until != "" || *to != "") {
+		return errors.New("-phase cannot be combined with -until or -to")
+	}
+	if *until != "" && *to != "" {
+		return errors.New("-until cannot be combined with -to")
+	}
+	if *repair && (*dry || *dryRun || *rollback > 0 ||
+		len(streams) > 0) {
+		return errors.New("-repair cannot be combined with -d, -dry-run, -rollback, or -stream")
+	}
+	if *slowestFile != "" && *slowest <= 0 {
+		return errors.New("-slowest-file requires -slowest")
+	}
+	if *report != "" && *report != "md" && *report != "json" {
+		return fmt.Errorf("invalid -report %q: use md or json", *report)
+	}
+	var atTime time.Time
+	if *at != "" {
+		var err error
+		atTime, err = time.Parse(time.RFC3339, *at)
+		if err != nil {
+			return fmt.Errorf("invalid -at %q: use RFC 3339", *at)
+		}
+	}
+	var untilTime time.Time
+	if *until != "" {
+		var err error
+		untilTime, err = time.Parse(time.RFC3339, *until)
+		if err != nil {
+			untilTime, err = time.Parse("2006-01-02", *until)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid -until %q: use RFC 3339 or YYYY-MM-DD",
+				*until)
+		}
+	}
 
 	// Validate flags for each type of database and set appropriate
 	// defaults
@@ -83,6 +495,20 @@ func run() error {
 		if *sslKey != "" || *sslCert != "" || *sslCA != "" || *sslServerName != "" {
 			return errors.New("sqlite does not support ssl")
 		}
+	case "bigquery":
+		if *dbUser != "" || *dbHost != "127.0.0.1" || *dbPort != 0 ||
+			*pass != "" {
+			return errors.New("bigquery uses application default credentials and does not support the -u, -h, -p, or -pass flags")
+		}
+		if *sslKey != "" || *sslCert != "" || *sslCA != "" || *sslServerName != "" {
+			return errors.New("bigquery does not support ssl")
+		}
+		if len(session) > 0 {
+			return errors.New("bigquery does not support the -session flag")
+		}
+		if !strings.Contains(*dbName, ".") {
+			return errors.New("bigquery -db must be project.dataset")
+		}
 	case "postgres":
 		if *dbUser == "" {
 			*dbUser = "postgres"
@@ -90,6 +516,20 @@ func run() error {
 		if *dbPort == 0 {
 			*dbPort = 5432
 		}
+	case "yugabyte":
+		if *dbUser == "" {
+			*dbUser = "yugabyte"
+		}
+		if *dbPort == 0 {
+			*dbPort = 5433
+		}
+	case "cockroach":
+		if *dbUser == "" {
+			*dbUser = "root"
+		}
+		if *dbPort == 0 {
+			*dbPort = 26257
+		}
 	case "mysql", "mariadb":
 		if *dbUser == "" {
 			*dbUser = "root"
@@ -97,13 +537,21 @@ func run() error {
 		if *dbPort == 0 {
 			*dbPort = 3306
 		}
+	case "db2":
+		return errors.New("db2 drivers require cgo, so db2 is only supported with -verify or by the db2 package")
+	case "sqlserver":
+		return errors.New("the sqlserver driver depends on Azure's SDK, so sqlserver is only supported with -verify or by the sqlserver package")
+	case "clickhouse":
+		return errors.New("clickhouse is only supported with -verify or by the clickhouse package")
+	case "oracle":
+		return errors.New("oracle is only supported with -verify or by the library with a Store of your own")
 	default:
-		return fmt.Errorf("unknown db type %q (mysql, postgres, sqlite allowed)", *dbType)
+		return fmt.Errorf("unknown db type %q (mysql, postgres, yugabyte, cockroach, sqlite, bigquery allowed)", *dbType)
 	}
 
 	// Request database password if not provided as a flag argument
 	var password []byte
-	if *dbType != "sqlite" {
+	if *dbType != "sqlite" && *dbType != "bigquery" {
 		if len(*pass) == 0 {
 			fmt.Printf("%s database password: ", *dbName)
 			var err error
@@ -124,24 +572,41 @@ func run() error {
 		var err error
 		db, err = mysql.New(*dbUser, string(password), *dbHost,
 			*dbName, *dbPort, *sslKey, *sslCert, *sslCA,
-			*sslServerName)
+			*sslServerName, mysql.WithSession(session...))
 		if err != nil {
 			return errors.Wrap(err, "mysql new")
 		}
 	case "sqlite":
-		db = sqlite.New(*dbName)
+		liteOpts := []sqlite.Option{sqlite.WithSession(session...)}
+		if *busyTimeout > 0 {
+			liteOpts = append(liteOpts,
+				sqlite.WithBusyTimeout(*busyTimeout))
+		}
+		db = sqlite.New(*dbName, liteOpts...)
+	case "bigquery":
+		parts := strings.SplitN(*dbName, ".", 2)
+		db = bigquery.New(parts[0], parts[1])
 	case "postgres":
 		db = postgres.New(*dbUser, string(password), *dbHost, *dbName,
-			*dbPort, *sslKey, *sslCert, *sslCA)
+			*dbPort, *sslKey, *sslCert, *sslCA,
+			postgres.WithSession(session...))
+	case "yugabyte", "cockroach":
+		db = postgres.New(*dbUser, string(password), *dbHost, *dbName,
+			*dbPort, *sslKey, *sslCert, *sslCA,
+			postgres.WithSession(session...),
+			postgres.WithConflictRetries(distributedConflictRetries))
 	default:
 		return fmt.Errorf("unknown db type: %s", *dbType)
 	}
 	if *sslKey != "" {
 		fmt.Println("using tls")
 	}
-	if err := db.Open(); err != nil {
-		return errors.Wrap(err, "open")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := migrate.OpenStore(ctx, db); err != nil {
+		return err
 	}
+	defer db.Close()
 
 	var dbt migrate.DBType
 	switch *dbType {
@@ -151,34 +616,209 @@ func run() error {
 		dbt = migrate.DBTypeMariaDB
 	case "postgres":
 		dbt = migrate.DBTypePostgres
+	case "yugabyte":
+		dbt = migrate.DBTypeYugabyte
+	case "cockroach":
+		dbt = migrate.DBTypeCockroach
 	case "sqlite":
 		dbt = migrate.DBTypeSQLite
+	case "bigquery":
+		dbt = migrate.DBTypeBigQuery
 	default:
 		return fmt.Errorf("unknown db type: %s", *dbType)
 	}
 
+	opts := []migrate.Option{
+		migrate.WithDBType(dbt),
+		migrate.WithColor(useColor(os.Stdout)),
+		migrate.WithExtensions(exts...),
+		migrate.WithInterrupt(notifyInterrupt()),
+	}
+	if transcript != nil {
+		opts = append(opts, migrate.WithTranscript(transcript))
+	}
+	if *fips {
+		opts = append(opts, migrate.WithFIPS())
+	}
+	if *noCheckpointContent {
+		opts = append(opts, migrate.WithoutCheckpointContent())
+	}
+	if *redact {
+		opts = append(opts, migrate.WithRedactedLiterals())
+	}
+	if *dev {
+		opts = append(opts, migrate.WithDevMode())
+	}
+	if *env != "" {
+		opts = append(opts, migrate.WithEnvironment(*env))
+	}
+	if *retries > 0 {
+		opts = append(opts, migrate.WithRetries(*retries))
+	}
+	if *fileTimeout > 0 {
+		opts = append(opts, migrate.WithFileTimeout(*fileTimeout))
+	}
+	switch dbt {
+	case migrate.DBTypeYugabyte, migrate.DBTypeCockroach:
+		opts = append(opts, migrate.WithoutLock())
+	default:
+		opts = append(opts, migrate.WithLockWait(*lockWait))
+	}
+	if len(annotations) > 0 {
+		opts = append(opts, migrate.WithAnnotations(
+			migrate.Annotations(annotations)))
+	}
+	if len(vars) > 0 {
+		opts = append(opts, migrate.WithTemplateVars(vars))
+	}
+	if *slowest > 0 {
+		opts = append(opts, migrate.WithSlowestReport(*slowest))
+	}
+	if *namespace != "" {
+		opts = append(opts, migrate.WithNamespace(*namespace))
+	}
+	if *tablePrefix != "" {
+		opts = append(opts, migrate.WithTablePrefix(*tablePrefix))
+	}
+	// Postgres notices arrive with each statement's result, so they're
+	// always logged unless batching.
+	pgNotices := dbt == migrate.DBTypePostgres ||
+		dbt == migrate.DBTypeYugabyte || dbt == migrate.DBTypeCockroach
+	switch {
+	case *failTruncation:
+		opts = append(opts, migrate.WithFailOnTruncation())
+	case *warnings, pgNotices && *batch <= 1:
+		opts = append(opts, migrate.WithWarnings())
+	}
+	if !atTime.IsZero() {
+		opts = append(opts, migrate.WithStartAt(atTime))
+	}
+	if *batch > 1 {
+		opts = append(opts, migrate.WithBatchSize(*batch))
+	}
+	if *noTransactions {
+		opts = append(opts, migrate.WithoutFileTransactions())
+	}
+	if *namePattern != "" {
+		re, err := regexp.Compile(*namePattern)
+		if err != nil {
+			return errors.Wrap(err, "compile -name-pattern")
+		}
+		opts = append(opts, migrate.WithFilenamePolicy(
+			migrate.MatchPattern(re)))
+	}
+	opts = append(opts, migrate.WithNaming(migrate.Naming(*naming)))
+
+	if len(streams) > 0 {
+		report, err := migrate.MigrateStreams(db, migrate.StdLogger{},
+			dbt, streams, opts...)
+		fmt.Print(report)
+		if err != nil {
+			return err
+		}
+		fmt.Println(colorize(colorGreen, "success"))
+		return nil
+	}
+
+	if *exportSnapshot {
+		m, err := migrate.Inspect(db, *migrationDir, opts...)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		return enc.Encode(m.Snapshot())
+	}
+
+	if *report != "" {
+		m, err := migrate.Inspect(db, *migrationDir, opts...)
+		if err != nil {
+			return err
+		}
+		return printReport(m, *report)
+	}
+
+	// Inspecting rather than initializing leaves the database untouched,
+	// even the meta tables.
+	if *dryRun {
+		m, err := migrate.Inspect(db, *migrationDir, opts...)
+		if err != nil {
+			return err
+		}
+		return printDryRun(m)
+	}
+
+	// Repairing replaces Init's checksum verification, so it can't follow
+	// New.
+	if *repair {
+		m, err := migrate.Load(db, *migrationDir,
+			append(opts, migrate.WithSkip(*skip))...)
+		if err != nil {
+			return err
+		}
+		repaired, err := m.Repair()
+		if err != nil {
+			return err
+		}
+		fmt.Println(colorize(colorGreen, "repaired"), len(repaired),
+			"migrations")
+		return nil
+	}
+
 	// Prepare our database for migrations and collect the relevant files.
-	m, err := migrate.New(db, migrate.StdLogger{}, dbt, *migrationDir,
-		*skip)
+	m, err := migrate.New(db, *migrationDir,
+		append(opts, migrate.WithSkip(*skip))...)
+	if errors.Is(err, migrate.ErrReadOnly) {
+		// Show what would be migrated instead, which only reads.
+		fmt.Println(colorize(colorYellow, err.Error()))
+		m, err = migrate.Inspect(db, *migrationDir, opts...)
+		if err != nil {
+			return err
+		}
+		if err = printPending(m); err != nil {
+			return err
+		}
+		if *dry {
+			return nil
+		}
+		return migrate.ErrReadOnly
+	}
 	if err != nil {
 		return err
 	}
 	if *dry {
-		if len(m.Migrations) == len(m.Files) {
-			fmt.Println("up to date")
-			return nil
-		}
-		for i := len(m.Migrations); i < len(m.Files); i++ {
-			fmt.Println("would migrate", m.Files[i].Info.Name())
+		return printPending(m)
+	}
+	if *rollback > 0 {
+		if err = m.Rollback(*rollback); err != nil {
+			return err
 		}
+		fmt.Println(colorize(colorGreen, "success"))
 		return nil
 	}
-	migrated, err := m.Migrate()
+	var migrated bool
+	switch {
+	case *phase != "":
+		migrated, err = m.MigratePhase(migrate.Phase(*phase))
+	case *until != "":
+		migrated, err = m.MigrateUntil(untilTime)
+	case *to != "":
+		migrated, err = m.MigrateTo(*to)
+	default:
+		migrated, err = m.Migrate()
+	}
+	if *slowestFile != "" {
+		// Write the report even if migrating failed, since the
+		// statements up to the failure may explain it.
+		if werr := writeSlowest(m, *slowestFile); werr != nil {
+			return werr
+		}
+	}
 	if err != nil {
 		return err
 	}
 	if migrated {
-		fmt.Println("success")
+		fmt.Println(colorize(colorGreen, "success"))
 	} else {
 		fmt.Println("up to date")
 	}
@@ -0,0 +1,18 @@
+package migrate
+
+import "regexp"
+
+// regexSchemaChange matches statements which change the schema, which
+// CockroachDB applies online in background jobs.
+var regexSchemaChange = regexp.MustCompile(
+	`(?i)^\s*(?:create|alter|drop|truncate|comment|rename)\b`)
+
+// onlineSchemaChange reports whether cmd is a schema change which the
+// database applies online, outside the transaction which executed it.
+// CockroachDB executes a batch in one implicit transaction, in which a
+// schema change can't follow writes, and it may fail a schema change after
+// the rest of its transaction has committed. Such statements are executed on
+// their own rather than in batches, and can't be in atomic groups.
+func (m *Migrate) onlineSchemaChange(cmd string) bool {
+	return m.dbt == DBTypeCockroach && regexSchemaChange.MatchString(cmd)
+}
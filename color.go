@@ -0,0 +1,18 @@
+package migrate
+
+// ANSI escape codes used to colorize output when enabled with WithColor.
+const (
+	colorReset  = "\x1b[0m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorDim    = "\x1b[2m"
+)
+
+// colorize s if color output is enabled.
+func (m *Migrate) colorize(color, s string) string {
+	if !m.color {
+		return s
+	}
+	return color + s + colorReset
+}
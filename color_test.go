@@ -0,0 +1,49 @@
+package migrate_test
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/thankful-ai/migrate"
+)
+
+func TestWithColor(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+		"2_typo.sql":         "CREAT TABLE typo (id INTEGER);",
+	})
+	run := func(color bool) string {
+		var buf bytes.Buffer
+		m, err := migrate.New(newDB(t), dir,
+			migrate.WithLogger(log.New(&buf, "", 0)),
+			migrate.WithDBType(migrate.DBTypeSQLite),
+			migrate.WithoutFileTransactions(),
+			migrate.WithColor(color))
+		check(t, err)
+		if _, err = m.Migrate(); err == nil {
+			t.Fatal("expected error")
+		}
+		return buf.String()
+	}
+
+	out := run(true)
+	for _, want := range []string{
+		"\x1b[32mmigrated\x1b[0m 1_create_users.sql",
+		"\x1b[2mCREATE TABLE users (id INTEGER)\x1b[0m",
+		"\x1b[31mfailed on\x1b[0m CREAT TABLE typo",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in output:\n%s", want, out)
+		}
+	}
+
+	// Without color, such as when piped, output is plain.
+	if out = run(false); strings.Contains(out, "\x1b[") {
+		t.Fatalf("expected no escape codes:\n%s", out)
+	}
+	if !strings.Contains(out, "migrated 1_create_users.sql") {
+		t.Fatalf("expected migrated file in output:\n%s", out)
+	}
+}
@@ -0,0 +1,176 @@
+package migrate
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Conflict describes files which share a numeric prefix, as happens when two
+// branches each add a migration with the same next number.
+type Conflict struct {
+	Number uint64
+
+	// SubNumber shared by the files, such as 1 for 42.1, or 0 if they
+	// have none.
+	SubNumber uint64
+
+	Filenames []string
+}
+
+// Conflicts reports every numeric prefix used by more than one migration file
+// in dir, without touching a database. Run it in CI to catch collisions from
+// merged branches before they reach production, then resolve them with
+// Renumber. Files with any of extensions are migrations, or only .sql files if
+// none are given; see WithExtensions.
+func Conflicts(dir string, extensions ...string) ([]Conflict, error) {
+	fsys := dirFS(dir)
+	f, err := newFilter(fsys, normalizeExtensions(extensions))
+	if err != nil {
+		return nil, err
+	}
+	files, err := readDir(fsys, ".", nil, f)
+	if err != nil {
+		return nil, err
+	}
+	byNum := map[fileOrder][]string{}
+	for _, fi := range files {
+		num, err := fileOrderOf(fi.Info.Name())
+		if err != nil {
+			return nil, err
+		}
+		byNum[num] = append(byNum[num], fi.Info.Name())
+	}
+	var conflicts []Conflict
+	for num, names := range byNum {
+		if len(names) < 2 {
+			continue
+		}
+		sort.Strings(names)
+		conflicts = append(conflicts, Conflict{
+			Number:    num.num,
+			SubNumber: num.sub,
+			Filenames: names,
+		})
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		return fileOrder{conflicts[i].Number, conflicts[i].SubNumber}.less(
+			fileOrder{conflicts[j].Number, conflicts[j].SubNumber})
+	})
+	return conflicts, nil
+}
+
+// Renumber moves filename in dir after every other migration by rewriting its
+// numeric prefix to one more than the highest in use, preserving the prefix's
+// width. A file named by NamingTimestamp is given the current time instead, or
+// a second after the latest timestamp if that's later. Overrides of the file
+// in DB-specific subdirectories are renamed to match, as are down files.
+// Renumber refuses to overwrite existing files, but it can't know whether
+// filename was already migrated somewhere: only renumber migrations which
+// haven't been deployed. It returns the new filename. Extensions are as in
+// Conflicts.
+func Renumber(dir, filename string, extensions ...string) (string, error) {
+	_, filename = filepath.Split(filename)
+	fsys := dirFS(dir)
+	f, err := newFilter(fsys, normalizeExtensions(extensions))
+	if err != nil {
+		return "", err
+	}
+	files, err := readDir(fsys, ".", nil, f)
+	if err != nil {
+		return "", err
+	}
+	var (
+		found bool
+		max   uint64
+		names = make([]string, 0, len(files))
+	)
+	for _, fi := range files {
+		if fi.Info.Name() == filename {
+			found = true
+		}
+		names = append(names, fi.Info.Name())
+		num, err := fileNumber(fi.Info.Name())
+		if err != nil {
+			return "", err
+		}
+		if num > max {
+			max = num
+		}
+	}
+	if !found {
+		return "", fmt.Errorf("%w: %s", ErrUnknownMigration, filename)
+	}
+	// A sub-number is dropped, since the file no longer needs to slot
+	// between others.
+	prefix := regexOrder.FindStringSubmatch(filename)
+	newNum := strconv.FormatUint(max+1, 10)
+	for len(newNum) < len(prefix[1]) {
+		newNum = "0" + newNum
+	}
+	if _, ok := timestampOf(filename); ok {
+		newNum = nextTimestamp(names, time.Now())
+	}
+	newName := newNum + filename[len(prefix[0]):]
+
+	// Collect every path to rename, with any down files, and confirm none
+	// of the targets exist before renaming anything, so we don't leave the
+	// overrides out of sync with the main directory.
+	dirs := []string{dir}
+	tmp, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", errors.Wrap(err, "read dir")
+	}
+	for _, fi := range tmp {
+		sub := filepath.Join(dir, fi.Name())
+		if !fi.IsDir() || f.ignored(fi.Name(), true) {
+			continue
+		}
+		_, err := os.Stat(filepath.Join(sub, filename))
+		switch {
+		case err == nil:
+			dirs = append(dirs, sub)
+		case !os.IsNotExist(err):
+			return "", err
+		}
+	}
+	var renames [][2]string
+	for _, d := range dirs {
+		renames = append(renames, [2]string{
+			filepath.Join(d, filename),
+			filepath.Join(d, newName),
+		})
+		down := filepath.Join(d, downPath(filename))
+		_, err := os.Stat(down)
+		switch {
+		case err == nil:
+			renames = append(renames, [2]string{
+				down,
+				filepath.Join(d, downPath(newName)),
+			})
+		case !os.IsNotExist(err):
+			return "", err
+		}
+	}
+	for _, r := range renames {
+		_, err := os.Stat(r[1])
+		if err == nil {
+			return "", fmt.Errorf("%s already exists", r[1])
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	for _, r := range renames {
+		if err := os.Rename(r[0], r[1]); err != nil {
+			return "", errors.Wrap(err, "rename")
+		}
+	}
+	return newName, nil
+}
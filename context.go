@@ -0,0 +1,54 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// ContextExecer is implemented by Stores which can cancel a statement midway
+// when its context is done. It's optional; on other Stores, a canceled
+// MigrateContext stops between statements instead. Statements are executed
+// with ExecContext rather than Exec whenever it's available, so a Store which
+// embeds another and overrides Exec must override ExecContext too.
+type ContextExecer interface {
+	ExecContext(
+		ctx context.Context,
+		query string,
+		args ...interface{},
+	) (sql.Result, error)
+}
+
+// MigrateContext is Migrate, stopping once ctx is done. On Stores which
+// implement ContextExecer, the statement being executed is canceled, which
+// fails it like any other error; otherwise it finishes and is checkpointed
+// first. Either way the error wraps both ErrInterrupted and ctx.Err(), and the
+// next run resumes from the last checkpoint. Batches and atomic groups are
+// never canceled midway.
+func (m *Migrate) MigrateContext(ctx context.Context) (bool, error) {
+	m.ctx = ctx
+	defer func() { m.ctx = context.Background() }()
+	return m.Migrate()
+}
+
+// exec query on s, canceling it once the context of the run is done if s is a
+// ContextExecer.
+func (m *Migrate) exec(
+	s Store,
+	query string,
+	args ...interface{},
+) (sql.Result, error) {
+	if c, ok := s.(ContextExecer); ok {
+		return c.ExecContext(m.ctx, query, args...)
+	}
+	return s.Exec(query, args...)
+}
+
+// interruption which stopped migrating, including the context's error if it's
+// done.
+func (m *Migrate) interruption() error {
+	if err := m.ctx.Err(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInterrupted, err)
+	}
+	return ErrInterrupted
+}
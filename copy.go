@@ -0,0 +1,188 @@
+package migrate
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Copier is implemented by Stores which can bulk load the inline data of a
+// COPY ... FROM STDIN statement, as emitted by pg_dump. It's optional;
+// migrations containing COPY blocks fail on Stores which don't implement it.
+type Copier interface {
+	// CopyFrom executes query, a COPY ... FROM STDIN statement, sending
+	// rows as its data. Each value is a string or nil for NULL.
+	CopyFrom(query string, rows [][]interface{}) error
+}
+
+// copyStart matches the first line of a COPY block. Its data follows on the
+// next lines, terminated by a line containing only `\.`.
+var copyStart = regexp.MustCompile(`(?i)^\s*copy\s.+\sfrom\s+stdin\b.*;\s*$`)
+
+// copyEnd terminates the data of a COPY block.
+const copyEnd = `\.`
+
+// splitCopyBlocks separates COPY blocks from the surrounding SQL, so their
+// data isn't split on semicolons. Every returned chunk is either SQL to be
+// split into statements or a complete COPY block, in which case isCopy is set
+// for its index.
+func splitCopyBlocks(s string) (chunks []string, isCopy []bool, err error) {
+	lines := strings.SplitAfter(s, "\n")
+	var (
+		cur    strings.Builder
+		inCopy bool
+	)
+	for _, line := range lines {
+		trimmed := strings.TrimRight(line, "\r\n")
+		switch {
+		case inCopy:
+			if trimmed == copyEnd {
+				cur.WriteString(copyEnd)
+				chunks = append(chunks, cur.String())
+				isCopy = append(isCopy, true)
+				cur.Reset()
+				inCopy = false
+				continue
+			}
+			cur.WriteString(line)
+		case copyStart.MatchString(trimmed):
+			if cur.Len() > 0 {
+				chunks = append(chunks, cur.String())
+				isCopy = append(isCopy, false)
+				cur.Reset()
+			}
+			cur.WriteString(strings.TrimSpace(trimmed))
+			cur.WriteString("\n")
+			inCopy = true
+		default:
+			cur.WriteString(line)
+		}
+	}
+	if inCopy {
+		return nil, nil, fmt.Errorf("unexpected exit, missing %q after copy data",
+			copyEnd)
+	}
+	if cur.Len() > 0 {
+		chunks = append(chunks, cur.String())
+		isCopy = append(isCopy, false)
+	}
+	return chunks, isCopy, nil
+}
+
+// isCopyStatement reports whether cmd is a COPY block from splitCopyBlocks.
+func isCopyStatement(cmd string) bool {
+	firstLine := strings.SplitN(cmd, "\n", 2)[0]
+	return copyStart.MatchString(firstLine) &&
+		strings.HasSuffix(cmd, copyEnd)
+}
+
+// parseCopyBlock into its query and rows, decoding the text format used by
+// COPY: tab-separated columns, \N for NULL, and backslash escapes.
+func parseCopyBlock(cmd string) (string, [][]interface{}, error) {
+	parts := strings.SplitN(cmd, "\n", 2)
+	query := strings.TrimSuffix(strings.TrimSpace(parts[0]), ";")
+	data := strings.TrimSuffix(parts[1], copyEnd)
+	lines := strings.Split(data, "\n")
+
+	// Drop the empty line after the newline preceding the terminator.
+	lines = lines[:len(lines)-1]
+	var rows [][]interface{}
+	for i, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+		fields := strings.Split(line, "\t")
+		row := make([]interface{}, len(fields))
+		for j, f := range fields {
+			if f == `\N` {
+				row[j] = nil
+				continue
+			}
+			v, err := unescapeCopy(f)
+			if err != nil {
+				return "", nil, errors.Wrapf(err, "row %d", i+1)
+			}
+			row[j] = v
+		}
+		rows = append(rows, row)
+	}
+	return query, rows, nil
+}
+
+// unescapeCopy decodes the backslash escapes of COPY's text format.
+func unescapeCopy(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i >= len(s) {
+			return "", errors.New("trailing backslash")
+		}
+		switch c := s[i]; c {
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		case 'x':
+			// One or two hex digits.
+			j := i + 1
+			for j < len(s) && j < i+3 && isHex(s[j]) {
+				j++
+			}
+			if j == i+1 {
+				b.WriteByte(c)
+				continue
+			}
+			n, _ := strconv.ParseUint(s[i+1:j], 16, 8)
+			b.WriteByte(byte(n))
+			i = j - 1
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			// One to three octal digits.
+			j := i
+			for j < len(s) && j < i+3 && s[j] >= '0' && s[j] <= '7' {
+				j++
+			}
+			n, _ := strconv.ParseUint(s[i:j], 8, 8)
+			b.WriteByte(byte(n))
+			i = j - 1
+		default:
+			// Any other escaped character represents itself.
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') ||
+		(c >= 'a' && c <= 'f') ||
+		(c >= 'A' && c <= 'F')
+}
+
+// copyFrom executes a COPY block using the Store's Copier.
+func (m *Migrate) copyFrom(cmd string) error {
+	c, ok := m.db.(Copier)
+	if !ok {
+		return errors.New("store does not support COPY FROM STDIN")
+	}
+	query, rows, err := parseCopyBlock(cmd)
+	if err != nil {
+		return errors.Wrap(err, "parse copy data")
+	}
+	return c.CopyFrom(query, rows)
+}
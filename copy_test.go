@@ -0,0 +1,60 @@
+package migrate
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStatementsCopy(t *testing.T) {
+	byt := []byte(`CREATE TABLE users (id INTEGER, name TEXT);
+COPY public.users (id, name) FROM stdin;
+1	alice; bob
+2	\N
+\.
+SELECT 1;
+`)
+	cmds, err := Statements(byt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cmds) != 3 {
+		t.Fatalf("expected 3 statements, got %q", cmds)
+	}
+	if !isCopyStatement(cmds[1]) {
+		t.Fatalf("expected copy statement, got %q", cmds[1])
+	}
+
+	query, rows, err := parseCopyBlock(cmds[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query != "COPY public.users (id, name) FROM stdin" {
+		t.Fatalf("unexpected query %q", query)
+	}
+	want := [][]interface{}{{"1", "alice; bob"}, {"2", nil}}
+	if !reflect.DeepEqual(rows, want) {
+		t.Fatalf("unexpected rows %v", rows)
+	}
+
+	_, err = Statements([]byte("COPY users FROM stdin;\n1\n"))
+	if err == nil {
+		t.Fatal("expected error for unterminated copy")
+	}
+}
+
+func TestUnescapeCopy(t *testing.T) {
+	for in, want := range map[string]string{
+		`plain`:      "plain",
+		`a\tb\nc`:    "a\tb\nc",
+		`back\\lash`: `back\lash`,
+		`\101\x42`:   "AB",
+	} {
+		got, err := unescapeCopy(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("unescape %q: expected %q, got %q", in, want, got)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package migrate
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Dashboard serves an HTML page for internal admin UIs showing m's applied,
+// pending, and partially applied migrations, the history with durations and
+// annotations, and any drift. Unless m was opened by Inspect, a button applies
+// the pending migrations in the background while the page reports their
+// progress.
+//
+// Dashboard doesn't authenticate requests: mount it behind your admin UI's
+// authentication, since anyone who can reach it can migrate the database.
+// Cross-origin form posts are rejected.
+func Dashboard(m *Migrate) http.Handler {
+	return &dashboard{m: m}
+}
+
+type dashboard struct {
+	m *Migrate
+
+	// mu guards running and lastErr. Status isn't safe to call while
+	// migrating, so only Progress is reported until the run finishes.
+	mu      sync.Mutex
+	running bool
+	lastErr error
+}
+
+// dashboardPage is the data rendered by dashboardTemplate.
+type dashboardPage struct {
+	Running  bool
+	Progress Progress
+	Status   Status
+
+	// Partial is the first pending migration if an earlier run
+	// checkpointed some of its statements before failing.
+	Partial     *PendingMigration
+	Checkpoints int
+
+	CanApply bool
+	LastErr  error
+}
+
+func (d *dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		d.render(w)
+	case http.MethodPost:
+		if !sameOrigin(r) {
+			http.Error(w, "cross-origin request", http.StatusForbidden)
+			return
+		}
+		if err := d.apply(); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// sameOrigin reports whether r was sent by a page from the same host, so
+// other sites can't trigger migrations with a form posted by an admin's
+// browser.
+func sameOrigin(r *http.Request) bool {
+	if r.Header.Get("Sec-Fetch-Site") == "cross-site" {
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// apply pending migrations in the background.
+func (d *dashboard) apply() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case d.m.readOnly:
+		return errors.New("cannot migrate: opened read-only by Inspect")
+	case d.running:
+		return errors.New("already migrating")
+	}
+	d.running = true
+	d.lastErr = nil
+	go func() {
+		_, err := d.m.Migrate()
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.running = false
+		d.lastErr = err
+	}()
+	return nil
+}
+
+func (d *dashboard) render(w http.ResponseWriter) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	page := dashboardPage{
+		Running:  d.running,
+		Progress: d.m.Progress(),
+		LastErr:  d.lastErr,
+	}
+	if !d.running {
+		page.Status = d.m.Status()
+		if err := d.loadPartial(&page); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		page.CanApply = !d.m.readOnly && len(page.Status.Pending) > 0 &&
+			len(page.Status.Drift) == 0
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, page); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// loadPartial into page if the first pending migration has checkpoints.
+func (d *dashboard) loadPartial(page *dashboardPage) error {
+	if len(page.Status.Pending) == 0 || page.Status.Version < 0 {
+		return nil
+	}
+	next := page.Status.Pending[0]
+	checkpoints, err := d.m.tracker.GetMetaCheckpoints(d.m.namespace,
+		next.Filename)
+	if err != nil {
+		return err
+	}
+	if len(checkpoints) > 0 {
+		page.Partial = &next
+		page.Checkpoints = len(checkpoints)
+	}
+	return nil
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(
+	template.FuncMap{
+		"round": func(d time.Duration) time.Duration {
+			return d.Round(time.Millisecond)
+		},
+	},
+).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>migrate</title>
+{{if .Running}}<meta http-equiv="refresh" content="2">{{end}}
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Migrations</h1>
+{{with .Progress}}{{if $.Running}}
+<p>Migrating {{.File}}: statement {{.Statement}} of {{.Statements}}, file {{.Applied}} of {{.Pending}}, {{round .Elapsed}} elapsed.</p>
+{{end}}{{end}}
+{{with .LastErr}}<p class="error">Last run failed: {{.}}</p>{{end}}
+{{if not .Running}}
+{{with .Status}}
+<p>Meta table version {{.Version}}. {{.Stats.Applied}} applied in {{round .Stats.Duration}}.</p>
+{{with .Stats.LastFailure}}<p class="error">Last failure: {{.Filename}} statement {{.Index}} at {{.FailedAt}}: {{.Error}}</p>{{end}}
+{{if .Drift}}
+<h2>Drift</h2>
+<table>
+<tr><th>File</th><th>Kind</th><th>Error</th></tr>
+{{range .Drift}}<tr><td>{{.Filename}}</td><td>{{.Kind}}</td><td class="error">{{.Err}}</td></tr>
+{{end}}</table>
+{{end}}
+<h2>Pending</h2>
+{{if .Pending}}
+<table>
+<tr><th>File</th><th>Statements</th><th>Size</th></tr>
+{{range .Pending}}<tr><td>{{.Filename}}</td><td>{{.Statements}}</td><td>{{.Size}}</td></tr>
+{{end}}</table>
+{{else}}<p>Up to date.</p>{{end}}
+{{end}}
+{{with .Partial}}<p>{{.Filename}} is partially applied: {{$.Checkpoints}} of {{.Statements}} statements are checkpointed.</p>{{end}}
+{{if .CanApply}}
+<form method="post"><button type="submit">Apply pending migrations</button></form>
+{{end}}
+{{with .Status}}
+<h2>History</h2>
+<table>
+<tr><th>File</th><th>Variant</th><th>Applied at</th><th>Statements</th><th>Duration</th><th>Annotations</th></tr>
+{{range .Applied}}<tr><td>{{.Filename}}</td><td>{{.Variant}}</td><td>{{.AppliedAt.Format "2006-01-02 15:04:05"}}</td><td>{{.Statements}}</td><td>{{round .Duration}}</td><td>{{range $k, $v := .Annotations}}{{$k}}={{$v}} {{end}}</td></tr>
+{{end}}</table>
+{{end}}
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,86 @@
+package migrate_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thankful-ai/migrate"
+)
+
+func TestDashboard(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+		"2_seed_users.sql":   "INSERT INTO users VALUES (1);",
+	})
+	db := newDB(t)
+	m := newMigrate(t, db, dir)
+	srv := httptest.NewServer(migrate.Dashboard(m))
+	defer srv.Close()
+
+	get := func() string {
+		t.Helper()
+		resp, err := http.Get(srv.URL)
+		check(t, err)
+		defer resp.Body.Close()
+		byt, err := io.ReadAll(resp.Body)
+		check(t, err)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", resp.StatusCode, byt)
+		}
+		return string(byt)
+	}
+	post := func(origin string) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, srv.URL, nil)
+		check(t, err)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		client := &http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		resp, err := client.Do(req)
+		check(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	body := get()
+	if !strings.Contains(body, "2_seed_users.sql") ||
+		!strings.Contains(body, "Apply pending migrations") {
+		t.Fatalf("expected pending migrations and apply button:\n%s", body)
+	}
+
+	if code := post("https://evil.example"); code != http.StatusForbidden {
+		t.Fatalf("expected cross-origin post to be forbidden, got %d", code)
+	}
+	if len(m.Pending()) != 2 {
+		t.Fatal("expected cross-origin post not to migrate")
+	}
+
+	u, err := url.Parse(srv.URL)
+	check(t, err)
+	if code := post("http://" + u.Host); code != http.StatusSeeOther {
+		t.Fatalf("expected redirect, got %d", code)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for strings.Contains(body, "Apply pending migrations") ||
+		strings.Contains(body, "Migrating") {
+		if time.Now().After(deadline) {
+			t.Fatalf("migrations weren't applied:\n%s", body)
+		}
+		time.Sleep(10 * time.Millisecond)
+		body = get()
+	}
+	if !strings.Contains(body, "Up to date.") ||
+		!strings.Contains(body, "<td>2_seed_users.sql</td>") {
+		t.Fatalf("expected applied history:\n%s", body)
+	}
+}
@@ -0,0 +1,474 @@
+// Package db2 records migrations in an IBM Db2 database.
+//
+// Db2's drivers require cgo and IBM's client libraries, so this package
+// doesn't import one. Register a driver in your program, such as with
+// `import _ "github.com/ibmdb/go_ibm_db"`, and pass its name WithDriver if it
+// isn't go_ibm_db.
+package db2
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/reflectx"
+	"github.com/pkg/errors"
+	"github.com/thankful-ai/migrate"
+)
+
+type DB struct {
+	driver string
+	dsn    string
+
+	// prefix of the meta tables' names; see SetTablePrefix.
+	prefix string
+
+	// Embed the sqlx DB struct
+	*sqlx.DB
+}
+
+// Option configures optional behavior in New.
+type Option func(*DB)
+
+// WithDriver opens the database with the database/sql driver registered as
+// name. The default is go_ibm_db.
+func WithDriver(name string) Option {
+	return func(db *DB) { db.driver = name }
+}
+
+// New Store for the database described by dsn, such as
+// `HOSTNAME=localhost;PORT=50000;DATABASE=app;UID=db2inst1;PWD=secret`.
+func New(dsn string, opts ...Option) *DB {
+	db := &DB{driver: "go_ibm_db", dsn: dsn}
+	for _, opt := range opts {
+		opt(db)
+	}
+	return db
+}
+
+func (db *DB) Open() error {
+	var err error
+	db.DB, err = sqlx.Open(db.driver, db.dsn)
+	if err != nil {
+		return errors.Wrap(err, "open db connection")
+	}
+
+	// Db2 folds unquoted column names to upper case, so match struct
+	// fields and tags in upper case too.
+	db.DB.Mapper = reflectx.NewMapperTagFunc("db", strings.ToUpper,
+		strings.ToUpper)
+	return nil
+}
+
+func (db *DB) Close() error {
+	if db.DB == nil {
+		return nil
+	}
+	return db.DB.Close()
+}
+
+// SetTablePrefix prepends prefix to the names of the meta tables. See
+// migrate.WithTablePrefix.
+func (db *DB) SetTablePrefix(prefix string) { db.prefix = prefix }
+
+// meta prefixes the names of the meta tables in the query q.
+func (db *DB) meta(q string) string {
+	return migrate.PrefixMetaTables(db.prefix, q)
+}
+
+func (db *DB) Ping(ctx context.Context) error { return db.DB.PingContext(ctx) }
+
+// createTable unless it exists. Db2 doesn't support CREATE TABLE IF NOT
+// EXISTS.
+func (db *DB) createTable(name, q string) error {
+	exists, err := db.tableExists(name)
+	if err != nil {
+		return errors.Wrapf(err, "%s exists", name)
+	}
+	if exists {
+		return nil
+	}
+	if _, err = db.Exec(db.meta(q)); err != nil {
+		return errors.Wrapf(err, "create %s table", name)
+	}
+	return nil
+}
+
+func (db *DB) CreateMetaIfNotExists() error {
+	return db.createTable("meta", `CREATE TABLE meta (
+		namespace VARCHAR(255) NOT NULL DEFAULT '',
+		filename VARCHAR(255) NOT NULL,
+		md5 VARCHAR(255) NOT NULL,
+		content CLOB(100M) NOT NULL,
+		algorithm VARCHAR(32) NOT NULL DEFAULT 'md5',
+		variant VARCHAR(64) NOT NULL DEFAULT '',
+		statements INTEGER NOT NULL DEFAULT 0,
+		duration_ns BIGINT NOT NULL DEFAULT 0,
+		annotations VARCHAR(4000) NOT NULL DEFAULT '',
+		appliedat TIMESTAMP NOT NULL DEFAULT CURRENT TIMESTAMP,
+		createdat TIMESTAMP NOT NULL DEFAULT CURRENT TIMESTAMP,
+		UNIQUE (namespace, filename)
+	)`)
+}
+
+func (db *DB) CreateMetaCheckpointsIfNotExists() error {
+	return db.createTable("metacheckpoints", `CREATE TABLE metacheckpoints (
+		namespace VARCHAR(255) NOT NULL DEFAULT '',
+		filename VARCHAR(255) NOT NULL,
+		idx INTEGER NOT NULL,
+		md5 VARCHAR(255) NOT NULL,
+		content CLOB(100M) NOT NULL,
+		createdat TIMESTAMP NOT NULL DEFAULT CURRENT TIMESTAMP,
+		PRIMARY KEY (namespace, filename, idx)
+	)`)
+}
+
+func (db *DB) CreateMetaObjectsIfNotExists() error {
+	return db.createTable("metaobjects", `CREATE TABLE metaobjects (
+		namespace VARCHAR(255) NOT NULL DEFAULT '',
+		filename VARCHAR(255) NOT NULL,
+		content CLOB(100M) NOT NULL,
+		createdat TIMESTAMP NOT NULL DEFAULT CURRENT TIMESTAMP,
+		PRIMARY KEY (namespace, filename)
+	)`)
+}
+
+func (db *DB) CreateMetaFailuresIfNotExists() error {
+	return db.createTable("metafailures", `CREATE TABLE metafailures (
+		namespace VARCHAR(255) NOT NULL DEFAULT '',
+		filename VARCHAR(255) NOT NULL,
+		idx INTEGER NOT NULL,
+		error CLOB(1M) NOT NULL,
+		createdat TIMESTAMP NOT NULL DEFAULT CURRENT TIMESTAMP
+	)`)
+}
+
+func (db *DB) GetMetaFailures(namespace string) ([]migrate.Failure, error) {
+	failures := []migrate.Failure{}
+	q := db.meta(`
+	SELECT namespace, filename, idx, error, createdat FROM metafailures
+	WHERE namespace=?
+	ORDER BY createdat`)
+	err := db.Select(&failures, q, namespace)
+	return failures, err
+}
+
+func (db *DB) InsertMetaFailure(f migrate.Failure) error {
+	q := db.meta(`
+		INSERT INTO metafailures (namespace, filename, idx, error)
+		VALUES (?, ?, ?, ?)`)
+	_, err := db.Exec(q, f.Namespace, f.Filename, f.Index, f.Error)
+	return err
+}
+
+func (db *DB) GetMetaObjects(namespace string) ([]migrate.Object, error) {
+	objects := []migrate.Object{}
+	q := db.meta(`
+	SELECT namespace, filename, content FROM metaobjects
+	WHERE namespace=?`)
+	err := db.Select(&objects, q, namespace)
+	return objects, err
+}
+
+// UpsertMetaObject updates the object, inserting it if it wasn't updated.
+// Db2's MERGE would need every parameter cast to a type, so this is simpler.
+func (db *DB) UpsertMetaObject(o migrate.Object) error {
+	q := db.meta(`
+		UPDATE metaobjects SET content=?, createdat=CURRENT TIMESTAMP
+		WHERE namespace=? AND filename=?`)
+	res, err := db.Exec(q, o.Content, o.Namespace, o.Filename)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "rows affected")
+	}
+	if n > 0 {
+		return nil
+	}
+	q = db.meta(`
+		INSERT INTO metaobjects (namespace, filename, content)
+		VALUES (?, ?, ?)`)
+	_, err = db.Exec(q, o.Namespace, o.Filename, o.Content)
+	return err
+}
+
+func (db *DB) GetMigrations(namespace string) ([]migrate.Migration, error) {
+	migrations := []migrate.Migration{}
+	q := db.meta(`
+	SELECT namespace, filename, content, md5 AS checksum, algorithm,
+		variant, statements, duration_ns AS duration, annotations,
+		appliedat
+	FROM meta
+	WHERE namespace=?
+	ORDER BY BIGINT(REGEXP_SUBSTR(filename, '^[0-9]+'))`)
+	err := db.Select(&migrations, q, namespace)
+	return migrations, err
+}
+
+func (db *DB) GetMetaCheckpoints(namespace, filename string) ([]string, error) {
+	checkpoints := []string{}
+	q := db.meta(`
+	SELECT md5 FROM metacheckpoints
+	WHERE namespace=? AND filename=?
+	ORDER BY idx`)
+	err := db.Select(&checkpoints, q, namespace, filename)
+	return checkpoints, err
+}
+
+// UpsertMigration updates the migration, inserting it if it wasn't updated;
+// see UpsertMetaObject.
+func (db *DB) UpsertMigration(m migrate.Migration) error {
+	q := db.meta(`
+		UPDATE meta SET content=?, md5=?, algorithm=?, variant=?,
+			statements=?, duration_ns=?, annotations=?, appliedat=?
+		WHERE namespace=? AND filename=?`)
+	res, err := db.Exec(q, m.Content, m.Checksum, m.Algorithm, m.Variant,
+		m.Statements, m.Duration, m.Annotations, m.AppliedAt, m.Namespace,
+		m.Filename)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "rows affected")
+	}
+	if n > 0 {
+		return nil
+	}
+	return db.InsertMigration(m)
+}
+
+func (db *DB) InsertMetaCheckpoint(
+	namespace, filename, content, checksum string,
+	idx int,
+) error {
+	q := db.meta(`
+		INSERT INTO metacheckpoints (namespace, filename, content, idx, md5)
+		VALUES (?, ?, ?, ?, ?)`)
+	_, err := db.Exec(q, namespace, filename, content, idx, checksum)
+	return err
+}
+
+func (db *DB) InsertMigration(m migrate.Migration) error {
+	q := db.meta(`
+		INSERT INTO meta
+			(namespace, filename, content, md5, algorithm, variant,
+			statements, duration_ns, annotations, appliedat)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	_, err := db.Exec(q, m.Namespace, m.Filename, m.Content, m.Checksum,
+		m.Algorithm, m.Variant, m.Statements, m.Duration, m.Annotations,
+		m.AppliedAt)
+	return err
+}
+
+func (db *DB) DeleteMetaCheckpoints(namespace string) error {
+	q := db.meta(`DELETE FROM metacheckpoints WHERE namespace=?`)
+	_, err := db.Exec(q, namespace)
+	return err
+}
+
+// DeleteMigration removes filename from the history of namespace.
+func (db *DB) DeleteMigration(namespace, filename string) error {
+	q := db.meta(`DELETE FROM meta WHERE namespace=? AND filename=?`)
+	_, err := db.Exec(q, namespace, filename)
+	return err
+}
+
+func (db *DB) CreateMetaVersionIfNotExists(schemaVersion int) (int, error) {
+	exists, err := db.tableExists("metaversion")
+	if err != nil {
+		return 0, errors.Wrap(err, "metaversion exists")
+	}
+	if !exists {
+		q := db.meta(`
+		CREATE TABLE metaversion (version INTEGER NOT NULL)`)
+		if _, err := db.Exec(q); err != nil {
+			return 0, errors.Wrap(err, "create metaversion table")
+		}
+	}
+
+	var version int
+	q := db.meta(`SELECT version FROM metaversion`)
+	err = db.Get(&version, q)
+	switch {
+	case err == sql.ErrNoRows:
+		if exists {
+			schemaVersion = 0
+		}
+		q = db.meta(`INSERT INTO metaversion (version) VALUES (?)`)
+		if _, err := db.Exec(q, schemaVersion); err != nil {
+			return 0, errors.Wrap(err, "insert version")
+		}
+		return schemaVersion, nil
+	case err != nil:
+		return 0, errors.Wrap(err, "get version")
+	}
+	return version, nil
+}
+
+// GetMetaVersion reports the current version without creating or modifying
+// anything. It returns 0 if the meta tables predate versioning and -1 if they
+// don't exist.
+func (db *DB) GetMetaVersion() (int, error) {
+	exists, err := db.tableExists("metaversion")
+	if err != nil {
+		return 0, errors.Wrap(err, "metaversion exists")
+	}
+	if !exists {
+		exists, err = db.tableExists("meta")
+		if err != nil {
+			return 0, errors.Wrap(err, "meta exists")
+		}
+		if exists {
+			return 0, nil
+		}
+		return -1, nil
+	}
+	var version int
+	err = db.Get(&version, db.meta(`SELECT version FROM metaversion`))
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, nil
+	case err != nil:
+		return 0, errors.Wrap(err, "get version")
+	}
+	return version, nil
+}
+
+// tableExists in the current schema. Db2 stores unquoted names in upper
+// case.
+func (db *DB) tableExists(name string) (bool, error) {
+	var n int
+	q := `
+	SELECT COUNT(*) FROM syscat.tables
+	WHERE tabschema=CURRENT SCHEMA AND tabname=?`
+	if err := db.Get(&n, q, strings.ToUpper(db.meta(name))); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// setVersion of the meta tables.
+func (db *DB) setVersion(version int) error {
+	q := db.meta(`UPDATE metaversion SET version=?`)
+	if _, err := db.Exec(q, version); err != nil {
+		return errors.Wrap(err, "update metaversion")
+	}
+	return nil
+}
+
+// UpgradeToV1 only records the version. Db2's meta tables were created in the
+// current format, so there's nothing to upgrade.
+func (db *DB) UpgradeToV1([]migrate.Migration) error { return db.setVersion(1) }
+
+// UpgradeToV2 only records the version; see UpgradeToV1.
+func (db *DB) UpgradeToV2() error { return db.setVersion(2) }
+
+// UpgradeToV3 only records the version; see UpgradeToV1.
+func (db *DB) UpgradeToV3() error { return db.setVersion(3) }
+
+// UpgradeToV4 only records the version; see UpgradeToV1.
+func (db *DB) UpgradeToV4() error { return db.setVersion(4) }
+
+// UpgradeToV5 only records the version; see UpgradeToV1.
+func (db *DB) UpgradeToV5() error { return db.setVersion(5) }
+
+// UpgradeToV6 records the annotations of the run which applied each
+// migration. Meta tables created since already have the column.
+func (db *DB) UpgradeToV6() error {
+	q := db.meta(`ALTER TABLE meta
+		ADD COLUMN annotations VARCHAR(4000) NOT NULL DEFAULT ''`)
+	_, err := db.Exec(q)
+	if err != nil && db.ClassifyError(err) != migrate.ClassDuplicateObject {
+		return errors.Wrap(err, "add annotations column")
+	}
+	return db.setVersion(6)
+}
+
+// UpgradeToV7 only records the version. Migrate rewrites md5 checksums as
+// SHA-256 once it's verified them.
+func (db *DB) UpgradeToV7() error { return db.setVersion(7) }
+
+// UpgradeToV8 records when each migration was applied. Migrations applied
+// before use the time they were recorded.
+func (db *DB) UpgradeToV8() error {
+	q := db.meta(`ALTER TABLE meta
+		ADD COLUMN appliedat TIMESTAMP NOT NULL DEFAULT CURRENT TIMESTAMP`)
+	_, err := db.Exec(q)
+	if err != nil && db.ClassifyError(err) != migrate.ClassDuplicateObject {
+		return errors.Wrap(err, "add appliedat column")
+	}
+	q = db.meta(`UPDATE meta SET appliedat=createdat`)
+	if _, err = db.Exec(q); err != nil {
+		return errors.Wrap(err, "update appliedat")
+	}
+	return db.setVersion(8)
+}
+
+// ExecAtomic executes cmds one at a time within a transaction, so a failed
+// atomic group leaves no trace.
+func (db *DB) ExecAtomic(cmds []string) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+	for _, cmd := range cmds {
+		if _, err = tx.Exec(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// regexSQLCode matches the SQLCODE in a Db2 message, such as SQL0601N.
+var regexSQLCode = regexp.MustCompile(`\bSQL(\d{4,5})N\b`)
+
+// Analyze collects the statistics of table with RUNSTATS, which is a command
+// rather than SQL, so it's run through ADMIN_CMD. An unqualified table is in
+// the current schema.
+func (db *DB) Analyze(table string) error {
+	cmd := `RUNSTATS ON TABLE ` + table +
+		` WITH DISTRIBUTION AND DETAILED INDEXES ALL`
+	_, err := db.Exec(`CALL SYSPROC.ADMIN_CMD(?)`, cmd)
+	return err
+}
+
+// ClassifyError by the SQLCODE in its message, since this package doesn't
+// depend on a particular driver's error type.
+func (db *DB) ClassifyError(err error) migrate.ErrorClass {
+	if err == nil {
+		return migrate.ClassUnknown
+	}
+	match := regexSQLCode.FindStringSubmatch(err.Error())
+	if match == nil {
+		return migrate.ClassUnknown
+	}
+	switch strings.TrimLeft(match[1], "0") {
+	case "551", // lacks the privilege for the operation
+		"552": // lacks the privilege to create the object
+		return migrate.ClassPermissionDenied
+	case "601", // object already exists
+		"612": // duplicate column name
+		return migrate.ClassDuplicateObject
+	case "911", // deadlock or timeout, rolled back
+		"913": // deadlock or timeout, statement failed
+		return migrate.ClassLockTimeout
+	case "104": // unexpected token
+		return migrate.ClassSyntax
+	case "1224", // database agent terminated
+		"30081": // communication error
+		return migrate.ClassConnectionLost
+	}
+	return migrate.ClassUnknown
+}
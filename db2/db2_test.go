@@ -0,0 +1,46 @@
+package db2
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/thankful-ai/migrate"
+)
+
+func TestClassifyError(t *testing.T) {
+	db := &DB{}
+	tcs := []struct {
+		err  error
+		want migrate.ErrorClass
+	}{
+		{
+			err:  errors.New(`SQLExecute: {42710} [IBM][CLI Driver][DB2/LINUXX8664] SQL0601N  The name of the object to be created is identical to the existing name "DB2INST1.USERS" of type "TABLE".  SQLSTATE=42710`),
+			want: migrate.ClassDuplicateObject,
+		},
+		{
+			err:  errors.Wrap(errors.New(`SQL0551N  The statement failed because the authorization ID does not have the required authorization.  SQLSTATE=42501`), "exec"),
+			want: migrate.ClassPermissionDenied,
+		},
+		{
+			err:  errors.New(`SQL0104N  An unexpected token "TABEL" was found following "CREATE ".  SQLSTATE=42601`),
+			want: migrate.ClassSyntax,
+		},
+		{
+			err:  errors.New(`SQL0911N  The current transaction has been rolled back because of a deadlock or timeout.  Reason code "68".  SQLSTATE=40001`),
+			want: migrate.ClassLockTimeout,
+		},
+		{
+			err:  errors.New(`SQL30081N  A communication error has been detected.  SQLSTATE=08001`),
+			want: migrate.ClassConnectionLost,
+		},
+		{
+			err:  errors.New("other"),
+			want: migrate.ClassUnknown,
+		},
+	}
+	for _, tc := range tcs {
+		if got := db.ClassifyError(tc.err); got != tc.want {
+			t.Errorf("%v: expected %s, got %s", tc.err, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package migrate
+
+import (
+	"regexp"
+)
+
+// WithDevMode lets you iterate on the newest migration during local
+// development without resetting the database after every edit. If the last
+// applied migration changed, it's applied again rather than failing with
+// ErrChecksumMismatch. While migrating, CREATE TABLE and DROP TABLE or VIEW
+// statements are rewritten to their IF [NOT] EXISTS forms, and statements
+// which fail because their object already exists are skipped with a warning.
+//
+// Dev mode rewrites history, so never use it on a shared database.
+func WithDevMode() Option {
+	return func(m *Migrate) { m.dev = true }
+}
+
+var (
+	regexCreateTable = regexp.MustCompile(
+		`(?i)^(\s*create\s+(?:(?:global\s+|local\s+)?(?:temp|temporary)\s+|unlogged\s+)?table)\s+(?:if\s+not\s+exists\s+)?`)
+	regexDropTable = regexp.MustCompile(
+		`(?i)^(\s*drop\s+(?:table|view))\s+(?:if\s+exists\s+)?`)
+)
+
+// idempotent rewrites cmd to succeed if it was already applied, where the
+// database supports it.
+func idempotent(cmd string) string {
+	if loc := regexCreateTable.FindStringSubmatchIndex(cmd); loc != nil {
+		return cmd[:loc[3]] + " IF NOT EXISTS " + cmd[loc[1]:]
+	}
+	if loc := regexDropTable.FindStringSubmatchIndex(cmd); loc != nil {
+		return cmd[:loc[3]] + " IF EXISTS " + cmd[loc[1]:]
+	}
+	return cmd
+}
+
+// devReapply records that dev mode is applying the changed migration mg
+// again, so it's removed from the history until it succeeds.
+func (m *Migrate) devReapply(mg Migration) {
+	m.warnf("%s %s changed, applying it again in dev mode\n",
+		m.colorize(colorYellow, "warning"), mg.Filename)
+	m.reapply = mg.Filename
+	m.Migrations = m.Migrations[:len(m.Migrations)-1]
+}
@@ -0,0 +1,46 @@
+package migrate
+
+import "testing"
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "CREATE TABLE users (\n\tid INTEGER,\n\tname TEXT\n);\n"
+	b := "CREATE TABLE users (\n\tid INTEGER,\n\temail TEXT\n);\n"
+	want := `--- a
++++ b
+@@ -1,4 +1,4 @@
+ CREATE TABLE users (
+ 	id INTEGER,
+-	name TEXT
++	email TEXT
+ );
+`
+	if got := unifiedDiff("a", "b", a, b); got != want {
+		t.Fatalf("unexpected diff:\n%s", got)
+	}
+	if got := unifiedDiff("a", "b", a, a); got != "" {
+		t.Fatalf("expected no diff, got:\n%s", got)
+	}
+}
+
+func TestUnifiedDiffHunks(t *testing.T) {
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"
+	b := "one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve\n"
+	want := `--- a
++++ b
+@@ -1,4 +1,4 @@
+-1
++one
+ 2
+ 3
+ 4
+@@ -9,4 +9,4 @@
+ 9
+ 10
+ 11
+-12
++twelve
+`
+	if got := unifiedDiff("a", "b", a, b); got != want {
+		t.Fatalf("unexpected diff:\n%s", got)
+	}
+}
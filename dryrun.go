@@ -0,0 +1,79 @@
+package migrate
+
+import "fmt"
+
+// PlannedStatement would be executed by Migrate, as listed by DryRun.
+type PlannedStatement struct {
+	Filename string
+
+	// Index of the statement within the file, starting at 0.
+	Index int
+
+	SQL string
+
+	// Target names the Store configured WithTarget on which the statement
+	// would be executed, if any.
+	Target string
+}
+
+// DryRun lists every statement of the pending migrations which Migrate would
+// execute, in order, without executing or recording anything. Statements
+// checkpointed by an earlier run which failed are left out, since they'd be
+// skipped, as are files skipped in the environment. Until the history is
+// loaded by Init or Inspect, every file is pending. Use PendingObjects for the
+// objects which would be recreated.
+func (m *Migrate) DryRun() ([]PlannedStatement, error) {
+	history := m.loaded || m.readOnly && m.version == version
+	var planned []PlannedStatement
+	for _, f := range m.pendingFiles() {
+		if f.skip {
+			continue
+		}
+		var checkpoints []string
+		if history {
+			var err error
+			checkpoints, err = m.tracker.GetMetaCheckpoints(
+				m.namespace, f.Info.Name())
+			if err != nil {
+				return nil, fmt.Errorf("get checkpoints: %w", err)
+			}
+		}
+		if f.up != nil {
+			planned = append(planned, PlannedStatement{
+				Filename: f.Info.Name(),
+				SQL:      "-- go migration",
+			})
+			continue
+		}
+		stmts, err := openStatements(nil, m.fsys, f.fullpath, m.dbt)
+		if err != nil {
+			return nil, fmt.Errorf("statements: %w", err)
+		}
+		for i := 0; ; i++ {
+			stmt, ok, err := stmts.next()
+			if err != nil {
+				stmts.Close()
+				return nil, fmt.Errorf("statements %s: %w",
+					f.Info.Name(), err)
+			}
+			if !ok {
+				break
+			}
+			if i < len(checkpoints) {
+				continue
+			}
+			sql := stmt.sql
+			if m.dev {
+				sql = idempotent(sql)
+			}
+			planned = append(planned, PlannedStatement{
+				Filename: f.Info.Name(),
+				Index:    i,
+				SQL:      sql,
+				Target:   f.target,
+			})
+		}
+		stmts.Close()
+	}
+	return planned, nil
+}
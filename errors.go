@@ -0,0 +1,159 @@
+package migrate
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// Sentinel errors for common failures, which can be detected with errors.Is.
+var (
+	// ErrChecksumMismatch indicates a file changed after it was
+	// migrated.
+	ErrChecksumMismatch = errors.New("checksum does not match")
+
+	// ErrMissingMigration indicates a file was removed after it was
+	// migrated.
+	ErrMissingMigration = errors.New("cannot continue with missing migrations")
+
+	// ErrOutOfOrder indicates a file was inserted earlier in history than
+	// an existing migration.
+	ErrOutOfOrder = errors.New("migrations must be appended")
+
+	// ErrUnknownMigration indicates a filename, such as one passed to
+	// MigrateTo or WithSkip, isn't a migration file.
+	ErrUnknownMigration = errors.New("no such migration file")
+
+	// ErrNoStatements indicates a file contains no SQL statements.
+	ErrNoStatements = errors.New("no sql statements in file")
+
+	// ErrDuplicateNumber indicates two files share a numeric prefix.
+	// Resolve it with Renumber.
+	ErrDuplicateNumber = errors.New("cannot have duplicate timestamp")
+
+	// ErrFilenamePolicy indicates a pending file violates a
+	// FilenamePolicy.
+	ErrFilenamePolicy = errors.New("filename policy violated")
+
+	// ErrOverrideMismatch indicates an override shares its number with a
+	// migration of a different name, so the override is never used.
+	ErrOverrideMismatch = errors.New("override does not match migration")
+
+	// ErrInvalidStatement indicates a pending statement was rejected by a
+	// Validator.
+	ErrInvalidStatement = errors.New("invalid statement")
+
+	// ErrReadOnly indicates the database can't be written to, such as a
+	// replica.
+	ErrReadOnly = errors.New("database is read-only")
+
+	// ErrTruncation indicates a statement truncated or coerced data, as
+	// reported by a Warner.
+	ErrTruncation = errors.New("data truncated")
+
+	// ErrFileTimeout indicates a migration file took longer than its
+	// timeout. Migrating stopped between statements, so it resumes from
+	// the last checkpoint on the next run.
+	ErrFileTimeout = errors.New("migration file timed out")
+
+	// ErrInterrupted indicates migrating stopped between statements because
+	// the channel configured WithInterrupt was closed. It resumes from the
+	// last checkpoint on the next run.
+	ErrInterrupted = errors.New("interrupted")
+
+	// ErrLocked indicates another process held the lock on the namespace
+	// for longer than the configured wait. See LockedError for who holds
+	// it.
+	ErrLocked = errors.New("locked by another migration")
+
+	// ErrNeedsUpgrade indicates the database was migrated by a newer
+	// version of migrate.
+	ErrNeedsUpgrade = errors.New("must upgrade migrate: go get -u github.com/thankful-ai/migrate")
+)
+
+// ErrorClass is a vendor-neutral category of database error, so callers can
+// handle failures without matching driver-specific codes or messages.
+type ErrorClass string
+
+const (
+	ClassUnknown          ErrorClass = "unknown"
+	ClassPermissionDenied ErrorClass = "permission denied"
+	ClassDuplicateObject  ErrorClass = "duplicate object"
+	ClassLockTimeout      ErrorClass = "lock timeout"
+	ClassSyntax           ErrorClass = "syntax error"
+	ClassConnectionLost   ErrorClass = "connection lost"
+)
+
+// ErrorClassifier is implemented by Stores which can categorize their
+// driver's errors.
+type ErrorClassifier interface {
+	ClassifyError(error) ErrorClass
+}
+
+// MigrationError reports a statement which failed to execute. Failures
+// before any statement runs, such as a changed file, are reported by the
+// other errors in this file instead, so an application can tell them apart:
+//
+//	var serr *migrate.StatementError
+//	switch {
+//	case errors.Is(err, migrate.ErrChecksumMismatch):
+//		// A migrated file changed; page someone.
+//	case errors.As(err, &serr) && serr.Transient():
+//		// Try again later.
+//	}
+type MigrationError struct {
+	// File containing the statement.
+	File string
+
+	// Index of the statement within the file, starting at 0. If the
+	// statement was part of a batch, it's the index of the batch's first
+	// statement.
+	Index int
+
+	// SQL of the failed statement, or of every statement in its batch,
+	// redacted if configured WithRedactedLiterals or WithRedactor.
+	SQL string
+
+	// Class of the underlying error.
+	Class ErrorClass
+
+	Err error
+}
+
+func (e *MigrationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.File, e.Err)
+}
+
+func (e *MigrationError) Unwrap() error { return e.Err }
+
+// Transient reports whether the statement failed in a way which may succeed
+// if migrating is tried again, such as a lock timeout or lost connection.
+// Migrating resumes from the last checkpoint.
+func (e *MigrationError) Transient() bool {
+	return e.Class == ClassLockTimeout || e.Class == ClassConnectionLost
+}
+
+// StatementError is MigrationError, named for what it reports.
+type StatementError = MigrationError
+
+// classifyError using the Store if it knows how, falling back to errors which
+// are the same across drivers.
+func (m *Migrate) classifyError(err error) ErrorClass {
+	if c, ok := m.db.(ErrorClassifier); ok {
+		if class := c.ClassifyError(err); class != ClassUnknown {
+			return class
+		}
+	}
+	var netErr net.Error
+	switch {
+	case errors.Is(err, driver.ErrBadConn),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.As(err, &netErr):
+		return ClassConnectionLost
+	}
+	return ClassUnknown
+}
@@ -0,0 +1,103 @@
+package migrate
+
+import "time"
+
+// Event reports progress while migrating, so tools can render it live without
+// parsing logs or polling the database. It's one of FileStarted,
+// StatementExecuted, CheckpointSaved, FileApplied, Failed, or RunFinished.
+type Event interface {
+	event()
+}
+
+// FileStarted is emitted before executing a migration file.
+type FileStarted struct {
+	Filename string
+
+	// Statements in the file, of which Checkpoints were already executed
+	// by an earlier run and will be skipped.
+	Statements  int
+	Checkpoints int
+}
+
+// StatementExecuted is emitted after a statement succeeds. If it was part of
+// a batch, Index and SQL describe the whole batch, and Statements is the
+// number of statements in it.
+type StatementExecuted struct {
+	Filename   string
+	Index      int
+	SQL        string
+	Statements int
+	Duration   time.Duration
+
+	// RowsAffected by the statement, if it's an INSERT, UPDATE, or DELETE.
+	RowsAffected int64
+}
+
+// CheckpointSaved is emitted after recording that the statement at Index
+// succeeded, so it won't be executed again if a later statement fails.
+type CheckpointSaved struct {
+	Filename string
+	Index    int
+}
+
+// FileApplied is emitted after a migration file is recorded in the history.
+type FileApplied struct {
+	Migration
+}
+
+// Failed is emitted when an error stops the run. Filename is empty if the
+// error didn't occur within a file.
+type Failed struct {
+	Filename string
+	Err      error
+}
+
+// RunFinished is emitted when Migrate or MigrateUntil returns.
+type RunFinished struct {
+	// Migrated contains the filenames applied in this run, in order.
+	Migrated []string
+
+	Duration time.Duration
+
+	// Err which stopped the run, if any.
+	Err error
+}
+
+func (FileStarted) event()       {}
+func (StatementExecuted) event() {}
+func (CheckpointSaved) event()   {}
+func (FileApplied) event()       {}
+func (Failed) event()            {}
+func (RunFinished) event()       {}
+
+// WithEvents calls fn with each Event while migrating. It's called
+// synchronously, so migrating waits for it to return; to render events
+// elsewhere, send them on a buffered channel.
+func WithEvents(fn func(Event)) Option {
+	return func(m *Migrate) { m.events = fn }
+}
+
+// emit e to the run's Progress and, if configured WithEvents, WithMetrics,
+// and WithTracerProvider, to its callback, Metrics, and spans. Statements are
+// redacted first.
+func (m *Migrate) emit(e Event) {
+	e = m.redactEvent(e)
+	m.progress.update(e)
+	m.slowest.update(e)
+	m.observe(e)
+	m.trace(e)
+	if m.events != nil {
+		m.events(e)
+	}
+}
+
+// finishRun emits RunFinished for a run which began at start, when the
+// history had before migrations.
+func (m *Migrate) finishRun(start time.Time, before int, err error) {
+	e := RunFinished{Duration: time.Since(start), Err: err}
+	for _, mg := range m.Migrations[before:] {
+		e.Migrated = append(e.Migrated, mg.Filename)
+	}
+	m.emit(e)
+	m.logSlowest()
+}
@@ -0,0 +1,5 @@
+package migrate
+
+// fipsBuild reports whether the binary was built or is running with a
+// FIPS-validated crypto module, in which case FIPS mode is always enabled.
+var fipsBuild bool
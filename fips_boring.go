@@ -0,0 +1,9 @@
+//go:build boringcrypto
+
+package migrate
+
+import "crypto/boring"
+
+func init() {
+	fipsBuild = fipsBuild || boring.Enabled()
+}
@@ -0,0 +1,9 @@
+//go:build go1.24
+
+package migrate
+
+import "crypto/fips140"
+
+func init() {
+	fipsBuild = fipsBuild || fips140.Enabled()
+}
@@ -0,0 +1,25 @@
+package migrate
+
+import "io/fs"
+
+// NewFS is New, reading migrations from fsys rather than a directory, such as
+// an embed.FS so migrations ship inside the binary:
+//
+//	//go:embed migrations
+//	var migrations embed.FS
+//
+//	sub, err := fs.Sub(migrations, "migrations")
+//	// ...
+//	m, err := migrate.NewFS(db, sub, migrate.WithDBType(migrate.DBTypePostgres))
+//
+// Overrides, objects, partitions, the skip file, and data files are found in
+// fsys just as they would be in a directory.
+func NewFS(db Store, fsys fs.FS, opts ...Option) (*Migrate, error) {
+	return New(db, "", append(opts, WithFS(fsys))...)
+}
+
+// WithFS reads migrations from fsys rather than the directory passed to New,
+// Load, or Inspect. See NewFS.
+func WithFS(fsys fs.FS) Option {
+	return func(m *Migrate) { m.fsys = fsys }
+}
@@ -0,0 +1,159 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// GoFunc applies a Go migration within tx, which is committed if it returns
+// nil and rolled back otherwise.
+type GoFunc func(tx *sql.Tx) error
+
+// TxBeginner is implemented by Stores which can begin a *sql.Tx, as those
+// embedding *sql.DB or *sqlx.DB do, to run Go migrations.
+type TxBeginner interface {
+	BeginTx(context.Context, *sql.TxOptions) (*sql.Tx, error)
+}
+
+// goAlgorithm is recorded as the Algorithm of Go migrations, which have no
+// content to checksum.
+const goAlgorithm = "go"
+
+// goMigration registered WithGoMigration.
+type goMigration struct {
+	name string
+	up   GoFunc
+}
+
+// WithGoMigration applies up as the migration called name, for data
+// transformations which need application logic, such as hashing or editing
+// JSON. The name is numbered like a migration file, such as 3_hash_emails, and
+// up runs in order among the files in one transaction. It's recorded in the
+// history like a file, but without content to checksum, so changes to up
+// aren't detected. A crash after up commits but before it's recorded runs it
+// again, so it should be idempotent. Go migrations require a Store which is a
+// TxBeginner, as every Store in this module is except BigQuery's. The option
+// may be repeated.
+func WithGoMigration(name string, up GoFunc) Option {
+	return func(m *Migrate) {
+		m.goMigrations = append(m.goMigrations, goMigration{
+			name: name,
+			up:   up,
+		})
+	}
+}
+
+// goFiles to sort among the migration files.
+func (m *Migrate) goFiles() ([]*file, error) {
+	files := make([]*file, 0, len(m.goMigrations))
+	seen := map[string]bool{}
+	for _, g := range m.goMigrations {
+		if seen[g.name] {
+			return nil, fmt.Errorf("go migration %s registered twice",
+				g.name)
+		}
+		seen[g.name] = true
+		if g.up == nil {
+			return nil, fmt.Errorf("go migration %s has no function",
+				g.name)
+		}
+		files = append(files, &file{
+			Info:          goFileInfo{name: g.name},
+			fullpath:      g.name,
+			up:            g.up,
+			statements:    1,
+			transactional: true,
+		})
+	}
+	return files, nil
+}
+
+// isGo reports whether the named migration is registered WithGoMigration.
+func (m *Migrate) isGo(name string) bool {
+	for _, g := range m.goMigrations {
+		if g.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkGo confirms that mg, recorded or registered as a Go migration, is
+// still the same kind of migration.
+func (m *Migrate) checkGo(mg Migration) error {
+	switch {
+	case mg.Algorithm == goAlgorithm && !m.isGo(mg.Filename):
+		return checksumMismatch(mg, " (migrated in go, but now a file)")
+	case mg.Algorithm != goAlgorithm && m.isGo(mg.Filename):
+		return checksumMismatch(mg, " (migrated as a file, but now in go)")
+	}
+	return nil
+}
+
+// migrateGo runs the function of the Go migration f in a transaction and
+// records it.
+func (m *Migrate) migrateGo(f *file) error {
+	b, ok := m.db.(TxBeginner)
+	if !ok {
+		return fmt.Errorf("%s: cannot run go migration: store can't begin a transaction",
+			f.Info.Name())
+	}
+	if m.interrupted() {
+		m.record("interrupted %s", f.Info.Name())
+		return fmt.Errorf("%w: %s", m.interruption(), f.Info.Name())
+	}
+	m.record("begin %s (go)", f.Info.Name())
+	m.emit(FileStarted{Filename: f.Info.Name(), Statements: 1})
+	start := time.Now()
+	if err := m.runGo(b, f.up); err != nil {
+		m.record("failed %s after %s: %s", f.Info.Name(),
+			time.Since(start), m.redactError(err))
+		return &MigrationError{
+			File:  f.Info.Name(),
+			Class: m.classifyError(err),
+			Err:   err,
+		}
+	}
+	mg, err := m.fileMigration(f)
+	if err != nil {
+		return err
+	}
+	mg.Statements = 1
+	mg.Duration = time.Since(start)
+	mg.AppliedAt = appliedNow()
+	if err = m.tracker.InsertMigration(mg); err != nil {
+		return errors.Wrap(err, "insert migration")
+	}
+	m.Migrations = append(m.Migrations, mg)
+	m.record("migrated %s (go)", mg.Filename)
+	m.emit(FileApplied{Migration: mg})
+	return nil
+}
+
+// runGo calls up in a transaction begun on b.
+func (m *Migrate) runGo(b TxBeginner, up GoFunc) error {
+	tx, err := b.BeginTx(m.ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "begin")
+	}
+	if err = up(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return errors.Wrap(tx.Commit(), "commit")
+}
+
+// goFileInfo names a Go migration among the files.
+type goFileInfo struct{ name string }
+
+func (fi goFileInfo) Name() string       { return fi.name }
+func (fi goFileInfo) Size() int64        { return 0 }
+func (fi goFileInfo) Mode() fs.FileMode  { return 0 }
+func (fi goFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi goFileInfo) IsDir() bool        { return false }
+func (fi goFileInfo) Sys() any           { return nil }
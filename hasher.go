@@ -0,0 +1,167 @@
+package migrate
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Hasher computes the checksums which guarantee that migrations don't change
+// after they've been run. The algorithm is recorded alongside every checksum
+// in the meta table, so migrations can be verified later using the same
+// Hasher even if the default changes.
+type Hasher interface {
+	// Algorithm uniquely identifies the hash, e.g. "md5" or
+	// "hmac-sha256".
+	Algorithm() string
+
+	// New returns a hash.Hash ready to accept a migration's content.
+	New() hash.Hash
+}
+
+// NewHasher returns a Hasher with the given algorithm identifier which uses fn
+// to create hashes. For instance, to use HMAC-keyed checksums:
+//
+//	h := migrate.NewHasher("hmac-sha256", func() hash.Hash {
+//		return hmac.New(sha256.New, key)
+//	})
+func NewHasher(algorithm string, fn func() hash.Hash) Hasher {
+	return hasherFunc{algorithm: algorithm, fn: fn}
+}
+
+// MD5Hasher was the default Hasher, and is the one used by all migrations
+// recorded before algorithms were tracked. Init verifies md5 checksums, then
+// rewrites them with the default Hasher.
+var MD5Hasher = NewHasher("md5", md5.New)
+
+// SHA256Hasher is the default Hasher.
+var SHA256Hasher = NewHasher("sha256", sha256.New)
+
+type hasherFunc struct {
+	algorithm string
+	fn        func() hash.Hash
+}
+
+func (h hasherFunc) Algorithm() string { return h.algorithm }
+func (h hasherFunc) New() hash.Hash    { return h.fn() }
+
+// setupHashers chooses the default Hasher once options have been applied.
+func (m *Migrate) setupHashers() error {
+	m.fips = m.fips || fipsBuild
+	if m.hasher == nil {
+		m.hasher = SHA256Hasher
+		m.hashers[m.hasher.Algorithm()] = m.hasher
+	}
+	if m.fips {
+		if m.hasher.Algorithm() == MD5Hasher.Algorithm() {
+			return errors.New("md5 is not allowed in fips mode")
+		}
+
+		// Legacy md5 checksums are verified against the content
+		// recorded alongside them instead. See checkHash.
+		delete(m.hashers, MD5Hasher.Algorithm())
+	}
+	return nil
+}
+
+// hasherFor returns the configured Hasher which matches the algorithm recorded
+// for a migration.
+func (m *Migrate) hasherFor(algorithm string) (Hasher, error) {
+	if isMD5(algorithm) {
+		algorithm = MD5Hasher.Algorithm()
+	}
+	h, exist := m.hashers[algorithm]
+	if !exist {
+		return nil, fmt.Errorf("unknown checksum algorithm %q: provide it with WithHasher", algorithm)
+	}
+	return h, nil
+}
+
+func computeChecksum(
+	hr Hasher,
+	r io.Reader,
+) (content string, checksum string, err error) {
+	h := hr.New()
+	byt, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", "", errors.Wrap(err, "read all")
+	}
+	if _, err := io.Copy(h, bytes.NewReader(byt)); err != nil {
+		return "", "", err
+	}
+	return string(byt), fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// Checksum of a migration's content as New records it with the default
+// Hasher, SHA256Hasher. Migrations which load data files or blobs also fold
+// their contents into the recorded checksum, which Checksum can't see.
+func Checksum(r io.Reader) (string, error) {
+	hh := SHA256Hasher.New()
+	if _, err := io.Copy(hh, r); err != nil {
+		return "", errors.Wrap(err, "read")
+	}
+	return fmt.Sprintf("%x", hh.Sum(nil)), nil
+}
+
+// isMD5 reports whether a recorded algorithm is md5. Migrations recorded
+// before algorithms were tracked have an empty algorithm.
+func isMD5(algorithm string) bool {
+	return algorithm == "" || algorithm == MD5Hasher.Algorithm()
+}
+
+// rehash rewrites the md5 checksums in the history with the default Hasher,
+// so history recorded before SHA-256 became the default stops depending on
+// md5. It relies on validHistory having verified them against the files,
+// including any data files and blobs, which the stored content lacks.
+// Checksums recorded with any other Hasher are left as they are.
+func (m *Migrate) rehash() error {
+	if isMD5(m.hasher.Algorithm()) {
+		return nil
+	}
+	var n int
+	for i := m.idx; i < len(m.Migrations); i++ {
+		mg := m.Migrations[i]
+		if !isMD5(mg.Algorithm) || mg.Filename == m.reapply ||
+			m.mismatched[mg.Filename] {
+			continue
+		}
+		check, err := fileChecksum(m.hasher, m.fsys, mg.fullpath, m.dbt)
+		if err != nil {
+			return err
+		}
+		mg.Checksum, mg.Algorithm = check, m.hasher.Algorithm()
+		if err = m.tracker.UpsertMigration(mg); err != nil {
+			return errors.Wrapf(err, "rewrite checksum of %s", mg.Filename)
+		}
+		m.Migrations[i] = mg
+		n++
+	}
+	if n > 0 {
+		m.infof("rewrote %d md5 checksums as %s\n", n,
+			m.hasher.Algorithm())
+	}
+	return nil
+}
+
+// checkpointMatches reports whether cmd has the checksum recorded in its
+// checkpoint. Checkpoints recorded before SHA-256 became the default have md5
+// checksums, which are accepted unless md5 is disallowed.
+func (m *Migrate) checkpointMatches(cmd, recorded string) (bool, error) {
+	_, checksum, err := computeChecksum(m.hasher, strings.NewReader(cmd))
+	if err != nil || checksum == recorded {
+		return err == nil, err
+	}
+	h, exist := m.hashers[MD5Hasher.Algorithm()]
+	if !exist || len(recorded) != 2*md5.Size {
+		return false, nil
+	}
+	_, checksum, err = computeChecksum(h, strings.NewReader(cmd))
+	return checksum == recorded, err
+}
@@ -0,0 +1,92 @@
+package migrate
+
+import (
+	"bufio"
+	"bytes"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ignoreFile in the migration directory lists glob patterns, one per line, of
+// files and directories which aren't migrations, such as scratch files and
+// docs. Blank lines and lines starting with # are skipped. As in .gitignore,
+// a pattern without a slash matches a name at any depth, a pattern with one
+// matches the path relative to the migration directory, and a trailing slash
+// matches only directories:
+//
+//	# Editor artifacts
+//	*.swp
+//	drafts/
+//	postgres/99_scratch.sql
+const ignoreFile = ".migrateignore"
+
+// filter decides which files under a migration directory are migrations.
+type filter struct {
+	exts []string
+
+	// ignore patterns from the root's ignoreFile.
+	ignore []ignorePattern
+}
+
+type ignorePattern struct {
+	glob    string
+	dirOnly bool
+}
+
+// newFilter for migrations with exts in fsys, reading its ignoreFile if it
+// exists.
+func newFilter(fsys fs.FS, exts []string) (filter, error) {
+	f := filter{exts: exts}
+	byt, err := fs.ReadFile(fsys, ignoreFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return f, errors.Wrap(err, "read "+ignoreFile)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(byt))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p := ignorePattern{glob: strings.TrimPrefix(line, "/")}
+		if strings.HasSuffix(p.glob, "/") {
+			p.glob = strings.TrimSuffix(p.glob, "/")
+			p.dirOnly = true
+		}
+		if _, err := path.Match(p.glob, ""); err != nil {
+			return f, errors.Wrapf(err, "%s: %s", ignoreFile, line)
+		}
+		f.ignore = append(f.ignore, p)
+	}
+	return f, nil
+}
+
+// ignored reports whether name, a path within the migration fsys, matches an
+// ignore pattern.
+func (f filter) ignored(name string, isDir bool) bool {
+	rel := path.Clean(name)
+	for _, p := range f.ignore {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		match := rel
+		if !strings.Contains(p.glob, "/") {
+			match = path.Base(rel)
+		}
+		if ok, _ := path.Match(p.glob, match); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isMigration reports whether the file at name is a migration, by its
+// extension and the ignore patterns.
+func (f filter) isMigration(name string) bool {
+	return hasExtension(name, f.exts) && !f.ignored(name, false)
+}
@@ -0,0 +1,22 @@
+package migrate
+
+// WithInterrupt stops migrating once done is closed, such as by a handler for
+// SIGTERM, rather than dying midway through a statement. The statement being
+// executed finishes and is checkpointed, then migrating returns
+// ErrInterrupted, and the next run resumes from the checkpoint.
+func WithInterrupt(done <-chan struct{}) Option {
+	return func(m *Migrate) { m.interrupt = done }
+}
+
+// interrupted reports whether the channel configured WithInterrupt, if any,
+// was closed, or the context of the run is done.
+func (m *Migrate) interrupted() bool {
+	select {
+	case <-m.interrupt:
+		return true
+	case <-m.ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,91 @@
+package migrate
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// LoadDataer is implemented by Stores which can send a file's contents for a
+// LOAD DATA LOCAL INFILE statement. It's optional; migrations which load data
+// fail on Stores which don't implement it.
+type LoadDataer interface {
+	// LoadData executes query, a LOAD DATA LOCAL INFILE statement, sending
+	// data in place of the file named by the quoted filename literal.
+	LoadData(query, filename string, data []byte) error
+}
+
+// loadDataFile matches a LOAD DATA LOCAL INFILE statement, capturing the
+// quoted filename.
+var loadDataFile = regexp.MustCompile(
+	`(?is)^\s*load\s+data\s+(?:(?:low_priority|concurrent)\s+)?local\s+infile\s+'([^']+)'`)
+
+// loadDataFilename reports the data file loaded by cmd, if it's a LOAD DATA
+// LOCAL INFILE statement.
+func loadDataFilename(cmd string) (string, bool) {
+	match := loadDataFile.FindStringSubmatch(cmd)
+	if match == nil {
+		return "", false
+	}
+	return match[1], true
+}
+
+// dataFilePath resolves the data file loaded by a migration, which must be
+// within the migration's directory. Both are paths within the migration fsys.
+func dataFilePath(migrationPath, name string) (string, error) {
+	if filepath.IsAbs(name) || path.IsAbs(filepath.ToSlash(name)) {
+		return "", fmt.Errorf("data file %s must be relative to the migration",
+			name)
+	}
+	name = path.Clean(filepath.ToSlash(name))
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("data file %s must be next to the migration",
+			name)
+	}
+	return path.Join(path.Dir(migrationPath), name), nil
+}
+
+// blobArgs reads the files named by a statement's blob directives, relative to
+// the migration at fullpath in fsys.
+func blobArgs(
+	fsys fs.FS,
+	fullpath string,
+	blobs []string,
+) ([]interface{}, error) {
+	args := make([]interface{}, 0, len(blobs))
+	for _, name := range blobs {
+		p, err := dataFilePath(fullpath, name)
+		if err != nil {
+			return nil, err
+		}
+		data, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return nil, errors.Wrap(err, "read blob")
+		}
+		args = append(args, data)
+	}
+	return args, nil
+}
+
+// loadData executes a LOAD DATA LOCAL INFILE statement using the Store's
+// LoadDataer, sending the data file next to the migration.
+func (m *Migrate) loadData(fullpath, cmd, name string) error {
+	l, ok := m.db.(LoadDataer)
+	if !ok {
+		return errors.New("store does not support LOAD DATA LOCAL INFILE")
+	}
+	p, err := dataFilePath(fullpath, name)
+	if err != nil {
+		return err
+	}
+	data, err := fs.ReadFile(m.fsys, p)
+	if err != nil {
+		return errors.Wrap(err, "read data file")
+	}
+	return l.LoadData(cmd, name, data)
+}
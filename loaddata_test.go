@@ -0,0 +1,71 @@
+package migrate
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadDataFilename(t *testing.T) {
+	name, ok := loadDataFilename(`
+		LOAD DATA LOW_PRIORITY LOCAL INFILE 'users.csv'
+		INTO TABLE users FIELDS TERMINATED BY ','`)
+	if !ok || name != "users.csv" {
+		t.Fatalf("unexpected filename %q", name)
+	}
+	if _, ok = loadDataFilename(`SELECT 'LOAD DATA LOCAL INFILE'`); ok {
+		t.Fatal("expected no filename")
+	}
+	if _, err := dataFilePath("db/1.sql", "../secret.csv"); err == nil {
+		t.Fatal("expected error for data file outside the directory")
+	}
+}
+
+func TestFileChecksum(t *testing.T) {
+	dir := t.TempDir()
+	sqlPath := filepath.Join(dir, "1_load.sql")
+	sql := []byte(`LOAD DATA LOCAL INFILE 'users.csv' INTO TABLE users;`)
+	if err := os.WriteFile(sqlPath, sql, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	csvPath := filepath.Join(dir, "users.csv")
+	if err := os.WriteFile(csvPath, []byte("1,alice\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := fileChecksum(MD5Hasher, os.DirFS(dir), "1_load.sql",
+		DBTypeMySQL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(csvPath, []byte("1,bob\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := fileChecksum(MD5Hasher, os.DirFS(dir), "1_load.sql",
+		DBTypeMySQL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Fatal("expected checksum to change with the data file")
+	}
+
+	// Migrations without data files keep their original checksums.
+	plain := []byte("SELECT 1;")
+	if err = os.WriteFile(sqlPath, plain, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := fileChecksum(MD5Hasher, os.DirFS(dir), "1_load.sql",
+		DBTypeMySQL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, want, err := computeChecksum(MD5Hasher, bytes.NewReader(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
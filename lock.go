@@ -0,0 +1,192 @@
+package migrate
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Locker is implemented by Stores which can hold a lock on a namespace across
+// processes, such as with an advisory lock, so replicas of an app which
+// migrate on startup don't apply the same files at once. The lock is taken on
+// the Store which records the history, and released when migrating finishes.
+// It's optional for backwards compatibility; Stores which don't implement it
+// aren't locked.
+type Locker interface {
+	// CreateMetaLocksIfNotExists creates the table recording who holds
+	// each lock. Init calls it along with the other meta tables.
+	CreateMetaLocksIfNotExists() error
+
+	// TryLock reports whether it took the lock on namespace without
+	// waiting.
+	TryLock(namespace string) (bool, error)
+
+	// GetLockHolder of namespace, as recorded by SetLockHolder. It's empty
+	// if none was recorded, such as while the holder creates the meta
+	// tables.
+	GetLockHolder(namespace string) (LockHolder, error)
+
+	// SetLockHolder records holder of namespace, which must have been
+	// locked by TryLock, so other processes can report who holds it.
+	SetLockHolder(namespace string, holder LockHolder) error
+
+	// Unlock namespace, which must have been locked by TryLock, removing
+	// its holder.
+	Unlock(namespace string) error
+}
+
+// LockHolder identifies the process holding the lock, so an operator whose
+// run is blocked can decide whether to wait or intervene.
+type LockHolder struct {
+	Hostname string `db:"hostname"`
+	PID      int    `db:"pid"`
+
+	// Started is when the lock was taken.
+	Started time.Time `db:"startedat"`
+
+	// File being migrated, if any.
+	File string `db:"filename"`
+}
+
+func (h LockHolder) String() string {
+	if h.Hostname == "" && h.PID == 0 {
+		return "an unknown process"
+	}
+	s := fmt.Sprintf("%s pid %d since %s", h.Hostname, h.PID,
+		h.Started.Format(time.RFC3339))
+	if h.File != "" {
+		s += ", migrating " + h.File
+	}
+	return s
+}
+
+// LockedError reports that the lock wasn't released within the wait
+// configured WithLockWait.
+type LockedError struct {
+	Namespace string
+	Holder    LockHolder
+	Wait      time.Duration
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%s after %s: held by %s", ErrLocked, e.Wait,
+		e.Holder)
+}
+
+func (e *LockedError) Unwrap() error { return ErrLocked }
+
+// defaultLockWait is how long to wait for another process to finish
+// migrating, unless configured WithLockWait.
+const defaultLockWait = 5 * time.Minute
+
+// lockPoll is the interval at which a held lock is tried again.
+const lockPoll = 250 * time.Millisecond
+
+// WithLockWait configures how long to wait for the lock held by another
+// process migrating the same namespace before failing with a LockedError.
+// Zero fails immediately. It defaults to 5 minutes. See Locker.
+func WithLockWait(d time.Duration) Option {
+	return func(m *Migrate) { m.lockWait = d }
+}
+
+// WithoutLock migrates without locking the namespace, even if the Store is a
+// Locker, such as on CockroachDB and YugabyteDB, which accept Postgres's
+// advisory lock functions without reliably enforcing them. Only run one
+// process at a time.
+func WithoutLock() Option {
+	return func(m *Migrate) { m.noLock = true }
+}
+
+// lock the namespace if the history's Store is a Locker, waiting up to the
+// configured time. If the history was loaded, it's then reloaded, since the
+// process which held the lock may have migrated. The returned func releases
+// it.
+func (m *Migrate) lock() (func(), error) {
+	l, ok := m.tracker.(Locker)
+	if !ok || m.noLock {
+		return func() {}, nil
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	holder := LockHolder{
+		Hostname: hostname,
+		PID:      os.Getpid(),
+		Started:  time.Now().UTC(),
+	}
+	deadline := time.Now().Add(m.lockWait)
+	for waited := false; ; waited = true {
+		locked, err := l.TryLock(m.namespace)
+		if err != nil {
+			return nil, errors.Wrap(err, "lock")
+		}
+		if locked {
+			break
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 || !waited {
+			current, err := l.GetLockHolder(m.namespace)
+			if err != nil {
+				return nil, errors.Wrap(err, "get lock holder")
+			}
+			if wait <= 0 {
+				return nil, &LockedError{
+					Namespace: m.namespace,
+					Holder:    current,
+					Wait:      m.lockWait,
+				}
+			}
+			m.warnf("waiting up to %s for lock held by %s\n",
+				m.lockWait, current)
+		}
+		select {
+		case <-time.After(min(wait, lockPoll)):
+		case <-m.interrupt:
+			return nil, ErrInterrupted
+		case <-m.ctx.Done():
+			return nil, m.interruption()
+		}
+	}
+	m.holder = &holder
+	unlock := func() {
+		m.holder = nil
+		if err := l.Unlock(m.namespace); err != nil {
+			m.warnf("unlock: %v\n", err)
+		}
+	}
+	if !m.loaded {
+		// Init records the holder once it has created the meta tables.
+		return unlock, nil
+	}
+	m.setLockHolder()
+	if err := m.loadHistory(); err != nil {
+		unlock()
+		return nil, err
+	}
+	return unlock, nil
+}
+
+// lockFile records the file being migrated in the lock, if it's held.
+func (m *Migrate) lockFile(filename string) {
+	if m.holder == nil {
+		return
+	}
+	m.holder.File = filename
+	m.setLockHolder()
+}
+
+// setLockHolder records this process as the holder of the lock, if it's
+// held. It's only informational, so failing to record it doesn't stop
+// migrating.
+func (m *Migrate) setLockHolder() {
+	if m.holder == nil {
+		return
+	}
+	err := m.tracker.(Locker).SetLockHolder(m.namespace, *m.holder)
+	if err != nil {
+		m.warnf("set lock holder: %v\n", err)
+	}
+}
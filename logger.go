@@ -1,15 +1,49 @@
 package migrate
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
 
 type Logger interface {
 	Printf(string, ...interface{})
 	Println(...interface{})
 }
 
-// StdLogger is a helper type that simply logs to stdout using fmt. Unless you
-// want to structure logs or redirect them in some way, this is probably what
-// you want to use in migrate.New().
+// LevelLogger is implemented by Loggers which accept leveled, structured
+// records, such as SlogLogger. Statements and other detail are logged at
+// slog.LevelDebug, migrated files at LevelInfo, warnings and retries at
+// LevelWarn, and failures at LevelError, with the namespace as an attribute
+// if there is one. Other Loggers receive every line as text.
+type LevelLogger interface {
+	Logger
+	Log(ctx context.Context, level slog.Level, msg string, args ...any)
+}
+
+// SlogLogger logs through a *slog.Logger, whose handler decides the levels to
+// keep and how to format them:
+//
+//	migrate.WithLogger(migrate.SlogLogger{Logger: slog.Default()})
+//
+// Lines from Printf and Println, such as those of the migratetest Logging
+// middleware, are logged at LevelInfo.
+type SlogLogger struct {
+	*slog.Logger
+}
+
+func (l SlogLogger) Printf(s string, vs ...interface{}) {
+	l.Info(strings.TrimSpace(fmt.Sprintf(s, vs...)))
+}
+
+func (l SlogLogger) Println(vs ...interface{}) {
+	l.Info(strings.TrimSpace(fmt.Sprintln(vs...)))
+}
+
+// StdLogger is a helper type that simply logs to stdout using fmt. It's the
+// default, unless you want to structure logs or redirect them in some way with
+// WithLogger.
 type StdLogger struct{}
 
 func (l StdLogger) Printf(s string, vs ...interface{}) {
@@ -19,3 +53,54 @@ func (l StdLogger) Printf(s string, vs ...interface{}) {
 func (l StdLogger) Println(vs ...interface{}) {
 	fmt.Println(vs...)
 }
+
+// nopLogger discards everything.
+type nopLogger struct{}
+
+func (l nopLogger) Printf(string, ...interface{}) {}
+func (l nopLogger) Println(...interface{})        {}
+
+// logf at level if the Logger is a LevelLogger, or as a line of text
+// otherwise. format ends with a newline, like the lines passed to Printf.
+func (m *Migrate) logf(level slog.Level, format string, vs ...interface{}) {
+	var attrs []any
+	if m.namespace != "" {
+		attrs = append(attrs, "namespace", m.namespace)
+	}
+	logTo(m.ctx, m.log, level, attrs, format, vs...)
+}
+
+// logTo logs like logf, with attrs, for callers without a Migrate, such as
+// Rollout.
+func logTo(
+	ctx context.Context,
+	log Logger,
+	level slog.Level,
+	attrs []any,
+	format string,
+	vs ...interface{},
+) {
+	l, ok := log.(LevelLogger)
+	if !ok {
+		log.Printf(format, vs...)
+		return
+	}
+	l.Log(ctx, level, strings.TrimSpace(fmt.Sprintf(format, vs...)),
+		attrs...)
+}
+
+func (m *Migrate) debugf(format string, vs ...interface{}) {
+	m.logf(slog.LevelDebug, format, vs...)
+}
+
+func (m *Migrate) infof(format string, vs ...interface{}) {
+	m.logf(slog.LevelInfo, format, vs...)
+}
+
+func (m *Migrate) warnf(format string, vs ...interface{}) {
+	m.logf(slog.LevelWarn, format, vs...)
+}
+
+func (m *Migrate) errorf(format string, vs ...interface{}) {
+	m.logf(slog.LevelError, format, vs...)
+}
@@ -0,0 +1,26 @@
+package migrate
+
+import (
+	"path"
+	"path/filepath"
+	"testing/fstest"
+)
+
+// WithFiles reads migrations from files, which maps paths relative to the
+// migration directory to their content, instead of the directory passed to
+// New. Paths may name overrides, objects, and data files, such as
+// postgres/2_add_index.sql or objects/active_users.sql. It lets unit tests of
+// code which runs migrations, or of a custom Store, skip fixtures on disk:
+//
+//	m, err := migrate.New(db, "", migrate.WithDBType(migrate.DBTypeSQLite),
+//		migrate.WithFiles(map[string]string{
+//			"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+//		}))
+func WithFiles(files map[string]string) Option {
+	fsys := make(fstest.MapFS, len(files))
+	for name, content := range files {
+		name = path.Clean(filepath.ToSlash(name))
+		fsys[name] = &fstest.MapFile{Data: []byte(content), Mode: 0o644}
+	}
+	return WithFS(fsys)
+}
@@ -0,0 +1,41 @@
+package migrate
+
+import "time"
+
+// Metrics is implemented by monitoring systems which record runs as they
+// happen, so migrations applied at startup show up on dashboards. The
+// migrateprom package provides a Prometheus collector.
+type Metrics interface {
+	// MigrationApplied after mg is recorded in the history, including
+	// the Duration it took to apply.
+	MigrationApplied(mg Migration)
+
+	// StatementExecuted after a statement, or a batch of statements,
+	// succeeds in namespace.
+	StatementExecuted(namespace string, statements int, d time.Duration)
+
+	// MigrationFailed when err stops a run. filename is empty if the error
+	// didn't occur within a file.
+	MigrationFailed(namespace, filename string, err error)
+}
+
+// WithMetrics records the migrations applied, statements executed, and
+// failures of every run in mx.
+func WithMetrics(mx Metrics) Option {
+	return func(m *Migrate) { m.metrics = mx }
+}
+
+// observe e in the configured Metrics.
+func (m *Migrate) observe(e Event) {
+	if m.metrics == nil {
+		return
+	}
+	switch e := e.(type) {
+	case StatementExecuted:
+		m.metrics.StatementExecuted(m.namespace, e.Statements, e.Duration)
+	case FileApplied:
+		m.metrics.MigrationApplied(e.Migration)
+	case Failed:
+		m.metrics.MigrationFailed(m.namespace, e.Filename, e.Err)
+	}
+}
@@ -1,29 +1,28 @@
 package migrate
 
 import (
-	"bytes"
-	"crypto/md5"
+	"context"
+	"database/sql"
 	"fmt"
-	"io"
-	"io/ioutil"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
 
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // version of the migrate tool's database schema.
-const version = 1
+const version = 8
 
-var (
-	spaces    = regexp.MustCompile(`\s+`)
-	fnReturns = regexp.MustCompile(`returns [\w\[\]]+ as`)
-)
+var spaces = regexp.MustCompile(`\s+`)
 
 type Migrate struct {
 	Migrations []Migration
@@ -31,144 +30,783 @@ type Migrate struct {
 
 	db  Store
 	log Logger
+
+	// tracker records the migration history. It's db unless configured
+	// WithTrackingStore. tablePrefix is prepended to the names of its meta
+	// tables; see WithTablePrefix.
+	tracker     Store
+	tablePrefix string
+
+	dir string
+	dbt DBType
 	idx int
+
+	// fsys containing the migrations, which is dir unless configured
+	// WithFS. Paths of files within it are slash-separated.
+	fsys fs.FS
+
+	// vars rendered into migration files; see WithTemplateVars.
+	vars map[string]string
+
+	// version of the meta tables in the database.
+	version int
+
+	// lastFailure recorded in the namespace, if any.
+	lastFailure *Failure
+
+	// events receives progress, if configured WithEvents.
+	events func(Event)
+
+	// redactLiterals and redactors applied to statements before they're
+	// logged; see WithRedactedLiterals and WithRedactor.
+	redactLiterals bool
+	redactors      []Redactor
+
+	// metrics records runs, if configured WithMetrics.
+	metrics Metrics
+
+	// tracer starts the spans of each run, if configured
+	// WithTracerProvider.
+	tracer trace.Tracer
+	spans  spans
+
+	// progress of the current or last run, as reported by Progress.
+	progress *progress
+
+	// slowest statements of the current or last run, as reported by
+	// SlowestStatements.
+	slowest *slowest
+
+	// loaded reports whether the history was loaded from the database.
+	// readOnly prevents any writes, as used by Inspect.
+	loaded   bool
+	readOnly bool
+
+	// hasher computes checksums for new migrations. hashers contains
+	// every Hasher available to verify existing migrations, keyed by
+	// algorithm.
+	hasher  Hasher
+	hashers map[string]Hasher
+	fips    bool
+
+	// color output with ANSI escape codes.
+	color bool
+
+	transcript *transcript
+
+	// policies validate the filenames of pending migrations.
+	policies []FilenamePolicy
+
+	// validators check the syntax of pending migrations' statements.
+	validators []Validator
+
+	// namespace of the migration history, which separates this
+	// instance's history from others sharing the database.
+	namespace string
+
+	// objects in the objects directory, in creation order.
+	objects []*object
+
+	// partitions templates in the partitions directory.
+	partitions []*partitionTemplate
+
+	// goMigrations registered WithGoMigration, sorted among the Files.
+	goMigrations []goMigration
+
+	// fallbacks lists the override directories, in order of preference,
+	// to use for each DB type when it has no override of its own.
+	fallbacks map[DBType][]DBType
+
+	// extensions of files which are migrations, such as ".sql".
+	extensions []string
+
+	// batchSize is the most statements to send in one round trip, if
+	// the Store is a Batcher.
+	batchSize int
+
+	// warnings are logged after each statement if the Store is a
+	// Warner. failOnTruncation stops migrating when data was truncated.
+	warnings         bool
+	failOnTruncation bool
+
+	// checkpointContent records each checkpointed statement's text in
+	// metacheckpoints alongside its checksum. It's only needed to inspect
+	// a failed migration's progress by hand.
+	checkpointContent bool
+
+	// roleStores execute the files with an as directive for each role.
+	roleStores map[string]Store
+
+	// targets execute the files with a target directive for each name.
+	targets map[string]Store
+
+	// skipTo is the last file New records as migrated without running
+	// it; see WithSkip.
+	skipTo string
+
+	// startAt delays migrating until the given time, if set.
+	startAt time.Time
+
+	// dev mode applies a changed last migration again and tolerates
+	// objects which already exist; see WithDevMode. reapply is the
+	// filename of the migration being applied again, if any.
+	dev     bool
+	reapply string
+
+	// repair tolerates checksum mismatches while loading the history,
+	// collecting the filenames of the mismatched migrations; see Repair.
+	repair     bool
+	mismatched map[string]bool
+
+	// env names the environment being migrated, which selects the files
+	// to skip from the skip file.
+	env string
+
+	// annotations are recorded with each migration applied.
+	annotations Annotations
+
+	// retries of each failed statement which the Store deems retryable.
+	retries int
+
+	// fileTimeout caps the time spent applying each file, unless the
+	// file has a timeout directive.
+	fileTimeout time.Duration
+
+	// interrupt stops migrating between statements once it's closed.
+	interrupt <-chan struct{}
+
+	// noFileTransactions executes files statement by statement even where
+	// they could run in one transaction; see WithoutFileTransactions.
+	noFileTransactions bool
+
+	// ctx of the current run, which stops migrating once it's done. It's
+	// Background unless set by MigrateContext.
+	ctx context.Context
+
+	// lockWait is how long to wait for another process's lock, unless
+	// noLock; see Locker. holder identifies this process while it holds
+	// the lock.
+	lockWait time.Duration
+	noLock   bool
+	holder   *LockHolder
 }
 
 type file struct {
-	Info     os.FileInfo
+	Info os.FileInfo
+
+	// fullpath of the file within the migration fsys.
 	fullpath string
+
+	// variant is the DB type of the override directory containing the
+	// file, or empty for the base file.
+	variant string
+
+	// statements is the number of SQL statements in the file.
+	statements int
+
+	// phase of the deploy in which the file is applied.
+	phase Phase
+
+	// skip records the file as applied without running it, since it's
+	// listed for the environment in the skip file.
+	skip bool
+
+	// target names the Store configured WithTarget on which the file is
+	// executed, if any.
+	target string
+
+	// transactional files have no no-transaction directive and consist
+	// only of statements which can be executed in one transaction.
+	transactional bool
+
+	// up is the function of a migration registered WithGoMigration, which
+	// has no file.
+	up GoFunc
 }
 
 type Migration struct {
 	Filename string
 	Checksum string
 	Content  string
+
+	// Algorithm identifies the Hasher which computed the Checksum.
+	Algorithm string
+
+	// Namespace of the history containing the migration. The default
+	// namespace is empty.
+	Namespace string
+
+	// Variant is the DB type of the override which was migrated, or empty
+	// if the base file was migrated.
+	Variant string
+
+	// Statements in the migration and the Duration it took to apply.
+	// They're zero for migrations skipped or applied before migrate
+	// recorded them.
+	Statements int
+	Duration   time.Duration
+
+	// AppliedAt is when the migration finished applying and was recorded
+	// in the history, in UTC. It started Duration earlier.
+	AppliedAt time.Time
+
+	// Annotations of the run which applied the migration; see
+	// WithAnnotations.
+	Annotations Annotations
+
+	// RowsAffected by the migration's INSERT, UPDATE, and DELETE
+	// statements. It's only known for migrations applied by this Migrate,
+	// since it's not part of the history.
+	RowsAffected int64
+
 	fullpath string
+
+	// currentVariant of the file, which differs from Variant if an
+	// override was added or removed since migrating.
+	currentVariant string
 }
 
-var regexNum = regexp.MustCompile(`^\d+`)
+// appliedNow is the AppliedAt of a migration recorded now, at the precision
+// the databases store.
+func appliedNow() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+var (
+	regexNum = regexp.MustCompile(`^\d+`)
+
+	// regexOrder matches a numeric prefix with an optional sub-number,
+	// such as 42.1.
+	regexOrder = regexp.MustCompile(`^(\d+)(?:\.(\d+))?`)
+)
 
 type DBType string
 
 const (
-	DBTypeMySQL    DBType = "mysql"
-	DBTypeMariaDB  DBType = "mariadb"
-	DBTypePostgres DBType = "postgres"
-	DBTypeSQLite   DBType = "sqlite"
+	DBTypeMySQL      DBType = "mysql"
+	DBTypeMariaDB    DBType = "mariadb"
+	DBTypePostgres   DBType = "postgres"
+	DBTypeSQLite     DBType = "sqlite"
+	DBTypeBigQuery   DBType = "bigquery"
+	DBTypeYugabyte   DBType = "yugabyte"
+	DBTypeCockroach  DBType = "cockroach"
+	DBTypeClickHouse DBType = "clickhouse"
+	DBTypeOracle     DBType = "oracle"
+	DBTypeDB2        DBType = "db2"
+	DBTypeSQLServer  DBType = "sqlserver"
 )
 
-func New(
-	db Store,
-	log Logger,
-	dbt DBType,
-	dir, skip string,
-) (*Migrate, error) {
-	m := &Migrate{db: db, log: log}
+// New prepares a database for migrations in dir. It's equivalent to calling
+// Load followed by Init and Verify. WithDBType is required.
+func New(db Store, dir string, opts ...Option) (*Migrate, error) {
+	m, err := Load(db, dir, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err = m.Init(m.skipTo); err != nil {
+		return nil, err
+	}
+	if err = m.Verify(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Load collects, sorts, and parses the migration files in dir without
+// touching the database. Call Init to prepare the database before migrating.
+// WithDBType is required.
+func Load(db Store, dir string, opts ...Option) (*Migrate, error) {
+	m := &Migrate{
+		db:      db,
+		log:     StdLogger{},
+		dir:     dir,
+		fsys:    dirFS(dir),
+		hashers: map[string]Hasher{MD5Hasher.Algorithm(): MD5Hasher},
+		fallbacks: map[DBType][]DBType{
+			DBTypeMariaDB:   {DBTypeMySQL},
+			DBTypeYugabyte:  {DBTypePostgres},
+			DBTypeCockroach: {DBTypePostgres},
+		},
+		roleStores:        map[string]Store{},
+		targets:           map[string]Store{},
+		checkpointContent: true,
+		progress:          &progress{},
+		slowest:           &slowest{},
+		ctx:               context.Background(),
+		lockWait:          defaultLockWait,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.dbt == "" {
+		return nil, errors.New("db type required: use WithDBType")
+	}
+	if m.tracker == nil {
+		m.tracker = db
+	}
+	if err := m.setTablePrefix(); err != nil {
+		return nil, err
+	}
+	if len(m.extensions) == 0 {
+		m.extensions = defaultExtensions
+	}
+	if m.vars != nil {
+		m.fsys = templateFS{FS: m.fsys, vars: m.vars, exts: m.extensions}
+	}
+	if err := m.setupHashers(); err != nil {
+		return nil, err
+	}
 
-	// Get files in migration dir and sort them
 	var err error
-	m.Files, err = readDir(dir, dbt)
+	m.Files, m.objects, m.partitions, err = m.readFiles()
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// readFiles collects, sorts, and parses the migration files, objects, and
+// partition templates in the migration directory.
+func (m *Migrate) readFiles() (
+	[]*file,
+	[]*object,
+	[]*partitionTemplate,
+	error,
+) {
+	// Get files in migration dir and sort them
+	f, err := m.filter()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	files, err := readDir(m.fsys, ".", m.variants(), f)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "get migrations")
+	}
+	for _, fi := range files {
+		if fi.variant != "" {
+			m.debugf("overriding %s with %s\n",
+				fi.Info.Name(), fi.fullpath)
+		}
+	}
+	goFiles, err := m.goFiles()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	files = append(files, goFiles...)
+	if err = sortFiles(files); err != nil {
+		return nil, nil, nil, errors.Wrap(err, "sort")
+	}
+
+	// Parse files up front, so any issues are reported before we begin
+	// migrating.
+	for _, fi := range files {
+		if fi.up != nil {
+			continue
+		}
+		st, n, err := scanFile(nil, m.fsys, fi.fullpath, m.dbt)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("statements %s: %w",
+				fi.Info.Name(), err)
+		}
+		d := st.directives
+		fi.statements, fi.phase, fi.target = n, d.phase, d.target
+		fi.transactional = !d.noTransaction && st.batchable
+		if st.atomic && !hasTransactions(m.dbt) {
+			return nil, nil, nil, fmt.Errorf("%s: %s has no transactions for %s groups",
+				fi.Info.Name(), m.dbt, atomicDirective)
+		}
+	}
+	if err = m.markSkipped(files); err != nil {
+		return nil, nil, nil, err
+	}
+	objects, err := readObjects(m.fsys, f, m.dbt)
 	if err != nil {
-		return nil, errors.Wrap(err, "get migrations")
+		return nil, nil, nil, errors.Wrap(err, "get objects")
 	}
-	if err = sortFiles(m.Files); err != nil {
-		return nil, errors.Wrap(err, "sort")
+	partitions, err := readPartitions(m.fsys, f, m.dbt)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "get partitions")
 	}
+	return files, objects, partitions, nil
+}
+
+// Init creates and upgrades the meta tables as needed, then loads and
+// validates the migration history. It returns ErrReadOnly if the Store
+// reports that it can't be written to; use Inspect to examine such databases.
+// If skip is not empty, then every file up to and including skip is recorded
+// as migrated without running it. The namespace is locked meanwhile, as when
+// migrating; see Locker.
+func (m *Migrate) Init(skip string) error {
+	if m.readOnly {
+		return errors.New("cannot init: opened read-only by Inspect")
+	}
+
+	if err := m.checkWritable(); err != nil {
+		return err
+	}
+
+	// Hold the lock while creating and upgrading the meta tables too, so
+	// concurrent processes don't upgrade or skip ahead at once.
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
 	// Create meta tables if we need to, so we can store the migration
 	// state in the db itself
-	if err = db.CreateMetaIfNotExists(); err != nil {
-		return nil, errors.Wrap(err, "create meta table")
+	if err := m.tracker.CreateMetaIfNotExists(); err != nil {
+		return errors.Wrap(err, "create meta table")
+	}
+	if err := m.tracker.CreateMetaCheckpointsIfNotExists(); err != nil {
+		return errors.Wrap(err, "create meta checkpoints table")
+	}
+	if err := m.tracker.CreateMetaObjectsIfNotExists(); err != nil {
+		return errors.Wrap(err, "create meta objects table")
+	}
+	if err := m.tracker.CreateMetaFailuresIfNotExists(); err != nil {
+		return errors.Wrap(err, "create meta failures table")
 	}
-	if err = db.CreateMetaCheckpointsIfNotExists(); err != nil {
-		return nil, errors.Wrap(err, "create meta checkpoints table")
+	if l, ok := m.tracker.(Locker); ok {
+		if err := l.CreateMetaLocksIfNotExists(); err != nil {
+			return errors.Wrap(err, "create meta locks table")
+		}
+		m.setLockHolder()
 	}
-	curVersion, err := db.CreateMetaVersionIfNotExists(version)
+	curVersion, err := m.tracker.CreateMetaVersionIfNotExists(version)
 	if err != nil {
-		return nil, errors.Wrap(err, "create meta version table")
+		return errors.Wrap(err, "create meta version table")
 	}
 
 	// Migrate the database schema to match the tool's expectations
 	// automatically
 	if curVersion > version {
-		return nil, errors.New("must upgrade migrate: go get -u github.com/thankful-ai/migrate")
+		return ErrNeedsUpgrade
 	}
 	if curVersion < 1 {
 		tmpMigrations, err := migrationsFromFiles(m)
 		if err != nil {
-			return nil, errors.Wrap(err, "migrations from files")
+			return errors.Wrap(err, "migrations from files")
 		}
-		if err = db.UpgradeToV1(tmpMigrations); err != nil {
-			return nil, errors.Wrap(err, "upgrade to v1")
+		if err = m.tracker.UpgradeToV1(tmpMigrations); err != nil {
+			return errors.Wrap(err, "upgrade to v1")
 		}
 		curVersion = 1
 	}
+	if curVersion < 2 {
+		if err = m.tracker.UpgradeToV2(); err != nil {
+			return errors.Wrap(err, "upgrade to v2")
+		}
+		curVersion = 2
+	}
+	if curVersion < 3 {
+		if err = m.tracker.UpgradeToV3(); err != nil {
+			return errors.Wrap(err, "upgrade to v3")
+		}
+		curVersion = 3
+	}
+	if curVersion < 4 {
+		if err = m.tracker.UpgradeToV4(); err != nil {
+			return errors.Wrap(err, "upgrade to v4")
+		}
+		curVersion = 4
+	}
+	if curVersion < 5 {
+		if err = m.tracker.UpgradeToV5(); err != nil {
+			return errors.Wrap(err, "upgrade to v5")
+		}
+		curVersion = 5
+	}
+	if curVersion < 6 {
+		if err = m.tracker.UpgradeToV6(); err != nil {
+			return errors.Wrap(err, "upgrade to v6")
+		}
+		curVersion = 6
+	}
+	if curVersion < 7 {
+		if err = m.tracker.UpgradeToV7(); err != nil {
+			return errors.Wrap(err, "upgrade to v7")
+		}
+		curVersion = 7
+	}
+	if curVersion < 8 {
+		if err = m.tracker.UpgradeToV8(); err != nil {
+			return errors.Wrap(err, "upgrade to v8")
+		}
+		curVersion = 8
+	}
+	m.version = curVersion
 
 	// If skip, then we record the migrations but do not perform them. This
 	// enables you to start using this package on an existing database
 	if skip != "" {
 		m.idx, err = m.skip(skip)
 		if err != nil {
-			return nil, errors.Wrap(err, "skip ahead")
+			return errors.Wrap(err, "skip ahead")
 		}
-		m.log.Println("skipped ahead")
+		m.infof("skipped ahead\n")
+	}
+	if err = m.loadHistory(); err != nil {
+		return err
+	}
+	return m.rehash()
+}
+
+// loadHistory of migrations from the database and confirm it's consistent
+// with the files. This only reads from the database.
+func (m *Migrate) loadHistory() error {
+	if err := m.checkTargets(); err != nil {
+		return err
+	}
+	var err error
+	m.Migrations, err = m.tracker.GetMigrations(m.namespace)
+	if err != nil {
+		return errors.Wrap(err, "get migrations")
+	}
+	sortMigrations(m.Migrations)
+	if err = m.fillFullpaths(); err != nil {
+		return err
 	}
+	if err = m.loadLastFailure(); err != nil {
+		return errors.Wrap(err, "get failures")
+	}
+	if err = m.validHistory(); err != nil {
+		return err
+	}
+	m.loaded = true
+	return nil
+}
 
-	// Get all migrations
-	m.Migrations, err = db.GetMigrations()
+// Reload re-scans the migration directory and reloads the history, so a
+// long-running process can pick up new files without calling New again. It
+// doesn't create or upgrade meta tables. History loaded by Init is validated
+// against the files as in Init, while history loaded by Inspect isn't; see
+// Status. On error, m is unchanged.
+func (m *Migrate) Reload() error {
+	files, objects, partitions, err := m.readFiles()
 	if err != nil {
-		return nil, errors.Wrap(err, "get migrations")
+		return err
+	}
+	prev := *m
+	m.Files, m.objects, m.partitions = files, objects, partitions
+	switch {
+	case m.loaded:
+		err = m.loadHistory()
+	case m.readOnly:
+		err = m.loadInspected()
 	}
+	if err != nil {
+		*m = prev
+		return err
+	}
+	return nil
+}
 
-	// Fill in migration fullpath field based on the db type.
-	overrides, err := getOverrideSet(dir, dbt)
+// fillFullpaths of migrations in the history based on the db type.
+func (m *Migrate) fillFullpaths() error {
+	f, err := m.filter()
 	if err != nil {
-		return nil, fmt.Errorf("get override set: %w", err)
+		return err
+	}
+	overrides, err := getOverrideSet(m.fsys, ".", m.variants(), f)
+	if err != nil {
+		return fmt.Errorf("get override set: %w", err)
 	}
 	for i, mg := range m.Migrations {
 		override, exist := overrides[mg.Filename]
 		if exist {
 			m.Migrations[i].fullpath = override.fullpath
+			m.Migrations[i].currentVariant = override.variant
 		} else {
-			m.Migrations[i].fullpath = filepath.Join(dir, mg.Filename)
+			m.Migrations[i].fullpath = mg.Filename
 		}
 	}
-	if err = m.validHistory(); err != nil {
-		return nil, err
-	}
-	return m, nil
+	return nil
 }
 
-// Migrate all files in the directory. This function reports whether any
-// migration took place.
+// Migrate all files in the directory, then drop and recreate any changed
+// files in its objects subdirectory and create upcoming partitions from its
+// partitions subdirectory. This function reports whether any migration took
+// place.
 func (m *Migrate) Migrate() (bool, error) {
+	if err := m.waitForStart(); err != nil {
+		return false, err
+	}
+	unlock, err := m.lock()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	start, before := time.Now(), len(m.Migrations)
+	migrated, err := m.migrateAll()
+	m.finishRun(start, before, err)
+	return migrated, err
+}
+
+func (m *Migrate) migrateAll() (bool, error) {
+	migrated, err := m.migrate(m.pendingFiles())
+	if err != nil {
+		return false, err
+	}
+	if m.interrupted() {
+		err = m.interruption()
+		m.failed(err)
+		return false, err
+	}
+	recreated, err := m.migrateObjects()
+	if err != nil {
+		m.failed(err)
+		return false, errors.Wrap(err, "migrate objects")
+	}
+	created, err := m.migratePartitions(time.Now())
+	if err != nil {
+		m.failed(err)
+		return false, errors.Wrap(err, "migrate partitions")
+	}
+	return migrated || recreated || created, nil
+}
+
+// failed records and emits err, which stopped migrating outside of the
+// numbered migrations.
+func (m *Migrate) failed(err error) {
+	m.recordFailure(err)
+	var filename string
+	var merr *MigrationError
+	if errors.As(err, &merr) {
+		filename = merr.File
+	}
+	m.emit(Failed{Filename: filename, Err: err})
+}
+
+// MigrateUntil applies pending migrations whose filenames are prefixed by a
+// timestamp at or before t, which is useful to reconstruct the schema at a
+// point in time. Every pending file must be timestamp-named; see fileTime for
+// the supported formats. This function reports whether any migration took
+// place.
+func (m *Migrate) MigrateUntil(t time.Time) (bool, error) {
+	if err := m.waitForStart(); err != nil {
+		return false, err
+	}
+	unlock, err := m.lock()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	pending := m.pendingFiles()
+	for i, fi := range pending {
+		ts, err := fileTime(fi.Info.Name())
+		if err != nil {
+			return false, err
+		}
+		if ts.After(t) {
+			// Files are ordered, so nothing after this can be
+			// migrated without leaving a gap in history.
+			pending = pending[:i]
+			break
+		}
+	}
+	start, before := time.Now(), len(m.Migrations)
+	migrated, err := m.migrate(pending)
+	m.finishRun(start, before, err)
+	return migrated, err
+}
+
+// MigrateTo applies pending migrations in order up to and including the file
+// named target, such as 34_add_index.sql, so later migrations can wait for a
+// separate deploy. Nothing is migrated if target was already applied. As with
+// MigrateUntil, objects and partitions are left for Migrate. This function
+// reports whether any migration took place.
+func (m *Migrate) MigrateTo(target string) (bool, error) {
+	idx := -1
+	for i, fi := range m.Files {
+		if fi.Info.Name() == target {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return false, fmt.Errorf("%w: %s", ErrUnknownMigration, target)
+	}
+	if err := m.waitForStart(); err != nil {
+		return false, err
+	}
+	unlock, err := m.lock()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	pending := m.pendingFiles()
+	if n := idx + 1 - len(m.Migrations); n > 0 {
+		pending = pending[:n]
+	} else {
+		pending = nil
+	}
+	start, before := time.Now(), len(m.Migrations)
+	migrated, err := m.migrate(pending)
+	m.finishRun(start, before, err)
+	return migrated, err
+}
+
+func (m *Migrate) migrate(files []*file) (bool, error) {
+	if m.readOnly {
+		return false, errors.New("cannot migrate: opened read-only by Inspect")
+	}
+	if !m.loaded {
+		return false, errors.New("must call Init before Migrate")
+	}
+	m.progress.begin(len(files))
+	m.slowest.begin()
+	m.beginTrace(len(files))
 	var migrated bool
-	for i := len(m.Migrations); i < len(m.Files); i++ {
-		fi := m.Files[i]
+	for _, fi := range files {
+		m.lockFile(fi.Info.Name())
 		if err := m.migrateFile(fi); err != nil {
+			m.recordFailure(err)
+			m.emit(Failed{Filename: fi.Info.Name(), Err: err})
 			return false, errors.Wrap(err, "migrate file")
 		}
-		m.log.Println("migrated", fi.Info.Name())
+		if fi.skip {
+			m.infof("%s %s in %s\n", m.colorize(colorYellow, "skipped"),
+				fi.Info.Name(), m.env)
+		} else {
+			m.infof("%s %s\n", m.colorize(colorGreen, "migrated"),
+				fi.Info.Name())
+		}
 		migrated = true
 	}
 	return migrated, nil
 }
 
 func (m *Migrate) validHistory() error {
+	m.reapply = ""
+	m.mismatched = nil
 	for i := len(m.Files); i < len(m.Migrations); i++ {
-		m.log.Printf("missing already-run migration %q\n", m.Migrations[i])
+		m.errorf("missing already-run migration %q\n",
+			m.Migrations[i].Filename)
 	}
 	if len(m.Files) < len(m.Migrations) {
-		return errors.New("cannot continue with missing migrations")
+		return ErrMissingMigration
 	}
 	for i := m.idx; i < len(m.Migrations); i++ {
 		mg := m.Migrations[i]
 		if mg.Filename != m.Files[i].Info.Name() {
-			m.log.Printf("\n%s was added to history before %s.\n",
+			m.errorf("\n%s was added to history before %s.\n",
 				m.Files[i].Info.Name(), mg.Filename)
-			return errors.New("failed to migrate. migrations must be appended")
+			return fmt.Errorf("failed to migrate. %w", ErrOutOfOrder)
 		}
 		if err := m.checkHash(mg); err != nil {
+			if m.repair && errors.Is(err, ErrChecksumMismatch) {
+				if m.mismatched == nil {
+					m.mismatched = map[string]bool{}
+				}
+				m.mismatched[mg.Filename] = true
+				continue
+			}
+			if m.dev && i == len(m.Migrations)-1 &&
+				errors.Is(err, ErrChecksumMismatch) {
+				m.devReapply(mg)
+				return nil
+			}
 			return errors.Wrap(err, "check hash")
 		}
 	}
@@ -176,159 +814,716 @@ func (m *Migrate) validHistory() error {
 }
 
 func (m *Migrate) checkHash(mg Migration) error {
-	fi, err := os.Open(mg.fullpath)
+	if mg.Algorithm == goAlgorithm || m.isGo(mg.Filename) {
+		return m.checkGo(mg)
+	}
+	if m.fips && isMD5(mg.Algorithm) {
+		if mg.Content == "" {
+			return fmt.Errorf("cannot verify md5 checksum of %s in fips mode: no content recorded",
+				mg.Filename)
+		}
+		byt, err := fs.ReadFile(m.fsys, mg.fullpath)
+		if err != nil {
+			return err
+		}
+		if string(byt) != mg.Content {
+			m.logDiff(mg, string(byt))
+			return checksumMismatch(mg, " (compared content in fips mode)")
+		}
+		return nil
+	}
+	h, err := m.hasherFor(mg.Algorithm)
 	if err != nil {
 		return err
 	}
-	defer fi.Close()
-	_, check, err := computeChecksum(fi)
+	check, err := fileChecksum(h, m.fsys, mg.fullpath, m.dbt)
 	if err != nil {
 		return err
 	}
 	if check != mg.Checksum {
-		m.log.Println("comparing", check, mg.Checksum)
-		return fmt.Errorf("checksum does not match %s. has the file changed?",
-			mg.Filename)
+		m.debugf("comparing %v %v\n", check, mg.Checksum)
+		current, err := fileContent(m.fsys, mg.fullpath)
+		if err != nil {
+			return err
+		}
+		m.logDiff(mg, current)
+		return checksumMismatch(mg, "")
 	}
 	return nil
 }
 
+// checksumMismatch reports that mg's file has changed. If a different variant
+// of the file is in use than was migrated, the error says so, since that's a
+// likelier explanation than an edit.
+func checksumMismatch(mg Migration, detail string) error {
+	if mg.Variant != mg.currentVariant {
+		return fmt.Errorf("%w %s%s: migrated from %s, but now using %s. was the override changed, or is the db type different?",
+			ErrChecksumMismatch, mg.Filename, detail,
+			describeVariant(mg.Variant),
+			describeVariant(mg.currentVariant))
+	}
+	return fmt.Errorf("%w %s%s. has the file changed?",
+		ErrChecksumMismatch, mg.Filename, detail)
+}
+
+func describeVariant(variant string) string {
+	if variant == "" {
+		return "the base file"
+	}
+	return fmt.Sprintf("the %s override", variant)
+}
+
+// Statements splits a migration file into the SQL statements to execute,
+// tokenized as on Postgres, so semicolons in string literals, quoted
+// identifiers, dollar-quoted bodies, and comments don't end statements. COPY
+// ... FROM STDIN blocks are returned whole, including their inline data.
 func Statements(byt []byte) ([]string, error) {
-	// Split commands and remove comments at the start of lines
-	cmds := strings.Split(string(byt), ";")
-
-	// For postgresql specifically, some statements may have multiple `;`
-	// such as when creating functions. Join those together.
-	newCmds := []string{}
-	var keepGoing bool
-	for _, c := range cmds {
-		lowC := strings.ToLower(c)
-
-		if fnReturns.MatchString(lowC) {
-			keepGoing = true
-			newCmds = append(newCmds, c+";")
+	stmts, err := parseStatements("", byt)
+	if err != nil {
+		return nil, err
+	}
+	cmds := make([]string, 0, len(stmts))
+	for _, stmt := range stmts {
+		cmds = append(cmds, stmt.sql)
+	}
+	return cmds, nil
+}
+
+// statement is a single SQL statement in a migration file along with any
+// directives which preceded it.
+type statement struct {
+	sql string
+
+	// legacy is the statement as it was split before comments were removed
+	// from statements, if that differs from sql. Checkpoints recorded by
+	// older versions have its checksum.
+	legacy string
+
+	// blobs are the paths of files, relative to the migration, whose
+	// contents are passed as the statement's arguments in order, from
+	// `-- migrate:blob logo.png` directives.
+	blobs []string
+
+	// role to execute the statement as, from a file's
+	// `-- migrate:as reporting_owner` directive.
+	role string
+
+	// group is the atomic group containing the statement, numbered from
+	// 1, or 0 if it's not in one; see atomicDirective.
+	group int
+}
+
+// parseStatements of a migration file for dbt.
+func parseStatements(dbt DBType, byt []byte) ([]statement, error) {
+	s, err := filterOnly(dbt, string(byt))
+	if err != nil {
+		return nil, err
+	}
+	role, err := fileRole(s)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := splitAtomic(dbt, s)
+	if err != nil {
+		return nil, err
+	}
+	stmts := []statement{}
+	for _, g := range groups {
+		groupStmts, err := parseSection(dbt, g.text)
+		if err != nil {
+			return nil, err
+		}
+		for i := range groupStmts {
+			groupStmts[i].group = g.group
+		}
+		stmts = append(stmts, groupStmts...)
+	}
+	for i := range stmts {
+		stmts[i].role = role
+	}
+	return stmts, nil
+}
+
+// parseSection of a file without atomic directives into statements for dbt.
+func parseSection(dbt DBType, s string) ([]statement, error) {
+	chunks, isCopy, err := splitCopyBlocks(s)
+	if err != nil {
+		return nil, err
+	}
+	stmts := []statement{}
+	for i, chunk := range chunks {
+		if isCopy[i] {
+			stmts = append(stmts, statement{sql: chunk})
 			continue
 		}
-		if keepGoing {
-			newCmds[len(newCmds)-1] += c
-			if !strings.Contains(lowC, "plpgsql") {
-				newCmds[len(newCmds)-1] += ";"
-				continue
+		for _, sec := range splitTerminators(dbt, chunk) {
+			var secStmts []statement
+			switch {
+			case sec.terminator == ";" && dbt == DBTypeOracle:
+				secStmts, err = splitPLSQL(sec.text)
+			case sec.terminator == ";":
+				secStmts, err = splitStatements(dbt, sec.text)
+			default:
+				secStmts, err = splitTerminated(dbt, sec.text,
+					sec.terminator)
 			}
-			keepGoing = false
+			if err != nil {
+				return nil, err
+			}
+			stmts = append(stmts, secStmts...)
+		}
+	}
+	return stmts, nil
+}
+
+// asDirective executes every statement in a file as a database role, so the
+// objects it creates are owned by that role.
+const asDirective = directivePrefix + "as"
+
+// fileRole from the file's as directive, if any.
+func fileRole(s string) (string, error) {
+	var role string
+	for _, line := range strings.Split(s, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, asDirective+" ") {
 			continue
 		}
-		newCmds = append(newCmds, c)
+		r := strings.TrimSpace(strings.TrimPrefix(trimmed, asDirective))
+		if role != "" && r != role {
+			return "", fmt.Errorf("conflicting %s directives: %s and %s",
+				asDirective, role, r)
+		}
+		role = r
 	}
-	if keepGoing {
-		return nil, errors.New("unexpected exit, missing 'plpgsql'")
+	return role, nil
+}
+
+// blobDirective passes a file's contents as an argument to the next
+// statement.
+const blobDirective = directivePrefix + "blob"
+
+// splitStatements of s ended by semicolons, which are tokenized as on dbt.
+func splitStatements(dbt DBType, s string) ([]statement, error) {
+	// Remove blob directives, tracking the offset of the statement which
+	// follows each one
+	var (
+		text  strings.Builder
+		blobs []offsetBlob
+	)
+	for _, line := range strings.SplitAfter(s, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, blobDirective+" ") {
+			path := strings.TrimSpace(
+				strings.TrimPrefix(trimmed, blobDirective))
+			blobs = append(blobs, offsetBlob{text.Len(), path})
+			continue
+		}
+		if isFileDirective(trimmed) {
+			// Handled by fileRole and openStatements.
+			continue
+		}
+		text.WriteString(line)
+	}
+	toks, err := dialectFor(dbt).tokenize(text.String())
+	if err != nil {
+		return nil, err
 	}
-	cmds = newCmds
 
-	filteredCmds := []string{}
-	for _, cmd := range cmds {
-		cmd = strings.TrimSpace(cmd)
-		if len(cmd) == 0 {
+	// Split commands at each semicolon which ends a statement, removing
+	// comments
+	var (
+		cmds  = make([]statement, 0, len(toks.ends)+1)
+		start int
+	)
+	for _, end := range append(toks.ends, text.Len()) {
+		cmd := statement{
+			sql:    toks.strip(text.String(), start, end),
+			legacy: text.String()[start:end],
+		}
+		for len(blobs) > 0 && blobs[0].offset <= end {
+			cmd.blobs = append(cmd.blobs, blobs[0].path)
+			blobs = blobs[1:]
+		}
+		cmds = append(cmds, cmd)
+		start = end + 1
+	}
+	return filterStatements(cmds)
+}
+
+// offsetBlob is a blob directive removed from a file, passing its contents to
+// the statement following offset.
+type offsetBlob struct {
+	offset int
+	path   string
+}
+
+// terminatorDirective changes the string which ends statements for the rest
+// of the file, following the convention of Db2's command line processor, so
+// compound statements containing semicolons, such as triggers and SQL PL
+// procedures, can be written whole:
+//
+//	--#SET TERMINATOR @
+//	CREATE PROCEDURE ... BEGIN ...; ...; END@
+//	--#SET TERMINATOR ;
+const terminatorDirective = "--#SET TERMINATOR"
+
+// delimiterDirective changes the string which ends statements for the rest of
+// a MySQL or MariaDB migration, following the mysql client, so triggers and
+// stored procedures can be written whole. Like terminatorDirective, the
+// delimiter is only recognized at the end of a line:
+//
+//	DELIMITER //
+//	CREATE PROCEDURE ... BEGIN ...; ...; END //
+//	DELIMITER ;
+const delimiterDirective = "DELIMITER"
+
+// cutTerminatorDirective reports whether the trimmed line is a terminator
+// directive, or a delimiter directive on dbt, returning the terminator it
+// sets.
+func cutTerminatorDirective(dbt DBType, trimmed string) (string, bool) {
+	upper := strings.ToUpper(trimmed)
+	if strings.HasPrefix(upper, terminatorDirective+" ") {
+		return strings.TrimSpace(trimmed[len(terminatorDirective):]), true
+	}
+	if dbt != DBTypeMySQL && dbt != DBTypeMariaDB ||
+		!strings.HasPrefix(upper, delimiterDirective+" ") {
+		return "", false
+	}
+	t := strings.TrimSpace(trimmed[len(delimiterDirective):])
+	return t, t != ""
+}
+
+// section of a migration file ended by terminator.
+type section struct {
+	text       string
+	terminator string
+}
+
+// splitTerminators splits s at each terminator directive for dbt.
+func splitTerminators(dbt DBType, s string) []section {
+	var (
+		sections []section
+		cur      = section{terminator: ";"}
+		text     strings.Builder
+	)
+	for _, line := range strings.SplitAfter(s, "\n") {
+		terminator, ok := cutTerminatorDirective(dbt,
+			strings.TrimSpace(line))
+		if !ok {
+			text.WriteString(line)
 			continue
 		}
-		if !strings.HasPrefix(cmd, "--") && !strings.HasPrefix(cmd, "/*") {
-			filteredCmds = append(filteredCmds, cmd)
+		cur.text = text.String()
+		sections = append(sections, cur)
+		text.Reset()
+		cur = section{terminator: terminator}
+	}
+	cur.text = text.String()
+	return append(sections, cur)
+}
+
+// splitTerminated splits s into statements which end with terminator at the
+// end of a line. Unlike semicolons, it isn't recognized within a line, so it
+// can be a character which appears in string literals, such as @. The batch
+// separator must be alone on its line. Comments are removed as on dbt.
+func splitTerminated(dbt DBType, s, terminator string) ([]statement, error) {
+	var (
+		cmds  []statement
+		text  strings.Builder
+		blobs []string
+	)
+	for _, line := range strings.SplitAfter(s, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, blobDirective+" ") {
+			blobs = append(blobs, strings.TrimSpace(
+				strings.TrimPrefix(trimmed, blobDirective)))
+			continue
 		}
+		if isFileDirective(trimmed) {
+			// Handled by fileRole and openStatements.
+			continue
+		}
+		rest, ok := cutTerminator(trimmed, terminator)
+		if !ok {
+			text.WriteString(line)
+			continue
+		}
+		text.WriteString(rest)
+		cmds = append(cmds, statement{sql: text.String(), blobs: blobs})
+		text.Reset()
+		blobs = nil
+	}
+	cmds = append(cmds, statement{sql: text.String(), blobs: blobs})
+	d := dialectFor(dbt)
+	for i := range cmds {
+		sql, err := d.stripComments(cmds[i].sql)
+		if err != nil {
+			return nil, err
+		}
+		cmds[i].sql, cmds[i].legacy = sql, cmds[i].sql
+	}
+	return filterStatements(cmds)
+}
+
+// filterStatements trims cmds, removing empty statements, such as those left
+// by comments.
+func filterStatements(cmds []statement) ([]statement, error) {
+	filteredCmds := []statement{}
+	for _, cmd := range cmds {
+		cmd.sql = strings.TrimSpace(cmd.sql)
+		if cmd.legacy = strings.TrimSpace(cmd.legacy); cmd.legacy == cmd.sql {
+			cmd.legacy = ""
+		}
+		if len(cmd.sql) == 0 {
+			if len(cmd.blobs) > 0 {
+				return nil, fmt.Errorf("%s must precede a statement",
+					blobDirective)
+			}
+			continue
+		}
+		filteredCmds = append(filteredCmds, cmd)
 	}
 	return filteredCmds, nil
 }
 
 func (m *Migrate) migrateFile(f *file) error {
-	byt, err := ioutil.ReadFile(f.fullpath)
-	if err != nil {
-		return err
+	// Ensure that commands are present
+	if f.statements == 0 {
+		return fmt.Errorf("%w: %s", ErrNoStatements, f.Info.Name())
 	}
-	filteredCmds, err := Statements(byt)
-	if err != nil {
-		return fmt.Errorf("statements: %w", err)
+	if f.skip {
+		return m.recordSkipped(f)
+	}
+	if f.up != nil {
+		return m.migrateGo(f)
 	}
 
-	// Ensure that commands are present
-	if len(filteredCmds) == 0 {
-		return fmt.Errorf("no sql statements in file: %s", f.Info.Name())
+	// Execute the file's statements on its target, while the history
+	// stays with the tracker.
+	if f.target != "" {
+		db := m.db
+		m.db = m.targets[f.target]
+		defer func() { m.db = db }()
 	}
 
 	// Get our checkpoints, if any
-	checkpoints, err := m.db.GetMetaCheckpoints(f.Info.Name())
+	checkpoints, err := m.tracker.GetMetaCheckpoints(m.namespace, f.Info.Name())
 	if err != nil {
 		return errors.Wrap(err, "get checkpoints")
 	}
 	if len(checkpoints) > 0 {
-		m.log.Printf("found %d checkpoints\n", len(checkpoints))
+		m.debugf("found %d checkpoints\n", len(checkpoints))
 	}
 
 	// Ensure commands weren't deleted from the file after we migrated them
-	if len(checkpoints) >= len(filteredCmds) {
-		return fmt.Errorf("len(checkpoints) %d >= len(cmds) %d",
-			len(checkpoints), len(filteredCmds))
+	if len(checkpoints) >= f.statements {
+		return fmt.Errorf("%w: %s has %d checkpoints but only %d statements. has the file changed since its checkpoints?",
+			ErrChecksumMismatch, f.Info.Name(), len(checkpoints),
+			f.statements)
+	}
+
+	// Stream the statements rather than reading the whole file, which may
+	// be too large to hold in memory, unless it's executed in one
+	// transaction.
+	tx := m.inTransaction(f)
+	stmts, err := openStatements(m.hasher, m.fsys, f.fullpath, m.dbt)
+	if err != nil {
+		return fmt.Errorf("statements: %w", err)
+	}
+	defer stmts.Close()
+
+	m.record("begin %s (%d statements, %d checkpoints)", f.Info.Name(),
+		f.statements, len(checkpoints))
+	m.emit(FileStarted{
+		Filename:    f.Info.Name(),
+		Statements:  f.statements,
+		Checkpoints: len(checkpoints),
+	})
+	var (
+		rows int64
+
+		// window of statements read but not yet executed, starting at
+		// index i, so batches can look ahead.
+		window []statement
+		done   bool
+		i      int
+	)
+	timeout := m.fileTimeout
+	if stmts.directives.timeout > 0 {
+		timeout = stmts.directives.timeout
 	}
+	fileStart := time.Now()
+	for ; ; i++ {
+		for !done && (len(window) == 0 || len(window) < m.batchSize ||
+			groupLen(window) == len(window)) {
+			stmt, ok, err := stmts.next()
+			if err != nil {
+				return fmt.Errorf("statements: %w", err)
+			}
+			if !ok {
+				done = true
+				break
+			}
+			if tx {
+				// The whole file is one atomic group, including
+				// any groups within it.
+				stmt.group = 1
+			}
+			window = append(window, stmt)
+		}
+		if len(window) == 0 {
+			break
+		}
+
+		if m.interrupted() {
+			m.record("interrupted %s [%d]", f.Info.Name(), i)
+			return fmt.Errorf("%w: %s, resume from statement %d",
+				m.interruption(), f.Info.Name(), i)
+		}
+
+		// Stop between statements once the timeout expires, but only
+		// after executing at least one, so every run makes progress.
+		if timeout > 0 && i > len(checkpoints) &&
+			time.Since(fileStart) > timeout {
+			m.record("timed out %s [%d] after %s", f.Info.Name(), i,
+				time.Since(fileStart))
+			return fmt.Errorf("%w: %s after %s, resume from statement %d",
+				ErrFileTimeout, f.Info.Name(), timeout, i)
+		}
+		stmt := window[0]
+		if m.dev {
+			stmt.sql = idempotent(stmt.sql)
+		}
+		cmd := stmt.sql
 
-	for i, cmd := range filteredCmds {
 		// Confirm the file up to our checkpoint has not changed
 		if i < len(checkpoints) {
-			r := strings.NewReader(cmd)
-			_, checksum, err := computeChecksum(r)
+			ok, err := m.checkpointMatches(cmd, checkpoints[i])
+			if err == nil && !ok && stmt.legacy != "" {
+				// Checkpoints recorded before comments were
+				// removed from statements include them.
+				ok, err = m.checkpointMatches(stmt.legacy,
+					checkpoints[i])
+			}
 			if err != nil {
 				return errors.Wrap(err, "compute checkpoint checksum")
 			}
-			if checksum != checkpoints[i] {
+			if !ok {
 				return fmt.Errorf(
-					"checksum does not equal checkpoint. has %s (cmd %d) changed?",
-					f.Info.Name(), i)
+					"%w: has %s (cmd %d) changed since its checkpoint?",
+					ErrChecksumMismatch, f.Info.Name(), i)
+			}
+			window = window[1:]
+			continue
+		}
+
+		// Execute atomic groups in one transaction
+		if n := groupLen(window); n > 0 {
+			if m.dev {
+				for j := range window[:n] {
+					window[j].sql = idempotent(window[j].sql)
+				}
 			}
+			if err = m.execAtomic(f, window[:n], i); err != nil {
+				return err
+			}
+			window = window[n:]
+			i += n - 1
 			continue
 		}
 
-		// Print the commands we're executing to give progress updates
-		// on large migrations
-		shortCmd := cmd
-		shortCmd = strings.ReplaceAll(shortCmd, "\n", " ")
-		shortCmd = spaces.ReplaceAllString(shortCmd, " ")
-		if len(shortCmd) >= 78 {
-			shortCmd = shortCmd[:74] + "..."
+		// Send runs of plain statements together if batching
+		if n := m.batchLen(window); n > 1 {
+			if err = m.execBatch(f, window[:n], i); err != nil {
+				return err
+			}
+			window = window[n:]
+			i += n - 1
+			continue
 		}
-		m.log.Println(">", shortCmd)
+		window = window[1:]
+		m.logStatement(cmd)
 
 		// Execute non-checkpointed commands one by one
-		_, err := m.db.Exec(cmd)
-		if err != nil {
-			m.log.Println("failed on", cmd)
-			return fmt.Errorf("%s: %s", f.Info.Name(), err)
+		m.record("exec %s [%d]\n%s", f.Info.Name(), i, m.redact(cmd))
+		start := time.Now()
+		res, err := m.execRetrying(f, i, stmt)
+		if err != nil && m.dev &&
+			m.classifyError(err) == ClassDuplicateObject {
+			m.warnf("  %s %s\n", m.colorize(colorYellow,
+				"skipped in dev mode:"), err)
+			err = nil
 		}
-
-		// Save a checkpoint
-		_, checksum, err := computeChecksum(strings.NewReader(cmd))
 		if err != nil {
-			return errors.Wrap(err, "compute checksum")
+			m.record("failed %s [%d] after %s: %s", f.Info.Name(), i,
+				time.Since(start), m.redactError(err))
+			m.errorf("%s %s\n", m.colorize(colorRed, "failed on"),
+				m.redact(cmd))
+			return &MigrationError{
+				File:  f.Info.Name(),
+				Index: i,
+				SQL:   m.redact(cmd),
+				Class: m.classifyError(err),
+				Err:   err,
+			}
 		}
-		err = m.db.InsertMetaCheckpoint(f.Info.Name(), cmd, checksum, i)
-		if err != nil {
-			return errors.Wrap(err, "insert checkpoint")
+		elapsed := time.Since(start)
+		m.record("ok %s [%d] in %s", f.Info.Name(), i, elapsed)
+		n := m.logRowsAffected(f, i, cmd, res)
+		rows += n
+		m.emit(StatementExecuted{
+			Filename:     f.Info.Name(),
+			Index:        i,
+			SQL:          cmd,
+			Statements:   1,
+			Duration:     elapsed,
+			RowsAffected: n,
+		})
+
+		if err = m.checkpoint(f, i, cmd); err != nil {
+			return err
 		}
 	}
 
 	// We've successfully finished migrating the file, so we delete the
 	// temporary progress in metacheckpoints and save the migration
-	if err = m.db.DeleteMetaCheckpoints(); err != nil {
+	if err = m.tracker.DeleteMetaCheckpoints(m.namespace); err != nil {
 		return errors.Wrap(err, "delete checkpoints")
 	}
 
-	_, checksum, err := computeChecksum(bytes.NewReader(byt))
+	checksum, err := stmts.checksum()
 	if err != nil {
 		return errors.Wrap(err, "compute file checksum")
 	}
-	err = m.db.InsertMigration(f.Info.Name(), string(byt), checksum)
+	content, err := fileContent(m.fsys, f.fullpath)
+	if err != nil {
+		return errors.Wrap(err, "read file")
+	}
+	mg := Migration{
+		Filename:  f.Info.Name(),
+		Checksum:  checksum,
+		Content:   content,
+		Algorithm: m.hasher.Algorithm(),
+		Namespace: m.namespace,
+		Variant:   f.variant,
+		fullpath:  f.fullpath,
+
+		Statements:     i,
+		Duration:       time.Since(fileStart),
+		AppliedAt:      appliedNow(),
+		Annotations:    m.annotations,
+		RowsAffected:   rows,
+		currentVariant: f.variant,
+	}
+	if mg.Filename == m.reapply {
+		err = m.tracker.UpsertMigration(mg)
+		m.reapply = ""
+	} else {
+		err = m.tracker.InsertMigration(mg)
+	}
 	if err != nil {
 		return errors.Wrap(err, "insert migration")
 	}
+	m.Migrations = append(m.Migrations, mg)
+	m.analyze(f, stmts.directives.analyze)
+	m.record("migrated %s (%s %s)", mg.Filename, mg.Algorithm, mg.Checksum)
+	m.emit(FileApplied{Migration: mg})
 	return nil
 }
 
+// logStatement being executed to give progress updates on large migrations.
+func (m *Migrate) logStatement(cmd string) {
+	shortCmd := m.redact(cmd)
+	shortCmd = strings.ReplaceAll(shortCmd, "\n", " ")
+	shortCmd = spaces.ReplaceAllString(shortCmd, " ")
+	if len(shortCmd) >= 78 {
+		shortCmd = shortCmd[:74] + "..."
+	}
+	m.debugf("> %s\n", m.colorize(colorDim, shortCmd))
+}
+
+// checkpoint the statement at index i of f, so it's not executed again if a
+// later statement fails.
+func (m *Migrate) checkpoint(f *file, i int, cmd string) error {
+	_, checksum, err := computeChecksum(m.hasher, strings.NewReader(cmd))
+	if err != nil {
+		return errors.Wrap(err, "compute checksum")
+	}
+	content := cmd
+	if !m.checkpointContent {
+		content = ""
+	}
+	err = m.tracker.InsertMetaCheckpoint(m.namespace, f.Info.Name(), content,
+		checksum, i)
+	if err != nil {
+		return errors.Wrap(err, "insert checkpoint")
+	}
+	m.emit(CheckpointSaved{Filename: f.Info.Name(), Index: i})
+	return nil
+}
+
+// execStatement at index i of f, dispatching statements which need more than
+// Exec to the Store's optional interfaces. The result is nil unless the
+// statement was executed by Exec.
+func (m *Migrate) execStatement(
+	f *file,
+	i int,
+	stmt statement,
+) (sql.Result, error) {
+	name, isLoadData := loadDataFilename(stmt.sql)
+	isCopy := isCopyStatement(stmt.sql)
+	if stmt.role != "" && (isLoadData || isCopy) {
+		return nil, fmt.Errorf("cannot load data as role %s", stmt.role)
+	}
+	if isLoadData {
+		return nil, m.loadData(f.fullpath, stmt.sql, name)
+	}
+	if isCopy {
+		return nil, m.copyFrom(stmt.sql)
+	}
+	args, err := blobArgs(m.fsys, f.fullpath, stmt.blobs)
+	if err != nil {
+		return nil, err
+	}
+	if stmt.role != "" {
+		return m.execAs(stmt.role, stmt.sql, args)
+	}
+	if w, ok := m.db.(Warner); ok && m.warnings {
+		return m.execWarnings(w, f, i, stmt.sql, args)
+	}
+	return m.exec(m.db, stmt.sql, args...)
+}
+
+// dml matches statements which modify rows, including data-modifying CTEs.
+var dml = regexp.MustCompile(
+	`(?is)^\s*(?:insert|update|delete|merge|replace)\b|^\s*with\b.*\b(?:insert|update|delete)\b`)
+
+// logRowsAffected by cmd, the statement at index i of f, if it modified rows.
+// Zero rows are highlighted, since a backfill which touches nothing is
+// usually a mistake. It returns the number of rows.
+func (m *Migrate) logRowsAffected(
+	f *file,
+	i int,
+	cmd string,
+	res sql.Result,
+) int64 {
+	if res == nil || !dml.MatchString(cmd) {
+		return 0
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0
+	}
+	msg := fmt.Sprintf("%d rows affected", n)
+	if n == 0 {
+		m.warnf("  %s\n", m.colorize(colorYellow, msg))
+	} else {
+		m.debugf("  %s\n", m.colorize(colorDim, msg))
+	}
+	m.record("rows %s [%d]: %d", f.Info.Name(), i, n)
+	return n
+}
+
 func (m *Migrate) skip(toFile string) (int, error) {
 	// Get just the filename if skip is a directory
 	_, toFile = filepath.Split(toFile)
@@ -342,47 +1537,103 @@ func (m *Migrate) skip(toFile string) (int, error) {
 		}
 	}
 	if index == -1 {
-		return 0, fmt.Errorf("%s does not exist", toFile)
+		return 0, fmt.Errorf("%w: %s", ErrUnknownMigration, toFile)
 	}
 	for i := 0; i <= index; i++ {
-		fi, err := os.Open(m.Files[i].fullpath)
-		if err != nil {
-			return -1, err
-		}
-		content, checksum, err := computeChecksum(fi)
-		if err != nil {
-			fi.Close()
-			return -1, err
-		}
-		name := m.Files[i].Info.Name()
-		err = m.db.UpsertMigration(name, content, checksum)
+		mg, err := m.fileMigration(m.Files[i])
 		if err != nil {
-			fi.Close()
 			return -1, err
 		}
-		if err = fi.Close(); err != nil {
+		mg.AppliedAt = appliedNow()
+		if err = m.tracker.UpsertMigration(mg); err != nil {
 			return -1, err
 		}
 	}
 	return index, nil
 }
 
-func computeChecksum(r io.Reader) (content string, checksum string, err error) {
-	h := md5.New()
-	byt, err := ioutil.ReadAll(r)
+// fileMigration of f to record in the history, without its statements,
+// duration, or when it was applied. Go migrations have no content or
+// checksum.
+func (m *Migrate) fileMigration(f *file) (Migration, error) {
+	mg := Migration{
+		Filename:  f.Info.Name(),
+		Algorithm: goAlgorithm,
+		Namespace: m.namespace,
+		Variant:   f.variant,
+		fullpath:  f.fullpath,
+
+		Annotations:    m.annotations,
+		currentVariant: f.variant,
+	}
+	if f.up != nil {
+		return mg, nil
+	}
+	var err error
+	mg.Checksum, err = fileChecksum(m.hasher, m.fsys, f.fullpath, m.dbt)
 	if err != nil {
-		return "", "", errors.Wrap(err, "read all")
+		return Migration{}, err
+	}
+	mg.Content, err = fileContent(m.fsys, f.fullpath)
+	if err != nil {
+		return Migration{}, errors.Wrap(err, "read file")
+	}
+	mg.Algorithm = m.hasher.Algorithm()
+	return mg, nil
+}
+
+// variants of migration files to prefer over the base files, from most to
+// least preferred: the override directory of the DB type followed by its
+// fallbacks.
+func (m *Migrate) variants() []DBType {
+	return append([]DBType{m.dbt}, m.fallbacks[m.dbt]...)
+}
+
+// defaultExtensions of migration files, unless configured WithExtensions.
+var defaultExtensions = []string{".sql"}
+
+// normalizeExtensions so each starts with a dot, as returned by
+// filepath.Ext, defaulting to .sql.
+func normalizeExtensions(exts []string) []string {
+	if len(exts) == 0 {
+		return defaultExtensions
+	}
+	normalized := make([]string, 0, len(exts))
+	for _, ext := range exts {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		normalized = append(normalized, ext)
 	}
-	if _, err := io.Copy(h, bytes.NewReader(byt)); err != nil {
-		return "", "", err
+	return normalized
+}
+
+// hasExtension reports whether name ends with one of exts.
+func hasExtension(name string, exts []string) bool {
+	ext := filepath.Ext(name)
+	for _, e := range exts {
+		if ext == e {
+			return true
+		}
 	}
-	return string(byt), fmt.Sprintf("%x", h.Sum(nil)), nil
+	return false
+}
+
+// filter for files in the migration directory.
+func (m *Migrate) filter() (filter, error) {
+	return newFilter(m.fsys, m.extensions)
 }
 
-// readDir collects file infos from the migration directory.
-func readDir(dir string, dbt DBType) ([]*file, error) {
+// readDir collects file infos from dir within fsys, preferring files in the
+// override directories of variants. Only files accepted by f are migrations.
+func readDir(
+	fsys fs.FS,
+	dir string,
+	variants []DBType,
+	f filter,
+) ([]*file, error) {
 	files := []*file{}
-	tmp, err := ioutil.ReadDir(dir)
+	tmp, err := readDirInfos(fsys, dir)
 	if err != nil {
 		return nil, errors.Wrap(err, "read dir")
 	}
@@ -399,15 +1650,20 @@ func readDir(dir string, dbt DBType) ([]*file, error) {
 	// the `maria-db` folder and prefer identical migration filenames in
 	// that folder over the other one.
 	for _, fi := range tmp {
-		fullpath := filepath.Join(dir, fi.Name())
+		fullpath := path.Join(dir, fi.Name())
 
 		// Skip directories.
 		if fi.IsDir() {
 			continue
 		}
 
-		// Skip any non-sql files.
-		if filepath.Ext(fi.Name()) != ".sql" {
+		// Skip any files which aren't migrations, such as data files.
+		if !f.isMigration(fullpath) {
+			continue
+		}
+
+		// Skip down files, which only Rollback runs.
+		if isDownFile(fi.Name()) {
 			continue
 		}
 
@@ -424,44 +1680,144 @@ func readDir(dir string, dbt DBType) ([]*file, error) {
 
 	// Prioritize our specific database over the set in the main migration
 	// directory.
-	overrideSet, err := getOverrideSet(dir, dbt)
+	overrideSet, err := getOverrideSet(fsys, dir, variants, f)
 	if err != nil {
 		return nil, fmt.Errorf("get override set: %w", err)
 	}
 	for i, fi := range files {
 		if override, exist := overrideSet[fi.Info.Name()]; exist {
 			files[i] = override
-			fmt.Println("OVERRIDING", override.Info.Name())
 		}
 	}
 	return files, nil
 }
 
-func getOverrideSet(dir string, dbt DBType) (map[string]*file, error) {
-	tmp, err := ioutil.ReadDir(dir)
+// dirFS of the migrations in dir. An empty dir is the working directory,
+// since os.DirFS doesn't allow it.
+func dirFS(dir string) fs.FS {
+	if dir == "" {
+		dir = "."
+	}
+	return os.DirFS(dir)
+}
+
+// readDirInfos of the entries in dir within fsys, sorted by name like
+// ioutil.ReadDir.
+func readDirInfos(fsys fs.FS, dir string) ([]os.FileInfo, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// getOverrideSet of files in the override directories of variants, keyed by
+// filename. Files in earlier variants take precedence.
+func getOverrideSet(
+	fsys fs.FS,
+	dir string,
+	variants []DBType,
+	f filter,
+) (map[string]*file, error) {
+	overrideSet := map[string]*file{}
+	for i := len(variants) - 1; i >= 0; i-- {
+		overrides, err := readOverrides(fsys, dir, variants[i], f)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range overrides {
+			overrideSet[o.Info.Name()] = o
+		}
+	}
+	return overrideSet, nil
+}
+
+// readOverrides in the override directory of dbt, if it exists.
+func readOverrides(
+	fsys fs.FS,
+	dir string,
+	dbt DBType,
+	f filter,
+) ([]*file, error) {
+	tmp, err := readDirInfos(fsys, dir)
 	if err != nil {
 		return nil, errors.Wrap(err, "read dir")
 	}
 	overrides := []*file{}
 	for _, fi := range tmp {
-		fullpath := filepath.Join(dir, fi.Name())
-		if !fi.IsDir() || fi.Name() != string(dbt) {
+		fullpath := path.Join(dir, fi.Name())
+		if !fi.IsDir() || fi.Name() != string(dbt) ||
+			f.ignored(fullpath, true) {
 			continue
 		}
 
-		// The empty DBType prevents recursive descent into structures
-		// like ./mariadb/mariadb/mariadb/...
-		overrides, err = readDir(fullpath, DBType(""))
+		// No variants prevents recursive descent into structures like
+		// ./mariadb/mariadb/mariadb/...
+		overrides, err = readDir(fsys, fullpath, nil, f)
 		if err != nil {
 			return nil, fmt.Errorf("read dir %s: %w",
 				fi.Name(), err)
 		}
 	}
-	overrideSet := make(map[string]*file, len(overrides))
 	for _, o := range overrides {
-		overrideSet[o.Info.Name()] = o
+		o.variant = string(dbt)
 	}
-	return overrideSet, nil
+	return overrides, nil
+}
+
+// verifyOverrides logs override files which don't correspond to a migration,
+// since the base file silently runs in their place. Overrides with the same
+// number as a migration of a different name are an error.
+func (m *Migrate) verifyOverrides() error {
+	base := make(map[fileOrder]string, len(m.Files))
+	for _, fi := range m.Files {
+		num, err := fileOrderOf(fi.Info.Name())
+		if err != nil {
+			return err
+		}
+		base[num] = fi.Info.Name()
+	}
+	f, err := m.filter()
+	if err != nil {
+		return err
+	}
+	var mismatches int
+	for _, v := range m.variants() {
+		overrides, err := readOverrides(m.fsys, ".", v, f)
+		if err != nil {
+			return err
+		}
+		for _, o := range overrides {
+			name := filepath.Join(o.variant, o.Info.Name())
+			num, err := fileOrderOf(o.Info.Name())
+			if err != nil {
+				return err
+			}
+			other, ok := base[num]
+			switch {
+			case !ok:
+				m.warnf("%s %s: no migration to override\n",
+					m.colorize(colorYellow, "warning"), name)
+			case other != o.Info.Name():
+				m.errorf("%s: number is used by %s\n", name,
+					other)
+				mismatches++
+			}
+		}
+	}
+	if mismatches > 0 {
+		return fmt.Errorf("%w: %d overrides", ErrOverrideMismatch,
+			mismatches)
+	}
+	return nil
 }
 
 // sortFiles by name, ensuring that something like 1.sql, 2.sql, 10.sql is
@@ -472,34 +1828,103 @@ func sortFiles(files []*file) error {
 		if nameErr != nil {
 			return false
 		}
-		fiName1 := regexNum.FindString(files[i].Info.Name())
-		fiName2 := regexNum.FindString(files[j].Info.Name())
-		fiNum1, err := strconv.ParseUint(fiName1, 10, 64)
+		fiNum1, err := fileOrderOf(files[i].Info.Name())
 		if err != nil {
-			nameErr = errors.Wrapf(err, "parse uint in file %s",
-				files[i].Info.Name())
+			nameErr = err
 			return false
 		}
-		fiNum2, err := strconv.ParseUint(fiName2, 10, 64)
+		fiNum2, err := fileOrderOf(files[j].Info.Name())
 		if err != nil {
-			nameErr = errors.Wrapf(err, "parse uint in file %s",
-				files[i].Info.Name())
+			nameErr = err
 			return false
 		}
 		if fiNum1 == fiNum2 {
-			nameErr = fmt.Errorf("cannot have duplicate timestamp: %d", fiNum1)
+			nameErr = duplicateNumber(files[i].Info.Name(),
+				files[j].Info.Name(), fiNum1)
 			return false
 		}
-		return fiNum1 < fiNum2
+		return fiNum1.less(fiNum2)
 	})
 	return nameErr
 }
 
+// fileNumber parses the numeric prefix of a migration filename.
+func fileNumber(name string) (uint64, error) {
+	num, err := strconv.ParseUint(regexNum.FindString(name), 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parse uint in file %s", name)
+	}
+	return num, nil
+}
+
+// fileOrder is the position of a migration: its numeric prefix followed by an
+// optional sub-number after a dot. Sub-numbers slot a hotfix between
+// migrations which were already merged without renumbering them, so
+// 42.1_fix.sql and 42.2_fix.sql run after 42_add.sql and before 43_drop.sql.
+// A sub-number of 0 is the same as none.
+type fileOrder struct {
+	num, sub uint64
+}
+
+// fileOrderOf parses the numeric prefix and sub-number of a migration
+// filename.
+func fileOrderOf(name string) (fileOrder, error) {
+	match := regexOrder.FindStringSubmatch(name)
+	if match == nil {
+		return fileOrder{}, fmt.Errorf("parse uint in file %s: no number",
+			name)
+	}
+	var o fileOrder
+	var err error
+	if o.num, err = strconv.ParseUint(match[1], 10, 64); err != nil {
+		return o, errors.Wrapf(err, "parse uint in file %s", name)
+	}
+	if match[2] != "" {
+		o.sub, err = strconv.ParseUint(match[2], 10, 64)
+		if err != nil {
+			return o, errors.Wrapf(err, "parse sub-number in file %s",
+				name)
+		}
+	}
+	return o, nil
+}
+
+func (o fileOrder) less(p fileOrder) bool {
+	if o.num != p.num {
+		return o.num < p.num
+	}
+	return o.sub < p.sub
+}
+
+func (o fileOrder) String() string {
+	if o.sub == 0 {
+		return strconv.FormatUint(o.num, 10)
+	}
+	return fmt.Sprintf("%d.%d", o.num, o.sub)
+}
+
+// sortMigrations in the order of their files. Stores order the history by
+// numeric prefix, which doesn't account for sub-numbers.
+func sortMigrations(ms []Migration) {
+	sort.SliceStable(ms, func(i, j int) bool {
+		o1, err1 := fileOrderOf(ms[i].Filename)
+		o2, err2 := fileOrderOf(ms[j].Filename)
+		if err1 != nil || err2 != nil {
+			return false
+		}
+		return o1.less(o2)
+	})
+}
+
 func migrationsFromFiles(m *Migrate) ([]Migration, error) {
 	ms := make([]Migration, len(m.Files))
 	for i, fi := range m.Files {
-		fmt.Println("FULLPATH", fi.fullpath)
-		byt, err := ioutil.ReadFile(fi.fullpath)
+		if fi.up != nil {
+			ms[i] = Migration{Filename: fi.Info.Name()}
+			continue
+		}
+		m.debugf("reading %s\n", fi.fullpath)
+		byt, err := fs.ReadFile(m.fsys, fi.fullpath)
 		if err != nil {
 			return nil, errors.Wrap(err, "read file")
 		}
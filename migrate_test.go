@@ -0,0 +1,3066 @@
+package migrate_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/fs"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/thankful-ai/migrate"
+	"github.com/thankful-ai/migrate/sqlite"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestPending(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+		"2_add_name.sql": `
+			ALTER TABLE users ADD COLUMN name TEXT;
+			ALTER TABLE users ADD COLUMN email TEXT;`,
+	})
+	db := newDB(t)
+
+	m := newMigrate(t, db, dir)
+	pending := m.Pending()
+	if len(pending) != 2 {
+		t.Fatalf("expected 2 pending, got %d", len(pending))
+	}
+	if pending[1].Filename != "2_add_name.sql" {
+		t.Fatalf("unexpected filename %s", pending[1].Filename)
+	}
+	if pending[1].Number != 2 {
+		t.Fatalf("expected number 2, got %d", pending[1].Number)
+	}
+	if pending[1].Statements != 2 {
+		t.Fatalf("expected 2 statements, got %d", pending[1].Statements)
+	}
+
+	if len(m.Applied()) != 0 {
+		t.Fatalf("expected nothing applied, got %d", len(m.Applied()))
+	}
+
+	_, err := m.Migrate()
+	check(t, err)
+	if len(m.Pending()) != 0 {
+		t.Fatal("expected no pending migrations after migrating")
+	}
+
+	// A fresh instance must agree.
+	m = newMigrate(t, db, dir)
+	if len(m.Pending()) != 0 {
+		t.Fatal("expected no pending migrations after reloading")
+	}
+	applied := m.Applied()
+	if len(applied) != 2 || applied[1].Filename != "2_add_name.sql" {
+		t.Fatalf("unexpected applied migrations %+v", applied)
+	}
+	if applied[0].Checksum == "" || applied[0].Checksum == applied[1].Checksum {
+		t.Fatalf("unexpected checksums %q and %q", applied[0].Checksum,
+			applied[1].Checksum)
+	}
+
+	// Callers can't change the history through the result.
+	applied[0].Filename = "changed.sql"
+	if m.Applied()[0].Filename != "1_create_users.sql" {
+		t.Fatal("expected Applied to return a copy")
+	}
+}
+
+func TestWithHasher(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+	})
+	db := newDB(t)
+	h := migrate.NewHasher("hmac-sha256", func() hash.Hash {
+		return hmac.New(sha256.New, []byte("secret"))
+	})
+
+	m, err := migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite), migrate.WithHasher(h))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+	if m.Migrations[0].Algorithm != "hmac-sha256" {
+		t.Fatalf("unexpected algorithm %q", m.Migrations[0].Algorithm)
+	}
+
+	// Verifying the history requires the same hasher.
+	_, err = migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite))
+	if err == nil {
+		t.Fatal("expected unknown algorithm error")
+	}
+	_, err = migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite), migrate.WithHasher(h))
+	check(t, err)
+}
+
+func TestWithFIPS(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+	})
+	db := newDB(t)
+
+	// Record a legacy md5 checksum, then verify it in fips mode.
+	m, err := migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithHasher(migrate.MD5Hasher))
+	if err != nil && strings.Contains(err.Error(), "fips") {
+		t.Skip("fips mode enabled by the runtime")
+	}
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+
+	// Changes are detected without computing md5.
+	path := filepath.Join(dir, "1_create_users.sql")
+	err = os.WriteFile(path, []byte("CREATE TABLE users (id TEXT);"), 0o644)
+	check(t, err)
+	_, err = migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite), migrate.WithFIPS())
+	if err == nil {
+		t.Fatal("expected content mismatch")
+	}
+
+	// Once verified, the checksum is rewritten.
+	err = os.WriteFile(path, []byte("CREATE TABLE users (id INTEGER);"),
+		0o644)
+	check(t, err)
+	m, err = migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite), migrate.WithFIPS())
+	check(t, err)
+	if alg := m.Migrations[0].Algorithm; alg != "sha256" {
+		t.Fatalf("expected sha256, got %s", alg)
+	}
+
+	// md5 cannot be chosen explicitly.
+	_, err = migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite), migrate.WithFIPS(),
+		migrate.WithHasher(migrate.MD5Hasher))
+	if err == nil {
+		t.Fatal("expected md5 to be rejected")
+	}
+}
+
+func TestRehash(t *testing.T) {
+	content := "ALTER TABLE users ADD COLUMN name TEXT;"
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+		"2_add_name.sql":     content,
+	})
+	db := newDB(t)
+	h := migrate.NewHasher("hmac-sha256", func() hash.Hash {
+		return hmac.New(sha256.New, []byte("secret"))
+	})
+
+	m, err := migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite), migrate.WithHasher(h))
+	check(t, err)
+	_, err = m.MigrateTo("1_create_users.sql")
+	check(t, err)
+	m, err = migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite), migrate.WithHasher(h),
+		migrate.WithHasher(migrate.MD5Hasher))
+	if err != nil && strings.Contains(err.Error(), "fips") {
+		t.Skip("fips mode enabled by the runtime")
+	}
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+
+	// The md5 checksum is rewritten with the default Hasher, while
+	// checksums from other hashers are left alone.
+	m, err = migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite), migrate.WithHasher(h),
+		migrate.WithHasher(migrate.SHA256Hasher))
+	check(t, err)
+	want, err := migrate.Checksum(strings.NewReader(content))
+	check(t, err)
+	applied := m.Applied()
+	if applied[0].Algorithm != "hmac-sha256" {
+		t.Fatalf("expected hmac-sha256, got %s", applied[0].Algorithm)
+	}
+	if applied[1].Algorithm != "sha256" || applied[1].Checksum != want {
+		t.Fatalf("unexpected checksum %s %s", applied[1].Algorithm,
+			applied[1].Checksum)
+	}
+
+	// The rewritten history verifies without md5.
+	_, err = migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite), migrate.WithHasher(h),
+		migrate.WithHasher(migrate.SHA256Hasher), migrate.WithFIPS())
+	check(t, err)
+}
+
+func TestLoad(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+	})
+	db := newDB(t)
+
+	m, err := migrate.Load(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite))
+	check(t, err)
+	if _, err = m.Migrate(); err == nil {
+		t.Fatal("expected error migrating before init")
+	}
+
+	// Load must not have touched the database.
+	var n int
+	err = db.Get(&n, `SELECT COUNT(*) FROM sqlite_master`)
+	check(t, err)
+	if n != 0 {
+		t.Fatalf("expected no tables, got %d", n)
+	}
+
+	check(t, m.Init(""))
+	_, err = m.Migrate()
+	check(t, err)
+}
+
+func TestInspect(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+		"2_add_name.sql":     "ALTER TABLE users ADD COLUMN name TEXT;",
+	})
+	db := newDB(t)
+
+	m, err := migrate.Inspect(db, dir,
+		migrate.WithDBType(migrate.DBTypeSQLite))
+	check(t, err)
+	status := m.Status()
+	if status.Version != -1 {
+		t.Fatalf("expected version -1, got %d", status.Version)
+	}
+	if len(status.Pending) != 2 {
+		t.Fatalf("expected 2 pending, got %d", len(status.Pending))
+	}
+	if _, err = m.Migrate(); err == nil {
+		t.Fatal("expected error migrating read-only")
+	}
+
+	_, err = newMigrate(t, db, dir).Migrate()
+	check(t, err)
+
+	// Change an applied file to introduce drift.
+	err = os.WriteFile(filepath.Join(dir, "1_create_users.sql"),
+		[]byte("CREATE TABLE users (id TEXT);"), 0o644)
+	check(t, err)
+
+	m, err = migrate.Inspect(db, dir,
+		migrate.WithDBType(migrate.DBTypeSQLite))
+	check(t, err)
+	status = m.Status()
+	if len(status.Applied) != 2 {
+		t.Fatalf("expected 2 applied, got %d", len(status.Applied))
+	}
+	if len(status.Drift) != 1 {
+		t.Fatalf("expected 1 drift, got %d", len(status.Drift))
+	}
+	if status.Drift[0].Kind != migrate.DriftChecksum {
+		t.Fatalf("unexpected drift kind %s", status.Drift[0].Kind)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+	})
+	db := newDB(t)
+
+	m := newMigrate(t, db, dir)
+	_, err := m.Migrate()
+	check(t, err)
+	inspected, err := migrate.Inspect(db, dir,
+		migrate.WithDBType(migrate.DBTypeSQLite))
+	check(t, err)
+
+	path := filepath.Join(dir, "2_add_name.sql")
+	err = os.WriteFile(path, []byte("ALTER TABLE users ADD COLUMN name TEXT;"),
+		0o644)
+	check(t, err)
+	check(t, m.Reload())
+	if len(m.Pending()) != 1 {
+		t.Fatalf("expected 1 pending, got %d", len(m.Pending()))
+	}
+	_, err = m.Migrate()
+	check(t, err)
+
+	check(t, inspected.Reload())
+	if st := inspected.Status(); len(st.Applied) != 2 || len(st.Pending) != 0 {
+		t.Fatalf("unexpected status %+v", st)
+	}
+
+	// Edits to applied files are caught, leaving the old state intact.
+	err = os.WriteFile(path, []byte("ALTER TABLE users ADD COLUMN email TEXT;"),
+		0o644)
+	check(t, err)
+	if err = m.Reload(); !errors.Is(err, migrate.ErrChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+	if len(m.Files) != 2 || len(m.Migrations) != 2 {
+		t.Fatalf("expected state to be unchanged")
+	}
+}
+
+func TestWithEvents(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);\nINSERT INTO users (id) VALUES (1);",
+		"2_bad.sql":          "CREAT TABLE x (id INTEGER);",
+	})
+	db := newDB(t)
+
+	var events []migrate.Event
+	m, err := migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithoutFileTransactions(),
+		migrate.WithEvents(func(e migrate.Event) {
+			events = append(events, e)
+		}))
+	check(t, err)
+	if _, err = m.Migrate(); err == nil {
+		t.Fatal("expected error")
+	}
+
+	var kinds []string
+	for _, e := range events {
+		kinds = append(kinds, fmt.Sprintf("%T", e))
+	}
+	want := []string{
+		"migrate.FileStarted",
+		"migrate.StatementExecuted", "migrate.CheckpointSaved",
+		"migrate.StatementExecuted", "migrate.CheckpointSaved",
+		"migrate.FileApplied",
+		"migrate.FileStarted",
+		"migrate.Failed",
+		"migrate.RunFinished",
+	}
+	if strings.Join(kinds, " ") != strings.Join(want, " ") {
+		t.Fatalf("unexpected events %v", kinds)
+	}
+	if e := events[3].(migrate.StatementExecuted); e.RowsAffected != 1 {
+		t.Fatalf("expected 1 row affected, got %d", e.RowsAffected)
+	}
+	finished := events[len(events)-1].(migrate.RunFinished)
+	if len(finished.Migrated) != 1 || finished.Err == nil {
+		t.Fatalf("unexpected run finished %+v", finished)
+	}
+}
+
+func TestWithoutCheckpointContent(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": `CREATE TABLE users (id INTEGER);
+			INSERT INTO missing VALUES (1);`,
+	})
+	db := newDB(t)
+
+	m, err := migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithoutFileTransactions(),
+		migrate.WithoutCheckpointContent())
+	check(t, err)
+	if _, err = m.Migrate(); err == nil {
+		t.Fatal("expected error")
+	}
+
+	var content string
+	err = db.Get(&content, `SELECT content FROM metacheckpoints`)
+	check(t, err)
+	if content != "" {
+		t.Fatalf("expected no content, got %q", content)
+	}
+
+	// Resuming still verifies the checkpoint by its checksum.
+	check(t, os.WriteFile(filepath.Join(dir, "1_create_users.sql"),
+		[]byte("CREATE TABLE users (id INTEGER);\nSELECT 1;"), 0o644))
+	check(t, m.Reload())
+	_, err = m.Migrate()
+	check(t, err)
+}
+
+func TestResumeCommentedCheckpoint(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": `CREATE TABLE users (
+				id INTEGER -- the user's id
+			);
+			INSERT INTO users VALUES (1);`,
+	})
+	db := newDB(t)
+	m := newMigrate(t, db, dir, migrate.WithoutFileTransactions())
+
+	// Simulate a run before comments were removed from statements, which
+	// checkpointed the first statement with its comment before failing.
+	old := `CREATE TABLE users (
+				id INTEGER -- the user's id
+			)`
+	_, err := db.Exec(old)
+	check(t, err)
+	checksum, err := migrate.Checksum(strings.NewReader(old))
+	check(t, err)
+	check(t, db.InsertMetaCheckpoint("", "1_create_users.sql", old,
+		checksum, 0))
+
+	// Resuming accepts the checkpoint rather than creating users again.
+	_, err = m.Migrate()
+	check(t, err)
+	var n int
+	check(t, db.Get(&n, `SELECT COUNT(*) FROM users`))
+	if n != 1 {
+		t.Fatalf("expected 1 user, got %d", n)
+	}
+}
+
+func TestMD5Checkpoint(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": `CREATE TABLE users (id INTEGER);
+			INSERT INTO missing VALUES (1);`,
+	})
+	db := newDB(t)
+
+	m, err := migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithHasher(migrate.MD5Hasher))
+	if err != nil && strings.Contains(err.Error(), "fips") {
+		t.Skip("fips mode enabled by the runtime")
+	}
+	check(t, err)
+	if _, err = m.Migrate(); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// A checkpoint recorded with md5 is still verified after upgrading.
+	check(t, os.WriteFile(filepath.Join(dir, "1_create_users.sql"),
+		[]byte("CREATE TABLE users (id INTEGER);\nSELECT 1;"), 0o644))
+	m = newMigrate(t, db, dir)
+	_, err = m.Migrate()
+	check(t, err)
+}
+
+func TestRepair(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+		"2_create_teams.sql": "CREATE TABLE teams (id INTEGER);",
+	})
+	db := newDB(t)
+	m := newMigrate(t, db, dir)
+	_, err := m.Migrate()
+	check(t, err)
+
+	// Reformatting a migrated file fails until it's repaired.
+	content := "-- users\ncreate table users (\n\tid INTEGER\n);\n"
+	check(t, os.WriteFile(filepath.Join(dir, "1_create_users.sql"),
+		[]byte(content), 0o644))
+	_, err = migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite))
+	if !errors.Is(err, migrate.ErrChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+	m, err = migrate.Load(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite))
+	check(t, err)
+	repaired, err := m.Repair()
+	check(t, err)
+	if len(repaired) != 1 || repaired[0].Filename != "1_create_users.sql" ||
+		repaired[0].Content != content {
+		t.Fatalf("unexpected repaired migrations %+v", repaired)
+	}
+
+	check(t, os.WriteFile(filepath.Join(dir, "3_create_posts.sql"),
+		[]byte("CREATE TABLE posts (id INTEGER);"), 0o644))
+	m = newMigrate(t, db, dir)
+	repaired, err = m.Repair()
+	check(t, err)
+	if len(repaired) != 0 {
+		t.Fatalf("expected nothing to repair, got %+v", repaired)
+	}
+	_, err = m.Migrate()
+	check(t, err)
+
+	// Only checksums are repaired.
+	check(t, os.Remove(filepath.Join(dir, "2_create_teams.sql")))
+	m, err = migrate.Load(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite))
+	check(t, err)
+	if _, err = m.Repair(); !errors.Is(err, migrate.ErrMissingMigration) {
+		t.Fatalf("expected missing migration, got %v", err)
+	}
+	if _, err = m.Migrate(); err == nil {
+		t.Fatal("expected migrating unrepaired history to fail")
+	}
+}
+
+func TestAnalyzeDirective(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": `CREATE TABLE users (id INTEGER, name TEXT);
+			CREATE INDEX users_name ON users (name);`,
+		"2_seed_users.sql": `-- migrate:analyze users, missing
+			INSERT INTO users VALUES (1, 'a');
+			INSERT INTO users VALUES (2, 'b');`,
+	})
+	db := newDB(t)
+	m := newMigrate(t, db, dir)
+	_, err := m.Migrate()
+	check(t, err)
+
+	// The missing table is only a warning, since the file was applied.
+	var stat string
+	err = db.Get(&stat,
+		`SELECT stat FROM sqlite_stat1 WHERE idx = 'users_name'`)
+	check(t, err)
+	if !strings.HasPrefix(stat, "2 ") {
+		t.Fatalf("expected statistics for 2 rows, got %q", stat)
+	}
+	if got := m.Status().Applied[1].Statements; got != 2 {
+		t.Fatalf("expected the directive not to be a statement, got %d", got)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+		"2_seed_users.sql":   "INSERT INTO users VALUES (1);\nINSERT INTO users VALUES (2);",
+	})
+	db := newDB(t)
+
+	var m *migrate.Migrate
+	var during []migrate.Progress
+	m, err := migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithoutFileTransactions(),
+		migrate.WithEvents(func(e migrate.Event) {
+			if _, ok := e.(migrate.StatementExecuted); ok {
+				during = append(during, m.Progress())
+			}
+		}))
+	check(t, err)
+
+	// Progress is safe to poll while migrating.
+	stop := make(chan struct{})
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				_ = m.Progress()
+			}
+		}
+	}()
+	_, err = m.Migrate()
+	close(stop)
+	<-polled
+	check(t, err)
+
+	if len(during) != 3 {
+		t.Fatalf("expected 3 snapshots, got %d", len(during))
+	}
+	last := during[2]
+	if !last.Running || last.File != "2_seed_users.sql" ||
+		last.Statement != 2 || last.Statements != 2 {
+		t.Fatalf("unexpected progress %+v", last)
+	}
+	p := m.Progress()
+	if p.Running || p.Applied != 2 || p.Pending != 2 || p.LastError != nil {
+		t.Fatalf("unexpected progress %+v", p)
+	}
+	if p.Elapsed <= 0 {
+		t.Fatalf("expected elapsed time, got %s", p.Elapsed)
+	}
+}
+
+func TestWithSlowestReport(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+		"2_seed_users.sql": `INSERT INTO users VALUES (1);
+			WITH RECURSIVE n(i) AS (
+				SELECT 2 UNION ALL SELECT i + 1 FROM n WHERE i < 200000
+			)
+			INSERT INTO users SELECT i FROM n;
+			UPDATE users SET id = id;`,
+	})
+	db := newDB(t)
+	m, err := migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithoutFileTransactions(),
+		migrate.WithSlowestReport(2))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+
+	slowest := m.SlowestStatements()
+	if len(slowest) != 2 {
+		t.Fatalf("expected 2 statements, got %d", len(slowest))
+	}
+	if slowest[0].Duration < slowest[1].Duration {
+		t.Fatalf("expected slowest first, got %+v", slowest)
+	}
+	for _, st := range slowest {
+		if st.Filename != "2_seed_users.sql" || st.Index == 0 ||
+			st.RowsAffected < 199999 {
+			t.Fatalf("expected the large statements, got %+v", st)
+		}
+	}
+}
+
+func TestWithTranscript(t *testing.T) {
+	long := "CREATE TABLE users (id INTEGER DEFAULT '" +
+		strings.Repeat("padding ", 20) + "')"
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": long + ";",
+	})
+	db := newDB(t)
+
+	var buf bytes.Buffer
+	m, err := migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithTranscript(&buf))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+
+	out := buf.String()
+	if !strings.Contains(out, long) {
+		t.Fatalf("expected untruncated statement in transcript:\n%s", out)
+	}
+	if !strings.Contains(out, "migrated 1_create_users.sql") {
+		t.Fatalf("expected migrated entry in transcript:\n%s", out)
+	}
+}
+
+func TestRedactedLiterals(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": `
+			CREATE TABLE users (name TEXT, token TEXT, n INTEGER);
+			INSERT INTO users VALUES ('admin', 'it''s secret', 42);`,
+	})
+	db := newDB(t)
+
+	var logs, transcript bytes.Buffer
+	var events []string
+	m, err := migrate.New(db, dir,
+		migrate.WithLogger(log.New(&logs, "", 0)),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithTranscript(&transcript),
+		migrate.WithRedactedLiterals(),
+		migrate.WithRedactor(func(sql string) string {
+			return strings.ReplaceAll(sql, "token", "[col]")
+		}),
+		migrate.WithEvents(func(e migrate.Event) {
+			switch ev := e.(type) {
+			case migrate.StatementExecuted:
+				events = append(events, ev.SQL)
+			case migrate.FileApplied:
+				events = append(events, ev.Content)
+			}
+		}))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+
+	want := "INSERT INTO users VALUES (?, ?, ?)"
+	for name, out := range map[string]string{
+		"logs":       logs.String(),
+		"transcript": transcript.String(),
+		"events":     strings.Join(events, "\n"),
+	} {
+		if strings.Contains(out, "secret") || strings.Contains(out, " 42)") {
+			t.Fatalf("expected literals redacted from %s:\n%s", name, out)
+		}
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in %s:\n%s", want, name, out)
+		}
+		if strings.Contains(out, "token") {
+			t.Fatalf("expected redactor applied to %s:\n%s", name, out)
+		}
+	}
+
+	// The statement itself was executed as written.
+	var token string
+	check(t, db.Get(&token, `SELECT token FROM users`))
+	if token != "it's secret" {
+		t.Fatalf("expected it's secret, got %q", token)
+	}
+
+	// Failed statements and diffs of changed files are redacted too.
+	check(t, os.WriteFile(filepath.Join(dir, "1_create_users.sql"),
+		[]byte("CREATE TABLE users (name TEXT, token TEXT);\n"+
+			"INSERT INTO users VALUES ('admin', 'new secret');"), 0o644))
+	check(t, os.WriteFile(filepath.Join(dir, "2_seed.sql"),
+		[]byte("INSERT INTO missing VALUES ('secret');"), 0o644))
+	logs.Reset()
+	_, err = migrate.New(db, dir,
+		migrate.WithLogger(log.New(&logs, "", 0)),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithRedactedLiterals())
+	if !errors.Is(err, migrate.ErrChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+	if out := logs.String(); strings.Contains(out, "secret") ||
+		!strings.Contains(out, "-\t\t\tINSERT INTO users VALUES (?, ?, ?);") {
+		t.Fatalf("expected redacted diff:\n%s", out)
+	}
+	check(t, os.Remove(filepath.Join(dir, "1_create_users.sql")))
+	check(t, os.WriteFile(filepath.Join(dir, "2_seed.sql"),
+		[]byte("INSERT INTO missing VALUES ('secret');"), 0o644))
+	transcript.Reset()
+	m, err = migrate.New(newDB(t), dir,
+		migrate.WithLogger(log.New(&logs, "", 0)),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithTranscript(&transcript),
+		migrate.WithRedactedLiterals(),
+		migrate.WithRedactor(func(sql string) string {
+			return strings.ReplaceAll(sql, "missing", "[table]")
+		}))
+	check(t, err)
+	_, err = m.Migrate()
+	var mErr *migrate.MigrationError
+	if !errors.As(err, &mErr) || mErr.SQL != "INSERT INTO [table] VALUES (?)" {
+		t.Fatalf("expected redacted MigrationError, got %v", err)
+	}
+
+	// So are the error messages recorded for the failure.
+	f := m.Status().Stats.LastFailure
+	if f == nil || strings.Contains(f.Error, "missing") ||
+		!strings.Contains(f.Error, "no such table: [table]") {
+		t.Fatalf("expected redacted failure, got %+v", f)
+	}
+	if out := transcript.String(); strings.Contains(out, "missing") ||
+		!strings.Contains(out, "no such table: [table]") {
+		t.Fatalf("expected redacted error in transcript:\n%s", out)
+	}
+}
+
+func TestMigrationError(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": `
+			CREATE TABLE users (id INTEGER);
+			CREAT TABLE typo (id INTEGER);`,
+	})
+	db := newDB(t)
+
+	_, err := newMigrate(t, db, dir, migrate.WithoutFileTransactions()).Migrate()
+	var mErr *migrate.MigrationError
+	if !errors.As(err, &mErr) {
+		t.Fatalf("expected MigrationError, got %v", err)
+	}
+	if mErr.File != "1_create_users.sql" || mErr.Index != 1 {
+		t.Fatalf("unexpected location %s [%d]", mErr.File, mErr.Index)
+	}
+	if mErr.Class != migrate.ClassSyntax {
+		t.Fatalf("expected syntax error, got %s", mErr.Class)
+	}
+	if mErr.Transient() {
+		t.Fatal("expected syntax error not to be transient")
+	}
+	var sErr *migrate.StatementError
+	if !errors.As(err, &sErr) || sErr.SQL != "CREAT TABLE typo (id INTEGER)" {
+		t.Fatalf("expected StatementError, got %v", err)
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"2_create_users.sql": "CREATE TABLE users (id INTEGER);",
+		"3_create_posts.sql": "CREATE TABLE posts (id INTEGER);",
+	})
+	db := newDB(t)
+	_, err := newMigrate(t, db, dir).Migrate()
+	check(t, err)
+
+	newErr := func() error {
+		_, err := migrate.New(db, dir,
+			migrate.WithLogger(testLogger{t}),
+			migrate.WithDBType(migrate.DBTypeSQLite))
+		return err
+	}
+
+	path := filepath.Join(dir, "3_create_posts.sql")
+	err = os.WriteFile(path, []byte("CREATE TABLE posts (id TEXT);"), 0o644)
+	check(t, err)
+	if err = newErr(); !errors.Is(err, migrate.ErrChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+
+	check(t, os.Remove(path))
+	if err = newErr(); !errors.Is(err, migrate.ErrMissingMigration) {
+		t.Fatalf("expected missing migration, got %v", err)
+	}
+	err = os.WriteFile(path, []byte("CREATE TABLE posts (id INTEGER);"),
+		0o644)
+	check(t, err)
+
+	err = os.WriteFile(filepath.Join(dir, "1_create_tags.sql"),
+		[]byte("CREATE TABLE tags (id INTEGER);"), 0o644)
+	check(t, err)
+	if err = newErr(); !errors.Is(err, migrate.ErrOutOfOrder) {
+		t.Fatalf("expected out of order, got %v", err)
+	}
+	check(t, os.Remove(filepath.Join(dir, "1_create_tags.sql")))
+
+	err = os.WriteFile(filepath.Join(dir, "4_empty.sql"),
+		[]byte("-- nothing to see here"), 0o644)
+	check(t, err)
+	m := newMigrate(t, db, dir)
+	if _, err = m.Migrate(); !errors.Is(err, migrate.ErrNoStatements) {
+		t.Fatalf("expected no statements, got %v", err)
+	}
+}
+
+func TestMigrateUntil(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"20240101_create_users.sql": "CREATE TABLE users (id INTEGER);",
+		"20240201_create_posts.sql": "CREATE TABLE posts (id INTEGER);",
+		"20240301_create_tags.sql":  "CREATE TABLE tags (id INTEGER);",
+	})
+	db := newDB(t)
+
+	m := newMigrate(t, db, dir)
+	cutoff := time.Date(2024, 2, 15, 0, 0, 0, 0, time.UTC)
+	migrated, err := m.MigrateUntil(cutoff)
+	check(t, err)
+	if !migrated {
+		t.Fatal("expected migrations")
+	}
+	pending := m.Pending()
+	if len(pending) != 1 || pending[0].Filename != "20240301_create_tags.sql" {
+		t.Fatalf("unexpected pending %v", pending)
+	}
+}
+
+func TestMigrateTo(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+		"2_create_posts.sql": "CREATE TABLE posts (id INTEGER);",
+		"3_create_tags.sql":  "CREATE TABLE tags (id INTEGER);",
+	})
+	db := newDB(t)
+
+	m := newMigrate(t, db, dir)
+	_, err := m.MigrateTo("4_missing.sql")
+	if !errors.Is(err, migrate.ErrUnknownMigration) {
+		t.Fatalf("expected unknown migration, got %v", err)
+	}
+	migrated, err := m.MigrateTo("2_create_posts.sql")
+	check(t, err)
+	if !migrated {
+		t.Fatal("expected migrations")
+	}
+	pending := m.Pending()
+	if len(pending) != 1 || pending[0].Filename != "3_create_tags.sql" {
+		t.Fatalf("unexpected pending %v", pending)
+	}
+
+	// Targeting an applied migration does nothing.
+	migrated, err = m.MigrateTo("1_create_users.sql")
+	check(t, err)
+	if migrated || len(m.Pending()) != 1 {
+		t.Fatal("expected no migrations")
+	}
+}
+
+func TestFilenamePolicy(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+		"2.sql":              "CREATE TABLE posts (id INTEGER);",
+		"3_tmp_fix.sql":      "CREATE TABLE tags (id INTEGER);",
+	})
+	db := newDB(t)
+	opts := []migrate.Option{
+		migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithFilenamePolicy(migrate.RequireDescription()),
+		migrate.WithFilenamePolicy(migrate.ForbidWords("TMP")),
+		migrate.WithFilenamePolicy(migrate.MaxLength(20)),
+	}
+
+	_, err := migrate.New(db, dir, opts...)
+	if !errors.Is(err, migrate.ErrFilenamePolicy) {
+		t.Fatalf("expected filename policy error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "2 violations") {
+		t.Fatalf("expected 2 violations, got %v", err)
+	}
+
+	// Files already in history are exempt.
+	m, err := migrate.New(db, dir,
+		append(opts, migrate.WithSkip("3_tmp_fix.sql"))...)
+	check(t, err)
+	check(t, m.Verify())
+}
+
+func TestTimestampNaming(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"001_create_users.sql": "CREATE TABLE users (id INTEGER);",
+	})
+	name, err := migrate.NewFilename(dir, "Add email", migrate.NamingSequential)
+	check(t, err)
+	if name != "002_add_email.sql" {
+		t.Fatalf("unexpected sequential name %s", name)
+	}
+	db := newDB(t)
+	m := newMigrate(t, db, dir)
+	_, err = m.Migrate()
+	check(t, err)
+
+	// Applied migrations aren't checked, but pending ones must be named
+	// by timestamp.
+	opts := []migrate.Option{
+		migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithNaming(migrate.NamingTimestamp),
+	}
+	_, err = migrate.New(db, dir, opts...)
+	check(t, err)
+	err = os.WriteFile(filepath.Join(dir, name), []byte("SELECT 1;"), 0o644)
+	check(t, err)
+	_, err = migrate.New(db, dir, opts...)
+	if !errors.Is(err, migrate.ErrFilenamePolicy) {
+		t.Fatalf("expected filename policy, got %v", err)
+	}
+	check(t, os.Remove(filepath.Join(dir, name)))
+
+	// New timestamps follow any in the future, such as from a clock which
+	// is ahead.
+	future := "29990101000000_add_email.sql"
+	err = os.WriteFile(filepath.Join(dir, future), []byte("SELECT 1;"), 0o644)
+	check(t, err)
+	name, err = migrate.NewFilename(dir, "add name", migrate.NamingTimestamp)
+	check(t, err)
+	if name != "29990101000001_add_name.sql" {
+		t.Fatalf("unexpected timestamp name %s", name)
+	}
+
+	// Files created in the same second conflict, and Renumber gives one a
+	// later timestamp.
+	err = os.WriteFile(filepath.Join(dir, "29990101000000_add_name.sql"),
+		[]byte("SELECT 2;"), 0o644)
+	check(t, err)
+	_, err = migrate.New(db, dir, opts...)
+	if !errors.Is(err, migrate.ErrDuplicateNumber) ||
+		!strings.Contains(err.Error(), "same second") {
+		t.Fatalf("expected duplicate timestamp, got %v", err)
+	}
+	name, err = migrate.Renumber(dir, "29990101000000_add_name.sql")
+	check(t, err)
+	if name != "29990101000001_add_name.sql" {
+		t.Fatalf("unexpected renumbered name %s", name)
+	}
+	_, err = migrate.New(db, dir, opts...)
+	check(t, err)
+}
+
+func TestConflicts(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"01_create_users.sql":        "CREATE TABLE users (id INTEGER);",
+		"02_create_posts.sql":        "CREATE TABLE posts (id INTEGER);",
+		"02_add_email.sql":           "ALTER TABLE users ADD COLUMN email TEXT;",
+		"sqlite/02_add_email.sql":    "ALTER TABLE users ADD COLUMN email TEXT;",
+		"sqlite/01_create_users.sql": "CREATE TABLE users (id INTEGER);",
+	})
+	db := newDB(t)
+
+	_, err := migrate.Load(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite))
+	if !errors.Is(err, migrate.ErrDuplicateNumber) {
+		t.Fatalf("expected duplicate number, got %v", err)
+	}
+	conflicts, err := migrate.Conflicts(dir)
+	check(t, err)
+	if len(conflicts) != 1 || conflicts[0].Number != 2 {
+		t.Fatalf("unexpected conflicts %v", conflicts)
+	}
+
+	newName, err := migrate.Renumber(dir, conflicts[0].Filenames[0])
+	check(t, err)
+	if newName != "03_add_email.sql" {
+		t.Fatalf("unexpected new name %s", newName)
+	}
+	_, err = os.Stat(filepath.Join(dir, "sqlite", newName))
+	check(t, err)
+	conflicts, err = migrate.Conflicts(dir)
+	check(t, err)
+	if len(conflicts) != 0 {
+		t.Fatalf("unexpected conflicts %v", conflicts)
+	}
+	m := newMigrate(t, db, dir)
+	_, err = m.Migrate()
+	check(t, err)
+}
+
+func TestWithNamespace(t *testing.T) {
+	authDir := writeFiles(t, map[string]string{
+		"1_init.sql": "CREATE TABLE users (id INTEGER);",
+	})
+	billingDir := writeFiles(t, map[string]string{
+		"1_init.sql":      "CREATE TABLE invoices (id INTEGER);",
+		"2_add_total.sql": "ALTER TABLE invoices ADD COLUMN total INTEGER;",
+	})
+	db := newDB(t)
+
+	auth, err := migrate.New(db, authDir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithNamespace("auth"))
+	check(t, err)
+	_, err = auth.Migrate()
+	check(t, err)
+
+	billing, err := migrate.New(db, billingDir,
+		migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithNamespace("billing"))
+	check(t, err)
+	if len(billing.Pending()) != 2 {
+		t.Fatalf("expected 2 pending, got %d", len(billing.Pending()))
+	}
+	_, err = billing.Migrate()
+	check(t, err)
+
+	// Each history is verified only against its own files.
+	auth, err = migrate.New(db, authDir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithNamespace("auth"))
+	check(t, err)
+	if len(auth.Migrations) != 1 {
+		t.Fatalf("expected 1 auth migration, got %d", len(auth.Migrations))
+	}
+}
+
+func TestWithTablePrefix(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+		"2_checkpoint.sql": "CREATE TABLE meta (id INTEGER);\n" +
+			"ALTER TABLE meta ADD COLUMN name TEXT;",
+	})
+	db := newDB(t)
+	m := newMigrate(t, db, dir, migrate.WithTablePrefix("deploy_"),
+		migrate.WithoutFileTransactions())
+	_, err := m.Migrate()
+	check(t, err)
+
+	// The application's own meta table doesn't collide with the history.
+	var names []string
+	err = db.Select(&names, `SELECT name FROM sqlite_master
+		WHERE type = 'table' AND name LIKE '%meta%' ORDER BY name`)
+	check(t, err)
+	want := "deploy_meta deploy_metacheckpoints deploy_metafailures " +
+		"deploy_metaobjects deploy_metaversion meta"
+	if got := strings.Join(names, " "); got != want {
+		t.Fatalf("expected tables %q, got %q", want, got)
+	}
+	m = newMigrate(t, db, dir, migrate.WithTablePrefix("deploy_"))
+	if len(m.Migrations) != 2 || len(m.Pending()) != 0 {
+		t.Fatalf("expected 2 applied migrations, got %+v", m.Migrations)
+	}
+
+	_, err = migrate.New(db, dir, migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithTablePrefix("deploy-"))
+	if err == nil ||
+		!strings.Contains(err.Error(), "invalid table prefix") {
+		t.Fatalf("expected invalid table prefix error, got %v", err)
+	}
+}
+
+func TestMigrateStreams(t *testing.T) {
+	authDir := writeFiles(t, map[string]string{
+		"1_init.sql": "CREATE TABLE users (id INTEGER);",
+	})
+	billingDir := writeFiles(t, map[string]string{
+		"1_init.sql":   "CREATE TABLE invoices (id INTEGER);",
+		"2_broken.sql": "ALTER TABLE nope ADD COLUMN total INTEGER;",
+	})
+	searchDir := writeFiles(t, map[string]string{
+		"1_init.sql": "CREATE TABLE documents (id INTEGER);",
+	})
+	db := newDB(t)
+
+	report, err := migrate.MigrateStreams(db, testLogger{t},
+		migrate.DBTypeSQLite, []migrate.Stream{
+			{Namespace: "auth", Dir: authDir},
+			{Namespace: "billing", Dir: billingDir},
+			{Namespace: "search", Dir: searchDir},
+		})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if len(report.Streams) != 2 {
+		t.Fatalf("expected to stop after billing, got %v", report)
+	}
+	billing := report.Streams[1]
+	if len(billing.Migrated) != 1 || len(billing.Pending) != 1 {
+		t.Fatalf("unexpected billing report %+v", billing)
+	}
+	if billing.Err == nil {
+		t.Fatal("expected billing error in report")
+	}
+}
+
+func TestRollout(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+	})
+	regions := []migrate.Region{
+		{Name: "us", DB: newDB(t)},
+		{Name: "eu", DB: newDB(t)},
+		{Name: "ap", DB: newDB(t)},
+	}
+
+	// Halt when eu is unhealthy.
+	healthy := map[string]bool{"us": true}
+	gate := func(r migrate.Region) error {
+		if !healthy[r.Name] {
+			return errors.New("unhealthy")
+		}
+		return nil
+	}
+	report, err := migrate.Rollout(testLogger{t}, migrate.DBTypeSQLite, dir,
+		regions, gate)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if report.Halted != "eu" || len(report.Regions) != 2 {
+		t.Fatalf("expected to halt at eu, got %v", report)
+	}
+
+	// Resuming migrates only the remaining region.
+	healthy["eu"] = true
+	report, err = migrate.Rollout(testLogger{t}, migrate.DBTypeSQLite, dir,
+		regions, gate)
+	check(t, err)
+	var migrated []string
+	for _, rr := range report.Regions {
+		migrated = append(migrated, rr.Migrated...)
+	}
+	if len(migrated) != 1 || report.Regions[2].Region != "ap" ||
+		len(report.Regions[2].Migrated) != 1 {
+		t.Fatalf("expected only ap to migrate, got %v", report)
+	}
+}
+
+func TestCanaryRollout(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+	})
+	canary := migrate.Region{Name: "canary", DB: newDB(t)}
+	target := newDB(t)
+	targets := []migrate.Region{{Name: "us", DB: target}}
+
+	gate := migrate.QueryGate(`SELECT COUNT(*) > 0 FROM users`)
+	report, err := migrate.CanaryRollout(testLogger{t},
+		migrate.DBTypeSQLite, dir, canary, gate, targets, nil)
+	if err == nil || report.Halted != "canary" {
+		t.Fatalf("expected to halt at canary, got %v: %v", report, err)
+	}
+	var n int
+	err = target.Get(&n, `SELECT COUNT(*) FROM sqlite_master WHERE name = 'users'`)
+	check(t, err)
+	if n != 0 {
+		t.Fatal("expected target to be untouched")
+	}
+
+	gate = migrate.QueryGate(`SELECT COUNT(*) = 0 FROM users`)
+	_, err = migrate.CanaryRollout(testLogger{t}, migrate.DBTypeSQLite, dir,
+		canary, gate, targets, nil)
+	check(t, err)
+}
+
+func TestWithAnnotations(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+	})
+	db := newDB(t)
+	m, err := migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithAnnotations(migrate.Annotations{
+			"deploy": "d-41",
+			"ticket": "OPS-7",
+		}),
+		migrate.WithAnnotations(migrate.Annotations{"deploy": "d-42"}))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+
+	// Annotations are read back from the history by later runs.
+	m = newMigrate(t, db, dir)
+	applied := m.Status().Applied
+	if len(applied) != 1 {
+		t.Fatalf("expected 1 applied migration, got %d", len(applied))
+	}
+	if a := applied[0].Annotations; len(a) != 2 || a["deploy"] != "d-42" ||
+		a["ticket"] != "OPS-7" {
+		t.Fatalf("unexpected annotations %v", a)
+	}
+}
+
+func TestWithEnvironment(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_orders.sql": "CREATE TABLE orders (id INTEGER);",
+		"2_fix_orders.sql":    "INSERT INTO missing VALUES (1);",
+		"3_add_index.sql":     "CREATE INDEX orders_id ON orders (id);",
+		".migrateskip": `# Production-only fixes
+			staging: 2_fix_orders.sql
+			prod: 3_add_index.sql`,
+	})
+	db := newDB(t)
+	m, err := migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithEnvironment("staging"))
+	check(t, err)
+	pending := m.Pending()
+	if len(pending) != 3 || pending[0].Skip || !pending[1].Skip ||
+		pending[2].Skip {
+		t.Fatalf("unexpected pending %+v", pending)
+	}
+	_, err = m.Migrate()
+	check(t, err)
+	if len(m.Migrations) != 3 || m.Migrations[1].Checksum == "" {
+		t.Fatalf("expected every migration recorded, got %+v",
+			m.Migrations)
+	}
+	var n int
+	err = db.Get(&n, `SELECT COUNT(*) FROM sqlite_master
+		WHERE name = 'orders_id'`)
+	check(t, err)
+	if n != 1 {
+		t.Fatal("expected migrations not listed for staging to run")
+	}
+
+	// The skip file doesn't affect checksums, so the history stays valid
+	// without an environment.
+	newMigrate(t, db, dir)
+
+	badDir := writeFiles(t, map[string]string{
+		"1_create_orders.sql": "CREATE TABLE orders (id INTEGER);",
+		".migrateskip":        "staging: 2_fix_ordres.sql",
+	})
+	_, err = migrate.New(db, badDir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithEnvironment("staging"))
+	if !errors.Is(err, migrate.ErrUnknownMigration) {
+		t.Fatalf("expected missing file error, got %v", err)
+	}
+}
+
+func TestMigratePhase(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_add_email.sql": "CREATE TABLE users (id INTEGER, name TEXT);",
+		"2_drop_name.sql": `-- migrate:phase post
+			ALTER TABLE users DROP COLUMN name;`,
+		"3_add_index.sql": "CREATE INDEX users_id ON users (id);",
+	})
+	db := newDB(t)
+	m := newMigrate(t, db, dir)
+
+	// Pre-deploy stops at the first post-deploy migration.
+	_, err := m.MigratePhase(migrate.PhasePre)
+	check(t, err)
+	pending := m.Pending()
+	if len(pending) != 2 || pending[0].Phase != migrate.PhasePost ||
+		pending[1].Phase != migrate.PhasePre {
+		t.Fatalf("unexpected pending %+v", pending)
+	}
+	migrated, err := m.MigratePhase(migrate.PhasePre)
+	check(t, err)
+	if migrated {
+		t.Fatal("expected pre-deploy to wait for post-deploy")
+	}
+
+	_, err = m.MigratePhase(migrate.PhasePost)
+	check(t, err)
+	if len(m.Pending()) != 0 {
+		t.Fatalf("expected nothing pending, got %+v", m.Pending())
+	}
+
+	badDir := writeFiles(t, map[string]string{
+		"1_add_email.sql": "-- migrate:phase later\nSELECT 1;",
+	})
+	_, err = migrate.New(db, badDir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite))
+	if err == nil || !strings.Contains(err.Error(), "unknown phase") {
+		t.Fatalf("expected unknown phase error, got %v", err)
+	}
+}
+
+func TestWithDevMode(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+		"2_create_posts.sql": "CREATE TABLE posts (id INTEGER);",
+	})
+	db := newDB(t)
+	m := newMigrate(t, db, dir)
+	_, err := m.Migrate()
+	check(t, err)
+
+	// Iterate on the newest migration.
+	check(t, os.WriteFile(filepath.Join(dir, "2_create_posts.sql"), []byte(`
+		CREATE TABLE posts (id INTEGER);
+		CREATE INDEX posts_id ON posts (id);
+		DROP TABLE scratch;`), 0o644))
+	_, err = migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite))
+	if !errors.Is(err, migrate.ErrChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+	m, err = migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite), migrate.WithDevMode())
+	check(t, err)
+	if len(m.Pending()) != 1 {
+		t.Fatalf("expected the changed migration to be pending, got %v",
+			m.Pending())
+	}
+	_, err = m.Migrate()
+	check(t, err)
+	if len(m.Migrations) != 2 || m.Migrations[1].Statements != 3 {
+		t.Fatalf("unexpected history %+v", m.Migrations)
+	}
+
+	// The new checksum is recorded, so dev mode is no longer needed.
+	newMigrate(t, db, dir)
+
+	// Only the newest migration can be reapplied.
+	check(t, os.WriteFile(filepath.Join(dir, "1_create_users.sql"),
+		[]byte("CREATE TABLE users (id INTEGER, name TEXT);"), 0o644))
+	_, err = migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite), migrate.WithDevMode())
+	if !errors.Is(err, migrate.ErrChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": `CREATE TABLE users (id INTEGER, email TEXT);
+			INSERT INTO users (id) VALUES (1), (2), (3), (4), (5), (6), (7);`,
+	})
+	db := newDB(t)
+	m := newMigrate(t, db, dir)
+	_, err := m.Migrate()
+	check(t, err)
+
+	var afters []string
+	fail := true
+	fn := func(after string, limit int) (string, error) {
+		afters = append(afters, after)
+		if after == "6" && fail {
+			return "", errors.New("connection reset")
+		}
+		var ids []int
+		err := db.Select(&ids, `SELECT id FROM users
+			WHERE id > CAST(? AS INTEGER) ORDER BY id LIMIT ?`,
+			after, limit)
+		if err != nil || len(ids) == 0 {
+			return "", err
+		}
+		last := strconv.Itoa(ids[len(ids)-1])
+		_, err = db.Exec(`UPDATE users SET email = id || '@example.com'
+			WHERE id > CAST(? AS INTEGER) AND id <= ?`, after, last)
+		return last, err
+	}
+	if _, err = m.Backfill("users_email", 3, fn); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// Resume after the last checkpointed batch.
+	fail = false
+	ran, err := m.Backfill("users_email", 3, fn)
+	check(t, err)
+	if !ran {
+		t.Fatal("expected backfill to run")
+	}
+	want := []string{"", "3", "6", "6", "7"}
+	if fmt.Sprint(afters) != fmt.Sprint(want) {
+		t.Fatalf("expected batches after %q, got %q", want, afters)
+	}
+	var n int
+	err = db.Get(&n, `SELECT COUNT(*) FROM users WHERE email IS NULL`)
+	check(t, err)
+	if n != 0 {
+		t.Fatalf("expected every row backfilled, got %d missing", n)
+	}
+
+	// Completed backfills are skipped.
+	ran, err = m.Backfill("users_email", 3, fn)
+	check(t, err)
+	if ran || len(afters) != len(want) {
+		t.Fatal("expected completed backfill to be skipped")
+	}
+}
+
+func TestPartitions(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+		"partitions/events.sql": `-- migrate:interval month
+			-- migrate:ahead 2
+			CREATE TABLE IF NOT EXISTS events_{{.Suffix}} (
+				id INTEGER,
+				at TEXT CHECK (at >= '{{.Start.Format "2006-01-02"}}'
+					AND at < '{{.End.Format "2006-01-02"}}')
+			);`,
+	})
+	db := newDB(t)
+	m := newMigrate(t, db, dir)
+	migrated, err := m.Migrate()
+	check(t, err)
+	if !migrated {
+		t.Fatal("expected migration")
+	}
+
+	var n int
+	err = db.Get(&n, `SELECT COUNT(*) FROM sqlite_master
+		WHERE type = 'table' AND name LIKE 'events_%'`)
+	check(t, err)
+	if n != 3 {
+		t.Fatalf("expected 3 partitions, got %d", n)
+	}
+	if len(m.Migrations) != 1 {
+		t.Fatalf("expected partitions outside the history, got %d migrations",
+			len(m.Migrations))
+	}
+
+	// Existing partitions aren't created again.
+	m = newMigrate(t, db, dir)
+	migrated, err = m.Migrate()
+	check(t, err)
+	if migrated {
+		t.Fatal("expected no migration")
+	}
+
+	badDir := writeFiles(t, map[string]string{
+		"1_create_users.sql":    "CREATE TABLE users (id INTEGER);",
+		"partitions/events.sql": "CREATE TABLE events_{{.Suffix}} (id INTEGER);",
+	})
+	_, err = migrate.New(db, badDir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite))
+	if err == nil || !strings.Contains(err.Error(), "missing interval") {
+		t.Fatalf("expected missing interval error, got %v", err)
+	}
+}
+
+func TestObjects(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": `
+			CREATE TABLE users (id INTEGER, active BOOLEAN);`,
+		"objects/active_users.sql": `
+			-- migrate:drop DROP VIEW IF EXISTS active_users
+			CREATE VIEW active_users AS SELECT id FROM users WHERE active;`,
+		"objects/active_count.sql": `
+			-- migrate:requires active_users.sql
+			-- migrate:drop DROP VIEW IF EXISTS active_count
+			CREATE VIEW active_count AS SELECT COUNT(*) AS n FROM active_users;`,
+	})
+	db := newDB(t)
+
+	m := newMigrate(t, db, dir)
+	pending, err := m.PendingObjects()
+	check(t, err)
+	if strings.Join(pending, ",") != "active_users.sql,active_count.sql" {
+		t.Fatalf("unexpected pending objects %v", pending)
+	}
+	_, err = m.Migrate()
+	check(t, err)
+
+	// Unchanged objects aren't recreated.
+	m = newMigrate(t, db, dir)
+	migrated, err := m.Migrate()
+	check(t, err)
+	if migrated {
+		t.Fatal("expected nothing to migrate")
+	}
+
+	// Changing an object recreates its dependents, too.
+	err = os.WriteFile(filepath.Join(dir, "objects", "active_users.sql"),
+		[]byte(`
+			-- migrate:drop DROP VIEW IF EXISTS active_users
+			CREATE VIEW active_users AS SELECT id FROM users;`), 0o644)
+	check(t, err)
+	m = newMigrate(t, db, dir)
+	pending, err = m.PendingObjects()
+	check(t, err)
+	if len(pending) != 2 {
+		t.Fatalf("expected dependents to be recreated, got %v", pending)
+	}
+	_, err = m.Migrate()
+	check(t, err)
+	_, err = db.Exec(`SELECT n FROM active_count`)
+	check(t, err)
+}
+
+func TestRepeatable(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": `
+			CREATE TABLE users (id INTEGER, active BOOLEAN);`,
+		"r_active_users.sql": `
+			-- migrate:drop DROP VIEW IF EXISTS active_users
+			CREATE VIEW active_users AS SELECT id FROM users WHERE active;`,
+		"repeatable/active_count.sql": `
+			-- migrate:requires r_active_users.sql
+			-- migrate:drop DROP VIEW IF EXISTS active_count
+			CREATE VIEW active_count AS SELECT COUNT(*) AS n FROM active_users;`,
+	})
+	db := newDB(t)
+
+	m := newMigrate(t, db, dir)
+	pending, err := m.PendingObjects()
+	check(t, err)
+	if strings.Join(pending, ",") != "r_active_users.sql,active_count.sql" {
+		t.Fatalf("unexpected pending objects %v", pending)
+	}
+	_, err = m.Migrate()
+	check(t, err)
+	_, err = db.Exec(`SELECT n FROM active_count`)
+	check(t, err)
+
+	// Unchanged objects aren't recreated.
+	m = newMigrate(t, db, dir)
+	pending, err = m.PendingObjects()
+	check(t, err)
+	if len(pending) != 0 {
+		t.Fatalf("expected nothing pending, got %v", pending)
+	}
+
+	// Names must be unique across directories.
+	dir = writeFiles(t, map[string]string{
+		"1_create_users.sql":        "CREATE TABLE users (id INTEGER);",
+		"objects/users_view.sql":    "CREATE VIEW v AS SELECT id FROM users;",
+		"repeatable/users_view.sql": "CREATE VIEW v AS SELECT id FROM users;",
+	})
+	_, err = migrate.New(db, dir, migrate.WithLogger(testLogger{t}))
+	if err == nil {
+		t.Fatal("expected duplicate object to fail")
+	}
+}
+
+func TestGoMigration(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": `
+			CREATE TABLE users (email TEXT);
+			INSERT INTO users (email) VALUES ('Ann@Example.com');`,
+		"3_unique_emails.sql": `
+			CREATE UNIQUE INDEX users_email ON users (email);`,
+	})
+	db := newDB(t)
+	lower := func(tx *sql.Tx) error {
+		_, err := tx.Exec(`UPDATE users SET email = ?`,
+			strings.ToLower("Ann@Example.com"))
+		return err
+	}
+	opts := []migrate.Option{
+		migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+	}
+
+	// A failed Go migration is rolled back and stops migrating.
+	fail := func(tx *sql.Tx) error {
+		if err := lower(tx); err != nil {
+			return err
+		}
+		return errors.New("oops")
+	}
+	m, err := migrate.New(db, dir, append(opts,
+		migrate.WithGoMigration("2_lower_emails", fail))...)
+	check(t, err)
+	_, err = m.Migrate()
+	var merr *migrate.MigrationError
+	if !errors.As(err, &merr) || merr.File != "2_lower_emails" {
+		t.Fatalf("expected go migration to fail, got %v", err)
+	}
+	var email string
+	check(t, db.QueryRow(`SELECT email FROM users`).Scan(&email))
+	if email != "Ann@Example.com" {
+		t.Fatalf("expected rollback, got %s", email)
+	}
+
+	m, err = migrate.New(db, dir, append(opts,
+		migrate.WithGoMigration("2_lower_emails", lower))...)
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+	var names []string
+	for _, mg := range m.Migrations {
+		names = append(names, mg.Filename)
+	}
+	if strings.Join(names, ",") != "1_create_users.sql,2_lower_emails,3_unique_emails.sql" {
+		t.Fatalf("unexpected migrations %v", names)
+	}
+	check(t, db.QueryRow(`SELECT email FROM users`).Scan(&email))
+	if email != "ann@example.com" {
+		t.Fatalf("expected go migration to run, got %s", email)
+	}
+
+	// The history requires the Go migration to still be registered.
+	_, err = migrate.New(db, dir, opts...)
+	if !errors.Is(err, migrate.ErrMissingMigration) {
+		t.Fatalf("expected missing migration, got %v", err)
+	}
+	_, err = migrate.New(db, dir, append(opts,
+		migrate.WithGoMigration("2_lower_emails", lower))...)
+	check(t, err)
+}
+
+func TestTemplateVars(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": `
+			CREATE TABLE {{.Prefix}}users (id INTEGER);
+			INSERT INTO {{.Prefix}}users (id) VALUES (1);`,
+		"objects/users_view.sql": `
+			-- migrate:drop DROP VIEW IF EXISTS {{.Prefix}}users_view
+			CREATE VIEW {{.Prefix}}users_view AS SELECT id FROM {{.Prefix}}users;`,
+	})
+	db := newDB(t)
+	newWithVars := func(vars map[string]string) (*migrate.Migrate, error) {
+		return migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+			migrate.WithDBType(migrate.DBTypeSQLite),
+			migrate.WithTemplateVars(vars))
+	}
+	m, err := newWithVars(map[string]string{"Prefix": "staging_"})
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+	var n int
+	check(t, db.QueryRow(`SELECT COUNT(*) FROM staging_users_view`).Scan(&n))
+	if n != 1 {
+		t.Fatalf("expected 1 user, got %d", n)
+	}
+	if c := m.Migrations[0].Content; !strings.Contains(c, "staging_users") {
+		t.Fatalf("expected rendered content, got %q", c)
+	}
+
+	// The checksum is of the rendered file, so it's stable for the same
+	// vars and changes with them.
+	_, err = newWithVars(map[string]string{"Prefix": "staging_"})
+	check(t, err)
+	_, err = newWithVars(map[string]string{"Prefix": "prod_"})
+	if !errors.Is(err, migrate.ErrChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+	_, err = newWithVars(map[string]string{})
+	if err == nil || !strings.Contains(err.Error(), "Prefix") {
+		t.Fatalf("expected missing var to fail, got %v", err)
+	}
+}
+
+func TestBlobDirective(t *testing.T) {
+	logo := []byte{0x89, 'P', 'N', 'G', 0x00, 0xff}
+	dir := writeFiles(t, map[string]string{
+		"1_create_images.sql": "CREATE TABLE images (name TEXT, data BLOB);",
+		"2_seed_logo.sql": `
+			-- migrate:blob assets/logo.png
+			INSERT INTO images (name, data) VALUES ('logo', ?);`,
+		"assets/logo.png": string(logo),
+	})
+	db := newDB(t)
+
+	m := newMigrate(t, db, dir)
+	_, err := m.Migrate()
+	check(t, err)
+
+	var data []byte
+	err = db.Get(&data, `SELECT data FROM images WHERE name='logo'`)
+	check(t, err)
+	if !bytes.Equal(data, logo) {
+		t.Fatalf("unexpected data %x", data)
+	}
+
+	// Changing the blob is detected like changing the migration.
+	err = os.WriteFile(filepath.Join(dir, "assets", "logo.png"),
+		[]byte("changed"), 0o644)
+	check(t, err)
+	_, err = migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite))
+	if !errors.Is(err, migrate.ErrChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+}
+
+func TestTerminatorDirective(t *testing.T) {
+	cmds, err := migrate.Statements([]byte(`CREATE TABLE users (email VARCHAR(255));
+--#SET TERMINATOR @
+CREATE TRIGGER default_email NO CASCADE BEFORE INSERT ON users
+REFERENCING NEW AS n FOR EACH ROW
+BEGIN ATOMIC
+	SET n.email = COALESCE(n.email, 'admin@example.com');
+END
+@
+--#SET TERMINATOR ;
+INSERT INTO users (email) VALUES (NULL);
+`))
+	check(t, err)
+	want := []string{
+		"CREATE TABLE users (email VARCHAR(255))",
+		`CREATE TRIGGER default_email NO CASCADE BEFORE INSERT ON users
+REFERENCING NEW AS n FOR EACH ROW
+BEGIN ATOMIC
+	SET n.email = COALESCE(n.email, 'admin@example.com');
+END`,
+		"INSERT INTO users (email) VALUES (NULL)",
+	}
+	if len(cmds) != len(want) {
+		t.Fatalf("expected %d statements, got %q", len(want), cmds)
+	}
+	for i := range want {
+		if cmds[i] != want[i] {
+			t.Fatalf("expected %q, got %q", want[i], cmds[i])
+		}
+	}
+}
+
+func TestDelimiterDirective(t *testing.T) {
+	cmds, err := migrate.StatementsFor(migrate.DBTypeMySQL, []byte(`CREATE TABLE counts (n INT);
+DELIMITER //
+CREATE TRIGGER reset_counts BEFORE INSERT ON counts
+FOR EACH ROW
+BEGIN
+	IF NEW.n < 0 THEN SET NEW.n = 0; END IF;
+END //
+delimiter ;
+INSERT INTO counts VALUES (1);
+`))
+	check(t, err)
+	want := []string{
+		"CREATE TABLE counts (n INT)",
+		`CREATE TRIGGER reset_counts BEFORE INSERT ON counts
+FOR EACH ROW
+BEGIN
+	IF NEW.n < 0 THEN SET NEW.n = 0; END IF;
+END`,
+		"INSERT INTO counts VALUES (1)",
+	}
+	if len(cmds) != len(want) {
+		t.Fatalf("expected %d statements, got %q", len(want), cmds)
+	}
+	for i := range want {
+		if cmds[i] != want[i] {
+			t.Fatalf("expected %q, got %q", want[i], cmds[i])
+		}
+	}
+
+	// DELIMITER is only a directive on MySQL and MariaDB.
+	cmds, err = migrate.StatementsFor(migrate.DBTypePostgres,
+		[]byte("DELIMITER //\nSELECT 1;"))
+	check(t, err)
+	if len(cmds) != 1 || cmds[0] != "DELIMITER //\nSELECT 1" {
+		t.Fatalf("unexpected statements %q", cmds)
+	}
+}
+
+func TestAppliedAt(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create.sql": "CREATE TABLE t (id INT);",
+	})
+	db := newDB(t)
+	m := newMigrate(t, db, dir)
+	before := time.Now().Add(-time.Second)
+	_, err := m.Migrate()
+	check(t, err)
+	after := time.Now().Add(time.Second)
+
+	// The time is read back from the meta table.
+	m = newMigrate(t, db, dir)
+	appliedAt := m.Migrations[0].AppliedAt
+	if appliedAt.Before(before) || appliedAt.After(after) {
+		t.Fatalf("expected applied between %s and %s, got %s", before,
+			after, appliedAt)
+	}
+}
+
+func TestSlogLogger(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create.sql": "CREATE TABLE t (id INT);",
+	})
+	var buf bytes.Buffer
+	log := slog.New(slog.NewJSONHandler(&buf,
+		&slog.HandlerOptions{Level: slog.LevelInfo}))
+	m, err := migrate.New(newDB(t), dir,
+		migrate.WithLogger(migrate.SlogLogger{Logger: log}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithNamespace("app"))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+
+	// Statements are logged at debug, so only the migrated file is kept.
+	var rec struct {
+		Level     string `json:"level"`
+		Msg       string `json:"msg"`
+		Namespace string `json:"namespace"`
+	}
+	check(t, json.Unmarshal(buf.Bytes(), &rec))
+	want := "migrated 1_create.sql"
+	if rec.Level != "INFO" || rec.Msg != want || rec.Namespace != "app" {
+		t.Fatalf("unexpected record %s", buf.String())
+	}
+
+	// Rollouts log each region through it too.
+	buf.Reset()
+	regions := []migrate.Region{{Name: "us", DB: newDB(t)}}
+	_, err = migrate.Rollout(migrate.SlogLogger{Logger: log},
+		migrate.DBTypeSQLite, dir, regions, nil)
+	check(t, err)
+	var region struct {
+		Level  string `json:"level"`
+		Msg    string `json:"msg"`
+		Region string `json:"region"`
+	}
+	line, _, _ := bytes.Cut(buf.Bytes(), []byte("\n"))
+	check(t, json.Unmarshal(line, &region))
+	if region.Level != "INFO" || region.Msg != "migrating region us" ||
+		region.Region != "us" {
+		t.Fatalf("unexpected record %s", buf.String())
+	}
+}
+
+func TestTracerProvider(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create.sql": "CREATE TABLE t (email TEXT);",
+		"2_seed.sql":   "INSERT INTO t VALUES ('a@b.c');\nINSERT INTO missing VALUES (1);",
+	})
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	m, err := migrate.New(newDB(t), dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithoutFileTransactions(),
+		migrate.WithTracerProvider(tp))
+	check(t, err)
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "startup")
+	_, err = m.MigrateContext(ctx)
+	parent.End()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	spans := sr.Ended()
+	names := make([]string, len(spans))
+	for i, span := range spans {
+		names[i] = span.Name()
+	}
+	want := []string{"1_create.sql", "2_seed.sql", "migrate", "startup"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("expected spans %q, got %q", want, names)
+	}
+	run, seed := spans[2], spans[1]
+	if run.Parent().SpanID() != spans[3].SpanContext().SpanID() {
+		t.Fatal("expected the run to be traced within the context's span")
+	}
+	if seed.Parent().SpanID() != run.SpanContext().SpanID() {
+		t.Fatal("expected files to be traced within the run")
+	}
+	if run.Status().Code != codes.Error || seed.Status().Code != codes.Error {
+		t.Fatal("expected the failure to be recorded")
+	}
+	events := seed.Events()
+	if len(events) < 1 || events[0].Name != "statement" {
+		t.Fatalf("expected a statement event, got %+v", events)
+	}
+	for _, attr := range events[0].Attributes {
+		got := attr.Value.AsString()
+		if attr.Key == "db.statement" && got != "INSERT INTO t VALUES (?)" {
+			t.Fatalf("expected sanitized sql, got %q", got)
+		}
+	}
+}
+
+func TestOverrideVariant(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql":        "CREATE TABLE users (id INTEGER);",
+		"sqlite/1_create_users.sql": "CREATE TABLE users (id INTEGER PRIMARY KEY);",
+	})
+	db := newDB(t)
+
+	m := newMigrate(t, db, dir)
+	_, err := m.Migrate()
+	check(t, err)
+	if m.Migrations[0].Variant != "sqlite" {
+		t.Fatalf("expected sqlite variant, got %q", m.Migrations[0].Variant)
+	}
+
+	// Removing the override is reported as such, not as an edit.
+	err = os.RemoveAll(filepath.Join(dir, "sqlite"))
+	check(t, err)
+	_, err = migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite))
+	if !errors.Is(err, migrate.ErrChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "migrated from the sqlite override, but now using the base file") {
+		t.Fatalf("expected variant in error, got %v", err)
+	}
+}
+
+func TestOverrideFallback(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql":        "CREATE TABLE users (id INTEGER);",
+		"2_create_teams.sql":        "CREATE TABLE teams (id INTEGER);",
+		"shared/1_create_users.sql": "CREATE TABLE users (id INTEGER PRIMARY KEY);",
+		"shared/2_create_teams.sql": "CREATE TABLE teams (id INTEGER PRIMARY KEY);",
+		"sqlite/2_create_teams.sql": "CREATE TABLE teams (id INTEGER PRIMARY KEY, name TEXT);",
+	})
+	db := newDB(t)
+
+	m, err := migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithOverrideFallback(migrate.DBTypeSQLite, "shared"))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+
+	// The DB's own override wins over the fallback.
+	if m.Migrations[0].Variant != "shared" {
+		t.Fatalf("expected shared variant, got %q", m.Migrations[0].Variant)
+	}
+	if m.Migrations[1].Variant != "sqlite" {
+		t.Fatalf("expected sqlite variant, got %q", m.Migrations[1].Variant)
+	}
+}
+
+func TestYugabyteOverrides(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql":          "CREATE TABLE users (id INTEGER);",
+		"2_create_teams.sql":          "CREATE TABLE teams (id INTEGER);",
+		"postgres/1_create_users.sql": "CREATE TABLE users (id INTEGER PRIMARY KEY);",
+		"postgres/2_create_teams.sql": "CREATE TABLE teams (id INTEGER PRIMARY KEY);",
+		"yugabyte/2_create_teams.sql": "CREATE TABLE teams (id INTEGER, PRIMARY KEY (id));",
+	})
+	db := newDB(t)
+
+	m, err := migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeYugabyte))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+
+	// Yugabyte uses the postgres overrides unless it has its own.
+	if m.Migrations[0].Variant != "postgres" {
+		t.Fatalf("expected postgres variant, got %q", m.Migrations[0].Variant)
+	}
+	if m.Migrations[1].Variant != "yugabyte" {
+		t.Fatalf("expected yugabyte variant, got %q", m.Migrations[1].Variant)
+	}
+}
+
+func TestWithExtensions(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql":        "CREATE TABLE users (id INTEGER);",
+		"sqlite/1_create_users.sql": "CREATE TABLE users (id INTEGER PRIMARY KEY);",
+		"2_create_teams.ddl":        "CREATE TABLE teams (id INTEGER);",
+		"sqlite/2_create_teams.ddl": "CREATE TABLE teams (id INTEGER PRIMARY KEY);",
+		"2_notes.txt":               "not a migration",
+	})
+	db := newDB(t)
+
+	// Only .sql files are migrations by default.
+	m, err := migrate.Load(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite))
+	check(t, err)
+	if len(m.Files) != 1 {
+		t.Fatalf("expected 1 file, got %d", len(m.Files))
+	}
+
+	m, err = migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithExtensions(".sql", "ddl"))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+	if len(m.Migrations) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(m.Migrations))
+	}
+	if m.Migrations[1].Variant != "sqlite" {
+		t.Fatalf("expected sqlite variant, got %q", m.Migrations[1].Variant)
+	}
+
+	conflicts, err := migrate.Conflicts(dir, ".sql", ".ddl", ".txt")
+	check(t, err)
+	if len(conflicts) != 1 || conflicts[0].Number != 2 {
+		t.Fatalf("unexpected conflicts %v", conflicts)
+	}
+}
+
+func TestMigrateIgnore(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		".migrateignore":            "# scratch work\n*_scratch.sql\nsqlite/\n",
+		"1_create_users.sql":        "CREATE TABLE users (id INTEGER);",
+		"2_create_teams.sql":        "CREATE TABLE teams (id INTEGER);",
+		"2_scratch.sql":             "not sql",
+		"sqlite/1_create_users.sql": "not sql",
+	})
+	db := newDB(t)
+
+	m := newMigrate(t, db, dir)
+	_, err := m.Migrate()
+	check(t, err)
+	if len(m.Migrations) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(m.Migrations))
+	}
+	if m.Migrations[0].Variant != "" {
+		t.Fatalf("expected base file, got %q", m.Migrations[0].Variant)
+	}
+	conflicts, err := migrate.Conflicts(dir)
+	check(t, err)
+	if len(conflicts) != 0 {
+		t.Fatalf("unexpected conflicts %v", conflicts)
+	}
+}
+
+func TestVerifyOverrides(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql":        "CREATE TABLE users (id INTEGER);",
+		"sqlite/2_create_teams.sql": "CREATE TABLE teams (id INTEGER);",
+	})
+	db := newDB(t)
+
+	// An override without a migration is only a warning.
+	newMigrate(t, db, dir)
+
+	err := os.WriteFile(filepath.Join(dir, "sqlite", "1_create_user.sql"),
+		[]byte("CREATE TABLE users (id INTEGER PRIMARY KEY);"), 0o644)
+	check(t, err)
+	_, err = migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite))
+	if !errors.Is(err, migrate.ErrOverrideMismatch) {
+		t.Fatalf("expected override mismatch, got %v", err)
+	}
+}
+
+func TestBatchSize(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_seed.sql": `CREATE TABLE users (id INTEGER PRIMARY KEY);
+INSERT INTO users (id) VALUES (1);
+INSERT INTO users (id) VALUES (1);`,
+	})
+	db := newDB(t)
+
+	// The failed batch is rolled back as a whole.
+	m, err := migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithBatchSize(10))
+	check(t, err)
+	_, err = m.Migrate()
+	var migErr *migrate.MigrationError
+	if !errors.As(err, &migErr) || migErr.Index != 0 {
+		t.Fatalf("expected migration error at index 0, got %v", err)
+	}
+	var n int
+	err = db.Get(&n, `SELECT COUNT(*) FROM sqlite_master WHERE name='users'`)
+	check(t, err)
+	if n != 0 {
+		t.Fatal("expected failed batch to be rolled back")
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "1_seed.sql"), []byte(`CREATE TABLE users (id INTEGER PRIMARY KEY);
+INSERT INTO users (id) VALUES (1);
+INSERT INTO users (id) VALUES (2);
+INSERT INTO users (id) VALUES (3);`), 0o644)
+	check(t, err)
+	m, err = migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithBatchSize(3))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+	err = db.Get(&n, `SELECT COUNT(*) FROM users`)
+	check(t, err)
+	if n != 3 {
+		t.Fatalf("expected 3 users, got %d", n)
+	}
+}
+
+func TestCockroachSchemaChanges(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_seed.sql": `CREATE TABLE users (id INTEGER PRIMARY KEY);
+INSERT INTO users (id) VALUES (1);
+INSERT INTO users (id) VALUES (1);`,
+	})
+	db := newDB(t)
+
+	// The schema change is executed and checkpointed before the batch.
+	m, err := migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeCockroach),
+		migrate.WithBatchSize(10))
+	check(t, err)
+	_, err = m.Migrate()
+	var migErr *migrate.MigrationError
+	if !errors.As(err, &migErr) || migErr.Index != 1 {
+		t.Fatalf("expected migration error at index 1, got %v", err)
+	}
+	checkpoints, err := db.GetMetaCheckpoints("", "1_seed.sql")
+	check(t, err)
+	if len(checkpoints) != 1 {
+		t.Fatalf("expected 1 checkpoint, got %d", len(checkpoints))
+	}
+
+	// Atomic groups can't contain schema changes.
+	dir = writeFiles(t, map[string]string{
+		"1_create.sql": `-- migrate:atomic begin
+CREATE TABLE users (id INTEGER PRIMARY KEY);
+INSERT INTO users (id) VALUES (1);
+-- migrate:atomic end`,
+	})
+	m, err = migrate.New(newDB(t), dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeCockroach))
+	check(t, err)
+	_, err = m.Migrate()
+	if err == nil || !strings.Contains(err.Error(), "schema changes") {
+		t.Fatalf("expected schema change error, got %v", err)
+	}
+}
+
+func TestAtomicWithoutTransactions(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create.sql": `CREATE TABLE events (at DateTime) ENGINE = Log;
+-- migrate:atomic begin
+INSERT INTO events VALUES (now());
+-- migrate:atomic end`,
+	})
+	_, err := migrate.New(newDB(t), dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeClickHouse))
+	if err == nil || !strings.Contains(err.Error(), "no transactions") {
+		t.Fatalf("expected error for atomic group, got %v", err)
+	}
+}
+
+// warnDB raises a truncation warning for every statement.
+type warnDB struct{ *sqlite.DB }
+
+func (db warnDB) ExecWarnings(
+	query string,
+	args ...interface{},
+) (sql.Result, []migrate.Warning, error) {
+	res, err := db.Exec(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, []migrate.Warning{{
+		Level:      "Warning",
+		Code:       "1265",
+		Message:    "Data truncated",
+		Truncation: true,
+	}}, nil
+}
+
+func TestFailOnTruncation(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+	})
+	db := warnDB{newDB(t)}
+
+	// Warnings alone are only logged.
+	m, err := migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithoutFileTransactions(),
+		migrate.WithWarnings())
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+
+	err = os.WriteFile(filepath.Join(dir, "2_create_teams.sql"),
+		[]byte("CREATE TABLE teams (id INTEGER);"), 0o644)
+	check(t, err)
+	m, err = migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithoutFileTransactions(),
+		migrate.WithFailOnTruncation())
+	check(t, err)
+	_, err = m.Migrate()
+	if !errors.Is(err, migrate.ErrTruncation) {
+		t.Fatalf("expected truncation, got %v", err)
+	}
+}
+
+func TestRowsAffected(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": `CREATE TABLE users (id INTEGER);
+INSERT INTO users (id) VALUES (1), (2), (3);
+UPDATE users SET id = id + 1 WHERE id > 1;
+DELETE FROM users WHERE id > 100;`,
+	})
+	db := newDB(t)
+
+	m := newMigrate(t, db, dir, migrate.WithoutFileTransactions())
+	_, err := m.Migrate()
+	check(t, err)
+	if n := m.Migrations[0].RowsAffected; n != 5 {
+		t.Fatalf("expected 5 rows affected, got %d", n)
+	}
+}
+
+func TestStats(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);\nCREATE TABLE teams (id INTEGER);",
+		"2_bad.sql":          "INSERT INTO users (id) VALUES (1);\nCREAT TABLE x (id INTEGER);",
+	})
+	db := newDB(t)
+
+	m := newMigrate(t, db, dir, migrate.WithoutFileTransactions())
+	if _, err := m.Migrate(); err == nil {
+		t.Fatal("expected error")
+	}
+	m, err := migrate.Inspect(db, dir,
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithoutFileTransactions())
+	check(t, err)
+	stats := m.Status().Stats
+	if stats.Applied != 1 || stats.Statements != 2 {
+		t.Fatalf("expected 1 applied with 2 statements, got %+v", stats)
+	}
+	if stats.Duration <= 0 || stats.AvgStatement != stats.Duration/2 {
+		t.Fatalf("unexpected durations %+v", stats)
+	}
+	f := stats.LastFailure
+	if f == nil || f.Filename != "2_bad.sql" || f.Index != 1 || f.Error == "" {
+		t.Fatalf("unexpected last failure %+v", f)
+	}
+}
+
+func TestVerifySnapshot(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+	})
+	db := newDB(t)
+
+	m := newMigrate(t, db, dir)
+	_, err := m.Migrate()
+	check(t, err)
+	byt, err := json.Marshal(m.Snapshot())
+	check(t, err)
+	var snap migrate.Snapshot
+	check(t, json.Unmarshal(byt, &snap))
+
+	// New migrations are allowed after those applied.
+	path := filepath.Join(dir, "2_create_teams.sql")
+	check(t, os.WriteFile(path, []byte("CREATE TABLE teams (id INTEGER);"), 0o644))
+	err = migrate.VerifySnapshot(testLogger{t}, migrate.DBTypeSQLite, dir, snap)
+	check(t, err)
+
+	path = filepath.Join(dir, "1_create_users.sql")
+	check(t, os.WriteFile(path, []byte("CREATE TABLE users (id TEXT);"), 0o644))
+	err = migrate.VerifySnapshot(testLogger{t}, migrate.DBTypeSQLite, dir, snap)
+	if !errors.Is(err, migrate.ErrChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+}
+
+func TestChangeReport(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER, legacy TEXT);",
+		"2_cleanup.sql": `CREATE INDEX users_id ON users (id);
+ALTER TABLE users DROP COLUMN legacy;`,
+	})
+	db := newDB(t)
+
+	m := newMigrate(t, db, dir)
+	report, err := m.ChangeReport()
+	check(t, err)
+	if len(report.Migrations) != 2 || len(report.Changes) != 3 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if len(report.Tables) != 1 || report.Tables[0] != "users" {
+		t.Fatalf("unexpected tables %v", report.Tables)
+	}
+	destructive := report.Destructive()
+	if len(destructive) != 1 || destructive[0].Filename != "2_cleanup.sql" {
+		t.Fatalf("unexpected destructive changes %+v", destructive)
+	}
+	md := report.Markdown()
+	if !strings.Contains(md, "## 2_cleanup.sql\n\n- CREATE INDEX `users_id` on `users`\n") {
+		t.Fatalf("unexpected markdown:\n%s", md)
+	}
+
+	// Applied migrations can be named.
+	_, err = m.Migrate()
+	check(t, err)
+	report, err = m.ChangeReport("1_create_users.sql")
+	check(t, err)
+	if len(report.Changes) != 1 || report.Changes[0].Destructive {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
+
+func TestValidator(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);\nCREAT TABLE teams (id INTEGER);",
+	})
+
+	// Only statements beginning with CREATE are valid here.
+	v := func(stmt string) error {
+		if !strings.HasPrefix(stmt, "CREATE ") {
+			return errors.New("syntax error")
+		}
+		return nil
+	}
+	m, err := migrate.Load(nil, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithValidator(v))
+	check(t, err)
+	if err = m.Verify(); !errors.Is(err, migrate.ErrInvalidStatement) {
+		t.Fatalf("expected invalid statement, got %v", err)
+	}
+}
+
+func TestWithTrackingStore(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+	})
+	db := newDB(t)
+	tracker := newDB(t)
+
+	m, err := migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithTrackingStore(tracker))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+
+	var n int
+	err = db.Get(&n, `SELECT COUNT(*) FROM sqlite_master WHERE name IN ('users', 'meta')`)
+	check(t, err)
+	if n != 1 {
+		t.Fatalf("expected only users in the migrated db, got %d tables", n)
+	}
+	ms, err := tracker.GetMigrations("")
+	check(t, err)
+	if len(ms) != 1 {
+		t.Fatalf("expected 1 tracked migration, got %d", len(ms))
+	}
+}
+
+// flakyDB fails inserts into users with errProxy until fails reaches zero,
+// like a proxy dropping connections.
+type flakyDB struct {
+	*sqlite.DB
+	fails *int
+}
+
+var errProxy = errors.New("server conn crashed")
+
+func (db flakyDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.ExecContext(context.Background(), query, args...)
+}
+
+func (db flakyDB) ExecContext(
+	ctx context.Context,
+	query string,
+	args ...interface{},
+) (sql.Result, error) {
+	if strings.HasPrefix(query, "INSERT INTO users") && *db.fails > 0 {
+		*db.fails--
+		return nil, errProxy
+	}
+	return db.DB.ExecContext(ctx, query, args...)
+}
+
+func (flakyDB) Retryable(err error) bool { return errors.Is(err, errProxy) }
+
+func TestWithRetries(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": `CREATE TABLE users (id INTEGER);
+			INSERT INTO users VALUES (1);`,
+	})
+	fails := 2
+	db := flakyDB{newDB(t), &fails}
+
+	// Without retries, the first failure stops the migration.
+	m, err := migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithoutFileTransactions())
+	check(t, err)
+	_, err = m.Migrate()
+	if !errors.Is(err, errProxy) {
+		t.Fatalf("expected proxy error, got %v", err)
+	}
+
+	fails = 2
+	m, err = migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithoutFileTransactions(),
+		migrate.WithRetries(2))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+	if fails != 0 || len(m.Migrations) != 1 {
+		t.Fatalf("expected retries to succeed, got %d fails left", fails)
+	}
+}
+
+func TestFileTimeout(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": `-- migrate:timeout 1ns
+			CREATE TABLE users (id INTEGER);
+			INSERT INTO users VALUES (1);
+			INSERT INTO users VALUES (2);`,
+	})
+	db := newDB(t)
+
+	// Each run executes one statement before the timeout stops it, then
+	// the next resumes from its checkpoint.
+	for i := 1; i < 3; i++ {
+		m := newMigrate(t, db, dir, migrate.WithoutFileTransactions())
+		_, err := m.Migrate()
+		if !errors.Is(err, migrate.ErrFileTimeout) {
+			t.Fatalf("run %d: expected timeout, got %v", i, err)
+		}
+	}
+	m := newMigrate(t, db, dir, migrate.WithoutFileTransactions())
+	_, err := m.Migrate()
+	check(t, err)
+	var n int
+	check(t, db.Get(&n, `SELECT COUNT(*) FROM users`))
+	if n != 2 {
+		t.Fatalf("expected 2 users, got %d", n)
+	}
+
+	dir = writeFiles(t, map[string]string{
+		"1_create_users.sql": "-- migrate:timeout soon\nSELECT 1;",
+	})
+	_, err = migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithoutFileTransactions())
+	if err == nil || !strings.Contains(err.Error(), "invalid timeout") {
+		t.Fatalf("expected invalid timeout, got %v", err)
+	}
+}
+
+func TestWithInterrupt(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": `CREATE TABLE users (id INTEGER);
+			INSERT INTO users VALUES (1);`,
+		"2_add_name.sql": "ALTER TABLE users ADD COLUMN name TEXT;",
+	})
+	db := newDB(t)
+
+	// Interrupt while the first statement executes, like a signal
+	// arriving mid-run.
+	done := make(chan struct{})
+	m, err := migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithoutFileTransactions(),
+		migrate.WithInterrupt(done),
+		migrate.WithEvents(func(e migrate.Event) {
+			if _, ok := e.(migrate.StatementExecuted); ok {
+				close(done)
+			}
+		}))
+	check(t, err)
+	_, err = m.Migrate()
+	if !errors.Is(err, migrate.ErrInterrupted) {
+		t.Fatalf("expected interrupted, got %v", err)
+	}
+	if len(m.Migrations) != 0 {
+		t.Fatalf("expected nothing migrated, got %d", len(m.Migrations))
+	}
+
+	// The next run resumes after the checkpointed statement.
+	m = newMigrate(t, db, dir, migrate.WithoutFileTransactions())
+	_, err = m.Migrate()
+	check(t, err)
+	var n int
+	check(t, db.Get(&n, `SELECT COUNT(*) FROM users`))
+	if n != 1 || len(m.Migrations) != 2 {
+		t.Fatalf("expected 1 user and 2 migrations, got %d and %d", n,
+			len(m.Migrations))
+	}
+}
+
+func TestMigrateContext(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+	})
+	db := newDB(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	m := newMigrate(t, db, dir)
+	_, err := m.MigrateContext(ctx)
+	if !errors.Is(err, migrate.ErrInterrupted) ||
+		!errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if len(m.Migrations) != 0 {
+		t.Fatalf("expected nothing migrated, got %d", len(m.Migrations))
+	}
+
+	// The deadline only applied to that run.
+	_, err = m.Migrate()
+	check(t, err)
+	if len(m.Migrations) != 1 {
+		t.Fatalf("expected 1 migration, got %d", len(m.Migrations))
+	}
+}
+
+func TestSubNumbers(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"42_create_users.sql": "CREATE TABLE users (id INTEGER);",
+		"43_create_posts.sql": "CREATE TABLE posts (id INTEGER);",
+		"42.1_add_name.sql":   "ALTER TABLE users ADD COLUMN name TEXT;",
+		"42.10_add_email.sql": "ALTER TABLE users ADD COLUMN email TEXT;",
+		"42.2_add_age.sql":    "ALTER TABLE users ADD COLUMN age INTEGER;",
+	})
+	db := newDB(t)
+	m := newMigrate(t, db, dir)
+	_, err := m.Migrate()
+	check(t, err)
+	want := []string{
+		"42_create_users.sql", "42.1_add_name.sql", "42.2_add_age.sql",
+		"42.10_add_email.sql", "43_create_posts.sql",
+	}
+	if len(m.Migrations) != len(want) {
+		t.Fatalf("expected %d migrations, got %d", len(want),
+			len(m.Migrations))
+	}
+	for i, mg := range m.Migrations {
+		if mg.Filename != want[i] {
+			t.Fatalf("expected %s at %d, got %s", want[i], i, mg.Filename)
+		}
+	}
+
+	// History reloads in the same order.
+	m = newMigrate(t, db, dir)
+	_, err = m.Migrate()
+	check(t, err)
+
+	// A hotfix slotted in after later migrations ran is out of order.
+	err = os.WriteFile(filepath.Join(dir, "42.3_fix.sql"),
+		[]byte("SELECT 1;"), 0o644)
+	check(t, err)
+	_, err = migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite))
+	if !errors.Is(err, migrate.ErrOutOfOrder) {
+		t.Fatalf("expected out of order, got %v", err)
+	}
+}
+
+func TestSubNumberDuplicate(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"42_create_users.sql": "CREATE TABLE users (id INTEGER);",
+		"42.0_add_name.sql":   "ALTER TABLE users ADD COLUMN name TEXT;",
+	})
+	_, err := migrate.New(newDB(t), dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite))
+	if !errors.Is(err, migrate.ErrDuplicateNumber) {
+		t.Fatalf("expected duplicate number, got %v", err)
+	}
+}
+
+func TestAtomicDirective(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": `CREATE TABLE users (id INTEGER UNIQUE);
+			-- migrate:atomic begin
+			INSERT INTO users VALUES (1);
+			INSERT INTO users VALUES (1);
+			-- migrate:atomic end`,
+	})
+	db := newDB(t)
+	m := newMigrate(t, db, dir, migrate.WithoutFileTransactions())
+	_, err := m.Migrate()
+	var merr *migrate.MigrationError
+	if !errors.As(err, &merr) || merr.Index != 1 {
+		t.Fatalf("expected failure at the group's start, got %v", err)
+	}
+
+	// The table was created, but the group was rolled back.
+	var n int
+	check(t, db.Get(&n, `SELECT COUNT(*) FROM users`))
+	if n != 0 {
+		t.Fatalf("expected no users, got %d", n)
+	}
+
+	// Fixing the group executes it again from its start.
+	path := filepath.Join(dir, "1_create_users.sql")
+	err = os.WriteFile(path, []byte(`CREATE TABLE users (id INTEGER UNIQUE);
+			-- migrate:atomic begin
+			INSERT INTO users VALUES (1);
+			INSERT INTO users VALUES (2);
+			-- migrate:atomic end`), 0o644)
+	check(t, err)
+	m = newMigrate(t, db, dir, migrate.WithoutFileTransactions())
+	_, err = m.Migrate()
+	check(t, err)
+	check(t, db.Get(&n, `SELECT COUNT(*) FROM users`))
+	if n != 2 || len(m.Migrations) != 1 {
+		t.Fatalf("expected 2 users and 1 migration, got %d and %d", n,
+			len(m.Migrations))
+	}
+}
+
+func TestFileTransactions(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": `CREATE TABLE users (id INTEGER);
+			INSERT INTO users VALUES (1);
+			INSERT INTO missing VALUES (1);`,
+		"2_create_posts.sql": `-- migrate:no-transaction
+			CREATE TABLE posts (id INTEGER);
+			INSERT INTO missing VALUES (1);`,
+	})
+	db := newDB(t)
+	newTx := func(opts ...migrate.Option) *migrate.Migrate {
+		m, err := migrate.New(db, dir, append([]migrate.Option{
+			migrate.WithLogger(testLogger{t}),
+			migrate.WithDBType(migrate.DBTypeSQLite),
+		}, opts...)...)
+		check(t, err)
+		return m
+	}
+
+	// By default, the failed file is rolled back whole, without
+	// checkpoints.
+	_, err := newTx().Migrate()
+	var merr *migrate.MigrationError
+	if !errors.As(err, &merr) || merr.File != "1_create_users.sql" {
+		t.Fatalf("expected 1_create_users.sql to fail, got %v", err)
+	}
+	var n int
+	check(t, db.Get(&n, `SELECT COUNT(*) FROM sqlite_master
+		WHERE name = 'users'`))
+	if n != 0 {
+		t.Fatal("expected users to be rolled back")
+	}
+	check(t, db.Get(&n, `SELECT COUNT(*) FROM metacheckpoints`))
+	if n != 0 {
+		t.Fatalf("expected no checkpoints, got %d", n)
+	}
+
+	// Files with a no-transaction directive run statement by statement.
+	err = os.WriteFile(filepath.Join(dir, "1_create_users.sql"),
+		[]byte("CREATE TABLE users (id INTEGER);"), 0o644)
+	check(t, err)
+	_, err = newTx().Migrate()
+	if !errors.As(err, &merr) || merr.File != "2_create_posts.sql" {
+		t.Fatalf("expected 2_create_posts.sql to fail, got %v", err)
+	}
+	check(t, db.Get(&n, `SELECT COUNT(*) FROM sqlite_master
+		WHERE name = 'posts'`))
+	if n != 1 {
+		t.Fatal("expected posts to remain")
+	}
+
+	// WithoutFileTransactions runs every file statement by statement.
+	db = newDB(t)
+	err = os.WriteFile(filepath.Join(dir, "1_create_users.sql"),
+		[]byte("CREATE TABLE users (id INTEGER);\nINSERT INTO missing VALUES (1);"),
+		0o644)
+	check(t, err)
+	_, err = newTx(migrate.WithoutFileTransactions()).Migrate()
+	if !errors.As(err, &merr) || merr.File != "1_create_users.sql" {
+		t.Fatalf("expected 1_create_users.sql to fail, got %v", err)
+	}
+	check(t, db.Get(&n, `SELECT COUNT(*) FROM metacheckpoints`))
+	if n != 1 {
+		t.Fatalf("expected 1 checkpoint, got %d", n)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+		"2_seed_users.sql": `INSERT INTO users VALUES (1);
+			INSERT INTO missing VALUES (1);`,
+	})
+	db := newDB(t)
+
+	// Without history, every statement is planned.
+	m, err := migrate.Load(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithoutFileTransactions())
+	check(t, err)
+	planned, err := m.DryRun()
+	check(t, err)
+	if len(planned) != 3 || planned[2].Filename != "2_seed_users.sql" ||
+		planned[2].Index != 1 {
+		t.Fatalf("unexpected plan %+v", planned)
+	}
+
+	// Checkpointed statements are left out, and nothing is executed.
+	m = newMigrate(t, db, dir, migrate.WithoutFileTransactions())
+	if _, err = m.Migrate(); err == nil {
+		t.Fatal("expected 2_seed_users.sql to fail")
+	}
+	m, err = migrate.Inspect(db, dir,
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithoutFileTransactions())
+	check(t, err)
+	planned, err = m.DryRun()
+	check(t, err)
+	want := []migrate.PlannedStatement{{
+		Filename: "2_seed_users.sql",
+		Index:    1,
+		SQL:      "INSERT INTO missing VALUES (1)",
+	}}
+	if !reflect.DeepEqual(planned, want) {
+		t.Fatalf("expected %+v, got %+v", want, planned)
+	}
+	var n int
+	check(t, db.Get(&n, `SELECT COUNT(*) FROM users`))
+	if n != 1 {
+		t.Fatalf("expected 1 user, got %d", n)
+	}
+}
+
+func TestValidateDir(t *testing.T) {
+	valid := fstest.MapFS{
+		"1_create_users.sql": {Data: []byte("CREATE TABLE users (id INTEGER);")},
+		"2_add_name.sql":     {Data: []byte("ALTER TABLE users ADD COLUMN name TEXT;")},
+		"README.md":          {Data: []byte("docs")},
+	}
+	check(t, migrate.ValidateDir(valid, migrate.DBTypeSQLite))
+
+	tcs := map[string]struct {
+		fsys fstest.MapFS
+		want error
+	}{
+		"duplicate": {
+			fsys: fstest.MapFS{
+				"1_create_users.sql": {Data: []byte("SELECT 1;")},
+				"1_create_posts.sql": {Data: []byte("SELECT 1;")},
+			},
+			want: migrate.ErrDuplicateNumber,
+		},
+		"empty": {
+			fsys: fstest.MapFS{
+				"1_create_users.sql": {Data: []byte("-- nothing yet")},
+			},
+			want: migrate.ErrNoStatements,
+		},
+		"override mismatch": {
+			fsys: fstest.MapFS{
+				"1_create_users.sql":        {Data: []byte("SELECT 1;")},
+				"sqlite/1_create_posts.sql": {Data: []byte("SELECT 1;")},
+			},
+			want: migrate.ErrOverrideMismatch,
+		},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			err := migrate.ValidateDir(tc.fsys, migrate.DBTypeSQLite)
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, err)
+			}
+		})
+	}
+
+	unparsable := fstest.MapFS{
+		"1_create_users.sql": {Data: []byte("-- migrate:atomic begin\nSELECT 1;")},
+	}
+	if err := migrate.ValidateDir(unparsable, migrate.DBTypeSQLite); err == nil {
+		t.Fatal("expected parse error")
+	}
+}
+
+func TestWithFiles(t *testing.T) {
+	db := newDB(t)
+	files := map[string]string{
+		"1_create_users.sql":       "CREATE TABLE users (id INTEGER);",
+		"2_add_name.sql":           "ALTER TABLE users ADD COLUMN name TEXT;",
+		"sqlite/2_add_name.sql":    "ALTER TABLE users ADD COLUMN nickname TEXT;",
+		"objects/active_users.sql": "CREATE VIEW active_users AS SELECT id FROM users;",
+		"3_insert_users.sql":       "INSERT INTO users (id) VALUES (1);",
+	}
+	m, err := migrate.New(db, "", migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithFiles(files))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+	if len(m.Migrations) != 3 {
+		t.Fatalf("expected 3 migrations, got %d", len(m.Migrations))
+	}
+	if m.Migrations[1].Variant != string(migrate.DBTypeSQLite) {
+		t.Fatalf("expected the sqlite override, got %q",
+			m.Migrations[1].Variant)
+	}
+	var n int
+	check(t, db.Get(&n, `SELECT COUNT(*) FROM active_users`))
+	if n != 1 {
+		t.Fatalf("expected 1 active user, got %d", n)
+	}
+
+	// The history is verified against the same files.
+	m, err = migrate.New(db, "", migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithFiles(files))
+	check(t, err)
+	if st := m.Status(); len(st.Pending) != 0 {
+		t.Fatalf("expected nothing pending, got %+v", st.Pending)
+	}
+}
+
+func TestNewFS(t *testing.T) {
+	db := newDB(t)
+	embedded := fstest.MapFS{
+		"migrations/1_create_users.sql": {
+			Data: []byte("CREATE TABLE users (id INTEGER);"),
+		},
+		"migrations/2_copy_users.sql": {
+			Data: []byte("INSERT INTO users (id) VALUES (1);"),
+		},
+	}
+	sub, err := fs.Sub(embedded, "migrations")
+	check(t, err)
+	m, err := migrate.NewFS(db, sub, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+	if len(m.Migrations) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(m.Migrations))
+	}
+
+	// Checksums are verified through the same filesystem.
+	embedded["migrations/1_create_users.sql"].Data = []byte(
+		"CREATE TABLE users (id INTEGER, name TEXT);")
+	_, err = migrate.NewFS(db, sub, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite))
+	if !errors.Is(err, migrate.ErrChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	content := "CREATE TABLE users (id INTEGER);"
+	dir := writeFiles(t, map[string]string{"1_create_users.sql": content})
+	m := newMigrate(t, newDB(t), dir)
+	_, err := m.Migrate()
+	check(t, err)
+
+	checksum, err := migrate.Checksum(strings.NewReader(content))
+	check(t, err)
+	if checksum != m.Migrations[0].Checksum {
+		t.Fatalf("expected %s, got %s", m.Migrations[0].Checksum, checksum)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql":      "CREATE TABLE users (id INTEGER);",
+		"1_create_users.down.sql": "DROP TABLE users;",
+		"2_create_posts.sql":      "CREATE TABLE posts (id INTEGER);",
+		"2_create_posts.down.sql": "DROP TABLE posts;",
+		"3_add_title.sql":         "ALTER TABLE posts ADD COLUMN title TEXT;",
+	})
+	db := newDB(t)
+	m := newMigrate(t, db, dir)
+	_, err := m.Migrate()
+	check(t, err)
+	if len(m.Migrations) != 3 {
+		t.Fatalf("expected 3 migrations, got %d", len(m.Migrations))
+	}
+
+	// Nothing rolls back unless every down file exists.
+	if err = m.Rollback(2); err == nil {
+		t.Fatal("expected error for a missing down file")
+	}
+	err = os.WriteFile(filepath.Join(dir, "3_add_title.down.sql"),
+		[]byte("ALTER TABLE posts DROP COLUMN title;"), 0o644)
+	check(t, err)
+	check(t, m.Rollback(2))
+	if len(m.Migrations) != 1 {
+		t.Fatalf("expected 1 migration, got %d", len(m.Migrations))
+	}
+	var n int
+	err = db.Get(&n, `SELECT COUNT(*) FROM sqlite_master
+		WHERE name = 'posts'`)
+	check(t, err)
+	if n != 0 {
+		t.Fatal("expected posts to be dropped")
+	}
+	err = db.Get(&n, `SELECT COUNT(*) FROM meta`)
+	check(t, err)
+	if n != 1 {
+		t.Fatalf("expected 1 migration in meta, got %d", n)
+	}
+
+	// Rolled-back migrations run again.
+	m = newMigrate(t, db, dir)
+	migrated, err := m.Migrate()
+	check(t, err)
+	if !migrated || len(m.Migrations) != 3 {
+		t.Fatalf("expected 3 migrations, got %d", len(m.Migrations))
+	}
+	if err = m.Rollback(4); err == nil {
+		t.Fatal("expected error rolling back more than was applied")
+	}
+}
+
+// readOnlyDB reports that it can't be written to.
+type readOnlyDB struct{ *sqlite.DB }
+
+func (readOnlyDB) ReadOnly() (string, error) { return "replica", nil }
+
+func TestReadOnly(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+	})
+	db := readOnlyDB{newDB(t)}
+
+	_, err := migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite))
+	if !errors.Is(err, migrate.ErrReadOnly) {
+		t.Fatalf("expected read-only, got %v", err)
+	}
+
+	// Inspecting still works, and nothing was created.
+	m, err := migrate.Inspect(db, dir,
+		migrate.WithDBType(migrate.DBTypeSQLite))
+	check(t, err)
+	if st := m.Status(); st.Version != -1 || len(st.Pending) != 1 {
+		t.Fatalf("unexpected status %+v", st)
+	}
+}
+
+func TestAsDirective(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+		"2_create_reports.sql": `-- migrate:as reporting_owner
+CREATE TABLE reports (id INTEGER);`,
+	})
+	db := newDB(t)
+
+	// SQLite can't switch roles itself.
+	m := newMigrate(t, db, dir)
+	_, err := m.Migrate()
+	if err == nil || !strings.Contains(err.Error(), "WithRoleStore") {
+		t.Fatalf("expected role error, got %v", err)
+	}
+
+	owner := newDB(t)
+	m, err = migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithRoleStore("reporting_owner", owner))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+	var n int
+	err = owner.Get(&n, `SELECT COUNT(*) FROM sqlite_master WHERE name = 'reports'`)
+	check(t, err)
+	if n != 1 {
+		t.Fatal("expected reports to be created by the role's store")
+	}
+}
+
+func TestTargetDirective(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_orders.sql": "CREATE TABLE orders (id INTEGER);",
+		"2_create_order_facts.sql": `-- migrate:target analytics
+CREATE TABLE order_facts (order_id INTEGER);`,
+		"3_add_total.sql": "ALTER TABLE orders ADD COLUMN total INTEGER;",
+	})
+	db := newDB(t)
+
+	_, err := migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite))
+	if err == nil || !strings.Contains(err.Error(), "WithTarget") {
+		t.Fatalf("expected target error, got %v", err)
+	}
+
+	analytics := newDB(t)
+	m, err := migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithTarget("analytics", analytics))
+	check(t, err)
+	if p := m.Pending(); len(p) != 3 || p[1].Target != "analytics" {
+		t.Fatalf("unexpected pending %+v", p)
+	}
+	_, err = m.Migrate()
+	check(t, err)
+	if len(m.Migrations) != 3 {
+		t.Fatalf("expected 3 migrations, got %d", len(m.Migrations))
+	}
+	var n int
+	err = analytics.Get(&n, `SELECT COUNT(*) FROM sqlite_master
+		WHERE name = 'order_facts'`)
+	check(t, err)
+	if n != 1 {
+		t.Fatal("expected order_facts to be created on the target")
+	}
+	err = db.Get(&n, `SELECT COUNT(*) FROM sqlite_master
+		WHERE name = 'order_facts'`)
+	check(t, err)
+	if n != 0 {
+		t.Fatal("expected order_facts not to be created on the primary")
+	}
+}
+
+func TestWithStartAt(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+	})
+	db := newDB(t)
+
+	startAt := time.Now().Add(50 * time.Millisecond)
+	m, err := migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithStartAt(startAt))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+	if time.Now().Before(startAt) {
+		t.Fatal("expected to wait until the start time")
+	}
+	if len(m.Migrations) != 1 {
+		t.Fatalf("expected 1 migration, got %d", len(m.Migrations))
+	}
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newDB(t *testing.T) *sqlite.DB {
+	t.Helper()
+	db := sqlite.New(filepath.Join(t.TempDir(), "test.db"))
+	check(t, migrate.OpenStore(context.Background(), db))
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func newMigrate(
+	t *testing.T,
+	db migrate.Store,
+	dir string,
+	opts ...migrate.Option,
+) *migrate.Migrate {
+	t.Helper()
+	m, err := migrate.New(db, dir, append([]migrate.Option{
+		migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+	}, opts...)...)
+	check(t, err)
+	return m
+}
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		check(t, err)
+		err = os.WriteFile(path, []byte(content), 0o644)
+		check(t, err)
+	}
+	return dir
+}
+
+type testLogger struct{ t *testing.T }
+
+func (l testLogger) Printf(s string, vs ...interface{}) { l.t.Logf(s, vs...) }
+func (l testLogger) Println(vs ...interface{})          { l.t.Log(vs...) }
@@ -0,0 +1,157 @@
+// Package migrategrpc exposes a Migrate over gRPC, so a central deployment
+// controller can check and apply migrations across a fleet of services
+// without shelling into each one. The service is defined in migrate.proto.
+package migrategrpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative migrate.proto
+
+import (
+	"context"
+	"sync"
+
+	"github.com/thankful-ai/migrate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Server implements MigratorServer for a Migrate. Status, Plan, and Verify
+// may run concurrently, but while migrating every call fails with
+// codes.Unavailable rather than queueing behind a long migration.
+type Server struct {
+	UnimplementedMigratorServer
+
+	m  *migrate.Migrate
+	mu sync.RWMutex
+}
+
+// NewServer for m, which must have been returned by migrate.New.
+func NewServer(m *migrate.Migrate) *Server {
+	return &Server{m: m}
+}
+
+// Register a Server for m with s.
+func Register(s grpc.ServiceRegistrar, m *migrate.Migrate) {
+	RegisterMigratorServer(s, NewServer(m))
+}
+
+var errBusy = status.Error(codes.Unavailable, "migration in progress")
+
+func (s *Server) Status(
+	ctx context.Context,
+	req *StatusRequest,
+) (*StatusResponse, error) {
+	if !s.mu.TryRLock() {
+		return nil, errBusy
+	}
+	defer s.mu.RUnlock()
+
+	st := s.m.Status()
+	return &StatusResponse{
+		Version: int32(st.Version),
+		Applied: migrations(st.Applied),
+		Pending: pending(st.Pending),
+		Drift:   drift(st.Drift),
+	}, nil
+}
+
+func (s *Server) Plan(
+	ctx context.Context,
+	req *PlanRequest,
+) (*PlanResponse, error) {
+	if !s.mu.TryRLock() {
+		return nil, errBusy
+	}
+	defer s.mu.RUnlock()
+
+	st := s.m.Status()
+	return &PlanResponse{
+		Pending: pending(st.Pending),
+		Drift:   drift(st.Drift),
+	}, nil
+}
+
+func (s *Server) Migrate(
+	ctx context.Context,
+	req *MigrateRequest,
+) (*MigrateResponse, error) {
+	if !s.mu.TryLock() {
+		return nil, errBusy
+	}
+	defer s.mu.Unlock()
+
+	before := len(s.m.Migrations)
+	migrated, err := s.m.Migrate()
+	if err != nil {
+		return nil, status.Error(codes.Aborted, err.Error())
+	}
+	return &MigrateResponse{
+		Migrated: migrated,
+		Applied:  migrations(s.m.Migrations[before:]),
+	}, nil
+}
+
+// Rollback always fails. Rolling back rewrites history, so it isn't offered
+// remotely; reverse a deployed migration by writing another which undoes it.
+func (s *Server) Rollback(
+	ctx context.Context,
+	req *RollbackRequest,
+) (*RollbackResponse, error) {
+	return nil, status.Error(codes.Unimplemented,
+		"rollback isn't served remotely: add a migration which reverses "+
+			req.Filename)
+}
+
+func (s *Server) Verify(
+	ctx context.Context,
+	req *VerifyRequest,
+) (*VerifyResponse, error) {
+	if !s.mu.TryRLock() {
+		return nil, errBusy
+	}
+	defer s.mu.RUnlock()
+
+	if err := s.m.Verify(); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &VerifyResponse{}, nil
+}
+
+func migrations(ms []migrate.Migration) []*Migration {
+	out := make([]*Migration, 0, len(ms))
+	for _, mg := range ms {
+		out = append(out, &Migration{
+			Filename:   mg.Filename,
+			Checksum:   mg.Checksum,
+			Variant:    mg.Variant,
+			Statements: int32(mg.Statements),
+			DurationMs: mg.Duration.Milliseconds(),
+		})
+	}
+	return out
+}
+
+func pending(ps []migrate.PendingMigration) []*PendingMigration {
+	out := make([]*PendingMigration, 0, len(ps))
+	for _, p := range ps {
+		out = append(out, &PendingMigration{
+			Filename:   p.Filename,
+			Number:     p.Number,
+			Size:       p.Size,
+			Statements: int32(p.Statements),
+		})
+	}
+	return out
+}
+
+func drift(ds []migrate.Drift) []*Drift {
+	out := make([]*Drift, 0, len(ds))
+	for _, d := range ds {
+		out = append(out, &Drift{
+			Filename: d.Filename,
+			Kind:     string(d.Kind),
+			Error:    d.Err.Error(),
+		})
+	}
+	return out
+}
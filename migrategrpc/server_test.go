@@ -0,0 +1,96 @@
+package migrategrpc
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/thankful-ai/migrate"
+	"github.com/thankful-ai/migrate/sqlite"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+type testLogger struct{ t *testing.T }
+
+func (l testLogger) Printf(s string, vs ...interface{}) { l.t.Logf(s, vs...) }
+func (l testLogger) Println(vs ...interface{})          { l.t.Log(vs...) }
+
+func TestServer(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+		"2_seed_users.sql":   "INSERT INTO users VALUES (1);\nINSERT INTO users VALUES (2);",
+	}
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+	db := sqlite.New(filepath.Join(t.TempDir(), "test.db"))
+	if err := migrate.OpenStore(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	m, err := migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	Register(srv, m)
+	go func() { _ = srv.Serve(lis) }()
+	defer srv.Stop()
+	conn, err := grpc.DialContext(ctx, "bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return lis.Dial()
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := NewMigratorClient(conn)
+
+	plan, err := client.Plan(ctx, &PlanRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Pending) != 2 || plan.Pending[1].Filename != "2_seed_users.sql" ||
+		plan.Pending[1].Statements != 2 {
+		t.Fatalf("unexpected plan %v", plan)
+	}
+	if _, err = client.Verify(ctx, &VerifyRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Migrate(ctx, &MigrateRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Migrated || len(resp.Applied) != 2 {
+		t.Fatalf("unexpected migrate response %v", resp)
+	}
+
+	st, err := client.Status(ctx, &StatusRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Applied) != 2 || len(st.Pending) != 0 || len(st.Drift) != 0 {
+		t.Fatalf("unexpected status %v", st)
+	}
+
+	_, err = client.Rollback(ctx, &RollbackRequest{Filename: "2_seed_users.sql"})
+	if status.Code(err) != codes.Unimplemented {
+		t.Fatalf("expected unimplemented rollback, got %v", err)
+	}
+}
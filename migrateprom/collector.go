@@ -0,0 +1,110 @@
+// Package migrateprom records migrations as Prometheus metrics, so runs at
+// pod startup are visible on dashboards and can be alerted on:
+//
+//	c := migrateprom.New()
+//	prometheus.MustRegister(c)
+//	m, err := migrate.New(db, dir, migrate.WithMetrics(c))
+//
+// Every metric is labeled by the namespace, which is empty by default.
+package migrateprom
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thankful-ai/migrate"
+)
+
+// Collector implements migrate.Metrics and prometheus.Collector.
+type Collector struct {
+	applied    *prometheus.CounterVec
+	statements *prometheus.CounterVec
+	duration   *prometheus.HistogramVec
+	failures   *prometheus.CounterVec
+}
+
+var _ migrate.Metrics = (*Collector)(nil)
+
+// New Collector, which must be registered to be scraped.
+func New() *Collector {
+	return &Collector{
+		applied: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "migrate_migrations_applied_total",
+			Help: "Migration files recorded in the history.",
+		}, []string{"namespace"}),
+		statements: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "migrate_statements_executed_total",
+			Help: "Statements executed successfully.",
+		}, []string{"namespace"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "migrate_migration_duration_seconds",
+			Help: "Time taken to apply each migration file.",
+
+			// From 10ms to about 45 minutes.
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 12),
+		}, []string{"namespace"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "migrate_failures_total",
+			Help: "Runs stopped by an error, by its reason.",
+		}, []string{"namespace", "reason"}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.applied.Describe(ch)
+	c.statements.Describe(ch)
+	c.duration.Describe(ch)
+	c.failures.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.applied.Collect(ch)
+	c.statements.Collect(ch)
+	c.duration.Collect(ch)
+	c.failures.Collect(ch)
+}
+
+// MigrationApplied implements migrate.Metrics.
+func (c *Collector) MigrationApplied(mg migrate.Migration) {
+	c.applied.WithLabelValues(mg.Namespace).Inc()
+	c.duration.WithLabelValues(mg.Namespace).Observe(mg.Duration.Seconds())
+}
+
+// StatementExecuted implements migrate.Metrics.
+func (c *Collector) StatementExecuted(
+	namespace string,
+	statements int,
+	_ time.Duration,
+) {
+	c.statements.WithLabelValues(namespace).Add(float64(statements))
+}
+
+// MigrationFailed implements migrate.Metrics.
+func (c *Collector) MigrationFailed(namespace, _ string, err error) {
+	c.failures.WithLabelValues(namespace, reason(err)).Inc()
+}
+
+// reason err stopped a run, as a label with few enough values to aggregate.
+// Failed statements are labeled with their migrate.ErrorClass.
+func reason(err error) string {
+	var serr *migrate.StatementError
+	switch {
+	case errors.As(err, &serr) && serr.Class != "":
+		return string(serr.Class)
+	case errors.Is(err, migrate.ErrChecksumMismatch):
+		return "checksum mismatch"
+	case errors.Is(err, migrate.ErrMissingMigration):
+		return "missing migration"
+	case errors.Is(err, migrate.ErrOutOfOrder):
+		return "out of order"
+	case errors.Is(err, migrate.ErrLocked):
+		return "locked"
+	case errors.Is(err, migrate.ErrInterrupted),
+		errors.Is(err, migrate.ErrFileTimeout):
+		return "interrupted"
+	}
+	return string(migrate.ClassUnknown)
+}
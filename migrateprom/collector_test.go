@@ -0,0 +1,68 @@
+package migrateprom
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thankful-ai/migrate"
+	"github.com/thankful-ai/migrate/sqlite"
+)
+
+type testLogger struct{ t *testing.T }
+
+func (l testLogger) Printf(s string, vs ...interface{}) { l.t.Logf(s, vs...) }
+func (l testLogger) Println(vs ...interface{})          { l.t.Log(vs...) }
+
+func TestCollector(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+		"2_seed_users.sql":   "INSERT INTO users VALUES (1);\nINSERT INTO users VALUES (2);",
+		"3_broken.sql":       "INSERT INTO missing VALUES (1);",
+	}
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	db := sqlite.New(filepath.Join(t.TempDir(), "test.db"))
+	if err := migrate.OpenStore(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	c := New()
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	m, err := migrate.New(db, dir, migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithNamespace("app"), migrate.WithMetrics(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.Migrate(); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if got := testutil.ToFloat64(c.applied.WithLabelValues("app")); got != 2 {
+		t.Fatalf("expected 2 migrations applied, got %v", got)
+	}
+	got := testutil.ToFloat64(c.statements.WithLabelValues("app"))
+	if got != 3 {
+		t.Fatalf("expected 3 statements executed, got %v", got)
+	}
+	if got := testutil.CollectAndCount(c.duration); got != 1 {
+		t.Fatalf("expected 1 duration histogram, got %d", got)
+	}
+	if got := testutil.CollectAndCount(c.failures); got != 1 {
+		t.Fatalf("expected 1 failure series, got %d", got)
+	}
+	if _, err = reg.Gather(); err != nil {
+		t.Fatal(err)
+	}
+}
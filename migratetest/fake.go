@@ -0,0 +1,369 @@
+// Package migratetest provides Store doubles for testing code which runs
+// migrations: a FakeStore which keeps the history in memory and records every
+// call for assertions, and Wrap, which adds middleware such as logging or
+// injected latency in front of any Store.
+package migratetest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/thankful-ai/migrate"
+)
+
+// Exec is a statement executed by a FakeStore.
+type Exec struct {
+	Query string
+	Args  []interface{}
+}
+
+// FakeStore is a migrate.Store which keeps the history in memory and executes
+// nothing, recording each statement instead. It's safe for concurrent use.
+// The zero value is ready to use.
+type FakeStore struct {
+	// FailExec, if set, is called before recording each statement, and a
+	// non-nil error fails the statement with it.
+	FailExec func(query string) error
+
+	mu          sync.Mutex
+	open        bool
+	meta        bool
+	version     int
+	hasVersion  bool
+	execs       []Exec
+	inserts     []migrate.Migration
+	migrations  []migrate.Migration
+	checkpoints []checkpoint
+	objects     []migrate.Object
+	failures    []migrate.Failure
+	locks       map[string]migrate.LockHolder
+	prefix      string
+}
+
+type checkpoint struct {
+	namespace, filename, content, checksum string
+	idx                                    int
+}
+
+// NewFakeStore with no history.
+func NewFakeStore() *FakeStore { return &FakeStore{} }
+
+// Execs are the statements executed so far, in order.
+func (s *FakeStore) Execs() []Exec {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Exec(nil), s.execs...)
+}
+
+// Queries executed so far, in order, without their arguments.
+func (s *FakeStore) Queries() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queries := make([]string, 0, len(s.execs))
+	for _, e := range s.execs {
+		queries = append(queries, e.Query)
+	}
+	return queries
+}
+
+// Inserts are the migrations inserted or upserted into the history so far,
+// in order.
+func (s *FakeStore) Inserts() []migrate.Migration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]migrate.Migration(nil), s.inserts...)
+}
+
+// TablePrefix set by migrate.WithTablePrefix, if any. The history is kept in
+// memory, so it only records the prefix.
+func (s *FakeStore) TablePrefix() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.prefix
+}
+
+func (s *FakeStore) SetTablePrefix(prefix string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prefix = prefix
+}
+
+// IsOpen reports whether the Store has been opened and not yet closed.
+func (s *FakeStore) IsOpen() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.open
+}
+
+func (s *FakeStore) Open() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.open = true
+	return nil
+}
+
+func (s *FakeStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.open = false
+	return nil
+}
+
+// Exec records query, reporting no rows affected, unless FailExec fails it.
+func (s *FakeStore) Exec(query string, args ...interface{}) (sql.Result, error) {
+	if s.FailExec != nil {
+		if err := s.FailExec(query); err != nil {
+			return nil, err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.execs = append(s.execs, Exec{Query: query, Args: args})
+	return driver.RowsAffected(0), nil
+}
+
+// ExecContext is Exec, failing with ctx's error instead once ctx is done.
+func (s *FakeStore) ExecContext(
+	ctx context.Context,
+	query string,
+	args ...interface{},
+) (sql.Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Exec(query, args...)
+}
+
+func (s *FakeStore) CreateMetaIfNotExists() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.meta = true
+	return nil
+}
+
+func (s *FakeStore) CreateMetaCheckpointsIfNotExists() error { return nil }
+func (s *FakeStore) CreateMetaObjectsIfNotExists() error     { return nil }
+func (s *FakeStore) CreateMetaFailuresIfNotExists() error    { return nil }
+func (s *FakeStore) CreateMetaLocksIfNotExists() error       { return nil }
+
+func (s *FakeStore) CreateMetaVersionIfNotExists(schemaVersion int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.hasVersion {
+		s.version, s.hasVersion = schemaVersion, true
+	}
+	return s.version, nil
+}
+
+func (s *FakeStore) GetMetaVersion() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.hasVersion:
+		return s.version, nil
+	case s.meta:
+		return 0, nil
+	}
+	return -1, nil
+}
+
+func (s *FakeStore) GetMigrations(namespace string) ([]migrate.Migration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	migrations := []migrate.Migration{}
+	for _, m := range s.migrations {
+		if m.Namespace == namespace {
+			migrations = append(migrations, m)
+		}
+	}
+	return migrations, nil
+}
+
+func (s *FakeStore) InsertMigration(m migrate.Migration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inserts = append(s.inserts, m)
+	s.migrations = append(s.migrations, m)
+	return nil
+}
+
+func (s *FakeStore) UpsertMigration(m migrate.Migration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inserts = append(s.inserts, m)
+	for i, old := range s.migrations {
+		if old.Namespace == m.Namespace && old.Filename == m.Filename {
+			s.migrations[i] = m
+			return nil
+		}
+	}
+	s.migrations = append(s.migrations, m)
+	return nil
+}
+
+// DeleteMigration removes filename from the history of namespace, so
+// Rollback can run against a FakeStore.
+func (s *FakeStore) DeleteMigration(namespace, filename string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.migrations[:0]
+	for _, m := range s.migrations {
+		if m.Namespace != namespace || m.Filename != filename {
+			kept = append(kept, m)
+		}
+	}
+	s.migrations = kept
+	return nil
+}
+
+// TryLock namespace unless it's already locked, so Migrate can be run
+// concurrently against one FakeStore.
+func (s *FakeStore) TryLock(namespace string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.locks[namespace]; ok {
+		return false, nil
+	}
+	if s.locks == nil {
+		s.locks = map[string]migrate.LockHolder{}
+	}
+	s.locks[namespace] = migrate.LockHolder{}
+	return true, nil
+}
+
+func (s *FakeStore) GetLockHolder(namespace string) (migrate.LockHolder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.locks[namespace], nil
+}
+
+func (s *FakeStore) SetLockHolder(
+	namespace string,
+	holder migrate.LockHolder,
+) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.locks[namespace]; !ok {
+		return fmt.Errorf("%s is not locked", namespace)
+	}
+	s.locks[namespace] = holder
+	return nil
+}
+
+func (s *FakeStore) Unlock(namespace string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.locks[namespace]; !ok {
+		return fmt.Errorf("%s is not locked", namespace)
+	}
+	delete(s.locks, namespace)
+	return nil
+}
+
+func (s *FakeStore) GetMetaCheckpoints(namespace, filename string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	checksums := []string{}
+	for _, c := range s.checkpoints {
+		if c.namespace == namespace && c.filename == filename {
+			checksums = append(checksums, c.checksum)
+		}
+	}
+	return checksums, nil
+}
+
+func (s *FakeStore) InsertMetaCheckpoint(
+	namespace, filename, content, checksum string,
+	idx int,
+) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkpoints = append(s.checkpoints, checkpoint{
+		namespace: namespace,
+		filename:  filename,
+		content:   content,
+		checksum:  checksum,
+		idx:       idx,
+	})
+	return nil
+}
+
+func (s *FakeStore) DeleteMetaCheckpoints(namespace string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.checkpoints[:0]
+	for _, c := range s.checkpoints {
+		if c.namespace != namespace {
+			kept = append(kept, c)
+		}
+	}
+	s.checkpoints = kept
+	return nil
+}
+
+func (s *FakeStore) GetMetaObjects(namespace string) ([]migrate.Object, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	objects := []migrate.Object{}
+	for _, o := range s.objects {
+		if o.Namespace == namespace {
+			objects = append(objects, o)
+		}
+	}
+	return objects, nil
+}
+
+func (s *FakeStore) UpsertMetaObject(o migrate.Object) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, old := range s.objects {
+		if old.Namespace == o.Namespace && old.Filename == o.Filename {
+			s.objects[i] = o
+			return nil
+		}
+	}
+	s.objects = append(s.objects, o)
+	return nil
+}
+
+func (s *FakeStore) GetMetaFailures(namespace string) ([]migrate.Failure, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	failures := []migrate.Failure{}
+	for _, f := range s.failures {
+		if f.Namespace == namespace {
+			failures = append(failures, f)
+		}
+	}
+	return failures, nil
+}
+
+func (s *FakeStore) InsertMetaFailure(f migrate.Failure) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f.FailedAt.IsZero() {
+		f.FailedAt = time.Now()
+	}
+	s.failures = append(s.failures, f)
+	return nil
+}
+
+func (s *FakeStore) UpgradeToV1([]migrate.Migration) error { return s.setVersion(1) }
+func (s *FakeStore) UpgradeToV2() error                    { return s.setVersion(2) }
+func (s *FakeStore) UpgradeToV3() error                    { return s.setVersion(3) }
+func (s *FakeStore) UpgradeToV4() error                    { return s.setVersion(4) }
+func (s *FakeStore) UpgradeToV5() error                    { return s.setVersion(5) }
+func (s *FakeStore) UpgradeToV6() error                    { return s.setVersion(6) }
+func (s *FakeStore) UpgradeToV7() error                    { return s.setVersion(7) }
+func (s *FakeStore) UpgradeToV8() error                    { return s.setVersion(8) }
+
+func (s *FakeStore) setVersion(version int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version, s.hasVersion = version, true
+	return nil
+}
@@ -0,0 +1,283 @@
+package migratetest
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/thankful-ai/migrate"
+)
+
+// Call to a method of a wrapped Store.
+type Call struct {
+	// Method of the Store, such as Exec or InsertMigration.
+	Method string
+
+	// Query and Args of an Exec. They're empty for other methods.
+	Query string
+	Args  []interface{}
+}
+
+// Middleware runs around each Call to a wrapped Store. It must call next to
+// run the Store's method, and return its error unless it's replacing it.
+type Middleware func(c Call, next func() error) error
+
+// Wrap s so every call to one of its Store methods runs through mws, the first
+// of which is outermost. Of the optional interfaces, only ErrorClassifier,
+// Pinger, and ContextExecer are passed through, so statements through the
+// wrapper aren't batched or run in atomic groups.
+func Wrap(s migrate.Store, mws ...Middleware) migrate.Store {
+	return &wrapped{s: s, mws: mws}
+}
+
+// Latency delays every call by d, such as to test timeouts and progress
+// reporting against a slow database.
+func Latency(d time.Duration) Middleware {
+	return func(_ Call, next func() error) error {
+		time.Sleep(d)
+		return next()
+	}
+}
+
+// Logging logs every call with its duration and error, if any.
+func Logging(log migrate.Logger) Middleware {
+	return func(c Call, next func() error) error {
+		start := time.Now()
+		err := next()
+		elapsed := time.Since(start)
+		switch {
+		case c.Method == "Exec" && err != nil:
+			log.Printf("%s %q in %s: %s\n", c.Method, c.Query, elapsed,
+				err)
+		case c.Method == "Exec":
+			log.Printf("%s %q in %s\n", c.Method, c.Query, elapsed)
+		case err != nil:
+			log.Printf("%s in %s: %s\n", c.Method, elapsed, err)
+		default:
+			log.Printf("%s in %s\n", c.Method, elapsed)
+		}
+		return err
+	}
+}
+
+type wrapped struct {
+	s   migrate.Store
+	mws []Middleware
+}
+
+// call fn through the middleware.
+func (w *wrapped) call(c Call, fn func() error) error {
+	next := fn
+	for i := len(w.mws) - 1; i >= 0; i-- {
+		mw, inner := w.mws[i], next
+		next = func() error { return mw(c, inner) }
+	}
+	return next()
+}
+
+func (w *wrapped) Open() error {
+	return w.call(Call{Method: "Open"}, w.s.Open)
+}
+
+func (w *wrapped) Close() error {
+	return w.call(Call{Method: "Close"}, w.s.Close)
+}
+
+func (w *wrapped) Exec(query string, args ...interface{}) (sql.Result, error) {
+	var res sql.Result
+	err := w.call(Call{Method: "Exec", Query: query, Args: args}, func() error {
+		var err error
+		res, err = w.s.Exec(query, args...)
+		return err
+	})
+	return res, err
+}
+
+// ExecContext through the middleware, with the wrapped Store's ContextExecer if
+// it has one.
+func (w *wrapped) ExecContext(
+	ctx context.Context,
+	query string,
+	args ...interface{},
+) (sql.Result, error) {
+	var res sql.Result
+	err := w.call(Call{Method: "Exec", Query: query, Args: args}, func() error {
+		var err error
+		if c, ok := w.s.(migrate.ContextExecer); ok {
+			res, err = c.ExecContext(ctx, query, args...)
+		} else {
+			res, err = w.s.Exec(query, args...)
+		}
+		return err
+	})
+	return res, err
+}
+
+func (w *wrapped) CreateMetaVersionIfNotExists(schemaVersion int) (int, error) {
+	var version int
+	err := w.call(Call{Method: "CreateMetaVersionIfNotExists"}, func() error {
+		var err error
+		version, err = w.s.CreateMetaVersionIfNotExists(schemaVersion)
+		return err
+	})
+	return version, err
+}
+
+func (w *wrapped) CreateMetaIfNotExists() error {
+	return w.call(Call{Method: "CreateMetaIfNotExists"},
+		w.s.CreateMetaIfNotExists)
+}
+
+func (w *wrapped) CreateMetaCheckpointsIfNotExists() error {
+	return w.call(Call{Method: "CreateMetaCheckpointsIfNotExists"},
+		w.s.CreateMetaCheckpointsIfNotExists)
+}
+
+func (w *wrapped) GetMetaVersion() (int, error) {
+	var version int
+	err := w.call(Call{Method: "GetMetaVersion"}, func() error {
+		var err error
+		version, err = w.s.GetMetaVersion()
+		return err
+	})
+	return version, err
+}
+
+func (w *wrapped) GetMigrations(namespace string) ([]migrate.Migration, error) {
+	var migrations []migrate.Migration
+	err := w.call(Call{Method: "GetMigrations"}, func() error {
+		var err error
+		migrations, err = w.s.GetMigrations(namespace)
+		return err
+	})
+	return migrations, err
+}
+
+func (w *wrapped) InsertMigration(m migrate.Migration) error {
+	return w.call(Call{Method: "InsertMigration"}, func() error {
+		return w.s.InsertMigration(m)
+	})
+}
+
+func (w *wrapped) UpsertMigration(m migrate.Migration) error {
+	return w.call(Call{Method: "UpsertMigration"}, func() error {
+		return w.s.UpsertMigration(m)
+	})
+}
+
+func (w *wrapped) GetMetaCheckpoints(namespace, filename string) ([]string, error) {
+	var checkpoints []string
+	err := w.call(Call{Method: "GetMetaCheckpoints"}, func() error {
+		var err error
+		checkpoints, err = w.s.GetMetaCheckpoints(namespace, filename)
+		return err
+	})
+	return checkpoints, err
+}
+
+func (w *wrapped) InsertMetaCheckpoint(
+	namespace, filename, content, checksum string,
+	idx int,
+) error {
+	return w.call(Call{Method: "InsertMetaCheckpoint"}, func() error {
+		return w.s.InsertMetaCheckpoint(namespace, filename, content,
+			checksum, idx)
+	})
+}
+
+func (w *wrapped) DeleteMetaCheckpoints(namespace string) error {
+	return w.call(Call{Method: "DeleteMetaCheckpoints"}, func() error {
+		return w.s.DeleteMetaCheckpoints(namespace)
+	})
+}
+
+func (w *wrapped) CreateMetaObjectsIfNotExists() error {
+	return w.call(Call{Method: "CreateMetaObjectsIfNotExists"},
+		w.s.CreateMetaObjectsIfNotExists)
+}
+
+func (w *wrapped) GetMetaObjects(namespace string) ([]migrate.Object, error) {
+	var objects []migrate.Object
+	err := w.call(Call{Method: "GetMetaObjects"}, func() error {
+		var err error
+		objects, err = w.s.GetMetaObjects(namespace)
+		return err
+	})
+	return objects, err
+}
+
+func (w *wrapped) UpsertMetaObject(o migrate.Object) error {
+	return w.call(Call{Method: "UpsertMetaObject"}, func() error {
+		return w.s.UpsertMetaObject(o)
+	})
+}
+
+func (w *wrapped) CreateMetaFailuresIfNotExists() error {
+	return w.call(Call{Method: "CreateMetaFailuresIfNotExists"},
+		w.s.CreateMetaFailuresIfNotExists)
+}
+
+func (w *wrapped) GetMetaFailures(namespace string) ([]migrate.Failure, error) {
+	var failures []migrate.Failure
+	err := w.call(Call{Method: "GetMetaFailures"}, func() error {
+		var err error
+		failures, err = w.s.GetMetaFailures(namespace)
+		return err
+	})
+	return failures, err
+}
+
+func (w *wrapped) InsertMetaFailure(f migrate.Failure) error {
+	return w.call(Call{Method: "InsertMetaFailure"}, func() error {
+		return w.s.InsertMetaFailure(f)
+	})
+}
+
+func (w *wrapped) UpgradeToV1(ms []migrate.Migration) error {
+	return w.call(Call{Method: "UpgradeToV1"}, func() error {
+		return w.s.UpgradeToV1(ms)
+	})
+}
+
+func (w *wrapped) UpgradeToV2() error {
+	return w.call(Call{Method: "UpgradeToV2"}, w.s.UpgradeToV2)
+}
+
+func (w *wrapped) UpgradeToV3() error {
+	return w.call(Call{Method: "UpgradeToV3"}, w.s.UpgradeToV3)
+}
+
+func (w *wrapped) UpgradeToV4() error {
+	return w.call(Call{Method: "UpgradeToV4"}, w.s.UpgradeToV4)
+}
+
+func (w *wrapped) UpgradeToV5() error {
+	return w.call(Call{Method: "UpgradeToV5"}, w.s.UpgradeToV5)
+}
+
+func (w *wrapped) UpgradeToV6() error {
+	return w.call(Call{Method: "UpgradeToV6"}, w.s.UpgradeToV6)
+}
+
+func (w *wrapped) UpgradeToV7() error {
+	return w.call(Call{Method: "UpgradeToV7"}, w.s.UpgradeToV7)
+}
+
+func (w *wrapped) UpgradeToV8() error {
+	return w.call(Call{Method: "UpgradeToV8"}, w.s.UpgradeToV8)
+}
+
+// ClassifyError with the wrapped Store's ErrorClassifier, if it has one.
+func (w *wrapped) ClassifyError(err error) migrate.ErrorClass {
+	if c, ok := w.s.(migrate.ErrorClassifier); ok {
+		return c.ClassifyError(err)
+	}
+	return migrate.ClassUnknown
+}
+
+// Ping the wrapped Store through the middleware, as migrate.Ping would.
+func (w *wrapped) Ping(ctx context.Context) error {
+	return w.call(Call{Method: "Ping"}, func() error {
+		return migrate.Ping(ctx, w.s)
+	})
+}
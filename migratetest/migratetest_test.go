@@ -0,0 +1,295 @@
+package migratetest
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/thankful-ai/migrate"
+)
+
+type testLogger struct{ t *testing.T }
+
+func (l testLogger) Printf(s string, vs ...interface{}) { l.t.Logf(s, vs...) }
+func (l testLogger) Println(vs ...interface{})          { l.t.Log(vs...) }
+
+var files = map[string]string{
+	"1_create_users.sql": "CREATE TABLE users (id INTEGER);",
+	"2_seed_users.sql":   "INSERT INTO users VALUES (1);\nINSERT INTO users VALUES (2);",
+}
+
+func newMigrate(t *testing.T, s migrate.Store) *migrate.Migrate {
+	m, err := migrate.New(s, "", migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithFiles(files))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestFakeStore(t *testing.T) {
+	s := NewFakeStore()
+	m := newMigrate(t, s)
+	if _, err := m.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"CREATE TABLE users (id INTEGER)",
+		"INSERT INTO users VALUES (1)",
+		"INSERT INTO users VALUES (2)",
+	}
+	if got := s.Queries(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	inserts := s.Inserts()
+	if len(inserts) != 2 || inserts[1].Filename != "2_seed_users.sql" {
+		t.Fatalf("unexpected inserts %+v", inserts)
+	}
+
+	// The history persists, so nothing runs again.
+	m = newMigrate(t, s)
+	if _, err := m.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.Execs()); n != len(want) {
+		t.Fatalf("expected %d execs, got %d", len(want), n)
+	}
+}
+
+func TestFakeStoreFailExec(t *testing.T) {
+	errBoom := errors.New("boom")
+	s := &FakeStore{FailExec: func(query string) error {
+		if query == "INSERT INTO users VALUES (2)" {
+			return errBoom
+		}
+		return nil
+	}}
+	m := newMigrate(t, s)
+	_, err := m.Migrate()
+	var merr *migrate.MigrationError
+	if !errors.As(err, &merr) || merr.File != "2_seed_users.sql" ||
+		merr.Index != 1 || !errors.Is(err, errBoom) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	failures, err := s.GetMetaFailures("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failures) != 1 || failures[0].Index != 1 {
+		t.Fatalf("unexpected failures %+v", failures)
+	}
+
+	// Resuming skips the checkpointed statement.
+	s.FailExec = nil
+	m = newMigrate(t, s)
+	if _, err = m.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.Execs()); n != 3 {
+		t.Fatalf("expected 3 execs, got %d", n)
+	}
+}
+
+func TestMigrateContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := &FakeStore{FailExec: func(query string) error {
+		if query == "INSERT INTO users VALUES (1)" {
+			cancel()
+		}
+		return nil
+	}}
+	m := newMigrate(t, s)
+	_, err := m.MigrateContext(ctx)
+	if !errors.Is(err, migrate.ErrInterrupted) ||
+		!errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled, got %v", err)
+	}
+	if n := len(s.Execs()); n != 2 {
+		t.Fatalf("expected 2 execs, got %d", n)
+	}
+
+	// Resuming skips the checkpointed statements.
+	m = newMigrate(t, s)
+	if _, err = m.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.Execs()); n != 3 {
+		t.Fatalf("expected 3 execs, got %d", n)
+	}
+}
+
+func TestFakeStoreLock(t *testing.T) {
+	s := NewFakeStore()
+	if ok, err := s.TryLock(""); err != nil || !ok {
+		t.Fatalf("expected lock, got %t %v", ok, err)
+	}
+	opts := []migrate.Option{migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithFiles(files), migrate.WithLockWait(0)}
+
+	// Init creates and upgrades the meta tables under the lock too.
+	if _, err := migrate.New(s, "", opts...); !errors.Is(err, migrate.ErrLocked) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := s.Unlock(""); err != nil {
+		t.Fatal(err)
+	}
+	m, err := migrate.New(s, "", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.TryLock(""); err != nil || !ok {
+		t.Fatalf("expected lock to be released, got %t %v", ok, err)
+	}
+
+	// The error reports who holds the lock.
+	other := migrate.LockHolder{Hostname: "deployer", PID: 42}
+	if err = s.SetLockHolder("", other); err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.Migrate()
+	var lerr *migrate.LockedError
+	if !errors.Is(err, migrate.ErrLocked) || !errors.As(err, &lerr) ||
+		lerr.Holder != other {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if n := len(s.Execs()); n != 0 {
+		t.Fatalf("expected no execs, got %d", n)
+	}
+	if err = s.Unlock(""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the lock is released, migrating takes it, records the file
+	// being migrated, and releases it again.
+	var holder migrate.LockHolder
+	s.FailExec = func(string) error {
+		holder, _ = s.GetLockHolder("")
+		return nil
+	}
+	if _, err = m.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if holder.PID != os.Getpid() || holder.File != "2_seed_users.sql" {
+		t.Fatalf("unexpected holder %+v", holder)
+	}
+	if ok, err := s.TryLock(""); err != nil || !ok {
+		t.Fatalf("expected lock to be released, got %t %v", ok, err)
+	}
+}
+
+func TestFakeStoreLockWait(t *testing.T) {
+	s := NewFakeStore()
+	first, second := newMigrate(t, s), newMigrate(t, s)
+	started, release := make(chan struct{}), make(chan struct{})
+	s.FailExec = func(query string) error {
+		if query == "CREATE TABLE users (id INTEGER)" {
+			close(started)
+			<-release
+		}
+		return nil
+	}
+	errs := make(chan error)
+	go func() {
+		_, err := first.Migrate()
+		errs <- err
+	}()
+	<-started
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+	}()
+
+	// The second run waits for the first, then finds nothing to migrate.
+	migrated, err := second.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if migrated {
+		t.Fatal("expected nothing to migrate after waiting")
+	}
+	if n := len(s.Execs()); n != 3 {
+		t.Fatalf("expected 3 execs, got %d", n)
+	}
+}
+
+func TestFakeStoreBackfillLock(t *testing.T) {
+	s := NewFakeStore()
+	m, err := migrate.New(s, "", migrate.WithLogger(testLogger{t}),
+		migrate.WithDBType(migrate.DBTypeSQLite),
+		migrate.WithFiles(files), migrate.WithLockWait(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var batches int
+	var holder migrate.LockHolder
+	fn := func(after string, limit int) (string, error) {
+		holder, _ = s.GetLockHolder("")
+		if batches++; batches > 1 {
+			return "", nil
+		}
+		return "1", nil
+	}
+
+	// Another process is backfilling.
+	if ok, err := s.TryLock(""); err != nil || !ok {
+		t.Fatalf("expected lock, got %t %v", ok, err)
+	}
+	_, err = m.Backfill("users_email", 10, fn)
+	if !errors.Is(err, migrate.ErrLocked) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if batches != 0 {
+		t.Fatalf("expected no batches while locked, got %d", batches)
+	}
+	if err = s.Unlock(""); err != nil {
+		t.Fatal(err)
+	}
+
+	ran, err := m.Backfill("users_email", 10, fn)
+	if err != nil || !ran {
+		t.Fatalf("expected backfill to run, got %t %v", ran, err)
+	}
+	if holder.PID != os.Getpid() || holder.File != "users_email" {
+		t.Fatalf("unexpected holder %+v", holder)
+	}
+	if ok, err := s.TryLock(""); err != nil || !ok {
+		t.Fatalf("expected lock to be released, got %t %v", ok, err)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	var calls []Call
+	record := func(c Call, next func() error) error {
+		calls = append(calls, c)
+		return next()
+	}
+	s := NewFakeStore()
+	start := time.Now()
+	m := newMigrate(t, Wrap(s, record, Latency(time.Millisecond),
+		Logging(testLogger{t})))
+	if _, err := m.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	var execs int
+	for _, c := range calls {
+		if c.Method == "Exec" {
+			execs++
+		}
+	}
+	if execs != 3 || len(s.Execs()) != 3 {
+		t.Fatalf("expected 3 execs, got %d", execs)
+	}
+	if elapsed := time.Since(start); elapsed < time.Duration(len(calls))*time.Millisecond {
+		t.Fatalf("expected latency for %d calls, took %s", len(calls),
+			elapsed)
+	}
+}
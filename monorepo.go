@@ -0,0 +1,116 @@
+package migrate
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Stream is a directory of migrations with its own history, as used by
+// MigrateStreams.
+type Stream struct {
+	Namespace string
+	Dir       string
+}
+
+// StreamReport describes the result of migrating one Stream.
+type StreamReport struct {
+	Stream
+
+	// Migrated contains the filenames applied in this run, in order.
+	Migrated []string
+
+	// RowsAffected by the migrations applied in this run.
+	RowsAffected int64
+
+	// Pending contains the filenames which were not applied because an
+	// error stopped the run.
+	Pending []string
+
+	// Err which stopped the stream, if any.
+	Err error
+}
+
+// Report is the combined result of MigrateStreams.
+type Report struct {
+	Streams []StreamReport
+}
+
+// String summarizes the report with one line per stream.
+func (r Report) String() string {
+	var b strings.Builder
+	for _, s := range r.Streams {
+		name := s.Namespace
+		if name == "" {
+			name = "(default)"
+		}
+		fmt.Fprintf(&b, "%s (%s): %d migrated, %d rows affected", name,
+			s.Dir, len(s.Migrated), s.RowsAffected)
+		if s.Err != nil {
+			fmt.Fprintf(&b, ", %d pending: %s", len(s.Pending), s.Err)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// MigrateStreams applies each stream in order, each in its own namespace, so
+// a monorepo can migrate every component's directory in one call. opts apply
+// to every stream. It stops at the first failure, leaving later streams
+// untouched, and reports what was migrated up to that point. The returned
+// error is that of the failing stream.
+func MigrateStreams(
+	db Store,
+	log Logger,
+	dbt DBType,
+	streams []Stream,
+	opts ...Option,
+) (Report, error) {
+	var report Report
+	seen := map[string]bool{}
+	for _, s := range streams {
+		if seen[s.Namespace] {
+			return report, fmt.Errorf("duplicate namespace %q",
+				s.Namespace)
+		}
+		seen[s.Namespace] = true
+	}
+	for _, s := range streams {
+		sr, err := migrateStream(db, log, dbt, s, opts)
+		report.Streams = append(report.Streams, sr)
+		if err != nil {
+			return report, fmt.Errorf("namespace %q: %w", s.Namespace,
+				err)
+		}
+	}
+	return report, nil
+}
+
+func migrateStream(
+	db Store,
+	log Logger,
+	dbt DBType,
+	s Stream,
+	opts []Option,
+) (StreamReport, error) {
+	sr := StreamReport{Stream: s}
+	opts = append([]Option{WithLogger(log), WithDBType(dbt)}, opts...)
+	m, err := New(db, s.Dir, append(opts, WithNamespace(s.Namespace))...)
+	if err != nil {
+		sr.Err = err
+		return sr, err
+	}
+	before := len(m.Migrations)
+	_, err = m.Migrate()
+	for _, mg := range m.Migrations[before:] {
+		sr.Migrated = append(sr.Migrated, mg.Filename)
+		sr.RowsAffected += mg.RowsAffected
+	}
+	if err != nil {
+		for _, p := range m.Pending() {
+			sr.Pending = append(sr.Pending, p.Filename)
+		}
+		sr.Err = err
+		return sr, err
+	}
+	return sr, nil
+}
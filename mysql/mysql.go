@@ -1,12 +1,21 @@
 package mysql
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
@@ -17,18 +26,45 @@ import (
 type DB struct {
 	connURL   string
 	tlsConfig *tlsConfig
+	session   []string
+
+	// external connections were opened by the caller, who closes them.
+	external bool
+
+	// locks are the connections holding the named lock of each namespace
+	// locked by TryLock.
+	mu    sync.Mutex
+	locks map[string]*sql.Conn
+
+	// prefix of the meta tables' names; see SetTablePrefix.
+	prefix string
 
 	// Embed the sqlx DB struct
 	*sqlx.DB
 }
 
+// Option configures optional behavior in New.
+type Option func(*DB)
+
+// WithSession executes stmts on every connection before it's used, such as
+// `SET SESSION lock_wait_timeout = 5`, so operational guardrails apply to every
+// migration without repeating them in each file.
+func WithSession(stmts ...string) Option {
+	return func(db *DB) { db.session = append(db.session, stmts...) }
+}
+
 func New(
 	user, pass, host, dbName string,
 	port int,
 	sslKey, sslCert, sslCA, sslServerName string,
+	opts ...Option,
 ) (*DB, error) {
 	db := &DB{}
-	db.connURL = fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?parseTime=true", user,
+	for _, opt := range opts {
+		opt(db)
+	}
+	db.connURL = fmt.Sprintf(
+		"%s:%s@tcp(%s:%d)/%s?parseTime=true&multiStatements=true", user,
 		pass, host, port, dbName)
 	if sslKey != "" {
 		if sslServerName == "" {
@@ -52,11 +88,24 @@ func New(
 	return db, nil
 }
 
+// FromDB is a Store using sqldb, a connection pool which the caller opened
+// with the go-sql-driver/mysql driver, such as the one a service already
+// uses. Its DSN must set parseTime=true, and multiStatements=true to batch
+// statements. Open and Close leave sqldb as it is, since it belongs to the
+// caller. WithSession configures the connection, so it can't be used.
+func FromDB(sqldb *sql.DB, opts ...Option) *DB {
+	db := &DB{DB: sqlx.NewDb(sqldb, "mysql"), external: true}
+	for _, opt := range opts {
+		opt(db)
+	}
+	return db
+}
+
 func (db *DB) CreateMetaVersionIfNotExists(schemaVersion int) (int, error) {
 	created := true
-	q := `CREATE TABLE metaversion (
+	q := db.meta(`CREATE TABLE metaversion (
 		version INTEGER NOT NULL
-	)`
+	)`)
 	_, err := db.Exec(q)
 	if err != nil {
 		// Check if the table already existed
@@ -67,14 +116,14 @@ func (db *DB) CreateMetaVersionIfNotExists(schemaVersion int) (int, error) {
 	}
 
 	var version int
-	q = `SELECT version FROM metaversion`
+	q = db.meta(`SELECT version FROM metaversion`)
 	err = db.Get(&version, q)
 	switch {
 	case err == sql.ErrNoRows:
 		if !created {
 			schemaVersion = 0
 		}
-		q = `INSERT INTO metaversion (version) VALUES (?)`
+		q = db.meta(`INSERT INTO metaversion (version) VALUES (?)`)
 		if _, err := db.Exec(q, schemaVersion); err != nil {
 			return 0, errors.Wrap(err, "insert version")
 		}
@@ -86,12 +135,20 @@ func (db *DB) CreateMetaVersionIfNotExists(schemaVersion int) (int, error) {
 }
 
 func (db *DB) CreateMetaIfNotExists() error {
-	q := `CREATE TABLE IF NOT EXISTS meta (
-		filename VARCHAR(255) UNIQUE NOT NULL,
+	q := db.meta(`CREATE TABLE IF NOT EXISTS meta (
+		namespace VARCHAR(255) NOT NULL DEFAULT '',
+		filename VARCHAR(255) NOT NULL,
 		md5 VARCHAR(255) NOT NULL,
 		content TEXT NOT NULL,
-		createdat DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)
-	)`
+		algorithm VARCHAR(255) NOT NULL DEFAULT 'md5',
+		variant VARCHAR(255) NOT NULL DEFAULT '',
+		statements INTEGER NOT NULL DEFAULT 0,
+		duration_ns BIGINT NOT NULL DEFAULT 0,
+		annotations TEXT NOT NULL,
+		appliedat DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+		createdat DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+		UNIQUE KEY namespace_filename (namespace, filename)
+	)`)
 	if _, err := db.Exec(q); err != nil {
 		return errors.Wrap(err, "create meta table")
 	}
@@ -99,66 +156,158 @@ func (db *DB) CreateMetaIfNotExists() error {
 }
 
 func (db *DB) CreateMetaCheckpointsIfNotExists() error {
-	q := `CREATE TABLE IF NOT EXISTS metacheckpoints (
+	q := db.meta(`CREATE TABLE IF NOT EXISTS metacheckpoints (
+		namespace VARCHAR(255) NOT NULL DEFAULT '',
 		filename VARCHAR(255) NOT NULL,
 		idx INTEGER NOT NULL,
 		md5 VARCHAR(255) NOT NULL,
 		content TEXT NOT NULL,
 		createdat DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
-		PRIMARY KEY (filename, idx)
-	)`
+		PRIMARY KEY (namespace, filename, idx)
+	)`)
 	if _, err := db.Exec(q); err != nil {
 		return errors.Wrap(err, "create metacheckpoints table")
 	}
 	return nil
 }
 
-func (db *DB) GetMigrations() ([]migrate.Migration, error) {
+func (db *DB) CreateMetaObjectsIfNotExists() error {
+	q := db.meta(`CREATE TABLE IF NOT EXISTS metaobjects (
+		namespace VARCHAR(255) NOT NULL DEFAULT '',
+		filename VARCHAR(255) NOT NULL,
+		content TEXT NOT NULL,
+		createdat DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+		PRIMARY KEY (namespace, filename)
+	)`)
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "create metaobjects table")
+	}
+	return nil
+}
+
+func (db *DB) CreateMetaFailuresIfNotExists() error {
+	q := db.meta(`CREATE TABLE IF NOT EXISTS metafailures (
+		namespace VARCHAR(255) NOT NULL DEFAULT '',
+		filename VARCHAR(255) NOT NULL,
+		idx INTEGER NOT NULL,
+		error TEXT NOT NULL,
+		createdat DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)
+	)`)
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "create metafailures table")
+	}
+	return nil
+}
+
+func (db *DB) GetMetaFailures(namespace string) ([]migrate.Failure, error) {
+	failures := []migrate.Failure{}
+	q := db.meta(`
+	SELECT namespace, filename, idx, error, createdat FROM metafailures
+	WHERE namespace=?
+	ORDER BY createdat`)
+	err := db.Select(&failures, q, namespace)
+	return failures, err
+}
+
+func (db *DB) InsertMetaFailure(f migrate.Failure) error {
+	q := db.meta(`
+		INSERT INTO metafailures (namespace, filename, idx, error)
+		VALUES (?, ?, ?, ?)`)
+	_, err := db.Exec(q, f.Namespace, f.Filename, f.Index, f.Error)
+	return err
+}
+
+func (db *DB) GetMetaObjects(namespace string) ([]migrate.Object, error) {
+	objects := []migrate.Object{}
+	q := db.meta(`
+	SELECT namespace, filename, content FROM metaobjects
+	WHERE namespace=?`)
+	err := db.Select(&objects, q, namespace)
+	return objects, err
+}
+
+func (db *DB) UpsertMetaObject(o migrate.Object) error {
+	q := db.meta(`
+		INSERT INTO metaobjects (namespace, filename, content)
+		VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE content=?, createdat=CURRENT_TIMESTAMP(6)`)
+	_, err := db.Exec(q, o.Namespace, o.Filename, o.Content,
+		o.Content)
+	return err
+}
+
+func (db *DB) GetMigrations(namespace string) ([]migrate.Migration, error) {
 	migrations := []migrate.Migration{}
-	q := `
-	SELECT filename, content, md5 AS checksum
+	q := db.meta(`
+	SELECT namespace, filename, content, md5 AS checksum, algorithm,
+		variant, statements, duration_ns AS duration, annotations,
+		appliedat
 	FROM meta
-	ORDER BY filename * 1`
-	err := db.Select(&migrations, q)
+	WHERE namespace=?
+	ORDER BY filename * 1`)
+	err := db.Select(&migrations, q, namespace)
 	return migrations, err
 
 }
 
-func (db *DB) GetMetaCheckpoints(filename string) ([]string, error) {
+func (db *DB) GetMetaCheckpoints(namespace, filename string) ([]string, error) {
 	checkpoints := []string{}
-	q := `SELECT md5 FROM metacheckpoints WHERE filename=? ORDER BY idx`
-	err := db.Select(&checkpoints, q, filename)
+	q := db.meta(`
+	SELECT md5 FROM metacheckpoints
+	WHERE namespace=? AND filename=?
+	ORDER BY idx`)
+	err := db.Select(&checkpoints, q, namespace, filename)
 	return checkpoints, err
 }
 
-func (db *DB) UpsertMigration(filename, content, checksum string) error {
-	q := `
-		INSERT INTO meta (filename, content, md5) VALUES (?, ?, ?)
-		ON DUPLICATE KEY UPDATE md5=?, content=?`
-	_, err := db.Exec(q, filename, content, checksum, checksum, content)
+func (db *DB) UpsertMigration(m migrate.Migration) error {
+	q := db.meta(`
+		INSERT INTO meta
+			(namespace, filename, content, md5, algorithm, variant,
+			statements, duration_ns, annotations, appliedat)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE content=?, md5=?, algorithm=?, variant=?,
+			statements=?, duration_ns=?, annotations=?, appliedat=?`)
+	_, err := db.Exec(q, m.Namespace, m.Filename, m.Content, m.Checksum,
+		m.Algorithm, m.Variant, m.Statements, m.Duration, m.Annotations,
+		m.AppliedAt, m.Content, m.Checksum, m.Algorithm, m.Variant,
+		m.Statements, m.Duration, m.Annotations, m.AppliedAt)
 	return err
 }
 
 func (db *DB) InsertMetaCheckpoint(
-	filename, content, checksum string,
+	namespace, filename, content, checksum string,
 	idx int,
 ) error {
-	q := `
-		INSERT INTO metacheckpoints (filename, content, idx, md5)
-		VALUES (?, ?, ?, ?)`
-	_, err := db.Exec(q, filename, content, idx, checksum)
+	q := db.meta(`
+		INSERT INTO metacheckpoints (namespace, filename, content, idx, md5)
+		VALUES (?, ?, ?, ?, ?)`)
+	_, err := db.Exec(q, namespace, filename, content, idx, checksum)
 	return err
 }
 
-func (db *DB) InsertMigration(filename, content, checksum string) error {
-	q := `INSERT INTO meta (filename, content, md5) VALUES (?, ?, ?)`
-	_, err := db.Exec(q, filename, content, checksum)
+func (db *DB) InsertMigration(m migrate.Migration) error {
+	q := db.meta(`
+		INSERT INTO meta
+			(namespace, filename, content, md5, algorithm, variant,
+			statements, duration_ns, annotations, appliedat)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	_, err := db.Exec(q, m.Namespace, m.Filename, m.Content, m.Checksum,
+		m.Algorithm, m.Variant, m.Statements, m.Duration, m.Annotations,
+		m.AppliedAt)
 	return err
 }
 
-func (db *DB) DeleteMetaCheckpoints() error {
-	q := `DELETE FROM metacheckpoints`
-	_, err := db.Exec(q)
+func (db *DB) DeleteMetaCheckpoints(namespace string) error {
+	q := db.meta(`DELETE FROM metacheckpoints WHERE namespace=?`)
+	_, err := db.Exec(q, namespace)
+	return err
+}
+
+// DeleteMigration removes filename from the history of namespace.
+func (db *DB) DeleteMigration(namespace, filename string) error {
+	q := db.meta(`DELETE FROM meta WHERE namespace=? AND filename=?`)
+	_, err := db.Exec(q, namespace, filename)
 	return err
 }
 
@@ -180,7 +329,7 @@ func (db *DB) UpgradeToV1(migrations []migrate.Migration) (err error) {
 	}()
 
 	// Remove the uniqueness constraint from md5
-	q := `ALTER TABLE meta DROP INDEX md5`
+	q := db.meta(`ALTER TABLE meta DROP INDEX md5`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "remove md5 unique")
 		return
@@ -188,28 +337,28 @@ func (db *DB) UpgradeToV1(migrations []migrate.Migration) (err error) {
 
 	// Add a content column to record the exact migration that ran
 	// alongside the md5, insert the appropriate data, then set not null
-	q = `ALTER TABLE meta ADD COLUMN content TEXT`
+	q = db.meta(`ALTER TABLE meta ADD COLUMN content TEXT`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "add content column")
 		return
 	}
 	for _, m := range migrations {
-		q = `UPDATE meta SET content=? WHERE filename=?`
+		q = db.meta(`UPDATE meta SET content=? WHERE filename=?`)
 		if _, err = tx.Exec(q, m.Content, m.Filename); err != nil {
 			err = errors.Wrap(err, "update meta content")
 			return
 		}
 	}
-	q = `ALTER TABLE meta MODIFY COLUMN content TEXT NOT NULL`
+	q = db.meta(`ALTER TABLE meta MODIFY COLUMN content TEXT NOT NULL`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "update meta content not null")
 		return
 	}
 
 	// Add the content column to metacheckpoints
-	q = `
+	q = db.meta(`
 	ALTER TABLE metacheckpoints
-	ADD COLUMN content TEXT NOT NULL`
+	ADD COLUMN content TEXT NOT NULL`)
 	_, err = tx.Exec(q)
 	if err != nil {
 		// Ignore duplicate column errors
@@ -219,18 +368,18 @@ func (db *DB) UpgradeToV1(migrations []migrate.Migration) (err error) {
 		}
 	}
 
-	q = `
-	CREATE TABLE IF NOT EXISTS metaversion (version INTEGER NOT NULL)`
+	q = db.meta(`
+	CREATE TABLE IF NOT EXISTS metaversion (version INTEGER NOT NULL)`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "create metaversion table")
 		return
 	}
-	q = `DELETE FROM metaversion`
+	q = db.meta(`DELETE FROM metaversion`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "delete metaversion")
 		return
 	}
-	q = `INSERT INTO metaversion (version) VALUES (1)`
+	q = db.meta(`INSERT INTO metaversion (version) VALUES (1)`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "insert metaversion")
 		return
@@ -238,9 +387,678 @@ func (db *DB) UpgradeToV1(migrations []migrate.Migration) (err error) {
 	return nil
 }
 
-func (db *DB) Close() error { return db.DB.Close() }
+// UpgradeToV2 records the checksum algorithm used for each migration. All
+// migrations before v2 used md5.
+func (db *DB) UpgradeToV2() (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	q := db.meta(`
+	ALTER TABLE meta
+	ADD COLUMN algorithm VARCHAR(255) NOT NULL DEFAULT 'md5'`)
+	_, err = tx.Exec(q)
+	if err != nil {
+		// Ignore duplicate column errors
+		if !strings.Contains(err.Error(), "Duplicate column name") {
+			err = errors.Wrap(err, "add algorithm column")
+			return
+		}
+	}
+	q = db.meta(`UPDATE metaversion SET version=2`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "update metaversion")
+		return
+	}
+	return nil
+}
+
+// UpgradeToV3 adds a namespace to the meta tables, replacing the unique
+// filename index with one on (namespace, filename). Existing history belongs
+// to the default, empty namespace. MySQL implicitly commits DDL, so each step
+// tolerates having already run.
+func (db *DB) UpgradeToV3() (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	for _, table := range []string{"meta", "metacheckpoints"} {
+		q := fmt.Sprintf(`
+		ALTER TABLE %s
+		ADD COLUMN namespace VARCHAR(255) NOT NULL DEFAULT '' FIRST`,
+			db.meta(table))
+		_, err = tx.Exec(q)
+		if err != nil {
+			// Ignore duplicate column errors
+			if !strings.Contains(err.Error(), "Duplicate column name") {
+				err = errors.Wrapf(err, "add %s namespace column",
+					table)
+				return
+			}
+		}
+	}
+
+	var hasFilenameIdx bool
+	q := db.meta(`
+	SELECT COUNT(*) > 0 FROM information_schema.statistics
+	WHERE table_schema = DATABASE()
+		AND table_name = 'meta'
+		AND index_name = 'filename'`)
+	if err = tx.Get(&hasFilenameIdx, q); err != nil {
+		err = errors.Wrap(err, "get meta indexes")
+		return
+	}
+	if hasFilenameIdx {
+		q = db.meta(`ALTER TABLE meta DROP INDEX filename`)
+		if _, err = tx.Exec(q); err != nil {
+			err = errors.Wrap(err, "drop filename unique")
+			return
+		}
+	}
+	q = db.meta(`
+	ALTER TABLE meta
+	ADD UNIQUE KEY namespace_filename (namespace, filename)`)
+	_, err = tx.Exec(q)
+	if err != nil {
+		// Ignore duplicate key errors
+		if !strings.Contains(err.Error(), "Duplicate key name") {
+			err = errors.Wrap(err, "add namespace filename unique")
+			return
+		}
+	}
+	q = db.meta(`
+	ALTER TABLE metacheckpoints
+	DROP PRIMARY KEY,
+	ADD PRIMARY KEY (namespace, filename, idx)`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "replace metacheckpoints primary key")
+		return
+	}
+	q = db.meta(`UPDATE metaversion SET version=3`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "update metaversion")
+		return
+	}
+	return nil
+}
+
+// UpgradeToV4 records which variant of each migration was applied: the base
+// file or a DB-specific override.
+func (db *DB) UpgradeToV4() (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	q := db.meta(`
+	ALTER TABLE meta
+	ADD COLUMN variant VARCHAR(255) NOT NULL DEFAULT ''`)
+	_, err = tx.Exec(q)
+	if err != nil {
+		// Ignore duplicate column errors
+		if !strings.Contains(err.Error(), "Duplicate column name") {
+			err = errors.Wrap(err, "add variant column")
+			return
+		}
+	}
+	q = db.meta(`UPDATE metaversion SET version=4`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "update metaversion")
+		return
+	}
+	return nil
+}
+
+// UpgradeToV5 records how many statements each migration had and how long it
+// took, for Stats.
+func (db *DB) UpgradeToV5() (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	q := db.meta(`
+	ALTER TABLE meta ADD COLUMN statements INTEGER NOT NULL DEFAULT 0`)
+	_, err = tx.Exec(q)
+	if err != nil {
+		// Ignore duplicate column errors
+		if !strings.Contains(err.Error(), "Duplicate column name") {
+			err = errors.Wrap(err, "add statements column")
+			return
+		}
+	}
+	q = db.meta(`
+	ALTER TABLE meta ADD COLUMN duration_ns BIGINT NOT NULL DEFAULT 0`)
+	_, err = tx.Exec(q)
+	if err != nil {
+		if !strings.Contains(err.Error(), "Duplicate column name") {
+			err = errors.Wrap(err, "add duration column")
+			return
+		}
+	}
+	q = db.meta(`UPDATE metaversion SET version=5`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "update metaversion")
+		return
+	}
+	return nil
+}
+
+// UpgradeToV6 records the annotations of the run which applied each
+// migration. TEXT columns can't have defaults before MySQL 8.0.13, so existing
+// rows get the implicit empty default.
+func (db *DB) UpgradeToV6() (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	q := db.meta(`ALTER TABLE meta ADD COLUMN annotations TEXT NOT NULL`)
+	_, err = tx.Exec(q)
+	if err != nil {
+		// Ignore duplicate column errors
+		if !strings.Contains(err.Error(), "Duplicate column name") {
+			err = errors.Wrap(err, "add annotations column")
+			return
+		}
+	}
+	q = db.meta(`UPDATE metaversion SET version=6`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "update metaversion")
+		return
+	}
+	return nil
+}
+
+// UpgradeToV7 only records the version. Migrate rewrites md5 checksums as
+// SHA-256 once it's verified them.
+func (db *DB) UpgradeToV7() error {
+	q := db.meta(`UPDATE metaversion SET version=7`)
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "update metaversion")
+	}
+	return nil
+}
+
+// UpgradeToV8 records when each migration was applied. Migrations applied
+// before use the time they were recorded.
+func (db *DB) UpgradeToV8() (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	q := db.meta(`
+	ALTER TABLE meta
+	ADD COLUMN appliedat DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)`)
+	_, err = tx.Exec(q)
+	if err != nil {
+		// Ignore duplicate column errors
+		if !strings.Contains(err.Error(), "Duplicate column name") {
+			err = errors.Wrap(err, "add appliedat column")
+			return
+		}
+	}
+	q = db.meta(`UPDATE meta SET appliedat=createdat`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "update appliedat")
+		return
+	}
+	q = db.meta(`UPDATE metaversion SET version=8`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "update metaversion")
+		return
+	}
+	return nil
+}
+
+// GetMetaVersion reports the current version without creating or modifying
+// anything. It returns 0 if the meta tables predate versioning and -1 if they
+// don't exist.
+func (db *DB) GetMetaVersion() (int, error) {
+	exists, err := db.tableExists("metaversion")
+	if err != nil {
+		return 0, errors.Wrap(err, "metaversion exists")
+	}
+	if !exists {
+		exists, err = db.tableExists("meta")
+		if err != nil {
+			return 0, errors.Wrap(err, "meta exists")
+		}
+		if exists {
+			return 0, nil
+		}
+		return -1, nil
+	}
+	var version int
+	q := db.meta(`SELECT version FROM metaversion`)
+	err = db.Get(&version, q)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, nil
+	case err != nil:
+		return 0, errors.Wrap(err, "get version")
+	}
+	return version, nil
+}
+
+func (db *DB) tableExists(name string) (bool, error) {
+	var exists bool
+	q := `
+	SELECT COUNT(*) > 0 FROM information_schema.tables
+	WHERE table_schema = DATABASE() AND table_name = ?`
+	err := db.Get(&exists, q, db.meta(name))
+	return exists, err
+}
+
+// LoadData executes a LOAD DATA LOCAL INFILE query, sending data in place of
+// the file named by filename. The data is sent through a registered reader,
+// so the driver never opens files itself. The server must allow it by
+// enabling local_infile.
+func (db *DB) LoadData(query, filename string, data []byte) error {
+	var enabled bool
+	if err := db.Get(&enabled, `SELECT @@GLOBAL.local_infile`); err != nil {
+		return errors.Wrap(err, "get local_infile")
+	}
+	if !enabled {
+		return errors.New("server does not allow LOAD DATA LOCAL INFILE: SET GLOBAL local_infile=1")
+	}
+
+	// Each reader needs a unique name, since handlers are global.
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return errors.Wrap(err, "rand")
+	}
+	name := "migrate-" + hex.EncodeToString(b[:])
+	mysql.RegisterReaderHandler(name, func() io.Reader {
+		return bytes.NewReader(data)
+	})
+	defer mysql.DeregisterReaderHandler(name)
+
+	literal := "'" + filename + "'"
+	if !strings.Contains(query, literal) {
+		return fmt.Errorf("query does not load %s", literal)
+	}
+	query = strings.Replace(query, literal, "'Reader::"+name+"'", 1)
+	if _, err := db.Exec(query); err != nil {
+		return errors.Wrap(err, "load data")
+	}
+	return nil
+}
+
+// ExecBatch executes cmds in one round trip. MySQL commits DDL implicitly, so
+// statements before a failure in the batch may have been applied.
+func (db *DB) ExecBatch(cmds []string) error {
+	_, err := db.Exec(strings.Join(cmds, ";\n"))
+	return err
+}
+
+// ExecAtomic executes cmds one at a time within a transaction, MySQL
+// commits DDL implicitly, so only the data changes of a failed atomic group
+// after its last DDL statement are rolled back.
+func (db *DB) ExecAtomic(cmds []string) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+	for _, cmd := range cmds {
+		if _, err = tx.Exec(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExecWarnings executes query, then fetches its warnings with SHOW WARNINGS on
+// the same connection.
+func (db *DB) ExecWarnings(
+	query string,
+	args ...interface{},
+) (sql.Result, []migrate.Warning, error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "conn")
+	}
+	defer func() { _ = conn.Close() }()
+
+	res, err := conn.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, err := conn.QueryContext(ctx, `SHOW WARNINGS`)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "show warnings")
+	}
+	defer func() { _ = rows.Close() }()
+
+	var warnings []migrate.Warning
+	for rows.Next() {
+		var (
+			level, message string
+			code           int
+		)
+		if err = rows.Scan(&level, &code, &message); err != nil {
+			return nil, nil, errors.Wrap(err, "scan warning")
+		}
+		var truncation bool
+		switch code {
+		case 1264, // ER_WARN_DATA_OUT_OF_RANGE
+			1265, // WARN_DATA_TRUNCATED
+			1292, // ER_TRUNCATED_WRONG_VALUE
+			1366, // ER_TRUNCATED_WRONG_VALUE_FOR_FIELD
+			1406: // ER_DATA_TOO_LONG
+			truncation = true
+		}
+		warnings = append(warnings, migrate.Warning{
+			Level:      level,
+			Code:       strconv.Itoa(code),
+			Message:    message,
+			Truncation: truncation,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, errors.Wrap(err, "warnings")
+	}
+	return res, warnings, nil
+}
+
+// Analyze refreshes the key distribution statistics of table with ANALYZE
+// TABLE, which reports problems such as a missing table as rows rather than
+// errors.
+func (db *DB) Analyze(table string) error {
+	parts := strings.Split(table, ".")
+	for i, p := range parts {
+		parts[i] = "`" + strings.ReplaceAll(p, "`", "``") + "`"
+	}
+	rows, err := db.Query(`ANALYZE TABLE ` + strings.Join(parts, "."))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rows.Close() }()
+	for rows.Next() {
+		var name, op, msgType, msgText string
+		if err = rows.Scan(&name, &op, &msgType, &msgText); err != nil {
+			return errors.Wrap(err, "scan")
+		}
+		if strings.EqualFold(msgType, "error") {
+			return errors.New(msgText)
+		}
+	}
+	return rows.Err()
+}
+
+// ReadOnly reports whether the server is read_only, as replicas usually are.
+func (db *DB) ReadOnly() (string, error) {
+	var readOnly bool
+	if err := db.Get(&readOnly, `SELECT @@GLOBAL.read_only`); err != nil {
+		return "", errors.Wrap(err, "get read_only")
+	}
+	if readOnly {
+		return "server is read_only", nil
+	}
+	return "", nil
+}
+
+// ClassifyError by its MySQL error number.
+func (db *DB) ClassifyError(err error) migrate.ErrorClass {
+	if errors.Is(err, mysql.ErrInvalidConn) {
+		return migrate.ClassConnectionLost
+	}
+	var myErr *mysql.MySQLError
+	if !errors.As(err, &myErr) {
+		return migrate.ClassUnknown
+	}
+	switch myErr.Number {
+	case 1044, // ER_DBACCESS_DENIED_ERROR
+		1045, // ER_ACCESS_DENIED_ERROR
+		1142, // ER_TABLEACCESS_DENIED_ERROR
+		1143, // ER_COLUMNACCESS_DENIED_ERROR
+		1227: // ER_SPECIFIC_ACCESS_DENIED_ERROR
+		return migrate.ClassPermissionDenied
+	case 1007, // ER_DB_CREATE_EXISTS
+		1050, // ER_TABLE_EXISTS_ERROR
+		1060, // ER_DUP_FIELDNAME
+		1061, // ER_DUP_KEYNAME
+		1304, // ER_SP_ALREADY_EXISTS
+		1359, // ER_TRG_ALREADY_EXISTS
+		1826: // ER_FK_DUP_NAME
+		return migrate.ClassDuplicateObject
+	case 1205, // ER_LOCK_WAIT_TIMEOUT
+		1213, // ER_LOCK_DEADLOCK
+		3572: // ER_LOCK_NOWAIT
+		return migrate.ClassLockTimeout
+	case 1064, // ER_PARSE_ERROR
+		1149: // ER_SYNTAX_ERROR
+		return migrate.ClassSyntax
+	case 2006, // CR_SERVER_GONE_ERROR
+		2013: // CR_SERVER_LOST
+		return migrate.ClassConnectionLost
+	}
+	return migrate.ClassUnknown
+}
+
+// lockName of the named lock on namespace. Names are limited to 64
+// characters and shared by every database on the server, so it's a hash of
+// the database and the namespace.
+func lockName(conn *sql.Conn, namespace string) (string, error) {
+	var dbName sql.NullString
+	q := `SELECT DATABASE()`
+	err := conn.QueryRowContext(context.Background(), q).Scan(&dbName)
+	if err != nil {
+		return "", errors.Wrap(err, "get database")
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(dbName.String + " " + namespace))
+	return fmt.Sprintf("thankful-ai/migrate:%x", h.Sum64()), nil
+}
+
+func (db *DB) CreateMetaLocksIfNotExists() error {
+	q := db.meta(`CREATE TABLE IF NOT EXISTS metalocks (
+		namespace VARCHAR(255) NOT NULL DEFAULT '',
+		hostname VARCHAR(255) NOT NULL,
+		pid INTEGER NOT NULL,
+		startedat DATETIME(6) NOT NULL,
+		filename VARCHAR(255) NOT NULL DEFAULT '',
+		PRIMARY KEY (namespace)
+	)`)
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "create metalocks table")
+	}
+	return nil
+}
+
+// TryLock namespace with GET_LOCK, held by a dedicated connection until
+// Unlock, so it's released by the server if the process dies.
+func (db *DB) TryLock(namespace string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.locks[namespace] != nil {
+		return false, errors.Errorf("%q is already locked", namespace)
+	}
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, "conn")
+	}
+	name, err := lockName(conn, namespace)
+	if err != nil {
+		_ = conn.Close()
+		return false, err
+	}
+	var locked sql.NullInt64
+	q := `SELECT GET_LOCK(?, 0)`
+	err = conn.QueryRowContext(ctx, q, name).Scan(&locked)
+	if err != nil || locked.Int64 != 1 {
+		_ = conn.Close()
+		return false, errors.Wrap(err, "get lock")
+	}
+	if db.locks == nil {
+		db.locks = map[string]*sql.Conn{}
+	}
+	db.locks[namespace] = conn
+	return true, nil
+}
+
+// GetLockHolder of namespace. It's empty if the holder was never recorded.
+func (db *DB) GetLockHolder(namespace string) (migrate.LockHolder, error) {
+	var holder migrate.LockHolder
+	q := db.meta(`
+	SELECT hostname, pid, startedat, filename FROM metalocks
+	WHERE namespace=?`)
+	err := db.Get(&holder, q, namespace)
+	switch {
+	case errors.Is(err, sql.ErrNoRows), noSuchTable(err):
+		// The holder hasn't created the table yet.
+		return holder, nil
+	}
+	return holder, err
+}
+
+// SetLockHolder records holder of namespace on the connection holding its
+// lock.
+func (db *DB) SetLockHolder(
+	namespace string,
+	holder migrate.LockHolder,
+) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	conn := db.locks[namespace]
+	if conn == nil {
+		return errors.Errorf("%q is not locked", namespace)
+	}
+	q := db.meta(`
+		INSERT INTO metalocks (namespace, hostname, pid, startedat, filename)
+		VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE hostname=VALUES(hostname), pid=VALUES(pid),
+			startedat=VALUES(startedat), filename=VALUES(filename)`)
+	_, err := conn.ExecContext(context.Background(), q, namespace,
+		holder.Hostname, holder.PID, holder.Started, holder.File)
+	return err
+}
+
+// Unlock namespace, removing its holder.
+func (db *DB) Unlock(namespace string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	conn := db.locks[namespace]
+	if conn == nil {
+		return errors.Errorf("%q is not locked", namespace)
+	}
+	q := db.meta(`DELETE FROM metalocks WHERE namespace=?`)
+	_, err := conn.ExecContext(context.Background(), q, namespace)
+	if noSuchTable(err) {
+		err = nil
+	}
+	if uerr := db.unlock(namespace); err == nil {
+		err = uerr
+	}
+	return errors.Wrap(err, "unlock")
+}
+
+// noSuchTable reports whether err is because a table doesn't exist, such as
+// metalocks before Init creates it.
+func noSuchTable(err error) bool {
+	var myErr *mysql.MySQLError
+	return errors.As(err, &myErr) && myErr.Number == 1146 // ER_NO_SUCH_TABLE
+}
+
+// unlock releases the named lock on namespace and its connection.
+func (db *DB) unlock(namespace string) error {
+	conn := db.locks[namespace]
+	delete(db.locks, namespace)
+	defer func() { _ = conn.Close() }()
+	name, err := lockName(conn, namespace)
+	if err == nil {
+		_, err = conn.ExecContext(context.Background(),
+			`SELECT RELEASE_LOCK(?)`, name)
+	}
+	if err != nil {
+		// Don't return the connection to the pool holding the lock.
+		_ = conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	}
+	return err
+}
+
+// Close the connection, unless it's from FromDB. It's safe to call even if
+// the connection was never opened.
+func (db *DB) Close() error {
+	if db.DB == nil || db.external {
+		return nil
+	}
+	return db.DB.Close()
+}
+
+// SetTablePrefix prepends prefix to the names of the meta tables. See
+// migrate.WithTablePrefix.
+func (db *DB) SetTablePrefix(prefix string) { db.prefix = prefix }
+
+// meta prefixes the names of the meta tables in the query q.
+func (db *DB) meta(q string) string {
+	return migrate.PrefixMetaTables(db.prefix, q)
+}
+
+// Ping checks that the database is reachable.
+func (db *DB) Ping(ctx context.Context) error { return db.DB.PingContext(ctx) }
 
 func (db *DB) Open() error {
+	if db.external {
+		if len(db.session) > 0 {
+			return errors.New("cannot configure a connection from FromDB")
+		}
+		return nil
+	}
 	if db.tlsConfig != nil {
 		err := mysql.RegisterTLSConfig(db.tlsConfig.ServerName,
 			db.tlsConfig.Config)
@@ -248,6 +1066,12 @@ func (db *DB) Open() error {
 			return errors.Wrap(err, "register tls config")
 		}
 	}
+	if len(db.session) > 0 {
+		c := migrate.SessionConnector(mysql.MySQLDriver{}, db.connURL,
+			db.session)
+		db.DB = sqlx.NewDb(sql.OpenDB(c), "mysql")
+		return nil
+	}
 	var err error
 	db.DB, err = sqlx.Open("mysql", db.connURL)
 	if err != nil {
@@ -2,16 +2,18 @@ package mysql
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
-	"github.com/thankful-ai/migrate"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
+	"github.com/thankful-ai/migrate"
 )
 
 const checkpointFile = "2.sql"
@@ -50,11 +52,44 @@ func TestCreateMetaCheckpointsIfNotExists(t *testing.T) {
 	check(t, err)
 }
 
+func TestLockHolder(t *testing.T) {
+	db := newDB(t)
+	defer teardown(t, db)
+
+	check(t, db.CreateMetaLocksIfNotExists())
+	ok, err := db.TryLock("")
+	check(t, err)
+	if !ok {
+		t.Fatal("expected lock")
+	}
+	want := migrate.LockHolder{
+		Hostname: "deployer",
+		PID:      42,
+		Started:  time.Date(2024, 5, 1, 9, 30, 0, 0, time.UTC),
+		File:     "1_create_users.sql",
+	}
+	check(t, db.SetLockHolder("", want))
+	holder, err := db.GetLockHolder("")
+	check(t, err)
+	if holder.Hostname != want.Hostname || holder.PID != want.PID ||
+		!holder.Started.Equal(want.Started) || holder.File != want.File {
+		t.Fatalf("expected %+v, got %+v", want, holder)
+	}
+
+	// Unlocking removes the holder.
+	check(t, db.Unlock(""))
+	holder, err = db.GetLockHolder("")
+	check(t, err)
+	if holder != (migrate.LockHolder{}) {
+		t.Fatalf("expected no holder, got %+v", holder)
+	}
+}
+
 func TestGetMigrations(t *testing.T) {
-	db := setupDBV1(t)
+	db := setupDBV8(t)
 	defer teardown(t, db)
 
-	ms, err := db.GetMigrations()
+	ms, err := db.GetMigrations("")
 	check(t, err)
 	if len(ms) != 1 {
 		t.Fatal("expected 1 migration")
@@ -62,10 +97,10 @@ func TestGetMigrations(t *testing.T) {
 }
 
 func TestGetMetaCheckpoints(t *testing.T) {
-	db := setupDBV1(t)
+	db := setupDBV8(t)
 	defer teardown(t, db)
 
-	mcs, err := db.GetMetaCheckpoints(checkpointFile)
+	mcs, err := db.GetMetaCheckpoints("", checkpointFile)
 	check(t, err)
 	if len(mcs) != 1 {
 		t.Fatal("expected 1 checkpoint")
@@ -73,18 +108,28 @@ func TestGetMetaCheckpoints(t *testing.T) {
 }
 
 func TestUpsertMigration(t *testing.T) {
-	db := setupDBV1(t)
+	db := setupDBV8(t)
 	defer teardown(t, db)
 
 	// Test update
-	err := db.UpsertMigration("1.sql", "SELECT 1;", "md5")
+	err := db.UpsertMigration(migrate.Migration{
+		Filename:  "1.sql",
+		Content:   "SELECT 1;",
+		Checksum:  "md5",
+		Algorithm: "md5",
+	})
 	check(t, err)
 
 	// Test insert
-	err = db.UpsertMigration("3.sql", "SELECT 3;", "md5")
+	err = db.UpsertMigration(migrate.Migration{
+		Filename:  "3.sql",
+		Content:   "SELECT 3;",
+		Checksum:  "md5",
+		Algorithm: "md5",
+	})
 	check(t, err)
 
-	ms, err := db.GetMigrations()
+	ms, err := db.GetMigrations("")
 	check(t, err)
 	if len(ms) != 2 {
 		t.Fatalf("expected 2 migrations, got %d", len(ms))
@@ -92,13 +137,13 @@ func TestUpsertMigration(t *testing.T) {
 }
 
 func TestInsertMetaCheckpoint(t *testing.T) {
-	db := setupDBV1(t)
+	db := setupDBV8(t)
 	defer teardown(t, db)
 
-	err := db.InsertMetaCheckpoint(checkpointFile, "SELECT 3;", "md5", 1)
+	err := db.InsertMetaCheckpoint("", checkpointFile, "SELECT 3;", "md5", 1)
 	check(t, err)
 
-	mcs, err := db.GetMetaCheckpoints(checkpointFile)
+	mcs, err := db.GetMetaCheckpoints("", checkpointFile)
 	check(t, err)
 	if len(mcs) != 2 {
 		t.Fatal("expected 2 checkpoints")
@@ -106,13 +151,18 @@ func TestInsertMetaCheckpoint(t *testing.T) {
 }
 
 func TestInsertMigration(t *testing.T) {
-	db := setupDBV1(t)
+	db := setupDBV8(t)
 	defer teardown(t, db)
 
-	err := db.InsertMigration("3.sql", "SELECT 3;", "md5")
+	err := db.InsertMigration(migrate.Migration{
+		Filename:  "3.sql",
+		Content:   "SELECT 3;",
+		Checksum:  "md5",
+		Algorithm: "md5",
+	})
 	check(t, err)
 
-	ms, err := db.GetMigrations()
+	ms, err := db.GetMigrations("")
 	check(t, err)
 	if len(ms) != 2 {
 		t.Fatal("expected 2 migrations")
@@ -120,19 +170,314 @@ func TestInsertMigration(t *testing.T) {
 }
 
 func TestDeleteMetaCheckpoints(t *testing.T) {
-	db := setupDBV1(t)
+	db := setupDBV8(t)
 	defer teardown(t, db)
 
-	err := db.DeleteMetaCheckpoints()
+	err := db.DeleteMetaCheckpoints("")
 	check(t, err)
 
-	mcs, err := db.GetMetaCheckpoints(checkpointFile)
+	mcs, err := db.GetMetaCheckpoints("", checkpointFile)
 	check(t, err)
 	if len(mcs) != 0 {
 		t.Fatal("expected 0 checkpoints")
 	}
 }
 
+func TestUpgradeToV2(t *testing.T) {
+	db := setupDBV8(t)
+	defer teardown(t, db)
+
+	ms, err := db.GetMigrations("")
+	check(t, err)
+	if len(ms) != 1 {
+		t.Fatalf("expected 1 migration, got %d", len(ms))
+	}
+	if ms[0].Algorithm != "md5" {
+		t.Fatalf("expected md5 algorithm, got %q", ms[0].Algorithm)
+	}
+}
+
+func TestUpsertMetaObject(t *testing.T) {
+	db := setupDBV8(t)
+	defer teardown(t, db)
+	err := db.CreateMetaObjectsIfNotExists()
+	check(t, err)
+
+	for _, content := range []string{"CREATE VIEW v1", "CREATE VIEW v2"} {
+		err = db.UpsertMetaObject(migrate.Object{
+			Filename: "v.sql",
+			Content:  content,
+		})
+		check(t, err)
+	}
+	objects, err := db.GetMetaObjects("")
+	check(t, err)
+	if len(objects) != 1 || objects[0].Content != "CREATE VIEW v2" {
+		t.Fatalf("unexpected objects %v", objects)
+	}
+}
+
+func TestUpgradeToV3(t *testing.T) {
+	db := setupDBV8(t)
+	defer teardown(t, db)
+
+	// Another namespace may reuse filenames without affecting the
+	// existing history in the default namespace.
+	err := db.InsertMigration(migrate.Migration{
+		Namespace: "auth",
+		Filename:  "1.sql",
+		Content:   "SELECT 1;",
+		Checksum:  "md5",
+		Algorithm: "md5",
+	})
+	check(t, err)
+	err = db.InsertMetaCheckpoint("auth", checkpointFile, "SELECT 2;",
+		"md5", 0)
+	check(t, err)
+	err = db.DeleteMetaCheckpoints("auth")
+	check(t, err)
+
+	ms, err := db.GetMigrations("")
+	check(t, err)
+	if len(ms) != 1 || ms[0].Namespace != "" {
+		t.Fatalf("unexpected default migrations %v", ms)
+	}
+	ms, err = db.GetMigrations("auth")
+	check(t, err)
+	if len(ms) != 1 || ms[0].Namespace != "auth" {
+		t.Fatalf("unexpected auth migrations %v", ms)
+	}
+	mcs, err := db.GetMetaCheckpoints("", checkpointFile)
+	check(t, err)
+	if len(mcs) != 1 {
+		t.Fatal("expected 1 checkpoint")
+	}
+}
+
+func TestLoadData(t *testing.T) {
+	db := setupDBV8(t)
+	defer teardown(t, db)
+
+	if _, err := db.Exec(`SET GLOBAL local_infile=1`); err != nil {
+		t.Skip("cannot enable local_infile:", err)
+	}
+	_, err := db.Exec(`CREATE TABLE users (id INTEGER, name TEXT)`)
+	check(t, err)
+	err = db.LoadData(`
+		LOAD DATA LOCAL INFILE 'users.csv' INTO TABLE users
+		FIELDS TERMINATED BY ','`, "users.csv", []byte("1,alice\n2,bob\n"))
+	check(t, err)
+
+	var n int
+	err = db.Get(&n, `SELECT COUNT(*) FROM users`)
+	check(t, err)
+	if n != 2 {
+		t.Fatalf("expected 2 users, got %d", n)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	db := setupDBV8(t)
+	defer teardown(t, db)
+
+	reason, err := db.ReadOnly()
+	check(t, err)
+	if reason != "" {
+		t.Fatalf("expected writable, got %q", reason)
+	}
+}
+
+func TestUpgradeToV4(t *testing.T) {
+	db := setupDBV8(t)
+	defer teardown(t, db)
+
+	err := db.InsertMigration(migrate.Migration{
+		Filename:  "2.sql",
+		Content:   "SELECT 2;",
+		Checksum:  "md5",
+		Algorithm: "md5",
+		Variant:   "mysql",
+	})
+	check(t, err)
+
+	ms, err := db.GetMigrations("")
+	check(t, err)
+	if len(ms) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(ms))
+	}
+	if ms[0].Variant != "" || ms[1].Variant != "mysql" {
+		t.Fatalf("unexpected variants %q, %q", ms[0].Variant, ms[1].Variant)
+	}
+}
+
+func TestUpgradeToV5(t *testing.T) {
+	db := setupDBV8(t)
+	defer teardown(t, db)
+
+	err := db.InsertMigration(migrate.Migration{
+		Filename:   "2.sql",
+		Content:    "SELECT 2;",
+		Checksum:   "md5",
+		Algorithm:  "md5",
+		Statements: 1,
+		Duration:   3 * time.Millisecond,
+	})
+	check(t, err)
+
+	ms, err := db.GetMigrations("")
+	check(t, err)
+	if len(ms) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(ms))
+	}
+	if ms[0].Statements != 0 || ms[0].Duration != 0 {
+		t.Fatalf("expected no stats for old migration, got %d, %s",
+			ms[0].Statements, ms[0].Duration)
+	}
+	if ms[1].Statements != 1 || ms[1].Duration != 3*time.Millisecond {
+		t.Fatalf("unexpected stats %d, %s", ms[1].Statements, ms[1].Duration)
+	}
+}
+
+func TestUpgradeToV6(t *testing.T) {
+	db := setupDBV8(t)
+
+	err := db.InsertMigration(migrate.Migration{
+		Filename:    "2.sql",
+		Content:     "SELECT 2;",
+		Checksum:    "md5",
+		Algorithm:   "md5",
+		Annotations: migrate.Annotations{"deploy": "d-42"},
+	})
+	check(t, err)
+
+	ms, err := db.GetMigrations("")
+	check(t, err)
+	if len(ms) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(ms))
+	}
+	if len(ms[0].Annotations) != 0 {
+		t.Fatalf("expected no annotations for old migration, got %v",
+			ms[0].Annotations)
+	}
+	if ms[1].Annotations["deploy"] != "d-42" {
+		t.Fatalf("unexpected annotations %v", ms[1].Annotations)
+	}
+}
+
+func TestUpgradeToV7(t *testing.T) {
+	db := setupDBV6(t)
+
+	err := db.UpgradeToV7()
+	check(t, err)
+	v, err := db.GetMetaVersion()
+	check(t, err)
+	if v != 7 {
+		t.Fatalf("expected version 7, got %d", v)
+	}
+}
+
+func TestUpgradeToV8(t *testing.T) {
+	db := setupDBV7(t)
+
+	err := db.UpgradeToV8()
+	check(t, err)
+	appliedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	err = db.InsertMigration(migrate.Migration{
+		Filename:  "2.sql",
+		Content:   "SELECT 2;",
+		Checksum:  "md5",
+		Algorithm: "md5",
+		AppliedAt: appliedAt,
+	})
+	check(t, err)
+
+	ms, err := db.GetMigrations("")
+	check(t, err)
+	if len(ms) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(ms))
+	}
+	if ms[0].AppliedAt.IsZero() {
+		t.Fatal("expected old migration to be applied when recorded")
+	}
+	if !ms[1].AppliedAt.Equal(appliedAt) {
+		t.Fatalf("expected applied at %s, got %s", appliedAt,
+			ms[1].AppliedAt)
+	}
+}
+
+func TestInsertMetaFailure(t *testing.T) {
+	db := setupDBV8(t)
+	defer teardown(t, db)
+
+	err := db.InsertMetaFailure(migrate.Failure{
+		Filename: "2.sql",
+		Index:    1,
+		Error:    "syntax error",
+	})
+	check(t, err)
+
+	fs, err := db.GetMetaFailures("")
+	check(t, err)
+	if len(fs) != 1 {
+		t.Fatalf("expected 1 failure, got %d", len(fs))
+	}
+	if fs[0].Filename != "2.sql" || fs[0].Index != 1 ||
+		fs[0].Error != "syntax error" || fs[0].FailedAt.IsZero() {
+		t.Fatalf("unexpected failure %+v", fs[0])
+	}
+	fs, err = db.GetMetaFailures("other")
+	check(t, err)
+	if len(fs) != 0 {
+		t.Fatalf("expected no failures in other namespace, got %d", len(fs))
+	}
+}
+
+func TestExecWarnings(t *testing.T) {
+	db := setupDBV8(t)
+	defer teardown(t, db)
+
+	_, err := db.Exec(`CREATE TABLE users (name VARCHAR(1))`)
+	check(t, err)
+	_, warnings, err := db.ExecWarnings(
+		`INSERT IGNORE INTO users (name) VALUES (?)`, "alice")
+	check(t, err)
+	if len(warnings) != 1 || !warnings[0].Truncation {
+		t.Fatalf("expected truncation warning, got %v", warnings)
+	}
+}
+
+func TestGetMetaVersion(t *testing.T) {
+	db := setupDBV0(t)
+	defer teardown(t, db)
+
+	v, err := db.GetMetaVersion()
+	check(t, err)
+	if v != 0 {
+		t.Fatalf("expected version 0, got %d", v)
+	}
+
+	err = db.UpgradeToV1(nil)
+	check(t, err)
+	err = db.UpgradeToV2()
+	check(t, err)
+	v, err = db.GetMetaVersion()
+	check(t, err)
+	if v != 2 {
+		t.Fatalf("expected version 2, got %d", v)
+	}
+}
+
+func TestGetMetaVersionMissing(t *testing.T) {
+	db := newDB(t)
+	defer teardown(t, db)
+
+	v, err := db.GetMetaVersion()
+	check(t, err)
+	if v != -1 {
+		t.Fatalf("expected -1 without meta tables, got %d", v)
+	}
+}
+
 func check(t *testing.T, err error) {
 	t.Helper()
 	if err != nil {
@@ -143,6 +488,23 @@ func check(t *testing.T, err error) {
 func must(err error) {
 }
 
+func TestFromDB(t *testing.T) {
+	sqldb := createDBAndOpen(t).DB
+	defer sqldb.Close()
+
+	db := FromDB(sqldb)
+	err := migrate.OpenStore(context.Background(), db)
+	check(t, err)
+	err = db.CreateMetaIfNotExists()
+	check(t, err)
+
+	// The caller's connection stays open.
+	err = db.Close()
+	check(t, err)
+	err = sqldb.Ping()
+	check(t, err)
+}
+
 func newDB(t *testing.T) *DB {
 	db := createDBAndOpen(t)
 	return &DB{DB: db}
@@ -218,6 +580,57 @@ func teardown(t *testing.T, db *DB) {
 	check(t, err)
 }
 
+func setupDBV8(t *testing.T) *DB {
+	db := setupDBV7(t)
+	err := db.UpgradeToV8()
+	check(t, err)
+	return db
+}
+
+func setupDBV7(t *testing.T) *DB {
+	db := setupDBV6(t)
+	err := db.UpgradeToV7()
+	check(t, err)
+	return db
+}
+
+func setupDBV6(t *testing.T) *DB {
+	db := setupDBV5(t)
+	err := db.UpgradeToV6()
+	check(t, err)
+	return db
+}
+
+func setupDBV5(t *testing.T) *DB {
+	db := setupDBV4(t)
+	err := db.UpgradeToV5()
+	check(t, err)
+	err = db.CreateMetaFailuresIfNotExists()
+	check(t, err)
+	return db
+}
+
+func setupDBV4(t *testing.T) *DB {
+	db := setupDBV3(t)
+	err := db.UpgradeToV4()
+	check(t, err)
+	return db
+}
+
+func setupDBV3(t *testing.T) *DB {
+	db := setupDBV2(t)
+	err := db.UpgradeToV3()
+	check(t, err)
+	return db
+}
+
+func setupDBV2(t *testing.T) *DB {
+	db := setupDBV1(t)
+	err := db.UpgradeToV2()
+	check(t, err)
+	return db
+}
+
 func setupDBV1(t *testing.T) *DB {
 	db := setupDBV0(t)
 	err := db.UpgradeToV1([]migrate.Migration{{
@@ -0,0 +1,23 @@
+// Package mysqlparse validates MySQL and MariaDB migrations offline using the
+// TiDB parser, which accepts the MySQL dialect. It's kept out of the migrate
+// package to avoid the dependency.
+package mysqlparse
+
+import (
+	"github.com/pingcap/tidb/parser"
+	"github.com/thankful-ai/migrate"
+
+	// Register the expression implementation the parser requires.
+	_ "github.com/pingcap/tidb/parser/test_driver"
+)
+
+// Validate parses stmt as MySQL, returning any syntax error. TiDB's parser
+// doesn't support every statement MySQL does, such as stored procedures, so
+// migrations using them can't be validated.
+func Validate(stmt string) error {
+	_, _, err := parser.New().Parse(stmt, "", "")
+	return err
+}
+
+// Validator for migrate.WithValidator.
+var Validator migrate.Validator = Validate
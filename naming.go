@@ -0,0 +1,151 @@
+package migrate
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// Naming is a scheme for numbering migration files.
+type Naming string
+
+const (
+	// NamingSequential numbers migrations 1, 2, 3, or with any other
+	// integer prefix. It's the default.
+	NamingSequential Naming = "sequential"
+
+	// NamingTimestamp names migrations by the UTC time they were created,
+	// as YYYYMMDDHHMMSS_description.sql, so migrations added on different
+	// branches rarely share a number.
+	NamingTimestamp Naming = "timestamp"
+)
+
+// timestampLayout of the prefix of migrations named by NamingTimestamp.
+const timestampLayout = "20060102150405"
+
+// regexTimestampName matches the filename of a migration named by
+// NamingTimestamp.
+var regexTimestampName = regexp.MustCompile(`^(\d{14})_[^.]`)
+
+// WithNaming requires pending migrations to be named by n. Migrations which
+// were already applied aren't checked, so a project can switch from
+// sequential numbers to timestamps once its numbered migrations are deployed;
+// every timestamp sorts after them.
+func WithNaming(n Naming) Option {
+	return func(m *Migrate) {
+		if n == NamingTimestamp {
+			m.policies = append(m.policies, TimestampNames())
+		}
+	}
+}
+
+// TimestampNames requires filenames to be named by NamingTimestamp with a
+// valid time, such as 20240102150405_add_email.sql. See WithNaming.
+func TimestampNames() FilenamePolicy {
+	return func(filename string) error {
+		if _, ok := timestampOf(filename); !ok {
+			return fmt.Errorf("must be named YYYYMMDDHHMMSS_description in UTC, such as %s_add_email.sql",
+				time.Now().UTC().Format(timestampLayout))
+		}
+		return nil
+	}
+}
+
+// timestampOf a migration filename named by NamingTimestamp.
+func timestampOf(filename string) (time.Time, bool) {
+	match := regexTimestampName.FindStringSubmatch(filename)
+	if match == nil {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(timestampLayout, match[1])
+	return t, err == nil
+}
+
+// nextTimestamp after every timestamp-named file in names, which is now unless
+// the clock is behind or another file was created this second.
+func nextTimestamp(names []string, now time.Time) string {
+	t := now.UTC().Truncate(time.Second)
+	for _, name := range names {
+		if latest, ok := timestampOf(name); ok && !t.After(latest) {
+			t = latest.Add(time.Second)
+		}
+	}
+	return t.Format(timestampLayout)
+}
+
+// NewFilename for a migration in dir described by description, such as "add
+// email", which is numbered after every existing migration by n: one more
+// than the highest number for NamingSequential, keeping its width, or the
+// current time for NamingTimestamp. It has the first of extensions, or .sql if
+// none are given. NewFilename doesn't create the file.
+func NewFilename(
+	dir, description string,
+	n Naming,
+	extensions ...string,
+) (string, error) {
+	desc := strings.Join(strings.FieldsFunc(strings.ToLower(description),
+		func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}), "_")
+	if desc == "" {
+		return "", errors.New("migration description required")
+	}
+	exts := normalizeExtensions(extensions)
+	fsys := dirFS(dir)
+	f, err := newFilter(fsys, exts)
+	if err != nil {
+		return "", err
+	}
+	infos, err := readDirInfos(fsys, ".")
+	if err != nil {
+		return "", errors.Wrap(err, "read dir")
+	}
+	var names []string
+	for _, fi := range infos {
+		name := fi.Name()
+		if !fi.IsDir() && f.isMigration(name) && !isDownFile(name) &&
+			unicode.IsDigit(rune(name[0])) {
+			names = append(names, name)
+		}
+	}
+	switch n {
+	case NamingTimestamp:
+		return nextTimestamp(names, time.Now()) + "_" + desc + exts[0], nil
+	case NamingSequential, "":
+	default:
+		return "", fmt.Errorf("unknown naming %q", n)
+	}
+	var max uint64
+	width := 1
+	for _, name := range names {
+		num, err := fileNumber(name)
+		if err != nil {
+			return "", err
+		}
+		if num >= max {
+			max, width = num, len(regexNum.FindString(name))
+		}
+	}
+	num := strconv.FormatUint(max+1, 10)
+	for len(num) < width {
+		num = "0" + num
+	}
+	return num + "_" + desc + exts[0], nil
+}
+
+// duplicateNumber reports that the files a and b share num, and how to
+// resolve it.
+func duplicateNumber(a, b string, num fileOrder) error {
+	hint := "move one after the others with Renumber"
+	_, aok := timestampOf(a)
+	if _, bok := timestampOf(b); aok && bok {
+		hint = "they were created in the same second, so give one a later timestamp with Renumber"
+	}
+	return fmt.Errorf("%w: %s and %s share %s: %s", ErrDuplicateNumber, a,
+		b, num, hint)
+}
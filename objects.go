@@ -0,0 +1,343 @@
+package migrate
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// objectsDir is the subdirectory of the migration directory containing
+// repeatable objects, such as views, functions, and grants.
+const objectsDir = "objects"
+
+// repeatableDir is read like objectsDir, for those who know objects as
+// repeatable migrations.
+const repeatableDir = "repeatable"
+
+// repeatablePrefix marks a file in the migration directory as an object, like
+// Flyway's R__ prefix, which is also accepted.
+const repeatablePrefix = "r_"
+
+// isRepeatable reports whether the file name in the migration directory is an
+// object rather than a numbered migration.
+func isRepeatable(name string) bool {
+	return strings.HasPrefix(strings.ToLower(name), repeatablePrefix)
+}
+
+// Object records the content of a file in the objects directory when it was
+// last applied.
+type Object struct {
+	Namespace string
+	Filename  string
+	Content   string
+}
+
+// object is a file in the objects directory. Unlike migrations, objects are
+// dropped and recreated whenever they change.
+type object struct {
+	name     string
+	fullpath string
+	content  string
+
+	// body of the file without directives.
+	body []byte
+
+	// requires lists the objects which must be created before this one,
+	// from `-- migrate:requires a.sql b.sql` directives.
+	requires []string
+
+	// drop statements, from `-- migrate:drop DROP VIEW ...` directives,
+	// which remove the object before it's recreated.
+	drop []string
+}
+
+// directivePrefix begins a line which configures how a file is applied,
+// rather than SQL to execute.
+const directivePrefix = "-- migrate:"
+
+// parseDirectives removes directive lines from byt and reports them as
+// name-argument pairs.
+func parseDirectives(byt []byte) ([][2]string, []byte, error) {
+	var (
+		directives [][2]string
+		body       bytes.Buffer
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(byt))
+	scanner.Buffer(nil, len(byt)+1)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		// Only blocks are kept for parsing statements.
+		if !strings.HasPrefix(trimmed, directivePrefix) ||
+			isOnlyDirective(trimmed) {
+			body.WriteString(line)
+			body.WriteByte('\n')
+			continue
+		}
+		parts := strings.SplitN(
+			strings.TrimPrefix(trimmed, directivePrefix), " ", 2)
+		var arg string
+		if len(parts) == 2 {
+			arg = strings.TrimSpace(parts[1])
+		}
+		directives = append(directives, [2]string{parts[0], arg})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return directives, body.Bytes(), nil
+}
+
+// readObjects for dbt in the objects and repeatable subdirectories of fsys,
+// and files prefixed by r_ in fsys itself, sorted so that every object follows
+// those it requires. It's not an error for the subdirectories to be missing.
+func readObjects(fsys fs.FS, f filter, dbt DBType) ([]*object, error) {
+	objects := map[string]*object{}
+	for _, dir := range []string{objectsDir, repeatableDir, "."} {
+		if err := readObjectDir(objects, fsys, dir, f, dbt); err != nil {
+			return nil, err
+		}
+	}
+	return sortObjects(objects)
+}
+
+// readObjectDir adds the objects in dir to objects, keyed by filename, so they
+// can require each other wherever they're kept. In the migration directory
+// itself, only files prefixed by r_ are objects.
+func readObjectDir(
+	objects map[string]*object,
+	fsys fs.FS,
+	dir string,
+	f filter,
+	dbt DBType,
+) error {
+	root := dir == "."
+	if !root && f.ignored(dir, true) {
+		return nil
+	}
+	tmp, err := readDirInfos(fsys, dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "read %s dir", dir)
+	}
+	for _, fi := range tmp {
+		if fi.IsDir() || !f.isMigration(path.Join(dir, fi.Name())) {
+			continue
+		}
+		if root && !isRepeatable(fi.Name()) {
+			continue
+		}
+		if prev, ok := objects[fi.Name()]; ok {
+			return fmt.Errorf("object %s is in both %s and %s",
+				fi.Name(), path.Dir(prev.fullpath), dir)
+		}
+		o := &object{
+			name:     fi.Name(),
+			fullpath: path.Join(dir, fi.Name()),
+		}
+		byt, err := fs.ReadFile(fsys, o.fullpath)
+		if err != nil {
+			return errors.Wrap(err, "read file")
+		}
+		o.content = string(byt)
+		directives, body, err := parseDirectives(byt)
+		if err != nil {
+			return fmt.Errorf("directives %s: %w", o.name, err)
+		}
+		o.body = body
+		for _, d := range directives {
+			switch d[0] {
+			case "requires":
+				o.requires = append(o.requires,
+					strings.Fields(d[1])...)
+			case "drop":
+				o.drop = append(o.drop, d[1])
+			default:
+				return fmt.Errorf("%s: unknown directive %q",
+					o.name, d[0])
+			}
+		}
+		cmds, err := StatementsFor(dbt, o.body)
+		if err != nil {
+			return fmt.Errorf("statements %s: %w", o.name, err)
+		}
+		if len(cmds) == 0 {
+			return fmt.Errorf("%w: %s", ErrNoStatements, o.name)
+		}
+		objects[o.name] = o
+	}
+	return nil
+}
+
+// sortObjects topologically by their requirements, breaking ties by name so
+// the order is stable.
+func sortObjects(objects map[string]*object) ([]*object, error) {
+	names := make([]string, 0, len(objects))
+	for name, o := range objects {
+		names = append(names, name)
+		for _, req := range o.requires {
+			if _, ok := objects[req]; !ok {
+				return nil, fmt.Errorf("%s requires missing object %s",
+					name, req)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[string]int{}
+	sorted := make([]*object, 0, len(objects))
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("dependency cycle at object %s", name)
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		reqs := append([]string(nil), objects[name].requires...)
+		sort.Strings(reqs)
+		for _, req := range reqs {
+			if err := visit(req); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		sorted = append(sorted, objects[name])
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+// changedObjects which differ from the content last applied, along with every
+// object which depends on them, since dropping an object may drop or block on
+// its dependents. They're returned in creation order.
+func (m *Migrate) changedObjects() ([]*object, error) {
+	if len(m.objects) == 0 {
+		return nil, nil
+	}
+	if m.version < 0 {
+		// Inspect found no meta tables, so nothing was applied.
+		return m.objects, nil
+	}
+	applied, err := m.tracker.GetMetaObjects(m.namespace)
+	if err != nil {
+		return nil, errors.Wrap(err, "get objects")
+	}
+	content := make(map[string]string, len(applied))
+	for _, o := range applied {
+		content[o.Filename] = o.Content
+	}
+	changed := map[string]bool{}
+	for _, o := range m.objects {
+		prev, ok := content[o.name]
+		if !ok || prev != o.content {
+			changed[o.name] = true
+			continue
+		}
+
+		// Objects are sorted, so requirements have already been
+		// considered.
+		for _, req := range o.requires {
+			if changed[req] {
+				changed[o.name] = true
+				break
+			}
+		}
+	}
+	var objects []*object
+	for _, o := range m.objects {
+		if changed[o.name] {
+			objects = append(objects, o)
+		}
+	}
+	return objects, nil
+}
+
+// PendingObjects reports the files in the objects directory which Migrate
+// would drop and recreate, in creation order. It requires Init or Inspect.
+func (m *Migrate) PendingObjects() ([]string, error) {
+	objects, err := m.changedObjects()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(objects))
+	for _, o := range objects {
+		names = append(names, o.name)
+	}
+	return names, nil
+}
+
+// migrateObjects drops every changed object, dependents first, then recreates
+// them in dependency order. This function reports whether any object was
+// recreated.
+func (m *Migrate) migrateObjects() (bool, error) {
+	objects, err := m.changedObjects()
+	if err != nil {
+		return false, err
+	}
+	for i := len(objects) - 1; i >= 0; i-- {
+		for j, cmd := range objects[i].drop {
+			m.debugf("> %s\n", m.colorize(colorDim, m.redact(cmd)))
+			m.record("exec %s [drop %d]\n%s", objects[i].name, j,
+				m.redact(cmd))
+			if _, err := m.exec(m.db, cmd); err != nil {
+				return false, &MigrationError{
+					File:  objects[i].fullpath,
+					Index: j,
+					SQL:   m.redact(cmd),
+					Class: m.classifyError(err),
+					Err:   err,
+				}
+			}
+		}
+	}
+	for _, o := range objects {
+		// Statements were validated in readObjects.
+		cmds, _ := StatementsFor(m.dbt, o.body)
+		for i, cmd := range cmds {
+			m.record("exec %s [%d]\n%s", o.name, i, m.redact(cmd))
+			if _, err := m.exec(m.db, cmd); err != nil {
+				m.errorf("%s %s\n", m.colorize(colorRed,
+					"failed on"), m.redact(cmd))
+				return false, &MigrationError{
+					File:  o.fullpath,
+					Index: i,
+					SQL:   m.redact(cmd),
+					Class: m.classifyError(err),
+					Err:   err,
+				}
+			}
+		}
+		err = m.tracker.UpsertMetaObject(Object{
+			Namespace: m.namespace,
+			Filename:  o.name,
+			Content:   o.content,
+		})
+		if err != nil {
+			return false, errors.Wrap(err, "upsert object")
+		}
+		m.infof("%s %s\n", m.colorize(colorGreen, "recreated"),
+			o.fullpath)
+	}
+	return len(objects) > 0, nil
+}
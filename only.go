@@ -0,0 +1,112 @@
+package migrate
+
+import (
+	"fmt"
+	"strings"
+)
+
+// onlyDirective limits the lines between it and an end to the DB types it
+// lists, so one file can carry the statements of several databases rather
+// than near-duplicates in their override directories:
+//
+//	-- migrate:only postgres
+//	CREATE INDEX CONCURRENTLY users_email ON users (email);
+//	-- migrate:only end
+//	-- migrate:only mysql mariadb
+//	CREATE INDEX users_email ON users (email) ALGORITHM=INPLACE;
+//	-- migrate:only end
+//
+// DB types are matched exactly, so a block for postgres doesn't apply to
+// cockroach unless it lists both. Blocks can't be nested.
+const onlyDirective = directivePrefix + "only"
+
+// isOnlyDirective reports whether the trimmed line begins or ends an only
+// block.
+func isOnlyDirective(trimmed string) bool {
+	return trimmed == onlyDirective ||
+		strings.HasPrefix(trimmed, onlyDirective+" ")
+}
+
+// onlyBlock tracks the block opened by only directives while reading a file.
+type onlyBlock struct {
+	open bool
+
+	// skip the lines of the open block, which is for other DB types.
+	skip bool
+}
+
+// directive updates the block from the trimmed only directive for dbt.
+func (b *onlyBlock) directive(dbt DBType, trimmed string) error {
+	args := strings.Fields(strings.TrimPrefix(trimmed, onlyDirective))
+	if len(args) == 1 && args[0] == "end" {
+		if !b.open {
+			return fmt.Errorf("%s end without a db type", onlyDirective)
+		}
+		*b = onlyBlock{}
+		return nil
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("%s requires db types or end", onlyDirective)
+	}
+	if b.open {
+		return fmt.Errorf("nested %s %s", onlyDirective,
+			strings.Join(args, " "))
+	}
+	b.open, b.skip = true, true
+	for _, arg := range args {
+		if !knownDBType(DBType(arg)) {
+			return fmt.Errorf("%s: unknown db type %q", onlyDirective,
+				arg)
+		}
+		if DBType(arg) == dbt {
+			b.skip = false
+		}
+	}
+	return nil
+}
+
+// close the file, reporting a block which was never ended.
+func (b *onlyBlock) close() error {
+	if b.open {
+		return fmt.Errorf("%s without end", onlyDirective)
+	}
+	return nil
+}
+
+// filterOnly removes the only directives from s, along with the lines of
+// blocks for DB types other than dbt.
+func filterOnly(dbt DBType, s string) (string, error) {
+	if !strings.Contains(s, onlyDirective) {
+		return s, nil
+	}
+	var (
+		block onlyBlock
+		text  strings.Builder
+	)
+	for _, line := range strings.SplitAfter(s, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case isOnlyDirective(trimmed):
+			if err := block.directive(dbt, trimmed); err != nil {
+				return "", err
+			}
+		case !block.skip:
+			text.WriteString(line)
+		}
+	}
+	if err := block.close(); err != nil {
+		return "", err
+	}
+	return text.String(), nil
+}
+
+// knownDBType reports whether dbt is one of the DBTypes.
+func knownDBType(dbt DBType) bool {
+	switch dbt {
+	case DBTypeMySQL, DBTypeMariaDB, DBTypePostgres, DBTypeSQLite,
+		DBTypeBigQuery, DBTypeYugabyte, DBTypeCockroach,
+		DBTypeClickHouse, DBTypeOracle, DBTypeDB2, DBTypeSQLServer:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package migrate
+
+import "io"
+
+// Option configures optional behavior in New.
+type Option func(*Migrate)
+
+// WithLogger logs progress and problems to log. The default is StdLogger,
+// except for Inspect, which logs nothing.
+func WithLogger(log Logger) Option {
+	return func(m *Migrate) { m.log = log }
+}
+
+// WithDBType of the database being migrated, which selects the override
+// directories to use and how statements are split. It's required.
+func WithDBType(dbt DBType) Option {
+	return func(m *Migrate) { m.dbt = dbt }
+}
+
+// WithSkip records every file up to and including filename as migrated
+// without running it when New prepares the database, which enables you to
+// start using this package on an existing database. See Init.
+func WithSkip(filename string) Option {
+	return func(m *Migrate) { m.skipTo = filename }
+}
+
+// WithHasher computes checksums for new migrations using h. Migrations
+// recorded with a different algorithm continue to be verified with the
+// matching Hasher, so WithHasher may be passed multiple times; the last one
+// wins for new migrations.
+func WithHasher(h Hasher) Option {
+	return func(m *Migrate) {
+		m.hasher = h
+		m.hashers[h.Algorithm()] = h
+	}
+}
+
+// WithColor colorizes log output: applied migrations in green, failures in
+// red, and statement previews dimmed. It's intended for terminals, so callers
+// should check that output is a TTY and respect NO_COLOR.
+func WithColor(enabled bool) Option {
+	return func(m *Migrate) { m.color = enabled }
+}
+
+// WithTranscript writes a timestamped record of every executed statement and
+// its result to w. Unlike log output, statements are never truncated. Write
+// errors are logged but don't interrupt migrations.
+func WithTranscript(w io.Writer) Option {
+	return func(m *Migrate) { m.transcript = &transcript{w: w} }
+}
+
+// WithNamespace keeps a separate migration history named ns, so multiple
+// services can migrate the same database independently, each from its own
+// directory. The default namespace is empty. Files in different namespaces
+// may share names.
+func WithNamespace(ns string) Option {
+	return func(m *Migrate) { m.namespace = ns }
+}
+
+// WithBatchSize sends runs of up to n statements to the database in one round
+// trip when the Store implements Batcher, which speeds up migrations with many
+// small statements, such as seed data. Statements with blobs, data files, or
+// COPY blocks are always sent alone. Each statement is still checkpointed, but
+// only after its whole batch succeeds. The default of 1 disables batching.
+func WithBatchSize(n int) Option {
+	return func(m *Migrate) { m.batchSize = n }
+}
+
+// WithWarnings logs the warnings raised by each statement when the Store
+// implements Warner, such as Postgres notices from RAISE NOTICE. On MySQL,
+// this costs a round trip per statement.
+func WithWarnings() Option {
+	return func(m *Migrate) { m.warnings = true }
+}
+
+// WithFailOnTruncation logs warnings like WithWarnings and fails the migration
+// with ErrTruncation if a statement truncated or coerced data, which MySQL
+// otherwise does silently outside of strict mode.
+func WithFailOnTruncation() Option {
+	return func(m *Migrate) {
+		m.warnings = true
+		m.failOnTruncation = true
+	}
+}
+
+// WithOverrideFallback uses the override directories of fallbacks, in order,
+// for files which dbt has no override of its own. By default, MariaDB falls
+// back to the mysql directory, and YugabyteDB and CockroachDB to the postgres
+// directory, since most overrides apply to both. For example,
+// WithOverrideFallback(DBTypeMySQL, DBTypeMariaDB) lets MySQL fall back to the
+// mariadb directory, and WithOverrideFallback(DBTypeMariaDB) disables the
+// default.
+func WithOverrideFallback(dbt DBType, fallbacks ...DBType) Option {
+	return func(m *Migrate) { m.fallbacks[dbt] = fallbacks }
+}
+
+// WithExtensions treats files with any of exts as migrations, rather than
+// only .sql files, such as WithExtensions(".sql", ".ddl"). It applies to the
+// override and objects directories too, and an override must have the same
+// name as the migration it replaces, including its extension.
+func WithExtensions(exts ...string) Option {
+	return func(m *Migrate) { m.extensions = normalizeExtensions(exts) }
+}
+
+// WithoutCheckpointContent records only the checksum of each checkpointed
+// statement, rather than also its text. Checkpoints are verified by checksum
+// when resuming, so the text is redundant, and for data-heavy migrations it's
+// enormous.
+func WithoutCheckpointContent() Option {
+	return func(m *Migrate) { m.checkpointContent = false }
+}
+
+// WithTrackingStore records the migration history in s rather than the
+// database being migrated, for databases which can't hold the meta tables,
+// such as vendor-managed schemas. Migrations are still executed on the Store
+// passed to New. Every run must use the same tracking store, or migrations
+// will be applied twice.
+func WithTrackingStore(s Store) Option {
+	return func(m *Migrate) { m.tracker = s }
+}
+
+// WithFIPS restricts checksums to FIPS-approved hashes, using SHA256Hasher by
+// default. MD5 is never computed: migrations recorded with md5 checksums are
+// instead verified by comparing the file byte-for-byte against the content
+// stored in the meta table. FIPS mode is enabled automatically in
+// boringcrypto builds and when Go's FIPS 140-3 mode is on.
+func WithFIPS() Option {
+	return func(m *Migrate) { m.fips = true }
+}
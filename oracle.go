@@ -0,0 +1,88 @@
+package migrate
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// plsqlEnd alone on a line ends a PL/SQL block on Oracle, following SQL*Plus
+// and SQLcl, since the block contains semicolons. Other statements end with
+// semicolons as usual, or with plsqlEnd:
+//
+//	CREATE TABLE counts (n NUMBER);
+//	CREATE OR REPLACE PROCEDURE reset_counts AS
+//	BEGIN
+//		UPDATE counts SET n = 0;
+//	END;
+//	/
+const plsqlEnd = "/"
+
+// regexPLSQLBlock matches the first line of a statement which is a PL/SQL
+// block, and so continues until plsqlEnd.
+var regexPLSQLBlock = regexp.MustCompile(`(?i)^(?:declare|begin)\b|` +
+	`^create\s+(?:or\s+replace\s+)?(?:(?:editionable|noneditionable)\s+)?` +
+	`(?:procedure|function|package|trigger|type|library)\b`)
+
+// splitPLSQL splits s into statements for Oracle. PL/SQL blocks are returned
+// whole, including the semicolon after their END, which Oracle requires.
+func splitPLSQL(s string) ([]statement, error) {
+	var (
+		stmts        []statement
+		plain, block strings.Builder
+		inBlock      bool
+	)
+	flushPlain := func() error {
+		plainStmts, err := splitStatements(DBTypeOracle, plain.String())
+		if err != nil {
+			return err
+		}
+		stmts = append(stmts, plainStmts...)
+		plain.Reset()
+		return nil
+	}
+	for _, line := range strings.SplitAfter(s, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case inBlock && trimmed == plsqlEnd:
+			stmts = append(stmts, statement{sql: block.String()})
+			block.Reset()
+			inBlock = false
+		case inBlock:
+			block.WriteString(line)
+		case trimmed == plsqlEnd:
+			// Ends the statement before it, if it has no semicolon.
+			plain.WriteString(";\n")
+		case statementStart(plain.String()) &&
+			regexPLSQLBlock.MatchString(trimmed):
+			if err := flushPlain(); err != nil {
+				return nil, err
+			}
+			inBlock = true
+			block.WriteString(line)
+		default:
+			plain.WriteString(line)
+		}
+	}
+	if inBlock {
+		return nil, errors.New("unterminated PL/SQL block, missing a line with only /")
+	}
+	if err := flushPlain(); err != nil {
+		return nil, err
+	}
+	return filterStatements(stmts)
+}
+
+// statementStart reports whether the next line of s begins a statement, since
+// s is empty or only comments follow its last semicolon.
+func statementStart(s string) bool {
+	rest := s[strings.LastIndex(s, ";")+1:]
+	for _, line := range strings.Split(rest, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed != "" && !strings.HasPrefix(trimmed, "--") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,266 @@
+package migrate
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// partitionsDir is the subdirectory of the migration directory containing
+// partition templates. Unlike migrations, they're executed on every run to
+// create upcoming time-based partitions, such as a table for each month of
+// events. Each template is executed once per partition with a Partition:
+//
+//	-- migrate:interval month
+//	-- migrate:ahead 3
+//	CREATE TABLE IF NOT EXISTS events_{{.Suffix}} PARTITION OF events
+//		FOR VALUES FROM ('{{.Start.Format "2006-01-02"}}')
+//		TO ('{{.End.Format "2006-01-02"}}');
+//
+// The interval directive is required. The ahead directive sets how many
+// partitions to create after the current one, and defaults to
+// defaultPartitionsAhead. Created partitions are recorded alongside objects
+// rather than in the migration history.
+const partitionsDir = "partitions"
+
+const defaultPartitionsAhead = 3
+
+// PartitionInterval is the span of time covered by each partition.
+type PartitionInterval string
+
+const (
+	PartitionDay   PartitionInterval = "day"
+	PartitionWeek  PartitionInterval = "week"
+	PartitionMonth PartitionInterval = "month"
+	PartitionYear  PartitionInterval = "year"
+)
+
+// Partition is the data with which partition templates are executed.
+type Partition struct {
+	// Start is inclusive and End is exclusive, both at midnight UTC.
+	// Weeks start on Monday.
+	Start time.Time
+	End   time.Time
+
+	// Suffix names the partition by its start, such as 2026_10 for a
+	// monthly partition or 2026_10_12 for a daily or weekly one.
+	Suffix string
+}
+
+// partitionAt returns the partition n intervals after the one containing t.
+func partitionAt(interval PartitionInterval, t time.Time, n int) Partition {
+	t = t.UTC()
+	y, mo, d := t.Date()
+	var p Partition
+	switch interval {
+	case PartitionDay:
+		p.Start = time.Date(y, mo, d+n, 0, 0, 0, 0, time.UTC)
+		p.End = p.Start.AddDate(0, 0, 1)
+		p.Suffix = p.Start.Format("2006_01_02")
+	case PartitionWeek:
+		// Go's weeks start on Sunday, so shift them to start on
+		// Monday.
+		offset := (int(t.Weekday()) + 6) % 7
+		p.Start = time.Date(y, mo, d-offset+7*n, 0, 0, 0, 0, time.UTC)
+		p.End = p.Start.AddDate(0, 0, 7)
+		p.Suffix = p.Start.Format("2006_01_02")
+	case PartitionMonth:
+		p.Start = time.Date(y, mo+time.Month(n), 1, 0, 0, 0, 0, time.UTC)
+		p.End = p.Start.AddDate(0, 1, 0)
+		p.Suffix = p.Start.Format("2006_01")
+	case PartitionYear:
+		p.Start = time.Date(y+n, 1, 1, 0, 0, 0, 0, time.UTC)
+		p.End = p.Start.AddDate(1, 0, 0)
+		p.Suffix = p.Start.Format("2006")
+	}
+	return p
+}
+
+// partitionTemplate is a file in the partitions directory.
+type partitionTemplate struct {
+	name     string
+	interval PartitionInterval
+	ahead    int
+	tmpl     *template.Template
+
+	// dbt whose terminator ends the rendered statements.
+	dbt DBType
+}
+
+// readPartitions for dbt in the partitions subdirectory of fsys, sorted by
+// name. It's not an error for the directory to be missing.
+func readPartitions(
+	fsys fs.FS,
+	f filter,
+	dbt DBType,
+) ([]*partitionTemplate, error) {
+	dir := partitionsDir
+	if f.ignored(dir, true) {
+		return nil, nil
+	}
+	tmp, err := readDirInfos(fsys, dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read partitions dir")
+	}
+	var partitions []*partitionTemplate
+	for _, fi := range tmp {
+		fullpath := path.Join(dir, fi.Name())
+		if fi.IsDir() || !f.isMigration(fullpath) {
+			continue
+		}
+		p, err := readPartition(fsys, fullpath, dbt)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fi.Name(), err)
+		}
+		partitions = append(partitions, p)
+	}
+	sort.Slice(partitions, func(i, j int) bool {
+		return partitions[i].name < partitions[j].name
+	})
+	return partitions, nil
+}
+
+func readPartition(
+	fsys fs.FS,
+	fullpath string,
+	dbt DBType,
+) (*partitionTemplate, error) {
+	byt, err := fs.ReadFile(fsys, fullpath)
+	if err != nil {
+		return nil, errors.Wrap(err, "read file")
+	}
+	directives, body, err := parseDirectives(byt)
+	if err != nil {
+		return nil, fmt.Errorf("directives: %w", err)
+	}
+	p := &partitionTemplate{
+		name:  path.Base(fullpath),
+		ahead: defaultPartitionsAhead,
+		dbt:   dbt,
+	}
+	for _, d := range directives {
+		switch d[0] {
+		case "interval":
+			p.interval = PartitionInterval(d[1])
+			switch p.interval {
+			case PartitionDay, PartitionWeek, PartitionMonth,
+				PartitionYear:
+			default:
+				return nil, fmt.Errorf("unknown interval %q", d[1])
+			}
+		case "ahead":
+			p.ahead, err = strconv.Atoi(d[1])
+			if err != nil || p.ahead < 0 {
+				return nil, fmt.Errorf("invalid ahead %q", d[1])
+			}
+		default:
+			return nil, fmt.Errorf("unknown directive %q", d[0])
+		}
+	}
+	if p.interval == "" {
+		return nil, errors.New("missing interval directive")
+	}
+	p.tmpl, err = template.New(p.name).Option("missingkey=error").
+		Parse(string(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "parse template")
+	}
+
+	// Render the current partition, so mistakes are reported before
+	// migrating.
+	cmds, err := p.statements(partitionAt(p.interval, time.Now(), 0))
+	if err != nil {
+		return nil, err
+	}
+	if len(cmds) == 0 {
+		return nil, ErrNoStatements
+	}
+	return p, nil
+}
+
+// statements creating partition part.
+func (p *partitionTemplate) statements(part Partition) ([]string, error) {
+	var buf bytes.Buffer
+	if err := p.tmpl.Execute(&buf, part); err != nil {
+		return nil, errors.Wrap(err, "execute template")
+	}
+	return StatementsFor(p.dbt, buf.Bytes())
+}
+
+// partitionKey records a created partition among the objects. It contains a
+// slash, so it can't collide with an object's filename.
+func partitionKey(name, suffix string) string {
+	return path.Join(partitionsDir, name, suffix)
+}
+
+// migratePartitions creates the partitions from the current one at now
+// through each template's ahead directive, skipping those already created.
+// This function reports whether any partition was created.
+func (m *Migrate) migratePartitions(now time.Time) (bool, error) {
+	if len(m.partitions) == 0 {
+		return false, nil
+	}
+	applied, err := m.tracker.GetMetaObjects(m.namespace)
+	if err != nil {
+		return false, errors.Wrap(err, "get objects")
+	}
+	done := make(map[string]bool, len(applied))
+	for _, o := range applied {
+		done[o.Filename] = true
+	}
+	var created bool
+	for _, p := range m.partitions {
+		for n := 0; n <= p.ahead; n++ {
+			part := partitionAt(p.interval, now, n)
+			key := partitionKey(p.name, part.Suffix)
+			if done[key] {
+				continue
+			}
+			cmds, err := p.statements(part)
+			if err != nil {
+				return false, fmt.Errorf("%s: %w", key, err)
+			}
+			for i, cmd := range cmds {
+				m.logStatement(cmd)
+				m.record("exec %s [%d]\n%s", key, i, m.redact(cmd))
+				if _, err := m.exec(m.db, cmd); err != nil {
+					m.errorf("%s %s\n", m.colorize(colorRed,
+						"failed on"), m.redact(cmd))
+					return false, &MigrationError{
+						File:  key,
+						Index: i,
+						SQL:   m.redact(cmd),
+						Class: m.classifyError(err),
+						Err:   err,
+					}
+				}
+			}
+			var content bytes.Buffer
+			for _, cmd := range cmds {
+				content.WriteString(cmd + ";\n")
+			}
+			err = m.tracker.UpsertMetaObject(Object{
+				Namespace: m.namespace,
+				Filename:  key,
+				Content:   content.String(),
+			})
+			if err != nil {
+				return false, errors.Wrap(err, "upsert partition")
+			}
+			m.infof("%s %s\n", m.colorize(colorGreen, "created"),
+				key)
+			created = true
+		}
+	}
+	return created, nil
+}
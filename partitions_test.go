@@ -0,0 +1,40 @@
+package migrate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPartitionAt(t *testing.T) {
+	// A Wednesday at the end of the year.
+	now := time.Date(2025, 12, 31, 15, 4, 5, 0, time.UTC)
+	tcs := []struct {
+		interval PartitionInterval
+		n        int
+		start    time.Time
+		suffix   string
+	}{
+		{PartitionDay, 1, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), "2026_01_01"},
+		{PartitionWeek, 0, time.Date(2025, 12, 29, 0, 0, 0, 0, time.UTC), "2025_12_29"},
+		{PartitionWeek, 1, time.Date(2026, 1, 5, 0, 0, 0, 0, time.UTC), "2026_01_05"},
+		{PartitionMonth, 2, time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC), "2026_02"},
+		{PartitionYear, 0, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), "2025"},
+	}
+	for _, tc := range tcs {
+		p := partitionAt(tc.interval, now, tc.n)
+		if !p.Start.Equal(tc.start) || p.Suffix != tc.suffix {
+			t.Fatalf("%s+%d: expected %s (%s), got %s (%s)", tc.interval,
+				tc.n, tc.start, tc.suffix, p.Start, p.Suffix)
+		}
+		if next := partitionAt(tc.interval, now, tc.n+1); !next.Start.Equal(p.End) {
+			t.Fatalf("%s+%d: expected end %s, got %s", tc.interval,
+				tc.n, next.Start, p.End)
+		}
+	}
+
+	// Sunday belongs to the week which started the previous Monday.
+	sunday := time.Date(2026, 1, 4, 23, 0, 0, 0, time.UTC)
+	if p := partitionAt(PartitionWeek, sunday, 0); p.Suffix != "2025_12_29" {
+		t.Fatalf("expected week of 2025_12_29, got %s", p.Suffix)
+	}
+}
@@ -0,0 +1,18 @@
+// Package pgparse validates Postgres migrations offline using the Postgres
+// parser itself, via libpg_query. It requires cgo, so it's kept out of the
+// migrate package.
+package pgparse
+
+import (
+	pg_query "github.com/pganalyze/pg_query_go/v5"
+	"github.com/thankful-ai/migrate"
+)
+
+// Validate parses stmt as Postgres SQL, returning any syntax error.
+func Validate(stmt string) error {
+	_, err := pg_query.Parse(stmt)
+	return err
+}
+
+// Validator for migrate.WithValidator.
+var Validator migrate.Validator = Validate
@@ -0,0 +1,14 @@
+package pgparse
+
+import "testing"
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+	err := Validate(`CREATE TABLE users (id SERIAL PRIMARY KEY, name TEXT)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Validate(`CREAT TABLE users (id INTEGER)`); err == nil {
+		t.Fatal("expected syntax error")
+	}
+}
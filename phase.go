@@ -0,0 +1,90 @@
+package migrate
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Phase of a deploy in which a migration is applied, for the expand and
+// contract workflow.
+type Phase string
+
+const (
+	// PhasePre migrations are safe to apply before the new code is
+	// deployed, such as adding a nullable column. Migrations are pre-deploy
+	// unless marked otherwise.
+	PhasePre Phase = "pre"
+
+	// PhasePost migrations must wait until the new code is fully rolled
+	// out, such as dropping a column the old code still reads.
+	PhasePost Phase = "post"
+)
+
+// phaseDirective marks the deploy phase of a file:
+//
+//	-- migrate:phase post
+const phaseDirective = directivePrefix + "phase"
+
+// filePhase from the file's phase directive, if any.
+func filePhase(s string) (Phase, error) {
+	var phase Phase
+	for _, line := range strings.Split(s, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, phaseDirective+" ") {
+			continue
+		}
+		p := Phase(strings.TrimSpace(
+			strings.TrimPrefix(trimmed, phaseDirective)))
+		if p != PhasePre && p != PhasePost {
+			return "", fmt.Errorf("unknown phase %q: use %s or %s", p,
+				PhasePre, PhasePost)
+		}
+		if phase != "" && p != phase {
+			return "", fmt.Errorf("conflicting %s directives: %s and %s",
+				phaseDirective, phase, p)
+		}
+		phase = p
+	}
+	if phase == "" {
+		phase = PhasePre
+	}
+	return phase, nil
+}
+
+// MigratePhase applies the pending migrations of a deploy phase. PhasePre
+// applies them in order until the first post-deploy migration, since history
+// must stay in order, so later pre-deploy migrations wait for the next
+// post-deploy run. PhasePost applies every pending migration, then recreates
+// changed objects and creates partitions, like Migrate. This function reports
+// whether any migration took place.
+func (m *Migrate) MigratePhase(p Phase) (bool, error) {
+	switch p {
+	case PhasePost:
+		return m.Migrate()
+	case PhasePre:
+	default:
+		return false, fmt.Errorf("unknown phase %q", p)
+	}
+	if err := m.waitForStart(); err != nil {
+		return false, err
+	}
+	unlock, err := m.lock()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	pending := m.pendingFiles()
+	for i, fi := range pending {
+		if fi.phase == PhasePost {
+			m.infof("%d migrations wait for the post-deploy phase, starting with %s\n",
+				len(pending)-i, fi.Info.Name())
+			pending = pending[:i]
+			break
+		}
+	}
+	start, before := time.Now(), len(m.Migrations)
+	migrated, err := m.migrate(pending)
+	m.finishRun(start, before, err)
+	return migrated, err
+}
@@ -0,0 +1,120 @@
+package migrate
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// FilenamePolicy validates the filename of a pending migration, returning an
+// error which describes the violation. Policies are registered with
+// WithFilenamePolicy and enforced by Verify.
+type FilenamePolicy func(filename string) error
+
+// WithFilenamePolicy enforces p on pending migration files. It may be passed
+// multiple times, and every policy must pass. Files which have already been
+// migrated are never checked, since renaming them would break history.
+func WithFilenamePolicy(p FilenamePolicy) Option {
+	return func(m *Migrate) { m.policies = append(m.policies, p) }
+}
+
+// MatchPattern requires filenames to match re.
+func MatchPattern(re *regexp.Regexp) FilenamePolicy {
+	return func(filename string) error {
+		if !re.MatchString(filename) {
+			return fmt.Errorf("must match %s", re)
+		}
+		return nil
+	}
+}
+
+// RequireDescription requires filenames to describe the migration after the
+// numeric prefix, e.g. 3_add_email.sql rather than 3.sql.
+func RequireDescription() FilenamePolicy {
+	return func(filename string) error {
+		if len(descriptionWords(filename)) == 0 {
+			return fmt.Errorf("must have a description after the number")
+		}
+		return nil
+	}
+}
+
+// MaxLength limits filenames, including the extension, to n bytes.
+func MaxLength(n int) FilenamePolicy {
+	return func(filename string) error {
+		if len(filename) > n {
+			return fmt.Errorf("must be at most %d characters, has %d",
+				n, len(filename))
+		}
+		return nil
+	}
+}
+
+// ForbidWords rejects filenames whose description contains any of words,
+// compared case-insensitively. Words are separated by underscores, dashes,
+// dots, or spaces, so ForbidWords("tmp") rejects 4_tmp_fix.sql but not
+// 4_tmpl.sql.
+func ForbidWords(words ...string) FilenamePolicy {
+	forbidden := make(map[string]bool, len(words))
+	for _, w := range words {
+		forbidden[strings.ToLower(w)] = true
+	}
+	return func(filename string) error {
+		for _, w := range descriptionWords(filename) {
+			if forbidden[strings.ToLower(w)] {
+				return fmt.Errorf("must not contain %q", w)
+			}
+		}
+		return nil
+	}
+}
+
+// descriptionWords of a filename, excluding the numeric prefix and the
+// extension.
+func descriptionWords(filename string) []string {
+	desc := strings.TrimSuffix(filename, filepath.Ext(filename))
+	desc = regexOrder.ReplaceAllString(desc, "")
+	return strings.FieldsFunc(desc, func(r rune) bool {
+		return r == '_' || r == '-' || r == '.' || r == ' '
+	})
+}
+
+// Verify the override directories in use and that pending migration files
+// satisfy every FilenamePolicy and Validator. Override files which don't
+// correspond to any migration are logged as warnings, since they're usually
+// typos, but an override sharing its number with a differently named
+// migration returns ErrOverrideMismatch. Each invalid statement is logged, and
+// the returned error wraps ErrInvalidStatement. Likewise, each policy
+// violation is logged, and the returned error wraps ErrFilenamePolicy. New
+// calls Verify automatically after loading the history.
+func (m *Migrate) Verify() error {
+	if err := m.verifyOverrides(); err != nil {
+		return err
+	}
+	invalid, err := m.validate()
+	if err != nil {
+		return err
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%w: %d statements", ErrInvalidStatement,
+			invalid)
+	}
+	if len(m.policies) == 0 {
+		return nil
+	}
+	var violations int
+	for _, fi := range m.pendingFiles() {
+		for _, p := range m.policies {
+			if err := p(fi.Info.Name()); err != nil {
+				m.errorf("%s: %s\n", fi.Info.Name(), err)
+				violations++
+			}
+		}
+	}
+	if violations > 0 {
+		return fmt.Errorf("%w: %d violations", ErrFilenamePolicy,
+			violations)
+	}
+	return nil
+}
@@ -1,28 +1,69 @@
 package postgres
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
+	"hash/fnv"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	"github.com/thankful-ai/migrate"
-
-	_ "github.com/lib/pq"
 )
 
 type DB struct {
 	connURL string
+	session []string
+
+	// conflictRetries is the number of times to retry a statement which
+	// failed because of a conflicting transaction.
+	conflictRetries int
+
+	// external connections were opened by the caller, who closes them.
+	external bool
+
+	// locks are the connections holding the advisory lock of each
+	// namespace locked by TryLock.
+	mu    sync.Mutex
+	locks map[string]*sql.Conn
+
+	// prefix of the meta tables' names; see SetTablePrefix.
+	prefix string
 
 	// Embed the sqlx DB struct
 	*sqlx.DB
 }
 
+// Option configures optional behavior in New.
+type Option func(*DB)
+
+// WithSession executes stmts on every connection before it's used, such as
+// `SET lock_timeout = '5s'`, so operational guardrails apply to every
+// migration without repeating them in each file.
+func WithSession(stmts ...string) Option {
+	return func(db *DB) { db.session = append(db.session, stmts...) }
+}
+
+// WithConflictRetries retries a statement or atomic group up to n times, with
+// backoff, if it fails with serialization_failure. Postgres only raises it in
+// serializable transactions, but YugabyteDB and CockroachDB raise it whenever
+// transactions conflict, and when a statement races a schema change on another
+// node. The failed transaction was aborted, so it's safe to retry.
+func WithConflictRetries(n int) Option {
+	return func(db *DB) { db.conflictRetries = n }
+}
+
 func New(
 	user, pass, host, dbName string,
 	port int,
 	sslKey, sslCert, sslCA string,
+	opts ...Option,
 ) *DB {
 	// The trailing space is important
 	url := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s ",
@@ -34,16 +75,96 @@ func New(
 			"sslmode=verify-ca sslkey=%s sslcert=%s sslrootcert=%s",
 			sslKey, sslCert, sslCA)
 	}
-	return &DB{connURL: url}
+	db := &DB{connURL: url}
+	for _, opt := range opts {
+		opt(db)
+	}
+	return db
+}
+
+// FromDB is a Store using sqldb, a connection pool which the caller opened
+// with the lib/pq driver, such as the one a service already uses. Open and
+// Close leave sqldb as it is, since it belongs to the caller. WithSession
+// configures the connection, so it can't be used.
+func FromDB(sqldb *sql.DB, opts ...Option) *DB {
+	db := &DB{DB: sqlx.NewDb(sqldb, "postgres"), external: true}
+	for _, opt := range opts {
+		opt(db)
+	}
+	return db
+}
+
+// conflictBackoff is the first wait before retrying a conflict. DDL waits
+// longer, since YugabyteDB and CockroachDB change the schema on every node
+// asynchronously, and a conflicting DDL statement generally needs another
+// schema change to finish first.
+const (
+	conflictBackoff    = 100 * time.Millisecond
+	ddlConflictBackoff = time.Second
+)
+
+var regexDDL = regexp.MustCompile(`(?i)^\s*(CREATE|ALTER|DROP|TRUNCATE|COMMENT|GRANT|REVOKE)\b`)
+
+// retryConflict calls fn until it doesn't fail with serialization_failure or
+// it's been retried conflictRetries times.
+func (db *DB) retryConflict(query string, fn func() error) error {
+	backoff := conflictBackoff
+	if regexDDL.MatchString(query) {
+		backoff = ddlConflictBackoff
+	}
+	for i := 0; ; i++ {
+		err := fn()
+		if i >= db.conflictRetries || !isConflict(err) {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func isConflict(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	return pqErr.Code == "40001" // serialization_failure
+}
+
+// Exec query, retrying conflicts if configured WithConflictRetries.
+func (db *DB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.ExecContext(context.Background(), query, args...)
+}
+
+// ExecContext is Exec, canceling query once ctx is done.
+func (db *DB) ExecContext(
+	ctx context.Context,
+	query string,
+	args ...interface{},
+) (sql.Result, error) {
+	var res sql.Result
+	err := db.retryConflict(query, func() error {
+		var err error
+		res, err = db.DB.ExecContext(ctx, query, args...)
+		return err
+	})
+	return res, err
 }
 
 func (db *DB) CreateMetaIfNotExists() error {
-	q := `CREATE TABLE IF NOT EXISTS meta (
-		filename TEXT UNIQUE NOT NULL,
+	q := db.meta(`CREATE TABLE IF NOT EXISTS meta (
+		namespace TEXT NOT NULL DEFAULT '',
+		filename TEXT NOT NULL,
 		md5 TEXT NOT NULL,
 		content TEXT NOT NULL,
-		createdat TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'utc')
-	)`
+		algorithm TEXT NOT NULL DEFAULT 'md5',
+		variant TEXT NOT NULL DEFAULT '',
+		statements INTEGER NOT NULL DEFAULT 0,
+		duration_ns BIGINT NOT NULL DEFAULT 0,
+		annotations TEXT NOT NULL DEFAULT '',
+		appliedat TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'utc'),
+		createdat TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'utc'),
+		UNIQUE (namespace, filename)
+	)`)
 	if _, err := db.Exec(q); err != nil {
 		return errors.Wrap(err, "create meta table")
 	}
@@ -51,74 +172,166 @@ func (db *DB) CreateMetaIfNotExists() error {
 }
 
 func (db *DB) CreateMetaCheckpointsIfNotExists() error {
-	q := `CREATE TABLE IF NOT EXISTS metacheckpoints (
+	q := db.meta(`CREATE TABLE IF NOT EXISTS metacheckpoints (
+		namespace TEXT NOT NULL DEFAULT '',
 		filename TEXT NOT NULL,
 		idx INTEGER NOT NULL,
 		md5 TEXT NOT NULL,
 		content TEXT NOT NULL,
 		createdat TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'utc'),
-		PRIMARY KEY (filename, idx)
-	)`
+		PRIMARY KEY (namespace, filename, idx)
+	)`)
 	if _, err := db.Exec(q); err != nil {
 		return errors.Wrap(err, "create metacheckpoints table")
 	}
 	return nil
 }
 
-func (db *DB) GetMigrations() ([]migrate.Migration, error) {
+func (db *DB) CreateMetaObjectsIfNotExists() error {
+	q := db.meta(`CREATE TABLE IF NOT EXISTS metaobjects (
+		namespace TEXT NOT NULL DEFAULT '',
+		filename TEXT NOT NULL,
+		content TEXT NOT NULL,
+		createdat TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'utc'),
+		PRIMARY KEY (namespace, filename)
+	)`)
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "create metaobjects table")
+	}
+	return nil
+}
+
+func (db *DB) CreateMetaFailuresIfNotExists() error {
+	q := db.meta(`CREATE TABLE IF NOT EXISTS metafailures (
+		namespace TEXT NOT NULL DEFAULT '',
+		filename TEXT NOT NULL,
+		idx INTEGER NOT NULL,
+		error TEXT NOT NULL,
+		createdat TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'utc')
+	)`)
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "create metafailures table")
+	}
+	return nil
+}
+
+func (db *DB) GetMetaFailures(namespace string) ([]migrate.Failure, error) {
+	failures := []migrate.Failure{}
+	q := db.meta(`
+	SELECT namespace, filename, idx, error, createdat FROM metafailures
+	WHERE namespace=$1
+	ORDER BY createdat`)
+	err := db.Select(&failures, q, namespace)
+	return failures, err
+}
+
+func (db *DB) InsertMetaFailure(f migrate.Failure) error {
+	q := db.meta(`
+		INSERT INTO metafailures (namespace, filename, idx, error)
+		VALUES ($1, $2, $3, $4)`)
+	_, err := db.Exec(q, f.Namespace, f.Filename, f.Index, f.Error)
+	return err
+}
+
+func (db *DB) GetMetaObjects(namespace string) ([]migrate.Object, error) {
+	objects := []migrate.Object{}
+	q := db.meta(`
+	SELECT namespace, filename, content FROM metaobjects
+	WHERE namespace=$1`)
+	err := db.Select(&objects, q, namespace)
+	return objects, err
+}
+
+func (db *DB) UpsertMetaObject(o migrate.Object) error {
+	q := db.meta(`
+		INSERT INTO metaobjects (namespace, filename, content)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (namespace, filename) DO UPDATE
+		SET content=$3, createdat=(now() AT TIME ZONE 'utc')`)
+	_, err := db.Exec(q, o.Namespace, o.Filename, o.Content)
+	return err
+}
+
+func (db *DB) GetMigrations(namespace string) ([]migrate.Migration, error) {
 	migrations := []migrate.Migration{}
-	q := `
-	SELECT filename, content, md5 AS checksum
+	q := db.meta(`
+	SELECT namespace, filename, content, md5 AS checksum, algorithm,
+		variant, statements, duration_ns AS duration, annotations,
+		appliedat
 	FROM meta
-	ORDER BY substring(filename, '^\d+')::int`
-	err := db.Select(&migrations, q)
+	WHERE namespace=$1
+	ORDER BY substring(filename, '^\d+')::int`)
+	err := db.Select(&migrations, q, namespace)
 	return migrations, err
 
 }
 
-func (db *DB) GetMetaCheckpoints(filename string) ([]string, error) {
+func (db *DB) GetMetaCheckpoints(namespace, filename string) ([]string, error) {
 	checkpoints := []string{}
-	q := `SELECT md5 FROM metacheckpoints WHERE filename=$1 ORDER BY idx`
-	err := db.Select(&checkpoints, q, filename)
+	q := db.meta(`
+	SELECT md5 FROM metacheckpoints
+	WHERE namespace=$1 AND filename=$2
+	ORDER BY idx`)
+	err := db.Select(&checkpoints, q, namespace, filename)
 	return checkpoints, err
 }
 
-func (db *DB) UpsertMigration(filename, content, checksum string) error {
-	q := `
-		INSERT INTO meta (filename, content, md5) VALUES ($1, $2, $3)
-		ON CONFLICT (filename) DO UPDATE SET md5=$4, content=$5`
-	_, err := db.Exec(q, filename, content, checksum, checksum, content)
+func (db *DB) UpsertMigration(m migrate.Migration) error {
+	q := db.meta(`
+		INSERT INTO meta
+			(namespace, filename, content, md5, algorithm, variant,
+			statements, duration_ns, annotations, appliedat)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (namespace, filename) DO UPDATE
+		SET content=$3, md5=$4, algorithm=$5, variant=$6, statements=$7,
+			duration_ns=$8, annotations=$9, appliedat=$10`)
+	_, err := db.Exec(q, m.Namespace, m.Filename, m.Content, m.Checksum,
+		m.Algorithm, m.Variant, m.Statements, m.Duration, m.Annotations,
+		m.AppliedAt)
 	return err
 }
 
 func (db *DB) InsertMetaCheckpoint(
-	filename, content, checksum string,
+	namespace, filename, content, checksum string,
 	idx int,
 ) error {
-	q := `
-		INSERT INTO metacheckpoints (filename, content, idx, md5)
-		VALUES ($1, $2, $3, $4)`
-	_, err := db.Exec(q, filename, content, idx, checksum)
+	q := db.meta(`
+		INSERT INTO metacheckpoints (namespace, filename, content, idx, md5)
+		VALUES ($1, $2, $3, $4, $5)`)
+	_, err := db.Exec(q, namespace, filename, content, idx, checksum)
 	return err
 }
 
-func (db *DB) InsertMigration(filename, content, checksum string) error {
-	q := `INSERT INTO meta (filename, content, md5) VALUES ($1, $2, $3)`
-	_, err := db.Exec(q, filename, content, checksum)
+func (db *DB) InsertMigration(m migrate.Migration) error {
+	q := db.meta(`
+		INSERT INTO meta
+			(namespace, filename, content, md5, algorithm, variant,
+			statements, duration_ns, annotations, appliedat)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`)
+	_, err := db.Exec(q, m.Namespace, m.Filename, m.Content, m.Checksum,
+		m.Algorithm, m.Variant, m.Statements, m.Duration, m.Annotations,
+		m.AppliedAt)
 	return err
 }
 
-func (db *DB) DeleteMetaCheckpoints() error {
-	q := `DELETE FROM metacheckpoints`
-	_, err := db.Exec(q)
+func (db *DB) DeleteMetaCheckpoints(namespace string) error {
+	q := db.meta(`DELETE FROM metacheckpoints WHERE namespace=$1`)
+	_, err := db.Exec(q, namespace)
+	return err
+}
+
+// DeleteMigration removes filename from the history of namespace.
+func (db *DB) DeleteMigration(namespace, filename string) error {
+	q := db.meta(`DELETE FROM meta WHERE namespace=$1 AND filename=$2`)
+	_, err := db.Exec(q, namespace, filename)
 	return err
 }
 
 func (db *DB) CreateMetaVersionIfNotExists(schemaVersion int) (int, error) {
 	created := true
-	q := `CREATE TABLE metaversion (
+	q := db.meta(`CREATE TABLE metaversion (
 		version INTEGER NOT NULL
-	)`
+	)`)
 	if _, err := db.Exec(q); err != nil {
 		// Check if the table already existed
 		if !strings.Contains(err.Error(), "already exists") {
@@ -128,14 +341,14 @@ func (db *DB) CreateMetaVersionIfNotExists(schemaVersion int) (int, error) {
 	}
 
 	var version int
-	q = `SELECT version FROM metaversion`
+	q = db.meta(`SELECT version FROM metaversion`)
 	err := db.Get(&version, q)
 	switch {
 	case err == sql.ErrNoRows:
 		if !created {
 			schemaVersion = 0
 		}
-		q = `INSERT INTO metaversion (version) VALUES ($1)`
+		q = db.meta(`INSERT INTO metaversion (version) VALUES ($1)`)
 		if _, err := db.Exec(q, schemaVersion); err != nil {
 			return 0, errors.Wrap(err, "insert version")
 		}
@@ -146,9 +359,76 @@ func (db *DB) CreateMetaVersionIfNotExists(schemaVersion int) (int, error) {
 	return version, nil
 }
 
-func (db *DB) Close() error { return db.DB.Close() }
+// GetMetaVersion reports the current version without creating or modifying
+// anything. It returns 0 if the meta tables predate versioning and -1 if they
+// don't exist.
+func (db *DB) GetMetaVersion() (int, error) {
+	exists, err := db.tableExists("metaversion")
+	if err != nil {
+		return 0, errors.Wrap(err, "metaversion exists")
+	}
+	if !exists {
+		exists, err = db.tableExists("meta")
+		if err != nil {
+			return 0, errors.Wrap(err, "meta exists")
+		}
+		if exists {
+			return 0, nil
+		}
+		return -1, nil
+	}
+	var version int
+	q := db.meta(`SELECT version FROM metaversion`)
+	err = db.Get(&version, q)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, nil
+	case err != nil:
+		return 0, errors.Wrap(err, "get version")
+	}
+	return version, nil
+}
+
+func (db *DB) tableExists(name string) (bool, error) {
+	var exists bool
+	q := `SELECT to_regclass($1) IS NOT NULL`
+	err := db.Get(&exists, q, db.meta(name))
+	return exists, err
+}
+
+// Close the connection, unless it's from FromDB. It's safe to call even if
+// the connection was never opened.
+func (db *DB) Close() error {
+	if db.DB == nil || db.external {
+		return nil
+	}
+	return db.DB.Close()
+}
+
+// SetTablePrefix prepends prefix to the names of the meta tables. See
+// migrate.WithTablePrefix.
+func (db *DB) SetTablePrefix(prefix string) { db.prefix = prefix }
+
+// meta prefixes the names of the meta tables in the query q.
+func (db *DB) meta(q string) string {
+	return migrate.PrefixMetaTables(db.prefix, q)
+}
+
+// Ping checks that the database is reachable.
+func (db *DB) Ping(ctx context.Context) error { return db.DB.PingContext(ctx) }
 
 func (db *DB) Open() error {
+	if db.external {
+		if len(db.session) > 0 {
+			return errors.New("cannot configure a connection from FromDB")
+		}
+		return nil
+	}
+	if len(db.session) > 0 {
+		c := migrate.SessionConnector(pq.Driver{}, db.connURL, db.session)
+		db.DB = sqlx.NewDb(sql.OpenDB(c), "postgres")
+		return nil
+	}
 	var err error
 	db.DB, err = sqlx.Open("postgres", db.connURL)
 	if err != nil {
@@ -175,7 +455,7 @@ func (db *DB) UpgradeToV1(migrations []migrate.Migration) (err error) {
 	}()
 
 	// Remove the uniqueness constraint from md5
-	q := `ALTER TABLE meta DROP CONSTRAINT meta_md5_key`
+	q := db.meta(`ALTER TABLE meta DROP CONSTRAINT meta_md5_key`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "remove md5 unique")
 		return
@@ -183,48 +463,624 @@ func (db *DB) UpgradeToV1(migrations []migrate.Migration) (err error) {
 
 	// Add a content column to record the exact migration that ran
 	// alongside the md5, insert the appropriate data, then set not null
-	q = `ALTER TABLE meta ADD COLUMN content TEXT`
+	q = db.meta(`ALTER TABLE meta ADD COLUMN content TEXT`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "add content column")
 		return
 	}
 	for _, m := range migrations {
-		q = `UPDATE meta SET content=$1 WHERE filename=$2`
+		q = db.meta(`UPDATE meta SET content=$1 WHERE filename=$2`)
 		if _, err = tx.Exec(q, m.Content, m.Filename); err != nil {
 			err = errors.Wrap(err, "update meta content")
 			return
 		}
 	}
-	q = `ALTER TABLE meta ALTER COLUMN content SET NOT NULL`
+	q = db.meta(`ALTER TABLE meta ALTER COLUMN content SET NOT NULL`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "update meta content not null")
 		return
 	}
 
 	// Add the content column to metacheckpoints
-	q = `
+	q = db.meta(`
 	ALTER TABLE metacheckpoints
-	ADD COLUMN IF NOT EXISTS content TEXT NOT NULL`
+	ADD COLUMN IF NOT EXISTS content TEXT NOT NULL`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "add metacheckpoints content")
 		return
 	}
 
-	q = `
-	CREATE TABLE IF NOT EXISTS metaversion (version INTEGER NOT NULL)`
+	q = db.meta(`
+	CREATE TABLE IF NOT EXISTS metaversion (version INTEGER NOT NULL)`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "create metaversion table")
 		return
 	}
-	q = `DELETE FROM metaversion`
+	q = db.meta(`DELETE FROM metaversion`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "delete metaversion")
 		return
 	}
-	q = `INSERT INTO metaversion (version) VALUES (1)`
+	q = db.meta(`INSERT INTO metaversion (version) VALUES (1)`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "insert metaversion")
 		return
 	}
 	return nil
 }
+
+// UpgradeToV2 records the checksum algorithm used for each migration. All
+// migrations before v2 used md5.
+func (db *DB) UpgradeToV2() (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	q := db.meta(`
+	ALTER TABLE meta
+	ADD COLUMN IF NOT EXISTS algorithm TEXT NOT NULL DEFAULT 'md5'`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "add algorithm column")
+		return
+	}
+	q = db.meta(`UPDATE metaversion SET version=2`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "update metaversion")
+		return
+	}
+	return nil
+}
+
+// UpgradeToV3 adds a namespace to the meta tables, replacing the unique
+// filename constraint with one on (namespace, filename). Existing history
+// belongs to the default, empty namespace.
+func (db *DB) UpgradeToV3() (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	q := db.meta(`
+	ALTER TABLE meta
+	ADD COLUMN IF NOT EXISTS namespace TEXT NOT NULL DEFAULT ''`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "add meta namespace column")
+		return
+	}
+	q = db.meta(`
+	ALTER TABLE meta
+	DROP CONSTRAINT IF EXISTS meta_filename_key,
+	ADD CONSTRAINT meta_namespace_filename_key UNIQUE (namespace, filename)`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "replace meta unique constraint")
+		return
+	}
+	q = db.meta(`
+	ALTER TABLE metacheckpoints
+	ADD COLUMN IF NOT EXISTS namespace TEXT NOT NULL DEFAULT ''`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "add metacheckpoints namespace column")
+		return
+	}
+	q = db.meta(`
+	ALTER TABLE metacheckpoints
+	DROP CONSTRAINT IF EXISTS metacheckpoints_pkey,
+	ADD PRIMARY KEY (namespace, filename, idx)`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "replace metacheckpoints primary key")
+		return
+	}
+	q = db.meta(`UPDATE metaversion SET version=3`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "update metaversion")
+		return
+	}
+	return nil
+}
+
+// CopyFrom executes a COPY ... FROM STDIN query, sending rows as its data.
+// lib/pq only supports COPY within a transaction.
+func (db *DB) CopyFrom(query string, rows [][]interface{}) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return errors.Wrap(err, "prepare copy")
+	}
+	for _, row := range rows {
+		if _, err = stmt.Exec(row...); err != nil {
+			_ = stmt.Close()
+			return errors.Wrap(err, "copy row")
+		}
+	}
+
+	// Executing without arguments flushes the buffered data.
+	if _, err = stmt.Exec(); err != nil {
+		_ = stmt.Close()
+		return errors.Wrap(err, "flush copy")
+	}
+	if err = stmt.Close(); err != nil {
+		return errors.Wrap(err, "close copy")
+	}
+	return nil
+}
+
+// ExecBatch executes cmds as one simple query, which Postgres runs in an
+// implicit transaction, so a failed batch leaves no trace.
+func (db *DB) ExecBatch(cmds []string) error {
+	_, err := db.Exec(strings.Join(cmds, ";\n"))
+	return err
+}
+
+// ExecAtomic executes cmds one at a time within a transaction, so a failed
+// atomic group leaves no trace. Statements which can't run in a transaction,
+// such as CREATE INDEX CONCURRENTLY, fail. The whole transaction is retried if
+// it conflicts, as configured WithConflictRetries.
+func (db *DB) ExecAtomic(cmds []string) error {
+	return db.retryConflict(strings.Join(cmds, ";\n"), func() error {
+		return db.execTx(cmds)
+	})
+}
+
+// execTx executes cmds one at a time within a transaction.
+func (db *DB) execTx(cmds []string) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+	for _, cmd := range cmds {
+		if _, err = tx.Exec(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExecWarnings executes query, collecting the notices it raises, such as from
+// RAISE NOTICE in a DO block or function.
+func (db *DB) ExecWarnings(
+	query string,
+	args ...interface{},
+) (sql.Result, []migrate.Warning, error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "conn")
+	}
+	defer func() { _ = conn.Close() }()
+
+	var warnings []migrate.Warning
+	setHandler := func(h func(*pq.Error)) error {
+		return conn.Raw(func(dc interface{}) error {
+			pq.SetNoticeHandler(dc.(driver.Conn), h)
+			return nil
+		})
+	}
+	err = setHandler(func(e *pq.Error) {
+		warnings = append(warnings, migrate.Warning{
+			Level:   e.Severity,
+			Code:    string(e.Code),
+			Message: e.Message,
+		})
+	})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "set notice handler")
+	}
+
+	// The connection returns to the pool, so stop collecting notices.
+	defer func() { _ = setHandler(nil) }()
+
+	var res sql.Result
+	err = db.retryConflict(query, func() error {
+		warnings = nil
+		var err error
+		res, err = conn.ExecContext(ctx, query, args...)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, warnings, nil
+}
+
+// ReadOnly reports whether the connection can't create tables: if the server
+// is a replica, transactions are read-only by default, or the user lacks the
+// privilege on the current schema.
+func (db *DB) ReadOnly() (string, error) {
+	var s struct {
+		Recovery  bool   `db:"recovery"`
+		ReadOnly  string `db:"read_only"`
+		Schema    string `db:"schema"`
+		CanCreate bool   `db:"can_create"`
+	}
+	q := `SELECT
+		pg_is_in_recovery() AS recovery,
+		current_setting('transaction_read_only') AS read_only,
+		COALESCE(current_schema(), '') AS schema,
+		COALESCE(has_schema_privilege(current_schema(), 'CREATE'), false) AS can_create`
+	if err := db.Get(&s, q); err != nil {
+		return "", errors.Wrap(err, "get read-only state")
+	}
+	switch {
+	case s.Recovery:
+		return "server is a replica in recovery", nil
+	case s.ReadOnly == "on":
+		return "transactions are read-only (default_transaction_read_only)", nil
+	case s.Schema == "":
+		return "no schema in search_path to create tables in", nil
+	case !s.CanCreate:
+		return fmt.Sprintf("user cannot create tables in schema %s",
+			s.Schema), nil
+	}
+	return "", nil
+}
+
+// ExecAs executes query with SET ROLE, so the objects it creates are owned by
+// role. The role is reset before the connection returns to the pool.
+func (db *DB) ExecAs(
+	role, query string,
+	args ...interface{},
+) (res sql.Result, err error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "conn")
+	}
+	defer func() { _ = conn.Close() }()
+
+	q := `SET ROLE ` + pq.QuoteIdentifier(role)
+	if _, err = conn.ExecContext(ctx, q); err != nil {
+		return nil, errors.Wrap(err, "set role")
+	}
+	defer func() {
+		if _, rerr := conn.ExecContext(ctx, `RESET ROLE`); rerr != nil {
+			// Don't return the connection to the pool as role.
+			_ = conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+			if err == nil {
+				err = errors.Wrap(rerr, "reset role")
+			}
+		}
+	}()
+	return conn.ExecContext(ctx, query, args...)
+}
+
+// Analyze refreshes the planner statistics of table, which may be
+// schema-qualified.
+func (db *DB) Analyze(table string) error {
+	parts := strings.Split(table, ".")
+	for i, p := range parts {
+		parts[i] = pq.QuoteIdentifier(p)
+	}
+	_, err := db.Exec(`ANALYZE ` + strings.Join(parts, "."))
+	return err
+}
+
+// UpgradeToV4 records which variant of each migration was applied: the base
+// file or a DB-specific override.
+func (db *DB) UpgradeToV4() (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	q := db.meta(`
+	ALTER TABLE meta
+	ADD COLUMN IF NOT EXISTS variant TEXT NOT NULL DEFAULT ''`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "add variant column")
+		return
+	}
+	q = db.meta(`UPDATE metaversion SET version=4`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "update metaversion")
+		return
+	}
+	return nil
+}
+
+// UpgradeToV5 records how many statements each migration had and how long it
+// took, for Stats.
+func (db *DB) UpgradeToV5() (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	q := db.meta(`
+	ALTER TABLE meta
+	ADD COLUMN IF NOT EXISTS statements INTEGER NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS duration_ns BIGINT NOT NULL DEFAULT 0`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "add statements and duration columns")
+		return
+	}
+	q = db.meta(`UPDATE metaversion SET version=5`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "update metaversion")
+		return
+	}
+	return nil
+}
+
+// UpgradeToV6 records the annotations of the run which applied each
+// migration.
+func (db *DB) UpgradeToV6() (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	q := db.meta(`
+	ALTER TABLE meta
+	ADD COLUMN IF NOT EXISTS annotations TEXT NOT NULL DEFAULT ''`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "add annotations column")
+		return
+	}
+	q = db.meta(`UPDATE metaversion SET version=6`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "update metaversion")
+		return
+	}
+	return nil
+}
+
+// UpgradeToV7 only records the version. Migrate rewrites md5 checksums as
+// SHA-256 once it's verified them.
+func (db *DB) UpgradeToV7() error {
+	q := db.meta(`UPDATE metaversion SET version=7`)
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "update metaversion")
+	}
+	return nil
+}
+
+// UpgradeToV8 records when each migration was applied. Migrations applied
+// before use the time they were recorded.
+func (db *DB) UpgradeToV8() (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	q := db.meta(`
+	ALTER TABLE meta
+	ADD COLUMN IF NOT EXISTS appliedat TIMESTAMP NOT NULL
+		DEFAULT (now() AT TIME ZONE 'utc')`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "add appliedat column")
+		return
+	}
+	q = db.meta(`UPDATE meta SET appliedat=createdat`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "update appliedat")
+		return
+	}
+	q = db.meta(`UPDATE metaversion SET version=8`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "update metaversion")
+		return
+	}
+	return nil
+}
+
+// ClassifyError by its Postgres error code.
+func (db *DB) ClassifyError(err error) migrate.ErrorClass {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return migrate.ClassUnknown
+	}
+	switch pqErr.Code {
+	case "42501": // insufficient_privilege
+		return migrate.ClassPermissionDenied
+	case "42P04", // duplicate_database
+		"42P06", // duplicate_schema
+		"42P07", // duplicate_table
+		"42701", // duplicate_column
+		"42710", // duplicate_object
+		"42712", // duplicate_alias
+		"42723": // duplicate_function
+		return migrate.ClassDuplicateObject
+	case "55P03", // lock_not_available
+		"40P01", // deadlock_detected
+		"40001": // serialization_failure
+		return migrate.ClassLockTimeout
+	case "42601": // syntax_error
+		return migrate.ClassSyntax
+	case "57P01": // admin_shutdown
+		return migrate.ClassConnectionLost
+	}
+	if pqErr.Code.Class() == "08" { // connection_exception
+		return migrate.ClassConnectionLost
+	}
+	return migrate.ClassUnknown
+}
+
+// lockKey of the advisory lock on namespace. Advisory locks are shared with
+// every application using the database, so the key is a hash of a name which
+// is unlikely to collide with theirs.
+func lockKey(namespace string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte("thankful-ai/migrate " + namespace))
+	return int64(h.Sum64())
+}
+
+func (db *DB) CreateMetaLocksIfNotExists() error {
+	q := db.meta(`CREATE TABLE IF NOT EXISTS metalocks (
+		namespace TEXT NOT NULL DEFAULT '',
+		hostname TEXT NOT NULL,
+		pid INTEGER NOT NULL,
+		startedat TIMESTAMP NOT NULL,
+		filename TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (namespace)
+	)`)
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "create metalocks table")
+	}
+	return nil
+}
+
+// TryLock namespace with a session-level advisory lock, held by a dedicated
+// connection until Unlock, so it's released by the server if the process
+// dies.
+func (db *DB) TryLock(namespace string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.locks[namespace] != nil {
+		return false, errors.Errorf("%q is already locked", namespace)
+	}
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, "conn")
+	}
+	var locked bool
+	q := `SELECT pg_try_advisory_lock($1)`
+	err = conn.QueryRowContext(ctx, q, lockKey(namespace)).Scan(&locked)
+	if err != nil || !locked {
+		_ = conn.Close()
+		return false, errors.Wrap(err, "try advisory lock")
+	}
+	if db.locks == nil {
+		db.locks = map[string]*sql.Conn{}
+	}
+	db.locks[namespace] = conn
+	return true, nil
+}
+
+// GetLockHolder of namespace. It's empty if the holder was never recorded.
+func (db *DB) GetLockHolder(namespace string) (migrate.LockHolder, error) {
+	var holder migrate.LockHolder
+	q := db.meta(`
+	SELECT hostname, pid, startedat, filename FROM metalocks
+	WHERE namespace=$1`)
+	err := db.Get(&holder, q, namespace)
+	switch {
+	case errors.Is(err, sql.ErrNoRows), undefinedTable(err):
+		// The holder hasn't created the table yet.
+		return holder, nil
+	}
+	return holder, err
+}
+
+// SetLockHolder records holder of namespace on the connection holding its
+// lock.
+func (db *DB) SetLockHolder(
+	namespace string,
+	holder migrate.LockHolder,
+) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	conn := db.locks[namespace]
+	if conn == nil {
+		return errors.Errorf("%q is not locked", namespace)
+	}
+	q := db.meta(`
+		INSERT INTO metalocks (namespace, hostname, pid, startedat, filename)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (namespace) DO UPDATE
+		SET hostname=$2, pid=$3, startedat=$4, filename=$5`)
+	_, err := conn.ExecContext(context.Background(), q, namespace,
+		holder.Hostname, holder.PID, holder.Started, holder.File)
+	return err
+}
+
+// Unlock namespace, removing its holder.
+func (db *DB) Unlock(namespace string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	conn := db.locks[namespace]
+	if conn == nil {
+		return errors.Errorf("%q is not locked", namespace)
+	}
+	q := db.meta(`DELETE FROM metalocks WHERE namespace=$1`)
+	_, err := conn.ExecContext(context.Background(), q, namespace)
+	if undefinedTable(err) {
+		err = nil
+	}
+	if uerr := db.unlock(namespace); err == nil {
+		err = uerr
+	}
+	return errors.Wrap(err, "unlock")
+}
+
+// undefinedTable reports whether err is because a table doesn't exist, such
+// as metalocks before Init creates it.
+func undefinedTable(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "42P01"
+}
+
+// unlock releases the advisory lock on namespace and its connection.
+func (db *DB) unlock(namespace string) error {
+	conn := db.locks[namespace]
+	delete(db.locks, namespace)
+	defer func() { _ = conn.Close() }()
+	q := `SELECT pg_advisory_unlock($1)`
+	_, err := conn.ExecContext(context.Background(), q, lockKey(namespace))
+	if err != nil {
+		// Don't return the connection to the pool holding the lock.
+		_ = conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	}
+	return err
+}
@@ -2,16 +2,18 @@ package postgres
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
-	"github.com/thankful-ai/migrate"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
+	"github.com/thankful-ai/migrate"
 )
 
 const checkpointFile = "2.sql"
@@ -48,10 +50,41 @@ func TestCreateMetaCheckpointsIfNotExists(t *testing.T) {
 	check(t, err)
 }
 
+func TestLockHolder(t *testing.T) {
+	db := newDB(t)
+	check(t, db.CreateMetaLocksIfNotExists())
+	ok, err := db.TryLock("")
+	check(t, err)
+	if !ok {
+		t.Fatal("expected lock")
+	}
+	want := migrate.LockHolder{
+		Hostname: "deployer",
+		PID:      42,
+		Started:  time.Date(2024, 5, 1, 9, 30, 0, 0, time.UTC),
+		File:     "1_create_users.sql",
+	}
+	check(t, db.SetLockHolder("", want))
+	holder, err := db.GetLockHolder("")
+	check(t, err)
+	if holder.Hostname != want.Hostname || holder.PID != want.PID ||
+		!holder.Started.Equal(want.Started) || holder.File != want.File {
+		t.Fatalf("expected %+v, got %+v", want, holder)
+	}
+
+	// Unlocking removes the holder.
+	check(t, db.Unlock(""))
+	holder, err = db.GetLockHolder("")
+	check(t, err)
+	if holder != (migrate.LockHolder{}) {
+		t.Fatalf("expected no holder, got %+v", holder)
+	}
+}
+
 func TestGetMigrations(t *testing.T) {
-	db := setupDBV1(t)
+	db := setupDBV8(t)
 
-	ms, err := db.GetMigrations()
+	ms, err := db.GetMigrations("")
 	check(t, err)
 	if len(ms) != 1 {
 		t.Fatalf("expected 1 migration, got %d", len(ms))
@@ -59,9 +92,9 @@ func TestGetMigrations(t *testing.T) {
 }
 
 func TestGetMetaCheckpoints(t *testing.T) {
-	db := setupDBV1(t)
+	db := setupDBV8(t)
 
-	mcs, err := db.GetMetaCheckpoints(checkpointFile)
+	mcs, err := db.GetMetaCheckpoints("", checkpointFile)
 	check(t, err)
 	if len(mcs) != 1 {
 		t.Fatal("expected 1 checkpoint")
@@ -69,17 +102,27 @@ func TestGetMetaCheckpoints(t *testing.T) {
 }
 
 func TestUpsertMigration(t *testing.T) {
-	db := setupDBV1(t)
+	db := setupDBV8(t)
 
 	// Test update
-	err := db.UpsertMigration("1.sql", "SELECT 1;", "md5")
+	err := db.UpsertMigration(migrate.Migration{
+		Filename:  "1.sql",
+		Content:   "SELECT 1;",
+		Checksum:  "md5",
+		Algorithm: "md5",
+	})
 	check(t, err)
 
 	// Test insert
-	err = db.UpsertMigration("3.sql", "SELECT 3;", "md5")
+	err = db.UpsertMigration(migrate.Migration{
+		Filename:  "3.sql",
+		Content:   "SELECT 3;",
+		Checksum:  "md5",
+		Algorithm: "md5",
+	})
 	check(t, err)
 
-	ms, err := db.GetMigrations()
+	ms, err := db.GetMigrations("")
 	check(t, err)
 	if len(ms) != 2 {
 		t.Fatalf("expected 2 migrations, got %d", len(ms))
@@ -87,12 +130,12 @@ func TestUpsertMigration(t *testing.T) {
 }
 
 func TestInsertMetaCheckpoint(t *testing.T) {
-	db := setupDBV1(t)
+	db := setupDBV8(t)
 
-	err := db.InsertMetaCheckpoint(checkpointFile, "SELECT 3;", "md5", 1)
+	err := db.InsertMetaCheckpoint("", checkpointFile, "SELECT 3;", "md5", 1)
 	check(t, err)
 
-	mcs, err := db.GetMetaCheckpoints(checkpointFile)
+	mcs, err := db.GetMetaCheckpoints("", checkpointFile)
 	check(t, err)
 	if len(mcs) != 2 {
 		t.Fatal("expected 2 checkpoints")
@@ -100,12 +143,17 @@ func TestInsertMetaCheckpoint(t *testing.T) {
 }
 
 func TestInsertMigration(t *testing.T) {
-	db := setupDBV1(t)
-
-	err := db.InsertMigration("3.sql", "SELECT 3;", "md5")
+	db := setupDBV8(t)
+
+	err := db.InsertMigration(migrate.Migration{
+		Filename:  "3.sql",
+		Content:   "SELECT 3;",
+		Checksum:  "md5",
+		Algorithm: "md5",
+	})
 	check(t, err)
 
-	ms, err := db.GetMigrations()
+	ms, err := db.GetMigrations("")
 	check(t, err)
 	if len(ms) != 2 {
 		t.Fatal("expected 2 migrations")
@@ -113,18 +161,313 @@ func TestInsertMigration(t *testing.T) {
 }
 
 func TestDeleteMetaCheckpoints(t *testing.T) {
-	db := setupDBV1(t)
+	db := setupDBV8(t)
 
-	err := db.DeleteMetaCheckpoints()
+	err := db.DeleteMetaCheckpoints("")
 	check(t, err)
 
-	mcs, err := db.GetMetaCheckpoints(checkpointFile)
+	mcs, err := db.GetMetaCheckpoints("", checkpointFile)
 	check(t, err)
 	if len(mcs) != 0 {
 		t.Fatal("expected 0 checkpoints")
 	}
 }
 
+func TestUpgradeToV2(t *testing.T) {
+	db := setupDBV8(t)
+
+	ms, err := db.GetMigrations("")
+	check(t, err)
+	if len(ms) != 1 {
+		t.Fatalf("expected 1 migration, got %d", len(ms))
+	}
+	if ms[0].Algorithm != "md5" {
+		t.Fatalf("expected md5 algorithm, got %q", ms[0].Algorithm)
+	}
+}
+
+func TestUpsertMetaObject(t *testing.T) {
+	db := setupDBV8(t)
+	err := db.CreateMetaObjectsIfNotExists()
+	check(t, err)
+
+	for _, content := range []string{"CREATE VIEW v1", "CREATE VIEW v2"} {
+		err = db.UpsertMetaObject(migrate.Object{
+			Filename: "v.sql",
+			Content:  content,
+		})
+		check(t, err)
+	}
+	objects, err := db.GetMetaObjects("")
+	check(t, err)
+	if len(objects) != 1 || objects[0].Content != "CREATE VIEW v2" {
+		t.Fatalf("unexpected objects %v", objects)
+	}
+}
+
+func TestUpgradeToV3(t *testing.T) {
+	db := setupDBV8(t)
+
+	// Another namespace may reuse filenames without affecting the
+	// existing history in the default namespace.
+	err := db.InsertMigration(migrate.Migration{
+		Namespace: "auth",
+		Filename:  "1.sql",
+		Content:   "SELECT 1;",
+		Checksum:  "md5",
+		Algorithm: "md5",
+	})
+	check(t, err)
+	err = db.InsertMetaCheckpoint("auth", checkpointFile, "SELECT 2;",
+		"md5", 0)
+	check(t, err)
+	err = db.DeleteMetaCheckpoints("auth")
+	check(t, err)
+
+	ms, err := db.GetMigrations("")
+	check(t, err)
+	if len(ms) != 1 || ms[0].Namespace != "" {
+		t.Fatalf("unexpected default migrations %v", ms)
+	}
+	ms, err = db.GetMigrations("auth")
+	check(t, err)
+	if len(ms) != 1 || ms[0].Namespace != "auth" {
+		t.Fatalf("unexpected auth migrations %v", ms)
+	}
+	mcs, err := db.GetMetaCheckpoints("", checkpointFile)
+	check(t, err)
+	if len(mcs) != 1 {
+		t.Fatal("expected 1 checkpoint")
+	}
+}
+
+func TestCopyFrom(t *testing.T) {
+	db := setupDBV8(t)
+
+	_, err := db.Exec(`CREATE TABLE users (id INTEGER, name TEXT)`)
+	check(t, err)
+	err = db.CopyFrom(`COPY users (id, name) FROM STDIN`,
+		[][]interface{}{{"1", "alice"}, {"2", nil}})
+	check(t, err)
+
+	var n int
+	err = db.Get(&n, `SELECT COUNT(*) FROM users WHERE name IS NULL`)
+	check(t, err)
+	if n != 1 {
+		t.Fatalf("expected 1 null name, got %d", n)
+	}
+}
+
+func TestExecWarnings(t *testing.T) {
+	db := setupDBV8(t)
+
+	_, warnings, err := db.ExecWarnings(
+		`DO $$ BEGIN RAISE NOTICE 'hello'; END $$`)
+	check(t, err)
+	if len(warnings) != 1 || warnings[0].Message != "hello" {
+		t.Fatalf("expected hello notice, got %v", warnings)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	db := setupDBV8(t)
+
+	reason, err := db.ReadOnly()
+	check(t, err)
+	if reason != "" {
+		t.Fatalf("expected writable, got %q", reason)
+	}
+}
+
+func TestExecAs(t *testing.T) {
+	db := setupDBV8(t)
+
+	var user string
+	err := db.Get(&user, `SELECT current_user`)
+	check(t, err)
+	_, err = db.ExecAs(user, `CREATE TABLE owned (id INTEGER)`)
+	check(t, err)
+
+	var owner string
+	err = db.Get(&owner, `SELECT tableowner FROM pg_tables WHERE tablename = 'owned'`)
+	check(t, err)
+	if owner != user {
+		t.Fatalf("expected owner %s, got %s", user, owner)
+	}
+}
+
+func TestUpgradeToV4(t *testing.T) {
+	db := setupDBV8(t)
+
+	err := db.InsertMigration(migrate.Migration{
+		Filename:  "2.sql",
+		Content:   "SELECT 2;",
+		Checksum:  "md5",
+		Algorithm: "md5",
+		Variant:   "postgres",
+	})
+	check(t, err)
+
+	ms, err := db.GetMigrations("")
+	check(t, err)
+	if len(ms) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(ms))
+	}
+	if ms[0].Variant != "" || ms[1].Variant != "postgres" {
+		t.Fatalf("unexpected variants %q, %q", ms[0].Variant, ms[1].Variant)
+	}
+}
+
+func TestUpgradeToV5(t *testing.T) {
+	db := setupDBV8(t)
+
+	err := db.InsertMigration(migrate.Migration{
+		Filename:   "2.sql",
+		Content:    "SELECT 2;",
+		Checksum:   "md5",
+		Algorithm:  "md5",
+		Statements: 1,
+		Duration:   3 * time.Millisecond,
+	})
+	check(t, err)
+
+	ms, err := db.GetMigrations("")
+	check(t, err)
+	if len(ms) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(ms))
+	}
+	if ms[0].Statements != 0 || ms[0].Duration != 0 {
+		t.Fatalf("expected no stats for old migration, got %d, %s",
+			ms[0].Statements, ms[0].Duration)
+	}
+	if ms[1].Statements != 1 || ms[1].Duration != 3*time.Millisecond {
+		t.Fatalf("unexpected stats %d, %s", ms[1].Statements, ms[1].Duration)
+	}
+}
+
+func TestUpgradeToV6(t *testing.T) {
+	db := setupDBV8(t)
+
+	err := db.InsertMigration(migrate.Migration{
+		Filename:    "2.sql",
+		Content:     "SELECT 2;",
+		Checksum:    "md5",
+		Algorithm:   "md5",
+		Annotations: migrate.Annotations{"deploy": "d-42"},
+	})
+	check(t, err)
+
+	ms, err := db.GetMigrations("")
+	check(t, err)
+	if len(ms) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(ms))
+	}
+	if len(ms[0].Annotations) != 0 {
+		t.Fatalf("expected no annotations for old migration, got %v",
+			ms[0].Annotations)
+	}
+	if ms[1].Annotations["deploy"] != "d-42" {
+		t.Fatalf("unexpected annotations %v", ms[1].Annotations)
+	}
+}
+
+func TestUpgradeToV7(t *testing.T) {
+	db := setupDBV6(t)
+
+	err := db.UpgradeToV7()
+	check(t, err)
+	v, err := db.GetMetaVersion()
+	check(t, err)
+	if v != 7 {
+		t.Fatalf("expected version 7, got %d", v)
+	}
+}
+
+func TestUpgradeToV8(t *testing.T) {
+	db := setupDBV7(t)
+
+	err := db.UpgradeToV8()
+	check(t, err)
+	appliedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	err = db.InsertMigration(migrate.Migration{
+		Filename:  "2.sql",
+		Content:   "SELECT 2;",
+		Checksum:  "md5",
+		Algorithm: "md5",
+		AppliedAt: appliedAt,
+	})
+	check(t, err)
+
+	ms, err := db.GetMigrations("")
+	check(t, err)
+	if len(ms) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(ms))
+	}
+	if ms[0].AppliedAt.IsZero() {
+		t.Fatal("expected old migration to be applied when recorded")
+	}
+	if !ms[1].AppliedAt.Equal(appliedAt) {
+		t.Fatalf("expected applied at %s, got %s", appliedAt,
+			ms[1].AppliedAt)
+	}
+}
+
+func TestInsertMetaFailure(t *testing.T) {
+	db := setupDBV8(t)
+
+	err := db.InsertMetaFailure(migrate.Failure{
+		Filename: "2.sql",
+		Index:    1,
+		Error:    "syntax error",
+	})
+	check(t, err)
+
+	fs, err := db.GetMetaFailures("")
+	check(t, err)
+	if len(fs) != 1 {
+		t.Fatalf("expected 1 failure, got %d", len(fs))
+	}
+	if fs[0].Filename != "2.sql" || fs[0].Index != 1 ||
+		fs[0].Error != "syntax error" || fs[0].FailedAt.IsZero() {
+		t.Fatalf("unexpected failure %+v", fs[0])
+	}
+	fs, err = db.GetMetaFailures("other")
+	check(t, err)
+	if len(fs) != 0 {
+		t.Fatalf("expected no failures in other namespace, got %d", len(fs))
+	}
+}
+
+func TestGetMetaVersion(t *testing.T) {
+	db := setupDBV0(t)
+
+	v, err := db.GetMetaVersion()
+	check(t, err)
+	if v != 0 {
+		t.Fatalf("expected version 0, got %d", v)
+	}
+
+	err = db.UpgradeToV1(nil)
+	check(t, err)
+	err = db.UpgradeToV2()
+	check(t, err)
+	v, err = db.GetMetaVersion()
+	check(t, err)
+	if v != 2 {
+		t.Fatalf("expected version 2, got %d", v)
+	}
+}
+
+func TestGetMetaVersionMissing(t *testing.T) {
+	db := newDB(t)
+
+	v, err := db.GetMetaVersion()
+	check(t, err)
+	if v != -1 {
+		t.Fatalf("expected -1 without meta tables, got %d", v)
+	}
+}
+
 func check(t *testing.T, err error) {
 	t.Helper()
 	if err != nil {
@@ -132,6 +475,23 @@ func check(t *testing.T, err error) {
 	}
 }
 
+func TestFromDB(t *testing.T) {
+	sqldb := createDBAndOpen(t).DB
+	defer sqldb.Close()
+
+	db := FromDB(sqldb)
+	err := migrate.OpenStore(context.Background(), db)
+	check(t, err)
+	err = db.CreateMetaIfNotExists()
+	check(t, err)
+
+	// The caller's connection stays open.
+	err = db.Close()
+	check(t, err)
+	err = sqldb.Ping()
+	check(t, err)
+}
+
 func newDB(t *testing.T) *DB {
 	db := createDBAndOpen(t)
 	return &DB{DB: db}
@@ -225,6 +585,57 @@ func teardown(db *sqlx.DB) func() {
 	}
 }
 
+func setupDBV8(t *testing.T) *DB {
+	db := setupDBV7(t)
+	err := db.UpgradeToV8()
+	check(t, err)
+	return db
+}
+
+func setupDBV7(t *testing.T) *DB {
+	db := setupDBV6(t)
+	err := db.UpgradeToV7()
+	check(t, err)
+	return db
+}
+
+func setupDBV6(t *testing.T) *DB {
+	db := setupDBV5(t)
+	err := db.UpgradeToV6()
+	check(t, err)
+	return db
+}
+
+func setupDBV5(t *testing.T) *DB {
+	db := setupDBV4(t)
+	err := db.UpgradeToV5()
+	check(t, err)
+	err = db.CreateMetaFailuresIfNotExists()
+	check(t, err)
+	return db
+}
+
+func setupDBV4(t *testing.T) *DB {
+	db := setupDBV3(t)
+	err := db.UpgradeToV4()
+	check(t, err)
+	return db
+}
+
+func setupDBV3(t *testing.T) *DB {
+	db := setupDBV2(t)
+	err := db.UpgradeToV3()
+	check(t, err)
+	return db
+}
+
+func setupDBV2(t *testing.T) *DB {
+	db := setupDBV1(t)
+	err := db.UpgradeToV2()
+	check(t, err)
+	return db
+}
+
 func setupDBV1(t *testing.T) *DB {
 	db := setupDBV0(t)
 	err := db.UpgradeToV1([]migrate.Migration{{
@@ -270,3 +681,32 @@ func setupDBV0(t *testing.T) *DB {
 
 	return db
 }
+
+func TestClassifyConflict(t *testing.T) {
+	db := &DB{}
+	err := errors.Wrap(&pq.Error{Code: "40001"}, "exec")
+	if got := db.ClassifyError(err); got != migrate.ClassLockTimeout {
+		t.Fatalf("expected lock timeout, got %s", got)
+	}
+	if !isConflict(err) {
+		t.Fatal("expected conflict")
+	}
+	if isConflict(&pq.Error{Code: "42601"}) {
+		t.Fatal("expected syntax error not to be a conflict")
+	}
+}
+
+func TestRetryConflict(t *testing.T) {
+	db := &DB{conflictRetries: 2}
+	var calls int
+	err := db.retryConflict("SELECT 1", func() error {
+		calls++
+		return &pq.Error{Code: "40001"}
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 calls, got %d", calls)
+	}
+}
@@ -0,0 +1,63 @@
+package migrate
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// TablePrefixer is implemented by Stores which can prefix the names of their
+// meta tables, so they don't collide with an application's own tables, or so
+// several histories can be kept apart in one schema. See WithTablePrefix.
+type TablePrefixer interface {
+	// SetTablePrefix prepends prefix to the names of the meta tables,
+	// including the checkpoint and lock tables. It's called before any of
+	// the Store's other methods.
+	SetTablePrefix(prefix string)
+}
+
+// WithTablePrefix prepends prefix to the names of the meta tables, such as
+// "deploy_" for deploy_meta and deploy_metacheckpoints. The prefix may only
+// contain letters, digits, and underscores, and the Store which records the
+// history must be a TablePrefixer. Changing the prefix of a database which was
+// already migrated starts a new history, so rename its meta tables first.
+func WithTablePrefix(prefix string) Option {
+	return func(m *Migrate) { m.tablePrefix = prefix }
+}
+
+// regexTablePrefix matches the prefixes accepted by WithTablePrefix, which are
+// safe to use in unquoted identifiers.
+var regexTablePrefix = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// regexMetaTable matches the names of the meta tables in queries, and of their
+// constraints and indexes, which start with the name of their table.
+var regexMetaTable = regexp.MustCompile(`\bmeta\w*`)
+
+// PrefixMetaTables prepends prefix to the names of the meta tables in the
+// query q, and to the constraints and indexes named after them, for Stores
+// implementing TablePrefixer.
+func PrefixMetaTables(prefix, q string) string {
+	if prefix == "" {
+		return q
+	}
+	return regexMetaTable.ReplaceAllString(q, prefix+"$0")
+}
+
+// setTablePrefix of the Store which records the history, if configured
+// WithTablePrefix.
+func (m *Migrate) setTablePrefix() error {
+	if m.tablePrefix == "" {
+		return nil
+	}
+	if !regexTablePrefix.MatchString(m.tablePrefix) {
+		return fmt.Errorf("invalid table prefix %q: use letters, digits, "+
+			"and underscores", m.tablePrefix)
+	}
+	p, ok := m.tracker.(TablePrefixer)
+	if !ok {
+		return errors.New("store cannot prefix its meta tables")
+	}
+	p.SetTablePrefix(m.tablePrefix)
+	return nil
+}
@@ -0,0 +1,81 @@
+package migrate
+
+import (
+	"sync"
+	"time"
+)
+
+// Progress is a snapshot of a run, for admin panels and other UIs which poll
+// rather than receive events WithEvents.
+type Progress struct {
+	// Running reports whether Migrate or MigrateUntil is in progress.
+	// Otherwise the snapshot describes the last run, if any.
+	Running bool
+
+	// Started is when the run began, and Elapsed is how long it has run.
+	Started time.Time
+	Elapsed time.Duration
+
+	// File being migrated, or the last file migrated. Statement is the
+	// number of its Statements executed so far, including the Checkpoints
+	// skipped because an earlier run executed them.
+	File        string
+	Statement   int
+	Statements  int
+	Checkpoints int
+
+	// Applied files in this run, of Pending files when it began.
+	Applied int
+	Pending int
+
+	// LastError which stopped the run, if any.
+	LastError error
+}
+
+// progress of a run, updated as events are emitted. It's shared by copies
+// of a Migrate, such as the one restored by a failed Reload.
+type progress struct {
+	mu sync.Mutex
+	p  Progress
+}
+
+// Progress of the current or last run. It's safe to call concurrently with a
+// running migration.
+func (m *Migrate) Progress() Progress {
+	m.progress.mu.Lock()
+	defer m.progress.mu.Unlock()
+	p := m.progress.p
+	if p.Running {
+		p.Elapsed = time.Since(p.Started)
+	}
+	return p
+}
+
+// begin a run of pending files.
+func (p *progress) begin(pending int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.p = Progress{Running: true, Started: time.Now(), Pending: pending}
+}
+
+// update progress with e.
+func (p *progress) update(e Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch e := e.(type) {
+	case FileStarted:
+		p.p.File = e.Filename
+		p.p.Statement = e.Checkpoints
+		p.p.Statements = e.Statements
+		p.p.Checkpoints = e.Checkpoints
+	case StatementExecuted:
+		p.p.Statement = e.Index + e.Statements
+	case FileApplied:
+		p.p.Applied++
+	case Failed:
+		p.p.LastError = e.Err
+	case RunFinished:
+		p.p.Running = false
+		p.p.Elapsed = time.Since(p.p.Started)
+	}
+}
@@ -0,0 +1,46 @@
+package migrate
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ReadOnlyChecker is implemented by Stores which can detect that they can't
+// be written to, such as a replica, so Init can fail with a precise message
+// rather than on the first CREATE TABLE.
+type ReadOnlyChecker interface {
+	// ReadOnly reports why the connection can't be written to, or an
+	// empty string if it can.
+	ReadOnly() (string, error)
+}
+
+// checkWritable confirms that the database being migrated, its targets, and
+// the one tracking its history can be written to, if they know.
+func (m *Migrate) checkWritable() error {
+	stores := []Store{m.db}
+	if m.tracker != m.db {
+		stores = append(stores, m.tracker)
+	}
+	names := make([]string, 0, len(m.targets))
+	for name := range m.targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		stores = append(stores, m.targets[name])
+	}
+	for _, s := range stores {
+		c, ok := s.(ReadOnlyChecker)
+		if !ok {
+			continue
+		}
+		reason, err := c.ReadOnly()
+		if err != nil {
+			return fmt.Errorf("check read-only: %w", err)
+		}
+		if reason != "" {
+			return fmt.Errorf("%w: %s", ErrReadOnly, reason)
+		}
+	}
+	return nil
+}
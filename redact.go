@@ -0,0 +1,69 @@
+package migrate
+
+// Redactor rewrites a statement before it leaves migrate other than to be
+// executed, such as to mask a token matching a pattern.
+type Redactor func(sql string) string
+
+// WithRedactedLiterals replaces the string and numeric literals of statements
+// with ? wherever they're logged, written to the transcript, reported as
+// slowest, emitted in events, traced, or returned in a MigrationError, so
+// passwords and tokens in seed migrations don't end up in centralized logging.
+// Diffs of changed files and the Content of FileApplied events are redacted
+// too. Statements are executed and checkpointed as written.
+//
+// Error messages from the database are not redacted, and drivers often echo
+// the values which failed, such as Postgres's "Key (email)=(...)". Mask those
+// in recorded failures, retry warnings, and the transcript with WithRedactor.
+func WithRedactedLiterals() Option {
+	return func(m *Migrate) { m.redactLiterals = true }
+}
+
+// WithRedactor applies r to statements wherever WithRedactedLiterals would
+// redact them, after their literals are redacted if both are configured, and
+// to error messages from the database in recorded failures, retry warnings,
+// and the transcript. It may be passed multiple times, and redactors are
+// applied in order.
+func WithRedactor(r Redactor) Option {
+	return func(m *Migrate) { m.redactors = append(m.redactors, r) }
+}
+
+// redact the statement cmd before it's logged.
+func (m *Migrate) redact(cmd string) string {
+	if m.redactLiterals {
+		cmd = dialectFor(m.dbt).sanitize(cmd)
+	}
+	for _, r := range m.redactors {
+		cmd = r(cmd)
+	}
+	return cmd
+}
+
+// redacting reports whether statements are redacted.
+func (m *Migrate) redacting() bool {
+	return m.redactLiterals || len(m.redactors) > 0
+}
+
+// redactError err before it's recorded. Error messages aren't statements, so
+// only the redactors apply.
+func (m *Migrate) redactError(err error) string {
+	msg := err.Error()
+	for _, r := range m.redactors {
+		msg = r(msg)
+	}
+	return msg
+}
+
+// redactEvent e before it's emitted.
+func (m *Migrate) redactEvent(e Event) Event {
+	switch ev := e.(type) {
+	case StatementExecuted:
+		ev.SQL = m.redact(ev.SQL)
+		return ev
+	case FileApplied:
+		if m.redacting() {
+			ev.Content = m.redact(ev.Content)
+		}
+		return ev
+	}
+	return e
+}
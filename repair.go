@@ -0,0 +1,85 @@
+package migrate
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Repair records new checksums for applied migrations whose files changed
+// after they were migrated, such as by reformatting or editing a comment, so
+// the history verifies again. Each repaired migration is logged with a diff
+// of the file against the content recorded for it, and returned. Since New
+// fails on a changed file, call Repair on a Migrate returned by Load instead
+// of Init, which it calls itself; it may also be called after Init.
+//
+// Repair trusts the files as they are now, without checking that the database
+// matches them, so only use it on files whose changes don't alter the schema.
+// Files which were removed, renamed, or inserted earlier in history still
+// fail.
+func (m *Migrate) Repair() (repaired []Migration, err error) {
+	if m.readOnly {
+		return nil, errors.New("cannot repair: opened read-only by Inspect")
+	}
+	var unrepaired bool
+	m.repair = true
+	defer func() {
+		// Don't leave unrepaired history loaded, so it can't be
+		// migrated.
+		if err != nil && (unrepaired || len(m.mismatched) > 0) {
+			m.loaded = false
+		}
+		m.repair, m.mismatched = false, nil
+	}()
+	loaded := m.loaded
+	if !loaded {
+		if err = m.Init(m.skipTo); err != nil {
+			return nil, err
+		}
+	}
+	unlock, err := m.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// Unless lock or Init just did, reload the history to find the
+	// mismatches, since the files may have changed since Init.
+	if _, locked := m.tracker.(Locker); loaded && (!locked || m.noLock) {
+		if err = m.loadHistory(); err != nil {
+			return nil, err
+		}
+	}
+	unrepaired = len(m.mismatched) > 0
+	for i, mg := range m.Migrations {
+		if !m.mismatched[mg.Filename] {
+			continue
+		}
+		old := mg.Checksum
+		mg.Checksum, err = fileChecksum(m.hasher, m.fsys, mg.fullpath,
+			m.dbt)
+		if err != nil {
+			return nil, errors.Wrapf(err, "checksum %s", mg.Filename)
+		}
+		mg.Content, err = fileContent(m.fsys, mg.fullpath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read %s", mg.Filename)
+		}
+		mg.Algorithm, mg.Variant = m.hasher.Algorithm(), mg.currentVariant
+		if err = m.tracker.UpsertMigration(mg); err != nil {
+			return nil, errors.Wrapf(err, "repair %s", mg.Filename)
+		}
+		m.Migrations[i] = mg
+		repaired = append(repaired, mg)
+		m.record("repaired %s (%s -> %s %s)", mg.Filename, old,
+			mg.Algorithm, mg.Checksum)
+		m.infof("%s %s: checksum %s is now %s %s\n",
+			m.colorize(colorYellow, "repaired"), mg.Filename, old,
+			mg.Algorithm, mg.Checksum)
+	}
+
+	// Confirm the repaired history verifies.
+	m.repair = false
+	if err = m.loadHistory(); err != nil {
+		return nil, err
+	}
+	return repaired, nil
+}
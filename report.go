@@ -0,0 +1,287 @@
+package migrate
+
+import (
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Change made by a statement, as summarized in a ChangeReport.
+type Change struct {
+	Filename string `json:"filename"`
+
+	// Index of the statement within the file, starting at 0.
+	Index int `json:"index"`
+
+	// Action is the statement's verb and the type of object it changes,
+	// such as "CREATE TABLE" or "DELETE".
+	Action string `json:"action"`
+
+	// Object names the table, index, view, or other object changed.
+	Object string `json:"object"`
+
+	// Table affected by the change, which differs from Object for
+	// indexes and triggers. It's empty for objects without a table, such
+	// as functions.
+	Table string `json:"table,omitempty"`
+
+	// Destructive changes may lose data: drops, truncations, deletes, and
+	// columns dropped by ALTER TABLE.
+	Destructive bool `json:"destructive,omitempty"`
+}
+
+func (c Change) String() string {
+	s := fmt.Sprintf("%s `%s`", c.Action, c.Object)
+	if c.Table != "" && c.Table != c.Object {
+		s += fmt.Sprintf(" on `%s`", c.Table)
+	}
+	return s
+}
+
+// ChangeReport summarizes what a set of migrations change, suitable for
+// release notes and change-management tickets. It's derived from the SQL
+// alone, so statements it doesn't recognize, such as grants and stored
+// procedure bodies, are left out.
+type ChangeReport struct {
+	Migrations []string `json:"migrations"`
+
+	// Tables affected by any change, sorted by name.
+	Tables []string `json:"tables"`
+
+	Changes []Change `json:"changes"`
+}
+
+// Destructive changes in the report, in order.
+func (r ChangeReport) Destructive() []Change {
+	var changes []Change
+	for _, c := range r.Changes {
+		if c.Destructive {
+			changes = append(changes, c)
+		}
+	}
+	return changes
+}
+
+// Markdown renders the report with a section per migration, preceded by the
+// affected tables and any destructive changes.
+func (r ChangeReport) Markdown() string {
+	var b strings.Builder
+	b.WriteString("# Schema changes\n\n")
+	if len(r.Migrations) == 0 {
+		b.WriteString("No migrations.\n")
+		return b.String()
+	}
+	if len(r.Tables) > 0 {
+		b.WriteString("Tables affected: `")
+		b.WriteString(strings.Join(r.Tables, "`, `"))
+		b.WriteString("`\n\n")
+	}
+	if destructive := r.Destructive(); len(destructive) > 0 {
+		b.WriteString("**Destructive changes:**\n\n")
+		for _, c := range destructive {
+			fmt.Fprintf(&b, "- `%s`: %s\n", c.Filename, c)
+		}
+		b.WriteString("\n")
+	}
+	byFile := map[string][]Change{}
+	for _, c := range r.Changes {
+		byFile[c.Filename] = append(byFile[c.Filename], c)
+	}
+	for i, name := range r.Migrations {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "## %s\n\n", name)
+		if len(byFile[name]) == 0 {
+			b.WriteString("No recognized changes.\n")
+			continue
+		}
+		for _, c := range byFile[name] {
+			fmt.Fprintf(&b, "- %s\n", c)
+		}
+	}
+	return b.String()
+}
+
+// ChangeReport for the named migration files, or for every pending migration
+// if none are named. To report on the migrations applied by a run, collect
+// the filenames of Migrations added by Migrate.
+func (m *Migrate) ChangeReport(filenames ...string) (ChangeReport, error) {
+	files := m.pendingFiles()
+	if len(filenames) > 0 {
+		byName := make(map[string]*file, len(m.Files))
+		for _, fi := range m.Files {
+			byName[fi.Info.Name()] = fi
+		}
+		files = make([]*file, 0, len(filenames))
+		for _, name := range filenames {
+			fi, ok := byName[name]
+			if !ok {
+				return ChangeReport{}, fmt.Errorf("%w: %s",
+					ErrUnknownMigration, name)
+			}
+			files = append(files, fi)
+		}
+	}
+	report := ChangeReport{
+		Migrations: []string{},
+		Tables:     []string{},
+		Changes:    []Change{},
+	}
+	tables := map[string]bool{}
+	for _, fi := range files {
+		if fi.up != nil {
+			// Go migrations have no statements to classify.
+			report.Migrations = append(report.Migrations, fi.Info.Name())
+			continue
+		}
+		byt, err := fs.ReadFile(m.fsys, fi.fullpath)
+		if err != nil {
+			return ChangeReport{}, errors.Wrap(err, "read file")
+		}
+		cmds, err := StatementsFor(m.dbt, byt)
+		if err != nil {
+			return ChangeReport{}, fmt.Errorf("statements %s: %w",
+				fi.Info.Name(), err)
+		}
+		report.Migrations = append(report.Migrations, fi.Info.Name())
+		for i, cmd := range cmds {
+			c, ok := classifyChange(cmd)
+			if !ok {
+				continue
+			}
+			c.Filename = fi.Info.Name()
+			c.Index = i
+			report.Changes = append(report.Changes, c)
+			if c.Table != "" && !tables[c.Table] {
+				tables[c.Table] = true
+				report.Tables = append(report.Tables, c.Table)
+			}
+		}
+	}
+	sort.Strings(report.Tables)
+	return report, nil
+}
+
+// identifier matches a possibly qualified and quoted object name.
+const identifier = "([\\w.\"`]+)"
+
+var (
+	changeDDL = regexp.MustCompile(`(?is)^\s*(create|drop|alter)\s+` +
+		`(?:or\s+replace\s+)?` +
+		`(?:(?:global|local|temp|temporary|unique|materialized|unlogged)\s+)*` +
+		`(table|view|index|function|procedure|trigger|sequence|type|schema|extension)\s+` +
+		`(?:concurrently\s+)?(?:if\s+(?:not\s+)?exists\s+)?` + identifier)
+	changeTruncate = regexp.MustCompile(
+		`(?is)^\s*truncate\s+(?:table\s+)?(?:only\s+)?` + identifier)
+	changeRename = regexp.MustCompile(
+		`(?is)^\s*rename\s+table\s+` + identifier)
+	changeInsert = regexp.MustCompile(`(?is)^\s*(insert|replace)\s+` +
+		`(?:(?:low_priority|delayed|high_priority|ignore)\s+)*into\s+` +
+		identifier)
+	changeUpdate = regexp.MustCompile(
+		`(?is)^\s*update\s+(?:(?:low_priority|ignore|only)\s+)*` + identifier)
+	changeDelete = regexp.MustCompile(`(?is)^\s*delete\s+` +
+		`(?:(?:low_priority|quick|ignore)\s+)*from\s+(?:only\s+)?` +
+		identifier)
+	changeCopy     = regexp.MustCompile(`(?is)^\s*copy\s+` + identifier)
+	changeLoadData = regexp.MustCompile(
+		`(?is)^\s*load\s+data\b.*?\binto\s+table\s+` + identifier)
+
+	// changeOnTable finds the table of an index or trigger.
+	changeOnTable = regexp.MustCompile(`(?is)\son\s+(?:only\s+)?` + identifier)
+
+	// changeAlterDrop finds what an ALTER TABLE drops.
+	changeAlterDrop = regexp.MustCompile("(?is)\\bdrop\\s+[\"`]?(\\w+)")
+)
+
+// tableChanges are statements which change a single table. An empty action
+// is taken from the statement's verb.
+var tableChanges = []struct {
+	action      string
+	re          *regexp.Regexp
+	destructive bool
+}{
+	{"TRUNCATE", changeTruncate, true},
+	{"RENAME TABLE", changeRename, false},
+	{"", changeInsert, false},
+	{"UPDATE", changeUpdate, false},
+	{"DELETE", changeDelete, true},
+	{"COPY", changeCopy, false},
+	{"LOAD DATA", changeLoadData, false},
+}
+
+// alterDropsKeepingData are the words following DROP in an ALTER TABLE which
+// don't drop a column. MySQL allows the COLUMN keyword to be omitted, so
+// anything else is assumed to be a column.
+var alterDropsKeepingData = map[string]bool{
+	"check":      true,
+	"constraint": true,
+	"default":    true,
+	"expression": true,
+	"foreign":    true,
+	"identity":   true,
+	"index":      true,
+	"key":        true,
+	"not":        true,
+	"primary":    true,
+	"trigger":    true,
+}
+
+// classifyChange made by cmd, reporting false if it's not recognized.
+func classifyChange(cmd string) (Change, bool) {
+	if match := changeDDL.FindStringSubmatch(cmd); match != nil {
+		verb, kind := strings.ToUpper(match[1]), strings.ToUpper(match[2])
+		c := Change{
+			Action: verb + " " + kind,
+			Object: unquoteIdentifier(match[3]),
+		}
+		switch kind {
+		case "TABLE":
+			c.Table = c.Object
+		case "INDEX", "TRIGGER":
+			if on := changeOnTable.FindStringSubmatch(cmd); on != nil {
+				c.Table = unquoteIdentifier(on[1])
+			}
+		}
+		switch {
+		case verb == "DROP":
+			c.Destructive = true
+		case verb == "ALTER" && kind == "TABLE":
+			for _, d := range changeAlterDrop.FindAllStringSubmatch(cmd, -1) {
+				if !alterDropsKeepingData[strings.ToLower(d[1])] {
+					c.Destructive = true
+					break
+				}
+			}
+		}
+		return c, true
+	}
+	for _, t := range tableChanges {
+		match := t.re.FindStringSubmatch(cmd)
+		if match == nil {
+			continue
+		}
+		action := t.action
+		if action == "" {
+			action = strings.ToUpper(match[1])
+		}
+		name := unquoteIdentifier(match[len(match)-1])
+		return Change{
+			Action:      action,
+			Object:      name,
+			Table:       name,
+			Destructive: t.destructive,
+		}, true
+	}
+	return Change{}, false
+}
+
+// unquoteIdentifier removes double quotes and backticks from a name.
+func unquoteIdentifier(s string) string {
+	return strings.NewReplacer(`"`, "", "`", "").Replace(s)
+}
@@ -0,0 +1,64 @@
+package migrate
+
+import "testing"
+
+func TestClassifyChange(t *testing.T) {
+	tcs := []struct {
+		cmd  string
+		want Change
+	}{
+		{
+			cmd: "CREATE TABLE IF NOT EXISTS users (id INTEGER)",
+			want: Change{Action: "CREATE TABLE", Object: "users",
+				Table: "users"},
+		},
+		{
+			cmd: `CREATE UNIQUE INDEX CONCURRENTLY "users_email" ON public.users (email)`,
+			want: Change{Action: "CREATE INDEX", Object: "users_email",
+				Table: "public.users"},
+		},
+		{
+			cmd: "DROP VIEW active_users",
+			want: Change{Action: "DROP VIEW", Object: "active_users",
+				Destructive: true},
+		},
+		{
+			cmd: "ALTER TABLE users ALTER COLUMN name DROP NOT NULL",
+			want: Change{Action: "ALTER TABLE", Object: "users",
+				Table: "users"},
+		},
+		{
+			cmd: "ALTER TABLE `users` DROP `legacy_id`",
+			want: Change{Action: "ALTER TABLE", Object: "users",
+				Table: "users", Destructive: true},
+		},
+		{
+			cmd: "INSERT IGNORE INTO teams (id) VALUES (1)",
+			want: Change{Action: "INSERT", Object: "teams",
+				Table: "teams"},
+		},
+		{
+			cmd: "DELETE FROM sessions WHERE expired",
+			want: Change{Action: "DELETE", Object: "sessions",
+				Table: "sessions", Destructive: true},
+		},
+		{
+			cmd: "TRUNCATE audit_log",
+			want: Change{Action: "TRUNCATE", Object: "audit_log",
+				Table: "audit_log", Destructive: true},
+		},
+	}
+	for _, tc := range tcs {
+		got, ok := classifyChange(tc.cmd)
+		if !ok {
+			t.Errorf("%s: not recognized", tc.cmd)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: expected %+v, got %+v", tc.cmd, tc.want, got)
+		}
+	}
+	if _, ok := classifyChange("GRANT SELECT ON users TO app"); ok {
+		t.Error("expected grant to be unrecognized")
+	}
+}
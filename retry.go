@@ -0,0 +1,91 @@
+package migrate
+
+import (
+	"database/sql"
+	"time"
+)
+
+// RetryClassifier is implemented by Stores which decide for themselves which
+// failed statements are safe to retry with WithRetries. It replaces the
+// default of retrying lock timeouts and lost connections, so to handle the
+// failure modes of a managed database or proxy, such as PgBouncer dropping a
+// server connection, embed the Store in a type of your own with a Retryable
+// method:
+//
+//	type proxied struct{ *postgres.DB }
+//
+//	func (p proxied) Retryable(err error) bool {
+//		return strings.Contains(err.Error(), "server conn crashed") ||
+//			p.ClassifyError(err) == migrate.ClassLockTimeout
+//	}
+type RetryClassifier interface {
+	Retryable(err error) bool
+}
+
+// WithRetries executes a failed statement up to n more times, with backoff,
+// if it's retryable according to the Store; see RetryClassifier. Batches
+// aren't retried, since a failed batch may have partially applied, but atomic
+// groups are, since they're rolled back.
+func WithRetries(n int) Option {
+	return func(m *Migrate) { m.retries = n }
+}
+
+// retryBackoff is the first wait before retrying a statement, which doubles
+// after each attempt.
+const retryBackoff = 100 * time.Millisecond
+
+// retryable reports whether the statement which failed with err may be
+// executed again.
+func (m *Migrate) retryable(err error) bool {
+	if r, ok := m.db.(RetryClassifier); ok {
+		return r.Retryable(err)
+	}
+	switch m.classifyError(err) {
+	case ClassLockTimeout, ClassConnectionLost:
+		return true
+	}
+	return false
+}
+
+// execRetrying the statement at index i of f until it succeeds, fails with
+// an error which isn't retryable, or has been retried as configured by
+// WithRetries.
+func (m *Migrate) execRetrying(
+	f *file,
+	i int,
+	stmt statement,
+) (sql.Result, error) {
+	var res sql.Result
+	err := m.retry(f, i, func() error {
+		var err error
+		res, err = m.execStatement(f, i, stmt)
+		return err
+	})
+	return res, err
+}
+
+// retry exec, which executes statements of f starting at index i, until it
+// succeeds, fails with an error which isn't retryable, or has been retried as
+// configured by WithRetries.
+func (m *Migrate) retry(f *file, i int, exec func() error) error {
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		err := exec()
+		if err == nil || attempt > m.retries || !m.retryable(err) {
+			return err
+		}
+		m.warnf("%s %s [%d] failed, retrying in %s (%d/%d): %s\n",
+			m.colorize(colorYellow, "warning"), f.Info.Name(), i,
+			backoff, attempt, m.retries, m.redactError(err))
+		m.record("retry %s [%d] in %s: %s", f.Info.Name(), i, backoff,
+			m.redactError(err))
+		select {
+		case <-time.After(backoff):
+		case <-m.interrupt:
+			return err
+		case <-m.ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
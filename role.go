@@ -0,0 +1,38 @@
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// RoleExecer is implemented by Stores which can execute a statement as
+// another database role, such as with SET ROLE in Postgres. It's optional;
+// without it, files with an as directive need WithRoleStore.
+type RoleExecer interface {
+	// ExecAs executes query as role, then resets the role.
+	ExecAs(role, query string, args ...interface{}) (sql.Result, error)
+}
+
+// WithRoleStore executes files with a `-- migrate:as role` directive on s,
+// such as a connection which logs in as role. It takes precedence over the
+// Store's RoleExecer, and is the only way to honor the directive on databases
+// without one.
+func WithRoleStore(role string, s Store) Option {
+	return func(m *Migrate) { m.roleStores[role] = s }
+}
+
+// execAs executes cmd as role, using the Store configured for the role if any.
+func (m *Migrate) execAs(
+	role, cmd string,
+	args []interface{},
+) (sql.Result, error) {
+	if s, ok := m.roleStores[role]; ok {
+		return m.exec(s, cmd, args...)
+	}
+	r, ok := m.db.(RoleExecer)
+	if !ok {
+		return nil, fmt.Errorf("store cannot execute as role %s: use WithRoleStore",
+			role)
+	}
+	return r.ExecAs(role, cmd, args...)
+}
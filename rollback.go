@@ -0,0 +1,168 @@
+package migrate
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// downSuffix marks the down file which reverses a migration, before its
+// extension, such as 12_add_users.down.sql for 12_add_users.sql. Down files
+// sit next to their migration, including in override directories, and are
+// never migrated themselves.
+const downSuffix = ".down"
+
+// MigrationDeleter is implemented by Stores which can remove a migration from
+// the history, as Rollback requires. It's optional; Rollback fails on Stores
+// without one.
+type MigrationDeleter interface {
+	DeleteMigration(namespace, filename string) error
+}
+
+// isDownFile reports whether name is the down file of a migration.
+func isDownFile(name string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(name, path.Ext(name)),
+		downSuffix)
+}
+
+// downPath of the down file for the migration at fullpath.
+func downPath(fullpath string) string {
+	ext := path.Ext(fullpath)
+	return strings.TrimSuffix(fullpath, ext) + downSuffix + ext
+}
+
+// Rollback the last n applied migrations, newest first, by executing their
+// down files and removing them from the history. Every down file must exist
+// and parse before anything is rolled back. Down files aren't checkpointed,
+// so one which fails partway must be finished by hand; keep each statement
+// safe to rerun. Rolled-back migrations are pending again, and run on the
+// next call to Migrate.
+//
+// Rolling back rewrites history which other environments may not share, so
+// prefer a new migration which reverses the change wherever it's been
+// deployed. Rollback is for mistakes caught before then.
+func (m *Migrate) Rollback(n int) error {
+	if m.readOnly {
+		return errors.New("cannot roll back: opened read-only by Inspect")
+	}
+	if !m.loaded {
+		return errors.New("must call Init before Rollback")
+	}
+	deleter, ok := m.tracker.(MigrationDeleter)
+	if !ok {
+		return errors.New("store cannot delete migrations: implement MigrationDeleter")
+	}
+	if n < 0 {
+		return fmt.Errorf("cannot roll back %d migrations", n)
+	}
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if n > len(m.Migrations) {
+		return fmt.Errorf("cannot roll back %d migrations: only %d applied",
+			n, len(m.Migrations))
+	}
+
+	// Confirm every down file exists and parses before running any.
+	downs := make([]*file, 0, n)
+	for i := len(m.Migrations) - 1; i >= len(m.Migrations)-n; i-- {
+		f, err := m.downFile(m.Migrations[i])
+		if err != nil {
+			return err
+		}
+		downs = append(downs, f)
+	}
+	for _, f := range downs {
+		mg := m.Migrations[len(m.Migrations)-1]
+		if err := m.rollbackFile(f); err != nil {
+			m.recordFailure(err)
+			return err
+		}
+		err := deleter.DeleteMigration(m.namespace, mg.Filename)
+		if err != nil {
+			return errors.Wrap(err, "delete migration")
+		}
+		m.Migrations = m.Migrations[:len(m.Migrations)-1]
+		m.record("rolled back %s", mg.Filename)
+		m.infof("%s %s\n", m.colorize(colorYellow, "rolled back"),
+			mg.Filename)
+	}
+	return nil
+}
+
+// downFile which reverses mg, with its statements counted.
+func (m *Migrate) downFile(mg Migration) (*file, error) {
+	p := downPath(mg.fullpath)
+	info, err := fs.Stat(m.fsys, p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("cannot roll back %s: %s does not exist",
+			mg.Filename, path.Base(p))
+	}
+	if err != nil {
+		return nil, err
+	}
+	f := &file{Info: info, fullpath: p}
+	var d fileDirectives
+	f.statements, d, err = countStatements(m.fsys, p, m.dbt)
+	if err != nil {
+		return nil, fmt.Errorf("statements %s: %w", info.Name(), err)
+	}
+	if f.statements == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoStatements, info.Name())
+	}
+	f.target = d.target
+	if f.target != "" {
+		if _, ok := m.targets[f.target]; !ok {
+			return nil, fmt.Errorf("%s: unknown target %s: use WithTarget",
+				info.Name(), f.target)
+		}
+	}
+	return f, nil
+}
+
+// rollbackFile executes the statements of the down file f one at a time.
+func (m *Migrate) rollbackFile(f *file) error {
+	if f.target != "" {
+		db := m.db
+		m.db = m.targets[f.target]
+		defer func() { m.db = db }()
+	}
+	stmts, err := openStatements(nil, m.fsys, f.fullpath, m.dbt)
+	if err != nil {
+		return fmt.Errorf("statements: %w", err)
+	}
+	defer stmts.Close()
+	for i := 0; ; i++ {
+		stmt, ok, err := stmts.next()
+		if err != nil {
+			return fmt.Errorf("statements: %w", err)
+		}
+		if !ok {
+			return nil
+		}
+		if stmt.group != 0 {
+			return fmt.Errorf("%s: %s groups aren't supported in down files",
+				f.Info.Name(), atomicDirective)
+		}
+		m.logStatement(stmt.sql)
+		m.record("exec %s [%d]\n%s", f.Info.Name(), i, m.redact(stmt.sql))
+		if _, err = m.execRetrying(f, i, stmt); err != nil {
+			m.record("failed %s [%d]: %s", f.Info.Name(), i,
+				m.redactError(err))
+			m.errorf("%s %s\n", m.colorize(colorRed, "failed on"),
+				m.redact(stmt.sql))
+			return &MigrationError{
+				File:  f.Info.Name(),
+				Index: i,
+				SQL:   m.redact(stmt.sql),
+				Class: m.classifyError(err),
+				Err:   err,
+			}
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Region is a database migrated as one step of a Rollout.
+type Region struct {
+	Name string
+	DB   Store
+}
+
+// Gate checks that a rollout may continue after region was migrated, such as
+// that it's healthy and its replicas have caught up. It may block until then.
+// Returning an error halts the rollout.
+type Gate func(region Region) error
+
+// RegionReport describes the result of migrating one Region.
+type RegionReport struct {
+	Region string
+
+	// Migrated contains the filenames applied in this run, in order.
+	Migrated []string
+
+	// Err which halted the rollout at this region, if any, from either
+	// migrating or its gate.
+	Err error
+}
+
+// RolloutReport is the combined result of Rollout.
+type RolloutReport struct {
+	Regions []RegionReport
+
+	// Halted is the name of the region where the rollout stopped, or empty
+	// if it completed. Later regions were not migrated.
+	Halted string
+}
+
+// String summarizes the report with one line per region.
+func (r RolloutReport) String() string {
+	var b strings.Builder
+	for _, rr := range r.Regions {
+		fmt.Fprintf(&b, "%s: %d migrated", rr.Region, len(rr.Migrated))
+		if rr.Err != nil {
+			fmt.Fprintf(&b, ": %s", rr.Err)
+		}
+		b.WriteString("\n")
+	}
+	if r.Halted != "" {
+		fmt.Fprintf(&b, "halted at %s\n", r.Halted)
+	}
+	return b.String()
+}
+
+// Rollout applies the migrations in dir to each region in order, calling gate
+// between regions, if it's not nil. opts apply to every region. It halts at the
+// first failure, leaving later regions untouched, and reports where. Calling
+// Rollout again resumes from there, since the regions which completed are
+// already up to date, and their gates are checked again.
+func Rollout(
+	log Logger,
+	dbt DBType,
+	dir string,
+	regions []Region,
+	gate Gate,
+	opts ...Option,
+) (RolloutReport, error) {
+	var report RolloutReport
+	seen := map[string]bool{}
+	for _, r := range regions {
+		if seen[r.Name] {
+			return report, fmt.Errorf("duplicate region %q", r.Name)
+		}
+		seen[r.Name] = true
+	}
+	for i, r := range regions {
+		logTo(context.Background(), log, slog.LevelInfo,
+			[]any{"region", r.Name}, "migrating region %s\n", r.Name)
+		rr := RegionReport{Region: r.Name}
+		rr.Migrated, rr.Err = migrateRegion(log, dbt, dir, r, opts)
+		if rr.Err == nil && gate != nil && i < len(regions)-1 {
+			if err := gate(r); err != nil {
+				rr.Err = fmt.Errorf("gate: %w", err)
+			}
+		}
+		report.Regions = append(report.Regions, rr)
+		if rr.Err != nil {
+			report.Halted = r.Name
+			return report, fmt.Errorf("region %q: %w", r.Name, rr.Err)
+		}
+	}
+	return report, nil
+}
+
+func migrateRegion(
+	log Logger,
+	dbt DBType,
+	dir string,
+	r Region,
+	opts []Option,
+) ([]string, error) {
+	opts = append([]Option{WithLogger(log), WithDBType(dbt)}, opts...)
+	m, err := New(r.DB, dir, opts...)
+	if err != nil {
+		return nil, err
+	}
+	before := len(m.Migrations)
+	_, err = m.Migrate()
+	var migrated []string
+	for _, mg := range m.Migrations[before:] {
+		migrated = append(migrated, mg.Filename)
+	}
+	return migrated, err
+}
+
+// CanaryRollout migrates canary first and checks it with check, such as
+// QueryGate, before rolling out to targets like Rollout. If the canary fails
+// either step, the targets are left untouched.
+func CanaryRollout(
+	log Logger,
+	dbt DBType,
+	dir string,
+	canary Region,
+	check Gate,
+	targets []Region,
+	gate Gate,
+	opts ...Option,
+) (RolloutReport, error) {
+	if len(targets) == 0 {
+		return RolloutReport{}, errors.New("canary rollout requires targets")
+	}
+	regions := append([]Region{canary}, targets...)
+	return Rollout(log, dbt, dir, regions, func(r Region) error {
+		if r.Name == canary.Name {
+			return check(r)
+		}
+		if gate == nil {
+			return nil
+		}
+		return gate(r)
+	}, opts...)
+}
+
+// queryRower is implemented by Stores built on database/sql, which includes
+// every bundled Store.
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// QueryGate runs each query against the region, requiring that it return a
+// single true value, such as `SELECT COUNT(*) > 0 FROM plans`.
+func QueryGate(queries ...string) Gate {
+	return func(r Region) error {
+		q, ok := r.DB.(queryRower)
+		if !ok {
+			return errors.New("store cannot run queries")
+		}
+		for _, query := range queries {
+			var pass bool
+			if err := q.QueryRow(query).Scan(&pass); err != nil {
+				return fmt.Errorf("%s: %w", query, err)
+			}
+			if !pass {
+				return fmt.Errorf("%s: check failed", query)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,39 @@
+package migrate
+
+import "time"
+
+// WithStartAt waits until t before executing any pending migrations, so heavy
+// migrations can be armed ahead of a low-traffic window. The history is
+// reloaded after waiting, in case another process migrated in the meantime.
+func WithStartAt(t time.Time) Option {
+	return func(m *Migrate) { m.startAt = t }
+}
+
+// waitForStart sleeps until the configured start time if there's anything to
+// migrate, then reloads the history.
+func (m *Migrate) waitForStart() error {
+	if !m.loaded || m.startAt.IsZero() {
+		return nil
+	}
+	wait := time.Until(m.startAt)
+	if wait <= 0 {
+		return nil
+	}
+	objects, err := m.changedObjects()
+	if err != nil {
+		return err
+	}
+	if len(m.pendingFiles()) == 0 && len(objects) == 0 {
+		return nil
+	}
+	m.infof("waiting until %s to migrate\n",
+		m.startAt.Format(time.RFC3339))
+	select {
+	case <-time.After(wait):
+	case <-m.interrupt:
+		return ErrInterrupted
+	case <-m.ctx.Done():
+		return m.interruption()
+	}
+	return m.loadHistory()
+}
@@ -0,0 +1,56 @@
+package migrate
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+)
+
+// SessionConnector opens connections to dsn with d, executing stmts on each
+// before it's used, such as `SET lock_timeout = '5s'`. Stores use it to apply
+// session settings to every connection in their pool, since a setting made by
+// one statement only affects the connection which ran it. A connection is
+// discarded if any statement fails.
+func SessionConnector(d driver.Driver, dsn string, stmts []string) driver.Connector {
+	return &sessionConnector{driver: d, dsn: dsn, stmts: stmts}
+}
+
+type sessionConnector struct {
+	driver driver.Driver
+	dsn    string
+	stmts  []string
+}
+
+func (c *sessionConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range c.stmts {
+		if err = execConn(ctx, conn, stmt); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("session %q: %w", stmt, err)
+		}
+	}
+	return conn, nil
+}
+
+func (c *sessionConnector) Driver() driver.Driver { return c.driver }
+
+// execConn executes stmt on a driver connection, preparing it if the driver
+// can't execute it directly.
+func execConn(ctx context.Context, conn driver.Conn, stmt string) error {
+	if e, ok := conn.(driver.ExecerContext); ok {
+		_, err := e.ExecContext(ctx, stmt, nil)
+		if err != driver.ErrSkip {
+			return err
+		}
+	}
+	ps, err := conn.Prepare(stmt)
+	if err != nil {
+		return err
+	}
+	defer ps.Close()
+	_, err = ps.Exec(nil)
+	return err
+}
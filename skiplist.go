@@ -0,0 +1,110 @@
+package migrate
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// skipFile in the migration directory lists migrations which are recorded as
+// applied without running them in named environments, such as a data fix for
+// production which must not run against staging clones. Each line names an
+// environment followed by its files. Blank lines and lines starting with #
+// are skipped:
+//
+//	# Production-only data fixes
+//	staging: 12_fix_orders.sql 15_refund_duplicates.sql
+//	dev: 12_fix_orders.sql
+//
+// The list isn't part of any migration's checksum, so an environment can be
+// added after the migration was applied elsewhere.
+const skipFile = ".migrateskip"
+
+// WithEnvironment names the environment being migrated, such as staging, so
+// the migrations listed for it in the skip file are recorded as applied
+// without running them, keeping its history aligned with other environments.
+// Without it, nothing is skipped.
+func WithEnvironment(env string) Option {
+	return func(m *Migrate) { m.env = env }
+}
+
+// readSkipList of the files to skip in env from the skip file in fsys. It's
+// not an error for the file to be missing.
+func readSkipList(fsys fs.FS, env string) (map[string]bool, error) {
+	byt, err := fs.ReadFile(fsys, skipFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read "+skipFile)
+	}
+	skip := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(byt))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || name == "" {
+			return nil, fmt.Errorf("%s:%d: expected environment: files",
+				skipFile, n)
+		}
+		if name != env {
+			continue
+		}
+		for _, filename := range strings.Fields(parts[1]) {
+			skip[filename] = true
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "read "+skipFile)
+	}
+	return skip, nil
+}
+
+// markSkipped files listed for the environment in the skip file, if one was
+// configured. Listing a file which doesn't exist is an error, so typos don't
+// run a migration which should have been skipped.
+func (m *Migrate) markSkipped(files []*file) error {
+	if m.env == "" {
+		return nil
+	}
+	skip, err := readSkipList(m.fsys, m.env)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if skip[fi.Info.Name()] {
+			fi.skip = true
+			delete(skip, fi.Info.Name())
+		}
+	}
+	for filename := range skip {
+		return fmt.Errorf("%s: %s: %w: %s", skipFile, m.env,
+			ErrUnknownMigration, filename)
+	}
+	return nil
+}
+
+// recordSkipped f as applied without running it.
+func (m *Migrate) recordSkipped(f *file) error {
+	mg, err := m.fileMigration(f)
+	if err != nil {
+		return err
+	}
+	mg.AppliedAt = appliedNow()
+	if err = m.tracker.InsertMigration(mg); err != nil {
+		return errors.Wrap(err, "insert migration")
+	}
+	m.Migrations = append(m.Migrations, mg)
+	m.record("skipped %s in %s (%s %s)", mg.Filename, m.env, mg.Algorithm,
+		mg.Checksum)
+	m.emit(FileApplied{Migration: mg})
+	return nil
+}
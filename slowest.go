@@ -0,0 +1,106 @@
+package migrate
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatementTiming is a statement executed during a run, as reported by
+// SlowestStatements.
+type StatementTiming struct {
+	Filename string `json:"filename"`
+
+	// Index of the statement within the file. Batched statements are
+	// timed together, starting at Index.
+	Index      int    `json:"index"`
+	Statements int    `json:"statements"`
+	SQL        string `json:"sql"`
+
+	Duration     time.Duration `json:"duration_ns"`
+	RowsAffected int64         `json:"rows_affected"`
+}
+
+// WithSlowestReport logs the n slowest statements of each run when it
+// finishes, with their durations and the rows they affected, so expensive
+// patterns are noticed before the next similar migration. They're also
+// available from SlowestStatements, such as to persist them.
+func WithSlowestReport(n int) Option {
+	return func(m *Migrate) { m.slowest.n = n }
+}
+
+// slowest statements of a run, updated as events are emitted. Like progress,
+// it's shared by copies of a Migrate.
+type slowest struct {
+	mu    sync.Mutex
+	n     int
+	stmts []StatementTiming
+}
+
+// SlowestStatements of the current or last run, slowest first, up to the
+// number configured by WithSlowestReport. It's safe to call concurrently
+// with a running migration.
+func (m *Migrate) SlowestStatements() []StatementTiming {
+	m.slowest.mu.Lock()
+	defer m.slowest.mu.Unlock()
+	return append([]StatementTiming(nil), m.slowest.stmts...)
+}
+
+// begin a run.
+func (s *slowest) begin() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stmts = nil
+}
+
+// update the slowest statements with e.
+func (s *slowest) update(e Event) {
+	ex, ok := e.(StatementExecuted)
+	if !ok || s.n <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.stmts) == s.n && ex.Duration <= s.stmts[s.n-1].Duration {
+		return
+	}
+	s.stmts = append(s.stmts, StatementTiming{
+		Filename:     ex.Filename,
+		Index:        ex.Index,
+		Statements:   ex.Statements,
+		SQL:          ex.SQL,
+		Duration:     ex.Duration,
+		RowsAffected: ex.RowsAffected,
+	})
+	sort.SliceStable(s.stmts, func(i, j int) bool {
+		return s.stmts[i].Duration > s.stmts[j].Duration
+	})
+	if len(s.stmts) > s.n {
+		s.stmts = s.stmts[:s.n]
+	}
+}
+
+// logSlowest statements of the run which just finished, if configured.
+func (m *Migrate) logSlowest() {
+	stmts := m.SlowestStatements()
+	if len(stmts) == 0 {
+		return
+	}
+	m.infof("%d slowest statements:\n", len(stmts))
+	for _, st := range stmts {
+		sql := spaces.ReplaceAllString(
+			strings.ReplaceAll(st.SQL, "\n", " "), " ")
+		if len(sql) >= 60 {
+			sql = sql[:56] + "..."
+		}
+		var rows string
+		if st.RowsAffected > 0 {
+			rows = fmt.Sprintf("%d rows", st.RowsAffected)
+		}
+		m.infof("  %10s %12s  %s [%d]  %s\n",
+			st.Duration.Round(time.Millisecond), rows, st.Filename,
+			st.Index, m.colorize(colorDim, sql))
+	}
+}
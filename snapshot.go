@@ -0,0 +1,73 @@
+package migrate
+
+// Snapshot of a migration history. Export one from production with
+// Migrate.Snapshot, then check pull requests against it with VerifySnapshot,
+// which needs no database access.
+type Snapshot struct {
+	Namespace  string              `json:"namespace,omitempty"`
+	Migrations []SnapshotMigration `json:"migrations"`
+}
+
+// SnapshotMigration is an applied migration in a Snapshot. Its content is
+// left out, so snapshots can't be verified in FIPS mode if the history uses
+// md5 checksums.
+type SnapshotMigration struct {
+	Filename  string `json:"filename"`
+	Checksum  string `json:"checksum"`
+	Algorithm string `json:"algorithm,omitempty"`
+	Variant   string `json:"variant,omitempty"`
+}
+
+// Snapshot of the migration history. It requires Init or Inspect.
+func (m *Migrate) Snapshot() Snapshot {
+	s := Snapshot{
+		Namespace:  m.namespace,
+		Migrations: make([]SnapshotMigration, 0, len(m.Migrations)),
+	}
+	for _, mg := range m.Migrations {
+		s.Migrations = append(s.Migrations, SnapshotMigration{
+			Filename:  mg.Filename,
+			Checksum:  mg.Checksum,
+			Algorithm: mg.Algorithm,
+			Variant:   mg.Variant,
+		})
+	}
+	return s
+}
+
+// VerifySnapshot confirms the migrations in dir are consistent with the
+// history in snap, as New would against the database: every applied
+// migration must still exist in the same order with the same checksum. Only
+// new migrations may be added, and only after those applied. opts are
+// applied after the snapshot's namespace.
+func VerifySnapshot(
+	log Logger,
+	dbt DBType,
+	dir string,
+	snap Snapshot,
+	opts ...Option,
+) error {
+	opts = append([]Option{
+		WithLogger(log),
+		WithDBType(dbt),
+		WithNamespace(snap.Namespace),
+	}, opts...)
+	m, err := Load(nil, dir, opts...)
+	if err != nil {
+		return err
+	}
+	m.Migrations = make([]Migration, 0, len(snap.Migrations))
+	for _, sm := range snap.Migrations {
+		m.Migrations = append(m.Migrations, Migration{
+			Filename:  sm.Filename,
+			Checksum:  sm.Checksum,
+			Algorithm: sm.Algorithm,
+			Namespace: snap.Namespace,
+			Variant:   sm.Variant,
+		})
+	}
+	if err = m.fillFullpaths(); err != nil {
+		return err
+	}
+	return m.validHistory()
+}
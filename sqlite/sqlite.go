@@ -1,34 +1,133 @@
 package sqlite
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
 	"github.com/pkg/errors"
 	"github.com/thankful-ai/migrate"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
 type DB struct {
-	filepath string
+	filepath    string
+	busyTimeout time.Duration
+	session     []string
+
+	// external connections were opened by the caller, who closes them.
+	external bool
+
+	// prefix of the meta tables' names; see SetTablePrefix.
+	prefix string
 
 	// Embed the sqlx DB struct
 	*sqlx.DB
 }
 
-func New(dbFile string) *DB {
-	return &DB{filepath: dbFile}
+// Option configures optional behavior in New.
+type Option func(*DB)
+
+// WithBusyTimeout sets how long SQLite waits for another connection's lock
+// before failing with "database is locked". The driver's default is 5s.
+func WithBusyTimeout(d time.Duration) Option {
+	return func(db *DB) { db.busyTimeout = d }
+}
+
+// WithSession executes stmts on every connection before it's used, such as
+// `PRAGMA foreign_keys = ON`, so operational guardrails apply to every
+// migration without repeating them in each file.
+func WithSession(stmts ...string) Option {
+	return func(db *DB) { db.session = append(db.session, stmts...) }
+}
+
+func New(dbFile string, opts ...Option) *DB {
+	db := &DB{filepath: dbFile}
+	for _, opt := range opts {
+		opt(db)
+	}
+	return db
+}
+
+// FromDB is a Store using sqldb, a connection pool which the caller opened
+// with the sqlite3 driver, such as an embedded app's own database. Open and
+// Close leave sqldb as it is, since it belongs to the caller. Options which
+// configure the connection, WithBusyTimeout and WithSession, can't be used.
+func FromDB(sqldb *sql.DB, opts ...Option) *DB {
+	db := &DB{DB: sqlx.NewDb(sqldb, "sqlite3"), external: true}
+	for _, opt := range opts {
+		opt(db)
+	}
+	return db
+}
+
+// busyRetries is the number of times to retry a statement which failed
+// because the database was locked, as happens when an embedded app's
+// background writers hold a lock longer than the busy timeout.
+const busyRetries = 5
+
+// retryBusy calls fn until it doesn't fail with SQLITE_BUSY or SQLITE_LOCKED,
+// backing off between attempts. A statement which failed to acquire a lock
+// had no effect, so it's safe to retry.
+func retryBusy(fn func() error) error {
+	backoff := 50 * time.Millisecond
+	for i := 0; ; i++ {
+		err := fn()
+		if i == busyRetries || !isBusy(err) {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func isBusy(err error) bool {
+	var liteErr sqlite3.Error
+	if !errors.As(err, &liteErr) {
+		return false
+	}
+	return liteErr.Code == sqlite3.ErrBusy || liteErr.Code == sqlite3.ErrLocked
+}
+
+// Exec query, retrying if the database is locked.
+func (db *DB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.ExecContext(context.Background(), query, args...)
+}
+
+// ExecContext is Exec, interrupting query once ctx is done.
+func (db *DB) ExecContext(
+	ctx context.Context,
+	query string,
+	args ...interface{},
+) (sql.Result, error) {
+	var res sql.Result
+	err := retryBusy(func() error {
+		var err error
+		res, err = db.DB.ExecContext(ctx, query, args...)
+		return err
+	})
+	return res, err
 }
 
 func (db *DB) CreateMetaIfNotExists() error {
-	q := `CREATE TABLE IF NOT EXISTS meta (
-		filename TEXT UNIQUE NOT NULL,
+	q := db.meta(`CREATE TABLE IF NOT EXISTS meta (
+		namespace TEXT NOT NULL DEFAULT '',
+		filename TEXT NOT NULL,
 		md5 TEXT NOT NULL,
 		content TEXT NOT NULL,
-		createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
-	)`
+		algorithm TEXT NOT NULL DEFAULT 'md5',
+		variant TEXT NOT NULL DEFAULT '',
+		statements INTEGER NOT NULL DEFAULT 0,
+		duration_ns INTEGER NOT NULL DEFAULT 0,
+		annotations TEXT NOT NULL DEFAULT '',
+		appliedat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (namespace, filename)
+	)`)
 	if _, err := db.Exec(q); err != nil {
 		return errors.Wrap(err, "create meta table")
 	}
@@ -36,71 +135,165 @@ func (db *DB) CreateMetaIfNotExists() error {
 }
 
 func (db *DB) CreateMetaCheckpointsIfNotExists() error {
-	q := `CREATE TABLE IF NOT EXISTS metacheckpoints (
+	q := db.meta(`CREATE TABLE IF NOT EXISTS metacheckpoints (
+		namespace TEXT NOT NULL DEFAULT '',
 		filename TEXT NOT NULL,
 		content TEXT NOT NULL,
 		idx INTEGER NOT NULL,
 		md5 TEXT NOT NULL,
 		createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-		PRIMARY KEY (filename, idx)
-	)`
+		PRIMARY KEY (namespace, filename, idx)
+	)`)
 	if _, err := db.Exec(q); err != nil {
 		return errors.Wrap(err, "create metacheckpoints table")
 	}
 	return nil
 }
 
-func (db *DB) GetMigrations() ([]migrate.Migration, error) {
+func (db *DB) CreateMetaObjectsIfNotExists() error {
+	q := db.meta(`CREATE TABLE IF NOT EXISTS metaobjects (
+		namespace TEXT NOT NULL DEFAULT '',
+		filename TEXT NOT NULL,
+		content TEXT NOT NULL,
+		createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (namespace, filename)
+	)`)
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "create metaobjects table")
+	}
+	return nil
+}
+
+func (db *DB) CreateMetaFailuresIfNotExists() error {
+	q := db.meta(`CREATE TABLE IF NOT EXISTS metafailures (
+		namespace TEXT NOT NULL DEFAULT '',
+		filename TEXT NOT NULL,
+		idx INTEGER NOT NULL,
+		error TEXT NOT NULL,
+		createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "create metafailures table")
+	}
+	return nil
+}
+
+func (db *DB) GetMetaFailures(namespace string) ([]migrate.Failure, error) {
+	failures := []migrate.Failure{}
+	q := db.meta(`
+	SELECT namespace, filename, idx, error, createdat FROM metafailures
+	WHERE namespace=$1
+	ORDER BY createdat`)
+	err := db.Select(&failures, q, namespace)
+	return failures, err
+}
+
+func (db *DB) InsertMetaFailure(f migrate.Failure) error {
+	q := db.meta(`
+		INSERT INTO metafailures (namespace, filename, idx, error)
+		VALUES ($1, $2, $3, $4)`)
+	_, err := db.Exec(q, f.Namespace, f.Filename, f.Index, f.Error)
+	return err
+}
+
+func (db *DB) GetMetaObjects(namespace string) ([]migrate.Object, error) {
+	objects := []migrate.Object{}
+	q := db.meta(`
+	SELECT namespace, filename, content FROM metaobjects
+	WHERE namespace=$1`)
+	err := db.Select(&objects, q, namespace)
+	return objects, err
+}
+
+func (db *DB) UpsertMetaObject(o migrate.Object) error {
+	q := db.meta(`
+		INSERT INTO metaobjects (namespace, filename, content)
+		VALUES ($1, $2, $3)
+		ON CONFLICT(namespace, filename) DO UPDATE
+		SET content=$3, createdat=CURRENT_TIMESTAMP`)
+	_, err := db.Exec(q, o.Namespace, o.Filename, o.Content)
+	return err
+}
+
+func (db *DB) GetMigrations(namespace string) ([]migrate.Migration, error) {
 	migrations := []migrate.Migration{}
-	q := `SELECT filename, content, md5 AS checksum FROM meta`
-	err := db.Select(&migrations, q)
+	q := db.meta(`
+	SELECT namespace, filename, content, md5 AS checksum, algorithm,
+		variant, statements, duration_ns AS duration, annotations,
+		appliedat
+	FROM meta
+	WHERE namespace=$1`)
+	err := db.Select(&migrations, q, namespace)
 	return migrations, err
 
 }
 
-func (db *DB) GetMetaCheckpoints(filename string) ([]string, error) {
+func (db *DB) GetMetaCheckpoints(namespace, filename string) ([]string, error) {
 	checkpoints := []string{}
-	q := `SELECT md5 FROM metacheckpoints WHERE filename=$1 ORDER BY idx`
-	err := db.Select(&checkpoints, q, filename)
+	q := db.meta(`
+	SELECT md5 FROM metacheckpoints
+	WHERE namespace=$1 AND filename=$2
+	ORDER BY idx`)
+	err := db.Select(&checkpoints, q, namespace, filename)
 	return checkpoints, err
 }
 
-func (db *DB) UpsertMigration(filename, content, checksum string) error {
-	q := `
-		INSERT INTO meta (filename, content, md5) VALUES ($1, $2, $3)
-		ON CONFLICT(filename) DO UPDATE SET md5=$4, content=$5`
-	_, err := db.Exec(q, filename, content, checksum, checksum, content)
+func (db *DB) UpsertMigration(m migrate.Migration) error {
+	q := db.meta(`
+		INSERT INTO meta
+			(namespace, filename, content, md5, algorithm, variant,
+			statements, duration_ns, annotations, appliedat)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT(namespace, filename) DO UPDATE
+		SET content=$3, md5=$4, algorithm=$5, variant=$6, statements=$7,
+			duration_ns=$8, annotations=$9, appliedat=$10`)
+	_, err := db.Exec(q, m.Namespace, m.Filename, m.Content, m.Checksum,
+		m.Algorithm, m.Variant, m.Statements, m.Duration, m.Annotations,
+		m.AppliedAt)
 	return err
 }
 
 func (db *DB) InsertMetaCheckpoint(
-	filename, content, checksum string,
+	namespace, filename, content, checksum string,
 	idx int,
 ) error {
-	q := `
-		INSERT INTO metacheckpoints (filename, content, idx, md5)
-		VALUES ($1, $2, $3, $4)`
-	_, err := db.Exec(q, filename, content, idx, checksum)
+	q := db.meta(`
+		INSERT INTO metacheckpoints (namespace, filename, content, idx, md5)
+		VALUES ($1, $2, $3, $4, $5)`)
+	_, err := db.Exec(q, namespace, filename, content, idx, checksum)
+	return err
+}
+
+func (db *DB) InsertMigration(m migrate.Migration) error {
+	q := db.meta(`
+		INSERT INTO meta
+			(namespace, filename, content, md5, algorithm, variant,
+			statements, duration_ns, annotations, appliedat)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`)
+	_, err := db.Exec(q, m.Namespace, m.Filename, m.Content, m.Checksum,
+		m.Algorithm, m.Variant, m.Statements, m.Duration, m.Annotations,
+		m.AppliedAt)
 	return err
 }
 
-func (db *DB) InsertMigration(filename, content, checksum string) error {
-	q := `INSERT INTO meta (filename, content, md5) VALUES ($1, $2, $3)`
-	_, err := db.Exec(q, filename, content, checksum)
+func (db *DB) DeleteMetaCheckpoints(namespace string) error {
+	q := db.meta(`DELETE FROM metacheckpoints WHERE namespace=$1`)
+	_, err := db.Exec(q, namespace)
 	return err
 }
 
-func (db *DB) DeleteMetaCheckpoints() error {
-	q := `DELETE FROM metacheckpoints`
-	_, err := db.Exec(q)
+// DeleteMigration removes filename from the history of namespace.
+func (db *DB) DeleteMigration(namespace, filename string) error {
+	q := db.meta(`DELETE FROM meta WHERE namespace=$1 AND filename=$2`)
+	_, err := db.Exec(q, namespace, filename)
 	return err
 }
 
 func (db *DB) CreateMetaVersionIfNotExists(schemaVersion int) (int, error) {
 	created := true
-	q := `CREATE TABLE metaversion (
+	q := db.meta(`CREATE TABLE metaversion (
 		version INTEGER NOT NULL
-	)`
+	)`)
 	if _, err := db.Exec(q); err != nil {
 		// Check if the table already existed
 		if !strings.Contains(err.Error(), "already exists") {
@@ -110,14 +303,14 @@ func (db *DB) CreateMetaVersionIfNotExists(schemaVersion int) (int, error) {
 	}
 
 	var version int
-	q = `SELECT version FROM metaversion`
+	q = db.meta(`SELECT version FROM metaversion`)
 	err := db.Get(&version, q)
 	switch {
 	case err == sql.ErrNoRows:
 		if !created {
 			schemaVersion = 0
 		}
-		q = `INSERT INTO metaversion (version) VALUES ($1)`
+		q = db.meta(`INSERT INTO metaversion (version) VALUES ($1)`)
 		if _, err := db.Exec(q, schemaVersion); err != nil {
 			return 0, errors.Wrap(err, "insert version")
 		}
@@ -128,11 +321,88 @@ func (db *DB) CreateMetaVersionIfNotExists(schemaVersion int) (int, error) {
 	return version, nil
 }
 
-func (db *DB) Close() error { return db.DB.Close() }
+// GetMetaVersion reports the current version without creating or modifying
+// anything. It returns 0 if the meta tables predate versioning and -1 if they
+// don't exist.
+func (db *DB) GetMetaVersion() (int, error) {
+	exists, err := db.tableExists("metaversion")
+	if err != nil {
+		return 0, errors.Wrap(err, "metaversion exists")
+	}
+	if !exists {
+		exists, err = db.tableExists("meta")
+		if err != nil {
+			return 0, errors.Wrap(err, "meta exists")
+		}
+		if exists {
+			return 0, nil
+		}
+		return -1, nil
+	}
+	var version int
+	q := db.meta(`SELECT version FROM metaversion`)
+	err = db.Get(&version, q)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, nil
+	case err != nil:
+		return 0, errors.Wrap(err, "get version")
+	}
+	return version, nil
+}
+
+func (db *DB) tableExists(name string) (bool, error) {
+	var exists bool
+	q := `SELECT COUNT(*) > 0 FROM sqlite_master WHERE type='table' AND name=$1`
+	err := db.Get(&exists, q, db.meta(name))
+	return exists, err
+}
+
+// Close the connection, unless it's from FromDB. It's safe to call even if
+// the connection was never opened.
+func (db *DB) Close() error {
+	if db.DB == nil || db.external {
+		return nil
+	}
+	return db.DB.Close()
+}
+
+// SetTablePrefix prepends prefix to the names of the meta tables. See
+// migrate.WithTablePrefix.
+func (db *DB) SetTablePrefix(prefix string) { db.prefix = prefix }
+
+// meta prefixes the names of the meta tables in the query q.
+func (db *DB) meta(q string) string {
+	return migrate.PrefixMetaTables(db.prefix, q)
+}
+
+// Ping checks that the database is reachable.
+func (db *DB) Ping(ctx context.Context) error { return db.DB.PingContext(ctx) }
 
 func (db *DB) Open() error {
+	if db.external {
+		if db.busyTimeout > 0 || len(db.session) > 0 {
+			return errors.New("cannot configure a connection from FromDB")
+		}
+		return nil
+	}
+	dsn := db.filepath
+	if db.busyTimeout > 0 {
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		dsn += fmt.Sprintf("%s_busy_timeout=%d", sep,
+			db.busyTimeout.Milliseconds())
+	}
+	if len(db.session) > 0 {
+		c := migrate.SessionConnector(&sqlite3.SQLiteDriver{}, dsn,
+			db.session)
+		db.DB = sqlx.NewDb(sql.OpenDB(c), "sqlite3")
+		return nil
+	}
 	var err error
-	db.DB, err = sqlx.Open("sqlite3", db.filepath)
+	db.DB, err = sqlx.Open("sqlite3", dsn)
 	if err != nil {
 		return errors.Wrap(err, "open db connection")
 	}
@@ -158,24 +428,25 @@ func (db *DB) UpgradeToV1(migrations []migrate.Migration) (err error) {
 
 	// Remove the uniqueness constraint from md5. sqlite doesn't support
 	// MODIFY COLUMN so we recreate the table.
-	q := `CREATE TABLE metatmp (
+	q := db.meta(`CREATE TABLE metatmp (
 		filename TEXT UNIQUE NOT NULL,
 		md5 TEXT NOT NULL,
 		createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
-	)`
+	)`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "create metatmp")
 		return
 	}
-	q = `INSERT INTO metatmp SELECT filename, md5, createdat FROM meta`
+	q = db.meta(`
+	INSERT INTO metatmp SELECT filename, md5, createdat FROM meta`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "insert metatmp")
 	}
-	q = `DROP TABLE meta`
+	q = db.meta(`DROP TABLE meta`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "drop meta")
 	}
-	q = `ALTER TABLE metatmp RENAME TO meta`
+	q = db.meta(`ALTER TABLE metatmp RENAME TO meta`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "rename metatmp 1")
 		return
@@ -183,13 +454,13 @@ func (db *DB) UpgradeToV1(migrations []migrate.Migration) (err error) {
 
 	// Add a content column to record the exact migration that ran
 	// alongside the md5, insert the appropriate data, then set not null
-	q = `ALTER TABLE meta ADD COLUMN content TEXT`
+	q = db.meta(`ALTER TABLE meta ADD COLUMN content TEXT`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "add content column")
 		return
 	}
 	for _, m := range migrations {
-		q = `UPDATE meta SET content=$1 WHERE filename=$2`
+		q = db.meta(`UPDATE meta SET content=$1 WHERE filename=$2`)
 		if _, err = tx.Exec(q, m.Content, m.Filename); err != nil {
 			err = errors.Wrap(err, "update meta content")
 			return
@@ -198,77 +469,444 @@ func (db *DB) UpgradeToV1(migrations []migrate.Migration) (err error) {
 
 	// Once again, sqlite3 doesn't support modify column, so we have to
 	// recreate our tables
-	q = `CREATE TABLE metatmp (
+	q = db.meta(`CREATE TABLE metatmp (
 		filename TEXT UNIQUE NOT NULL,
 		content TEXT NOT NULL,
 		md5 TEXT NOT NULL,
 		createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
-	)`
+	)`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "create metatmp")
 		return
 	}
-	q = `
+	q = db.meta(`
 		INSERT INTO metatmp
-		SELECT filename, content, md5, createdat FROM meta`
+		SELECT filename, content, md5, createdat FROM meta`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "")
 	}
-	q = `DROP TABLE meta`
+	q = db.meta(`DROP TABLE meta`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "drop meta")
 		return
 	}
-	q = `ALTER TABLE metatmp RENAME TO meta`
+	q = db.meta(`ALTER TABLE metatmp RENAME TO meta`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "rename metatmp 2")
 		return
 	}
 
 	// Add the content column to metacheckpoints. Same song and dance as above
-	q = `CREATE TABLE metacheckpointstmp (
+	q = db.meta(`CREATE TABLE metacheckpointstmp (
 		filename TEXT NOT NULL,
 		content TEXT NOT NULL,
 		idx INTEGER NOT NULL,
 		md5 TEXT NOT NULL,
 		createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
 		PRIMARY KEY (filename, idx)
-	)`
+	)`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "create metacheckpointstmp")
 		return
 	}
-	q = `
+	q = db.meta(`
 		INSERT INTO metacheckpointstmp
-		SELECT filename, md5, createdat FROM meta`
+		SELECT filename, md5, createdat FROM meta`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "insert metacheckpointstmp")
 	}
-	q = `DROP TABLE metacheckpoints`
+	q = db.meta(`DROP TABLE metacheckpoints`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "drop metacheckpoints")
 		return
 	}
-	q = `ALTER TABLE metacheckpointstmp RENAME TO metacheckpoints`
+	q = db.meta(`ALTER TABLE metacheckpointstmp RENAME TO metacheckpoints`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "rename metacheckpointstmp")
 		return
 	}
 
-	q = `CREATE TABLE IF NOT EXISTS metaversion (version INTEGER NOT NULL)`
+	q = db.meta(`
+	CREATE TABLE IF NOT EXISTS metaversion (version INTEGER NOT NULL)`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "create metaversion table")
 		return
 	}
-	q = `DELETE FROM metaversion`
+	q = db.meta(`DELETE FROM metaversion`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "delete metaversion")
 		return
 	}
-	q = `INSERT INTO metaversion (version) VALUES (1)`
+	q = db.meta(`INSERT INTO metaversion (version) VALUES (1)`)
 	if _, err = tx.Exec(q); err != nil {
 		err = errors.Wrap(err, "update metaversion")
 		return
 	}
 	return nil
 }
+
+// UpgradeToV2 records the checksum algorithm used for each migration. All
+// migrations before v2 used md5.
+func (db *DB) UpgradeToV2() (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	q := db.meta(`
+	ALTER TABLE meta ADD COLUMN algorithm TEXT NOT NULL DEFAULT 'md5'`)
+	_, err = tx.Exec(q)
+	if err != nil {
+		// Ignore duplicate column errors
+		if !strings.Contains(err.Error(), "duplicate column name") {
+			err = errors.Wrap(err, "add algorithm column")
+			return
+		}
+	}
+	q = db.meta(`UPDATE metaversion SET version=2`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "update metaversion")
+		return
+	}
+	return nil
+}
+
+// UpgradeToV3 adds a namespace to the meta tables, replacing the unique
+// filename constraint with one on (namespace, filename). Existing history
+// belongs to the default, empty namespace. sqlite can't alter constraints, so
+// we recreate the tables.
+func (db *DB) UpgradeToV3() (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	q := db.meta(`CREATE TABLE metatmp (
+		namespace TEXT NOT NULL DEFAULT '',
+		filename TEXT NOT NULL,
+		md5 TEXT NOT NULL,
+		content TEXT NOT NULL,
+		algorithm TEXT NOT NULL DEFAULT 'md5',
+		createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (namespace, filename)
+	)`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "create metatmp")
+		return
+	}
+	q = db.meta(`
+	INSERT INTO metatmp (filename, md5, content, algorithm, createdat)
+	SELECT filename, md5, content, algorithm, createdat
+	FROM meta ORDER BY rowid`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "insert metatmp")
+		return
+	}
+	q = db.meta(`DROP TABLE meta`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "drop meta")
+		return
+	}
+	q = db.meta(`ALTER TABLE metatmp RENAME TO meta`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "rename metatmp")
+		return
+	}
+
+	q = db.meta(`CREATE TABLE metacheckpointstmp (
+		namespace TEXT NOT NULL DEFAULT '',
+		filename TEXT NOT NULL,
+		content TEXT NOT NULL,
+		idx INTEGER NOT NULL,
+		md5 TEXT NOT NULL,
+		createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (namespace, filename, idx)
+	)`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "create metacheckpointstmp")
+		return
+	}
+	q = db.meta(`
+	INSERT INTO metacheckpointstmp (filename, content, idx, md5, createdat)
+	SELECT filename, content, idx, md5, createdat FROM metacheckpoints`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "insert metacheckpointstmp")
+		return
+	}
+	q = db.meta(`DROP TABLE metacheckpoints`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "drop metacheckpoints")
+		return
+	}
+	q = db.meta(`ALTER TABLE metacheckpointstmp RENAME TO metacheckpoints`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "rename metacheckpointstmp")
+		return
+	}
+
+	q = db.meta(`UPDATE metaversion SET version=3`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "update metaversion")
+		return
+	}
+	return nil
+}
+
+// UpgradeToV4 records which variant of each migration was applied: the base
+// file or a DB-specific override.
+func (db *DB) UpgradeToV4() (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	q := db.meta(`
+	ALTER TABLE meta ADD COLUMN variant TEXT NOT NULL DEFAULT ''`)
+	_, err = tx.Exec(q)
+	if err != nil {
+		// Ignore duplicate column errors
+		if !strings.Contains(err.Error(), "duplicate column name") {
+			err = errors.Wrap(err, "add variant column")
+			return
+		}
+	}
+	q = db.meta(`UPDATE metaversion SET version=4`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "update metaversion")
+		return
+	}
+	return nil
+}
+
+// UpgradeToV5 records how many statements each migration had and how long it
+// took, for Stats.
+func (db *DB) UpgradeToV5() (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	q := db.meta(`
+	ALTER TABLE meta ADD COLUMN statements INTEGER NOT NULL DEFAULT 0`)
+	_, err = tx.Exec(q)
+	if err != nil {
+		// Ignore duplicate column errors
+		if !strings.Contains(err.Error(), "duplicate column name") {
+			err = errors.Wrap(err, "add statements column")
+			return
+		}
+	}
+	q = db.meta(`
+	ALTER TABLE meta ADD COLUMN duration_ns INTEGER NOT NULL DEFAULT 0`)
+	_, err = tx.Exec(q)
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") {
+			err = errors.Wrap(err, "add duration column")
+			return
+		}
+	}
+	q = db.meta(`UPDATE metaversion SET version=5`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "update metaversion")
+		return
+	}
+	return nil
+}
+
+// UpgradeToV6 records the annotations of the run which applied each
+// migration.
+func (db *DB) UpgradeToV6() (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	q := db.meta(`
+	ALTER TABLE meta ADD COLUMN annotations TEXT NOT NULL DEFAULT ''`)
+	_, err = tx.Exec(q)
+	if err != nil {
+		// Ignore duplicate column errors
+		if !strings.Contains(err.Error(), "duplicate column name") {
+			err = errors.Wrap(err, "add annotations column")
+			return
+		}
+	}
+	q = db.meta(`UPDATE metaversion SET version=6`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "update metaversion")
+		return
+	}
+	return nil
+}
+
+// UpgradeToV7 only records the version. Migrate rewrites md5 checksums as
+// SHA-256 once it's verified them.
+func (db *DB) UpgradeToV7() error {
+	q := db.meta(`UPDATE metaversion SET version=7`)
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "update metaversion")
+	}
+	return nil
+}
+
+// UpgradeToV8 records when each migration was applied. Migrations applied
+// before use the time they were recorded.
+func (db *DB) UpgradeToV8() (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	// sqlite can't add a column defaulting to CURRENT_TIMESTAMP, but every
+	// row is updated anyway.
+	q := db.meta(`ALTER TABLE meta
+		ADD COLUMN appliedat TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00'`)
+	_, err = tx.Exec(q)
+	if err != nil {
+		// Ignore duplicate column errors
+		if !strings.Contains(err.Error(), "duplicate column name") {
+			err = errors.Wrap(err, "add appliedat column")
+			return
+		}
+	}
+	q = db.meta(`UPDATE meta SET appliedat=createdat`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "update appliedat")
+		return
+	}
+	q = db.meta(`UPDATE metaversion SET version=8`)
+	if _, err = tx.Exec(q); err != nil {
+		err = errors.Wrap(err, "update metaversion")
+		return
+	}
+	return nil
+}
+
+// ExecBatch executes cmds in one call within a transaction, so a failed batch
+// leaves no trace. The whole batch is retried if the database is locked.
+func (db *DB) ExecBatch(cmds []string) error {
+	return retryBusy(func() error { return db.execBatch(cmds) })
+}
+
+// ExecAtomic executes cmds within a transaction for an atomic group. It's
+// the same as ExecBatch, since sqlite batches are already transactional.
+func (db *DB) ExecAtomic(cmds []string) error { return db.ExecBatch(cmds) }
+
+func (db *DB) execBatch(cmds []string) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+	if _, err = tx.Exec(strings.Join(cmds, ";\n")); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Analyze gathers the statistics of table and its indexes for the query
+// planner.
+func (db *DB) Analyze(table string) error {
+	parts := strings.Split(table, ".")
+	for i, p := range parts {
+		parts[i] = `"` + strings.ReplaceAll(p, `"`, `""`) + `"`
+	}
+	_, err := db.Exec(`ANALYZE ` + strings.Join(parts, "."))
+	return err
+}
+
+// ReadOnly reports whether the database was opened read-only, either with
+// mode=ro or PRAGMA query_only, or its file can't be written.
+func (db *DB) ReadOnly() (string, error) {
+	if strings.Contains(db.filepath, "mode=ro") {
+		return "opened with mode=ro", nil
+	}
+	var queryOnly bool
+	if err := db.Get(&queryOnly, `PRAGMA query_only`); err != nil {
+		return "", errors.Wrap(err, "get query_only")
+	}
+	if queryOnly {
+		return "query_only is enabled", nil
+	}
+	f, err := os.OpenFile(db.filepath, os.O_WRONLY, 0)
+	switch {
+	case os.IsPermission(err):
+		return fmt.Sprintf("%s is not writable", db.filepath), nil
+	case err == nil:
+		_ = f.Close()
+	}
+	return "", nil
+}
+
+// ClassifyError by its SQLite result code. SQLite reports most failures as
+// generic errors, so those are classified by message.
+func (db *DB) ClassifyError(err error) migrate.ErrorClass {
+	var liteErr sqlite3.Error
+	if !errors.As(err, &liteErr) {
+		return migrate.ClassUnknown
+	}
+	switch liteErr.Code {
+	case sqlite3.ErrPerm, sqlite3.ErrAuth, sqlite3.ErrReadonly:
+		return migrate.ClassPermissionDenied
+	case sqlite3.ErrBusy, sqlite3.ErrLocked:
+		return migrate.ClassLockTimeout
+	case sqlite3.ErrError:
+		msg := liteErr.Error()
+		switch {
+		case strings.Contains(msg, "already exists"),
+			strings.Contains(msg, "duplicate column name"):
+			return migrate.ClassDuplicateObject
+		case strings.Contains(msg, "syntax error"):
+			return migrate.ClassSyntax
+		}
+	}
+	return migrate.ClassUnknown
+}
@@ -1,11 +1,15 @@
 package sqlite
 
 import (
+	"context"
+	"database/sql"
+	"path/filepath"
 	"testing"
+	"time"
 
-	"github.com/thankful-ai/migrate"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/thankful-ai/migrate"
 )
 
 const checkpointFile = "2.sql"
@@ -35,8 +39,8 @@ func TestCreateMetaCheckpointsIfNotExists(t *testing.T) {
 
 func TestGetMigrations(t *testing.T) {
 	t.Parallel()
-	db := setupDBV1(t)
-	ms, err := db.GetMigrations()
+	db := setupDBV8(t)
+	ms, err := db.GetMigrations("")
 	check(t, err)
 	if len(ms) != 1 {
 		t.Fatal("expected 1 migration")
@@ -45,8 +49,8 @@ func TestGetMigrations(t *testing.T) {
 
 func TestGetMetaCheckpoints(t *testing.T) {
 	t.Parallel()
-	db := setupDBV1(t)
-	mcs, err := db.GetMetaCheckpoints(checkpointFile)
+	db := setupDBV8(t)
+	mcs, err := db.GetMetaCheckpoints("", checkpointFile)
 	check(t, err)
 	if len(mcs) != 1 {
 		t.Fatal("expected 1 checkpoint")
@@ -55,17 +59,27 @@ func TestGetMetaCheckpoints(t *testing.T) {
 
 func TestUpsertMigration(t *testing.T) {
 	t.Parallel()
-	db := setupDBV1(t)
+	db := setupDBV8(t)
 
 	// Test update
-	err := db.UpsertMigration("1.sql", "SELECT 1;", "md5")
+	err := db.UpsertMigration(migrate.Migration{
+		Filename:  "1.sql",
+		Content:   "SELECT 1;",
+		Checksum:  "md5",
+		Algorithm: "md5",
+	})
 	check(t, err)
 
 	// Test insert
-	err = db.UpsertMigration("3.sql", "SELECT 3;", "md5")
+	err = db.UpsertMigration(migrate.Migration{
+		Filename:  "3.sql",
+		Content:   "SELECT 3;",
+		Checksum:  "md5",
+		Algorithm: "md5",
+	})
 	check(t, err)
 
-	ms, err := db.GetMigrations()
+	ms, err := db.GetMigrations("")
 	check(t, err)
 	if len(ms) != 2 {
 		t.Fatal("expected 2 migrations")
@@ -74,12 +88,12 @@ func TestUpsertMigration(t *testing.T) {
 
 func TestInsertMetaCheckpoint(t *testing.T) {
 	t.Parallel()
-	db := setupDBV1(t)
+	db := setupDBV8(t)
 
-	err := db.InsertMetaCheckpoint(checkpointFile, "SELECT 3;", "md5", 1)
+	err := db.InsertMetaCheckpoint("", checkpointFile, "SELECT 3;", "md5", 1)
 	check(t, err)
 
-	mcs, err := db.GetMetaCheckpoints(checkpointFile)
+	mcs, err := db.GetMetaCheckpoints("", checkpointFile)
 	check(t, err)
 	if len(mcs) != 2 {
 		t.Fatal("expected 2 checkpoints")
@@ -88,12 +102,17 @@ func TestInsertMetaCheckpoint(t *testing.T) {
 
 func TestInsertMigration(t *testing.T) {
 	t.Parallel()
-	db := setupDBV1(t)
-
-	err := db.InsertMigration("3.sql", "SELECT 3;", "md5")
+	db := setupDBV8(t)
+
+	err := db.InsertMigration(migrate.Migration{
+		Filename:  "3.sql",
+		Content:   "SELECT 3;",
+		Checksum:  "md5",
+		Algorithm: "md5",
+	})
 	check(t, err)
 
-	ms, err := db.GetMigrations()
+	ms, err := db.GetMigrations("")
 	check(t, err)
 	if len(ms) != 2 {
 		t.Fatal("expected 2 migrations")
@@ -102,18 +121,400 @@ func TestInsertMigration(t *testing.T) {
 
 func TestDeleteMetaCheckpoints(t *testing.T) {
 	t.Parallel()
-	db := setupDBV1(t)
+	db := setupDBV8(t)
 
-	err := db.DeleteMetaCheckpoints()
+	err := db.DeleteMetaCheckpoints("")
 	check(t, err)
 
-	mcs, err := db.GetMetaCheckpoints(checkpointFile)
+	mcs, err := db.GetMetaCheckpoints("", checkpointFile)
 	check(t, err)
 	if len(mcs) != 0 {
 		t.Fatal("expected 0 checkpoints")
 	}
 }
 
+func TestUpgradeToV2(t *testing.T) {
+	t.Parallel()
+	db := setupDBV8(t)
+
+	ms, err := db.GetMigrations("")
+	check(t, err)
+	if len(ms) != 1 {
+		t.Fatalf("expected 1 migration, got %d", len(ms))
+	}
+	if ms[0].Algorithm != "md5" {
+		t.Fatalf("expected md5 algorithm, got %q", ms[0].Algorithm)
+	}
+}
+
+func TestUpsertMetaObject(t *testing.T) {
+	t.Parallel()
+	db := setupDBV8(t)
+	err := db.CreateMetaObjectsIfNotExists()
+	check(t, err)
+
+	for _, content := range []string{"CREATE VIEW v1", "CREATE VIEW v2"} {
+		err = db.UpsertMetaObject(migrate.Object{
+			Filename: "v.sql",
+			Content:  content,
+		})
+		check(t, err)
+	}
+	objects, err := db.GetMetaObjects("")
+	check(t, err)
+	if len(objects) != 1 || objects[0].Content != "CREATE VIEW v2" {
+		t.Fatalf("unexpected objects %v", objects)
+	}
+}
+
+func TestUpgradeToV3(t *testing.T) {
+	t.Parallel()
+	db := setupDBV8(t)
+
+	// Another namespace may reuse filenames without affecting the
+	// existing history in the default namespace.
+	err := db.InsertMigration(migrate.Migration{
+		Namespace: "auth",
+		Filename:  "1.sql",
+		Content:   "SELECT 1;",
+		Checksum:  "md5",
+		Algorithm: "md5",
+	})
+	check(t, err)
+	err = db.InsertMetaCheckpoint("auth", checkpointFile, "SELECT 2;",
+		"md5", 0)
+	check(t, err)
+	err = db.DeleteMetaCheckpoints("auth")
+	check(t, err)
+
+	ms, err := db.GetMigrations("")
+	check(t, err)
+	if len(ms) != 1 || ms[0].Namespace != "" {
+		t.Fatalf("unexpected default migrations %v", ms)
+	}
+	ms, err = db.GetMigrations("auth")
+	check(t, err)
+	if len(ms) != 1 || ms[0].Namespace != "auth" {
+		t.Fatalf("unexpected auth migrations %v", ms)
+	}
+	mcs, err := db.GetMetaCheckpoints("", checkpointFile)
+	check(t, err)
+	if len(mcs) != 1 {
+		t.Fatal("expected 1 checkpoint")
+	}
+}
+
+func TestUpgradeToV4(t *testing.T) {
+	t.Parallel()
+	db := setupDBV8(t)
+
+	err := db.InsertMigration(migrate.Migration{
+		Filename:  "2.sql",
+		Content:   "SELECT 2;",
+		Checksum:  "md5",
+		Algorithm: "md5",
+		Variant:   "sqlite",
+	})
+	check(t, err)
+
+	ms, err := db.GetMigrations("")
+	check(t, err)
+	if len(ms) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(ms))
+	}
+	if ms[0].Variant != "" || ms[1].Variant != "sqlite" {
+		t.Fatalf("unexpected variants %q, %q", ms[0].Variant, ms[1].Variant)
+	}
+}
+
+func TestUpgradeToV5(t *testing.T) {
+	t.Parallel()
+	db := setupDBV8(t)
+
+	err := db.InsertMigration(migrate.Migration{
+		Filename:   "2.sql",
+		Content:    "SELECT 2;",
+		Checksum:   "md5",
+		Algorithm:  "md5",
+		Statements: 1,
+		Duration:   3 * time.Millisecond,
+	})
+	check(t, err)
+
+	ms, err := db.GetMigrations("")
+	check(t, err)
+	if len(ms) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(ms))
+	}
+	if ms[0].Statements != 0 || ms[0].Duration != 0 {
+		t.Fatalf("expected no stats for old migration, got %d, %s",
+			ms[0].Statements, ms[0].Duration)
+	}
+	if ms[1].Statements != 1 || ms[1].Duration != 3*time.Millisecond {
+		t.Fatalf("unexpected stats %d, %s", ms[1].Statements, ms[1].Duration)
+	}
+}
+
+func TestUpgradeToV6(t *testing.T) {
+	t.Parallel()
+	db := setupDBV8(t)
+
+	err := db.InsertMigration(migrate.Migration{
+		Filename:    "2.sql",
+		Content:     "SELECT 2;",
+		Checksum:    "md5",
+		Algorithm:   "md5",
+		Annotations: migrate.Annotations{"deploy": "d-42"},
+	})
+	check(t, err)
+
+	ms, err := db.GetMigrations("")
+	check(t, err)
+	if len(ms) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(ms))
+	}
+	if len(ms[0].Annotations) != 0 {
+		t.Fatalf("expected no annotations for old migration, got %v",
+			ms[0].Annotations)
+	}
+	if ms[1].Annotations["deploy"] != "d-42" {
+		t.Fatalf("unexpected annotations %v", ms[1].Annotations)
+	}
+}
+
+func TestUpgradeToV7(t *testing.T) {
+	t.Parallel()
+	db := setupDBV6(t)
+
+	err := db.UpgradeToV7()
+	check(t, err)
+	v, err := db.GetMetaVersion()
+	check(t, err)
+	if v != 7 {
+		t.Fatalf("expected version 7, got %d", v)
+	}
+}
+
+func TestUpgradeToV8(t *testing.T) {
+	t.Parallel()
+	db := setupDBV7(t)
+
+	err := db.UpgradeToV8()
+	check(t, err)
+	appliedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	err = db.InsertMigration(migrate.Migration{
+		Filename:  "2.sql",
+		Content:   "SELECT 2;",
+		Checksum:  "md5",
+		Algorithm: "md5",
+		AppliedAt: appliedAt,
+	})
+	check(t, err)
+
+	ms, err := db.GetMigrations("")
+	check(t, err)
+	if len(ms) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(ms))
+	}
+	if ms[0].AppliedAt.IsZero() {
+		t.Fatal("expected old migration to be applied when recorded")
+	}
+	if !ms[1].AppliedAt.Equal(appliedAt) {
+		t.Fatalf("expected applied at %s, got %s", appliedAt,
+			ms[1].AppliedAt)
+	}
+}
+
+func TestInsertMetaFailure(t *testing.T) {
+	t.Parallel()
+	db := setupDBV8(t)
+
+	err := db.InsertMetaFailure(migrate.Failure{
+		Filename: "2.sql",
+		Index:    1,
+		Error:    "syntax error",
+	})
+	check(t, err)
+
+	fs, err := db.GetMetaFailures("")
+	check(t, err)
+	if len(fs) != 1 {
+		t.Fatalf("expected 1 failure, got %d", len(fs))
+	}
+	if fs[0].Filename != "2.sql" || fs[0].Index != 1 ||
+		fs[0].Error != "syntax error" || fs[0].FailedAt.IsZero() {
+		t.Fatalf("unexpected failure %+v", fs[0])
+	}
+	fs, err = db.GetMetaFailures("other")
+	check(t, err)
+	if len(fs) != 0 {
+		t.Fatalf("expected no failures in other namespace, got %d", len(fs))
+	}
+}
+
+func TestGetMetaVersion(t *testing.T) {
+	t.Parallel()
+	db := setupDBV0(t)
+
+	v, err := db.GetMetaVersion()
+	check(t, err)
+	if v != 0 {
+		t.Fatalf("expected version 0, got %d", v)
+	}
+
+	err = db.UpgradeToV1(nil)
+	check(t, err)
+	err = db.UpgradeToV2()
+	check(t, err)
+	v, err = db.GetMetaVersion()
+	check(t, err)
+	if v != 2 {
+		t.Fatalf("expected version 2, got %d", v)
+	}
+}
+
+func TestGetMetaVersionMissing(t *testing.T) {
+	t.Parallel()
+	db := newDB()
+
+	v, err := db.GetMetaVersion()
+	check(t, err)
+	if v != -1 {
+		t.Fatalf("expected -1 without meta tables, got %d", v)
+	}
+}
+
+func TestFromDB(t *testing.T) {
+	t.Parallel()
+	sqldb, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "app.db"))
+	check(t, err)
+	defer sqldb.Close()
+
+	db := FromDB(sqldb)
+	err = migrate.OpenStore(context.Background(), db)
+	check(t, err)
+	err = db.CreateMetaIfNotExists()
+	check(t, err)
+
+	// The caller's connection stays open.
+	err = db.Close()
+	check(t, err)
+	err = sqldb.Ping()
+	check(t, err)
+
+	db = FromDB(sqldb, WithBusyTimeout(time.Second))
+	if err = db.Open(); err == nil {
+		t.Fatal("expected error configuring the caller's connection")
+	}
+}
+
+func TestPing(t *testing.T) {
+	t.Parallel()
+	db := New(":memory:")
+
+	// Closing an unopened database is safe.
+	err := db.Close()
+	check(t, err)
+
+	err = db.Open()
+	check(t, err)
+	defer db.Close()
+
+	err = db.Ping(context.Background())
+	check(t, err)
+}
+
+func TestClassifyError(t *testing.T) {
+	t.Parallel()
+	db := newDB()
+
+	_, err := db.Exec(`CREATE TABLE users (id INTEGER)`)
+	check(t, err)
+
+	_, err = db.Exec(`CREATE TABLE users (id INTEGER)`)
+	if class := db.ClassifyError(err); class != migrate.ClassDuplicateObject {
+		t.Fatalf("expected duplicate object, got %s", class)
+	}
+	_, err = db.Exec(`CREAT TABLE x (id INTEGER)`)
+	if class := db.ClassifyError(err); class != migrate.ClassSyntax {
+		t.Fatalf("expected syntax error, got %s", class)
+	}
+}
+
+func TestExecRetriesBusy(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "test.db")
+	holder := New(path)
+	check(t, holder.Open())
+	defer holder.Close()
+	db := New(path, WithBusyTimeout(time.Millisecond))
+	check(t, db.Open())
+	defer db.Close()
+
+	_, err := holder.Exec(`CREATE TABLE users (id INTEGER)`)
+	check(t, err)
+	tx, err := holder.Begin()
+	check(t, err)
+	_, err = tx.Exec(`INSERT INTO users (id) VALUES (1)`)
+	check(t, err)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_ = tx.Commit()
+	}()
+
+	// The lock outlasts the busy timeout, but not the retries.
+	_, err = db.Exec(`INSERT INTO users (id) VALUES (2)`)
+	check(t, err)
+}
+
+func TestWithSession(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := New(path, WithSession(`PRAGMA foreign_keys = ON`))
+	check(t, db.Open())
+	defer db.Close()
+
+	// Hold one connection so the next query must open another.
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	check(t, err)
+	defer conn.Close()
+	for _, q := range []interface {
+		QueryRowContext(context.Context, string, ...interface{}) *sql.Row
+	}{conn, db} {
+		var on bool
+		err = q.QueryRowContext(ctx, `PRAGMA foreign_keys`).Scan(&on)
+		check(t, err)
+		if !on {
+			t.Fatal("expected foreign keys on every connection")
+		}
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := New(path)
+	check(t, db.Open())
+	defer db.Close()
+	_, err := db.Exec(`CREATE TABLE users (id INTEGER)`)
+	check(t, err)
+	reason, err := db.ReadOnly()
+	check(t, err)
+	if reason != "" {
+		t.Fatalf("expected writable, got %q", reason)
+	}
+
+	ro := New("file:" + path + "?mode=ro")
+	check(t, ro.Open())
+	defer ro.Close()
+	reason, err = ro.ReadOnly()
+	check(t, err)
+	if reason == "" {
+		t.Fatal("expected read-only")
+	}
+}
+
 func check(t *testing.T, err error) {
 	t.Helper()
 	if err != nil {
@@ -131,6 +532,57 @@ func newDB() *DB {
 	return &DB{DB: db}
 }
 
+func setupDBV8(t *testing.T) *DB {
+	db := setupDBV7(t)
+	err := db.UpgradeToV8()
+	check(t, err)
+	return db
+}
+
+func setupDBV7(t *testing.T) *DB {
+	db := setupDBV6(t)
+	err := db.UpgradeToV7()
+	check(t, err)
+	return db
+}
+
+func setupDBV6(t *testing.T) *DB {
+	db := setupDBV5(t)
+	err := db.UpgradeToV6()
+	check(t, err)
+	return db
+}
+
+func setupDBV5(t *testing.T) *DB {
+	db := setupDBV4(t)
+	err := db.UpgradeToV5()
+	check(t, err)
+	err = db.CreateMetaFailuresIfNotExists()
+	check(t, err)
+	return db
+}
+
+func setupDBV4(t *testing.T) *DB {
+	db := setupDBV3(t)
+	err := db.UpgradeToV4()
+	check(t, err)
+	return db
+}
+
+func setupDBV3(t *testing.T) *DB {
+	db := setupDBV2(t)
+	err := db.UpgradeToV3()
+	check(t, err)
+	return db
+}
+
+func setupDBV2(t *testing.T) *DB {
+	db := setupDBV1(t)
+	err := db.UpgradeToV2()
+	check(t, err)
+	return db
+}
+
 func setupDBV1(t *testing.T) *DB {
 	db := setupDBV0(t)
 	err := db.UpgradeToV1([]migrate.Migration{{
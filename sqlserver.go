@@ -0,0 +1,56 @@
+package migrate
+
+import "strings"
+
+// batchSeparator ends statements on SQL Server, following sqlcmd and
+// Management Studio, since T-SQL procedures, triggers, and other batches
+// contain semicolons. It's only recognized alone on a line, in any case:
+//
+//	CREATE PROCEDURE reset_counts AS
+//	BEGIN
+//		UPDATE counts SET n = 0;
+//	END
+//	GO
+const batchSeparator = "GO"
+
+// defaultTerminator ending statements in migrations for dbt until a
+// terminator directive changes it.
+func defaultTerminator(dbt DBType) string {
+	if dbt == DBTypeSQLServer {
+		return batchSeparator
+	}
+	return ";"
+}
+
+// cutTerminator reports whether the trimmed line ends a statement with
+// terminator, returning the line without it.
+func cutTerminator(trimmed, terminator string) (string, bool) {
+	if strings.EqualFold(terminator, batchSeparator) {
+		return "", strings.EqualFold(trimmed, batchSeparator)
+	}
+	return strings.CutSuffix(trimmed, terminator)
+}
+
+// parseStatementsFor splits byt into statements ended by the default
+// terminator of dbt.
+func parseStatementsFor(dbt DBType, byt []byte) ([]statement, error) {
+	if t := defaultTerminator(dbt); t != ";" {
+		byt = append([]byte(terminatorDirective+" "+t+"\n"), byt...)
+	}
+	return parseStatements(dbt, byt)
+}
+
+// StatementsFor is Statements for migrations on dbt, so SQL Server migrations
+// are split on GO lines rather than semicolons, and Oracle's PL/SQL blocks end
+// with / lines.
+func StatementsFor(dbt DBType, byt []byte) ([]string, error) {
+	stmts, err := parseStatementsFor(dbt, byt)
+	if err != nil {
+		return nil, err
+	}
+	cmds := make([]string, 0, len(stmts))
+	for _, stmt := range stmts {
+		cmds = append(cmds, stmt.sql)
+	}
+	return cmds, nil
+}
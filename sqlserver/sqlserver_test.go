@@ -0,0 +1,55 @@
+package sqlserver
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/thankful-ai/migrate"
+)
+
+// mssqlError stands in for go-mssqldb's Error.
+type mssqlError struct {
+	number  int32
+	message string
+}
+
+func (e mssqlError) Error() string         { return "mssql: " + e.message }
+func (e mssqlError) SQLErrorNumber() int32 { return e.number }
+
+func TestClassifyError(t *testing.T) {
+	db := &DB{}
+	tcs := []struct {
+		err  error
+		want migrate.ErrorClass
+	}{
+		{
+			err:  mssqlError{2714, "There is already an object named 'users' in the database."},
+			want: migrate.ClassDuplicateObject,
+		},
+		{
+			err:  errors.Wrap(mssqlError{262, "CREATE TABLE permission denied in database 'app'."}, "exec"),
+			want: migrate.ClassPermissionDenied,
+		},
+		{
+			err:  mssqlError{102, "Incorrect syntax near 'TABEL'."},
+			want: migrate.ClassSyntax,
+		},
+		{
+			err:  mssqlError{1205, "Transaction (Process ID 52) was deadlocked on lock resources with another process and has been chosen as the deadlock victim. Rerun the transaction."},
+			want: migrate.ClassLockTimeout,
+		},
+		{
+			err:  mssqlError{8134, "Divide by zero error encountered."},
+			want: migrate.ClassUnknown,
+		},
+		{
+			err:  errors.New("other"),
+			want: migrate.ClassUnknown,
+		},
+	}
+	for _, tc := range tcs {
+		if got := db.ClassifyError(tc.err); got != tc.want {
+			t.Errorf("%v: expected %s, got %s", tc.err, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package migrate
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Failure records a statement which failed to migrate, so the error outlives
+// the process which hit it.
+type Failure struct {
+	Namespace string
+	Filename  string
+	Index     int `db:"idx"`
+	Error     string
+	FailedAt  time.Time `db:"createdat"`
+}
+
+// Stats aggregates the migration history for reporting.
+type Stats struct {
+	// Applied is the number of migrations in the history.
+	Applied int
+
+	// Statements and Duration are totals across applied migrations.
+	// Migrations applied before migrate recorded them count as zero.
+	Statements int
+	Duration   time.Duration
+
+	// AvgStatement is the mean time taken by a statement, or zero if no
+	// statements were recorded.
+	AvgStatement time.Duration
+
+	// LastFailure is the most recent failure in the namespace, if any. It's
+	// kept after the migration is fixed and applied.
+	LastFailure *Failure
+}
+
+// stats of the loaded history.
+func (m *Migrate) stats() Stats {
+	s := Stats{Applied: len(m.Migrations), LastFailure: m.lastFailure}
+	for _, mg := range m.Migrations {
+		s.Statements += mg.Statements
+		s.Duration += mg.Duration
+	}
+	if s.Statements > 0 {
+		s.AvgStatement = s.Duration / time.Duration(s.Statements)
+	}
+	return s
+}
+
+// loadLastFailure from the database.
+func (m *Migrate) loadLastFailure() error {
+	failures, err := m.tracker.GetMetaFailures(m.namespace)
+	if err != nil {
+		return err
+	}
+	m.lastFailure = nil
+	if len(failures) > 0 {
+		m.lastFailure = &failures[len(failures)-1]
+	}
+	return nil
+}
+
+// recordFailure of a migration in the database. It's best effort: the
+// original error is more important than any error recording it, so that's
+// only logged.
+func (m *Migrate) recordFailure(err error) {
+	var merr *MigrationError
+	if !errors.As(err, &merr) {
+		return
+	}
+	f := Failure{
+		Namespace: m.namespace,
+		Filename:  merr.File,
+		Index:     merr.Index,
+		Error:     m.redactError(merr.Err),
+		FailedAt:  time.Now().UTC(),
+	}
+	if err := m.tracker.InsertMetaFailure(f); err != nil {
+		m.warnf("record failure: %v\n", err)
+		return
+	}
+	m.lastFailure = &f
+}
@@ -0,0 +1,220 @@
+package migrate
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// PendingMigration describes a migration file which has not yet been applied
+// to the database.
+type PendingMigration struct {
+	Filename string
+
+	// Number is the numeric prefix which orders the migration, followed
+	// by its SubNumber, such as 1 for 42.1, or 0 if it has none.
+	Number    uint64
+	SubNumber uint64
+
+	// Size of the file in bytes.
+	Size int64
+
+	// Statements is the number of SQL statements in the file.
+	Statements int
+
+	// Phase of the deploy in which the file is applied.
+	Phase Phase
+
+	// Skip reports that the file is listed for the environment in the skip
+	// file, so it will be recorded as applied without running it.
+	Skip bool
+
+	// Target names the database on which the file is executed, from its
+	// target directive, or empty for the Store passed to New.
+	Target string
+}
+
+// Pending reports the migration files which have not yet been applied, in the
+// order in which Migrate will apply them. Until the history is loaded by Init,
+// every file is pending.
+func (m *Migrate) Pending() []PendingMigration {
+	files := m.pendingFiles()
+	pending := make([]PendingMigration, 0, len(files))
+	for _, fi := range files {
+		// The number was validated when sorting files in New, so we
+		// can ignore the error.
+		num, _ := fileOrderOf(fi.Info.Name())
+		pending = append(pending, PendingMigration{
+			Filename:   fi.Info.Name(),
+			Number:     num.num,
+			SubNumber:  num.sub,
+			Size:       fi.Info.Size(),
+			Statements: fi.statements,
+			Phase:      fi.phase,
+			Skip:       fi.skip,
+			Target:     fi.target,
+		})
+	}
+	return pending
+}
+
+// Applied reports the migrations recorded in the history, in the order of
+// their files, with the checksum of each file when it was applied. A
+// sub-numbered hotfix applied late is listed in its file's position, so sort
+// by AppliedAt for the order in which they were applied. Until the history is
+// loaded by Init or Inspect, none are applied.
+// The files aren't read, so use Status to find applied migrations which have
+// since changed.
+func (m *Migrate) Applied() []Migration {
+	return append([]Migration(nil), m.Migrations...)
+}
+
+// pendingFiles which have not yet been migrated. This relies on validHistory
+// having confirmed that every migration recorded in the database corresponds
+// to a file in the same position.
+func (m *Migrate) pendingFiles() []*file {
+	if len(m.Migrations) >= len(m.Files) {
+		return nil
+	}
+	return m.Files[len(m.Migrations):]
+}
+
+// Status of the database's migration history compared to the migration
+// files.
+type Status struct {
+	// Version of the meta tables in the database, or -1 if they don't
+	// exist.
+	Version int
+
+	Applied []Migration
+	Pending []PendingMigration
+
+	// Drift describes any inconsistencies between the history in the
+	// database and the files, such as edited or missing migrations. No
+	// migrations can run until drift is resolved.
+	Drift []Drift
+
+	// Stats aggregates the applied migrations and most recent failure.
+	Stats Stats
+}
+
+// DriftKind categorizes an inconsistency between the migration history and
+// files.
+type DriftKind string
+
+const (
+	// DriftMissing indicates an applied migration has no file.
+	DriftMissing DriftKind = "missing"
+
+	// DriftOutOfOrder indicates a file was added earlier in history than
+	// an applied migration.
+	DriftOutOfOrder DriftKind = "out of order"
+
+	// DriftChecksum indicates an applied migration's file has changed.
+	DriftChecksum DriftKind = "checksum"
+)
+
+// Drift is an inconsistency between the migration history and files.
+type Drift struct {
+	Filename string
+	Kind     DriftKind
+	Err      error
+}
+
+// Inspect loads the files and migration history for reporting without
+// writing to the database, so it's safe to use with read-only credentials.
+// The returned Migrate cannot run migrations. Unlike New, Inspect doesn't
+// fail when the history is inconsistent with the files; see Status.
+func Inspect(db Store, dir string, opts ...Option) (*Migrate, error) {
+	opts = append([]Option{WithLogger(nopLogger{})}, opts...)
+	m, err := Load(db, dir, opts...)
+	if err != nil {
+		return nil, err
+	}
+	m.readOnly = true
+	if err = m.loadInspected(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// loadInspected history without validating it against the files.
+func (m *Migrate) loadInspected() error {
+	var err error
+	m.version, err = m.tracker.GetMetaVersion()
+	if err != nil {
+		return errors.Wrap(err, "get meta version")
+	}
+	switch {
+	case m.version < 0:
+		// Nothing has been migrated yet.
+		m.Migrations = nil
+		return nil
+	case m.version > version:
+		return ErrNeedsUpgrade
+	case m.version < version:
+		return fmt.Errorf("meta tables are version %d, but %d is required: run migrate to upgrade them",
+			m.version, version)
+	}
+	m.Migrations, err = m.tracker.GetMigrations(m.namespace)
+	if err != nil {
+		return errors.Wrap(err, "get migrations")
+	}
+	sortMigrations(m.Migrations)
+	if err = m.fillFullpaths(); err != nil {
+		return err
+	}
+	if err = m.loadLastFailure(); err != nil {
+		return errors.Wrap(err, "get failures")
+	}
+	return nil
+}
+
+// Status reports the applied and pending migrations alongside any drift. It
+// reads every applied migration's file to verify its checksum.
+func (m *Migrate) Status() Status {
+	return Status{
+		Version: m.version,
+		Applied: m.Applied(),
+		Pending: m.Pending(),
+		Drift:   m.drift(),
+		Stats:   m.stats(),
+	}
+}
+
+// drift collects every inconsistency between the history and the files. This
+// mirrors validHistory, which stops at the first problem.
+func (m *Migrate) drift() []Drift {
+	var drift []Drift
+	for i := len(m.Files); i < len(m.Migrations); i++ {
+		drift = append(drift, Drift{
+			Filename: m.Migrations[i].Filename,
+			Kind:     DriftMissing,
+			Err: fmt.Errorf("%w: %s", ErrMissingMigration,
+				m.Migrations[i].Filename),
+		})
+	}
+	for i := m.idx; i < len(m.Migrations) && i < len(m.Files); i++ {
+		mg := m.Migrations[i]
+		if mg.Filename != m.Files[i].Info.Name() {
+			// Every later migration is misaligned, so there's no
+			// point in checking them.
+			drift = append(drift, Drift{
+				Filename: m.Files[i].Info.Name(),
+				Kind:     DriftOutOfOrder,
+				Err: fmt.Errorf("%w: %s was added to history before %s",
+					ErrOutOfOrder, m.Files[i].Info.Name(),
+					mg.Filename),
+			})
+			break
+		}
+		if err := m.checkHash(mg); err != nil {
+			drift = append(drift, Drift{
+				Filename: mg.Filename,
+				Kind:     DriftChecksum,
+				Err:      err,
+			})
+		}
+	}
+	return drift
+}
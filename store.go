@@ -1,7 +1,10 @@
 package migrate
 
 import (
+	"context"
 	"database/sql"
+
+	"github.com/pkg/errors"
 )
 
 type Store interface {
@@ -14,13 +17,91 @@ type Store interface {
 	CreateMetaIfNotExists() error
 	CreateMetaCheckpointsIfNotExists() error
 
-	GetMigrations() ([]Migration, error)
-	InsertMigration(filename, content, checksum string) error
-	UpsertMigration(filename, content, checksum string) error
+	// GetMetaVersion reports the current version without creating or
+	// modifying anything. It returns 0 if the meta tables predate
+	// versioning and -1 if they don't exist.
+	GetMetaVersion() (int, error)
+
+	// GetMigrations in the namespace, in the order they were applied.
+	GetMigrations(namespace string) ([]Migration, error)
+	InsertMigration(Migration) error
+	UpsertMigration(Migration) error
+
+	GetMetaCheckpoints(namespace, filename string) ([]string, error)
+	InsertMetaCheckpoint(
+		namespace, filename, content, checksum string,
+		idx int,
+	) error
+	DeleteMetaCheckpoints(namespace string) error
 
-	GetMetaCheckpoints(string) ([]string, error)
-	InsertMetaCheckpoint(filename, content, checksum string, idx int) error
-	DeleteMetaCheckpoints() error
+	// CreateMetaObjectsIfNotExists, GetMetaObjects, and
+	// UpsertMetaObject record the content of repeatable objects when
+	// they were last applied.
+	CreateMetaObjectsIfNotExists() error
+	GetMetaObjects(namespace string) ([]Object, error)
+	UpsertMetaObject(Object) error
+
+	// CreateMetaFailuresIfNotExists, GetMetaFailures, and
+	// InsertMetaFailure record statements which failed, oldest first.
+	CreateMetaFailuresIfNotExists() error
+	GetMetaFailures(namespace string) ([]Failure, error)
+	InsertMetaFailure(Failure) error
 
 	UpgradeToV1([]Migration) error
+
+	// UpgradeToV2 records the checksum algorithm of each migration.
+	UpgradeToV2() error
+
+	// UpgradeToV3 keys the meta tables by namespace, so independent
+	// migration histories can share a database.
+	UpgradeToV3() error
+
+	// UpgradeToV4 records which variant of each migration was applied.
+	UpgradeToV4() error
+
+	// UpgradeToV5 records the statements and duration of each migration.
+	UpgradeToV5() error
+
+	// UpgradeToV6 records the annotations of each migration.
+	UpgradeToV6() error
+
+	// UpgradeToV7 only records the version. Migrate then rewrites md5
+	// checksums as SHA-256, which older versions can't verify, so they
+	// refuse the history with ErrNeedsUpgrade instead.
+	UpgradeToV7() error
+
+	// UpgradeToV8 records when each migration was applied, as AppliedAt.
+	// Migrations applied before use the time they were recorded.
+	UpgradeToV8() error
+}
+
+// Pinger is implemented by Stores which can check the health of their
+// connection. It's optional for backwards compatibility; see Ping.
+type Pinger interface {
+	Ping(context.Context) error
+}
+
+// Ping checks that the Store's connection is healthy. Stores which don't
+// implement Pinger are checked by executing a trivial statement.
+func Ping(ctx context.Context, db Store) error {
+	if p, ok := db.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	_, err := db.Exec(`SELECT 1`)
+	return err
+}
+
+// OpenStore opens the Store and confirms the connection is healthy, so
+// connection problems are reported up front rather than midway through
+// migrating. The Store is closed if the connection is unhealthy. Callers are
+// responsible for closing it otherwise.
+func OpenStore(ctx context.Context, db Store) error {
+	if err := db.Open(); err != nil {
+		return errors.Wrap(err, "open")
+	}
+	if err := Ping(ctx, db); err != nil {
+		_ = db.Close()
+		return errors.Wrap(err, "ping")
+	}
+	return nil
 }
@@ -0,0 +1,416 @@
+package migrate
+
+import (
+	"bufio"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxContentSize is the largest migration whose content is recorded in the
+// meta table. Larger files, such as multi-gigabyte seed data, are streamed
+// without ever being held in memory, so they're recorded with only their
+// checksum.
+const maxContentSize = 64 << 20
+
+// statementScanner reads a migration's statements one at a time, so large
+// files aren't held in memory. Lines are collected until they end with the
+// statement terminator and parse, which joins statements spanning several
+// terminators, such as functions and COPY blocks, exactly as parsing the
+// whole file would.
+type statementScanner struct {
+	r    *bufio.Reader
+	dbt  DBType
+	role string
+
+	// terminator currently ending statements; see terminatorDirective.
+	terminator string
+
+	// groups opened by atomic directives so far.
+	groups atomicGroups
+
+	// only block currently open, whose lines may be for other DB types.
+	only onlyBlock
+
+	// buf of lines which don't yet form complete statements, and queue
+	// of parsed statements not yet returned.
+	buf   strings.Builder
+	queue []statement
+	eof   bool
+}
+
+// newStatementScanner of r for dbt, executing every statement as role.
+func newStatementScanner(
+	r io.Reader,
+	dbt DBType,
+	role string,
+) *statementScanner {
+	return &statementScanner{
+		r:          bufio.NewReader(r),
+		dbt:        dbt,
+		role:       role,
+		terminator: defaultTerminator(dbt),
+	}
+}
+
+// next statement, or false once every statement has been returned.
+func (s *statementScanner) next() (statement, bool, error) {
+	for len(s.queue) == 0 {
+		if s.eof {
+			return statement{}, false, nil
+		}
+		if err := s.readLine(); err != nil {
+			return statement{}, false, err
+		}
+	}
+	stmt := s.queue[0]
+	s.queue = s.queue[1:]
+	stmt.role = s.role
+	if err := checkAtomic(stmt); err != nil {
+		return statement{}, false, err
+	}
+	return stmt, true, nil
+}
+
+// readLine into buf, parsing it once it ends a statement.
+func (s *statementScanner) readLine() error {
+	line, err := s.r.ReadString('\n')
+	switch {
+	case err == io.EOF:
+		s.eof = true
+	case err != nil:
+		return errors.Wrap(err, "read")
+	}
+	trimmed := strings.TrimSpace(line)
+	switch {
+	case isOnlyDirective(trimmed):
+		if err = s.only.directive(s.dbt, trimmed); err != nil {
+			return err
+		}
+		line, trimmed = "", ""
+	case s.only.skip:
+		line, trimmed = "", ""
+	}
+	if terminator, ok := cutTerminatorDirective(s.dbt, trimmed); ok {
+		if err = s.flush(false); err != nil {
+			return err
+		}
+		s.terminator = terminator
+		return nil
+	}
+	if isAtomicDirective(trimmed) {
+		if err = s.flush(false); err != nil {
+			return err
+		}
+		if err = s.groups.directive(trimmed); err != nil {
+			return err
+		}
+		if s.eof {
+			return s.close()
+		}
+		return nil
+	}
+	s.buf.WriteString(line)
+	if s.eof {
+		if err = s.flush(false); err != nil {
+			return err
+		}
+		return s.close()
+	}
+	if _, ok := cutTerminator(trimmed, s.terminator); ok ||
+		s.dbt == DBTypeOracle && trimmed == plsqlEnd {
+		return s.flush(true)
+	}
+	return nil
+}
+
+// close the file once it's read, reporting any group or block which was never
+// ended.
+func (s *statementScanner) close() error {
+	if err := s.groups.close(); err != nil {
+		return err
+	}
+	return s.only.close()
+}
+
+// flush buf into the queue. If partial, buf may end midway through a
+// statement, and it's kept for more lines if it doesn't parse.
+func (s *statementScanner) flush(partial bool) error {
+	text := s.buf.String()
+	if s.terminator != ";" {
+		text = terminatorDirective + " " + s.terminator + "\n" + text
+	}
+	stmts, err := parseStatements(s.dbt, []byte(text))
+	if err != nil {
+		if partial {
+			return nil
+		}
+		return err
+	}
+	for i := range stmts {
+		stmts[i].group = s.groups.cur
+	}
+	s.queue = append(s.queue, stmts...)
+	s.buf.Reset()
+	return nil
+}
+
+// fileDirectives apply to a whole migration file rather than the statement
+// which follows them.
+type fileDirectives struct {
+	// role from as directives; see fileRole.
+	role string
+
+	// analyze lists the tables whose statistics are refreshed once the
+	// file is applied.
+	analyze []string
+
+	// phase of the deploy in which the file is applied.
+	phase Phase
+
+	// target names the Store on which the file is executed, if not the
+	// one passed to New.
+	target string
+
+	// timeout caps the time spent applying the file, if set.
+	timeout time.Duration
+
+	// noTransaction executes the file statement by statement rather than
+	// in one transaction.
+	noTransaction bool
+}
+
+// isFileDirective reports whether the trimmed line is a directive applying
+// to the whole file rather than to the statement which follows it.
+func isFileDirective(trimmed string) bool {
+	return strings.HasPrefix(trimmed, asDirective+" ") ||
+		strings.HasPrefix(trimmed, analyzeDirective+" ") ||
+		strings.HasPrefix(trimmed, phaseDirective+" ") ||
+		strings.HasPrefix(trimmed, targetDirective+" ") ||
+		strings.HasPrefix(trimmed, timeoutDirective+" ") ||
+		trimmed == noTransactionDirective
+}
+
+// scanDirectives of the migration at fullpath in fsys which apply to the
+// whole file.
+func scanDirectives(fsys fs.FS, fullpath string) (fileDirectives, error) {
+	var d fileDirectives
+	fi, err := fsys.Open(fullpath)
+	if err != nil {
+		return d, err
+	}
+	defer fi.Close()
+	var roles, phases, targets, timeouts strings.Builder
+	r := bufio.NewReader(fi)
+	for {
+		line, err := r.ReadString('\n')
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, asDirective+" "):
+			roles.WriteString(line + "\n")
+		case strings.HasPrefix(trimmed, analyzeDirective+" "):
+			d.analyze = append(d.analyze, analyzeTables(trimmed)...)
+		case strings.HasPrefix(trimmed, phaseDirective+" "):
+			phases.WriteString(line + "\n")
+		case strings.HasPrefix(trimmed, targetDirective+" "):
+			targets.WriteString(line + "\n")
+		case strings.HasPrefix(trimmed, timeoutDirective+" "):
+			timeouts.WriteString(line + "\n")
+		case trimmed == noTransactionDirective:
+			d.noTransaction = true
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return d, errors.Wrap(err, "read")
+		}
+	}
+	if d.role, err = fileRole(roles.String()); err != nil {
+		return d, err
+	}
+	if d.phase, err = filePhase(phases.String()); err != nil {
+		return d, err
+	}
+	if d.target, err = fileTarget(targets.String()); err != nil {
+		return d, err
+	}
+	d.timeout, err = fileTimeout(timeouts.String())
+	return d, err
+}
+
+// fileStatements streams the statements of a migration file while computing
+// its checksum.
+type fileStatements struct {
+	*statementScanner
+	file     fs.File
+	fsys     fs.FS
+	fullpath string
+	hash     hash.Hash
+
+	directives fileDirectives
+
+	// dataFiles loaded by the statements returned so far, which are part
+	// of the checksum.
+	dataFiles []string
+
+	// batchable reports whether every statement returned so far could be
+	// executed in a batch or transaction.
+	batchable bool
+
+	// atomic reports whether any statement returned so far is in an
+	// atomic group.
+	atomic bool
+}
+
+// openStatements of the migration at fullpath in fsys for dbt, hashing it with
+// h unless it's nil.
+func openStatements(
+	h Hasher,
+	fsys fs.FS,
+	fullpath string,
+	dbt DBType,
+) (*fileStatements, error) {
+	d, err := scanDirectives(fsys, fullpath)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := fsys.Open(fullpath)
+	if err != nil {
+		return nil, err
+	}
+	st := &fileStatements{
+		file:       fi,
+		fsys:       fsys,
+		fullpath:   fullpath,
+		directives: d,
+		batchable:  true,
+	}
+	var r io.Reader = fi
+	if h != nil {
+		st.hash = h.New()
+		r = io.TeeReader(fi, st.hash)
+	}
+	st.statementScanner = newStatementScanner(r, dbt, d.role)
+	return st, nil
+}
+
+func (st *fileStatements) next() (statement, bool, error) {
+	stmt, ok, err := st.statementScanner.next()
+	if !ok || err != nil {
+		return stmt, ok, err
+	}
+	st.batchable = st.batchable && batchable(stmt)
+	st.atomic = st.atomic || stmt.group > 0
+	st.dataFiles = append(st.dataFiles, stmt.blobs...)
+	if name, ok := loadDataFilename(stmt.sql); ok {
+		st.dataFiles = append(st.dataFiles, name)
+	}
+	return stmt, true, nil
+}
+
+// checksum of the file and its data files, once every statement has been
+// read.
+func (st *fileStatements) checksum() (string, error) {
+	for _, name := range st.dataFiles {
+		path, err := dataFilePath(st.fullpath, name)
+		if err != nil {
+			return "", err
+		}
+		if err = copyFile(st.hash, st.fsys, path); err != nil {
+			return "", errors.Wrap(err, "read data file")
+		}
+	}
+	return fmt.Sprintf("%x", st.hash.Sum(nil)), nil
+}
+
+func (st *fileStatements) Close() error { return st.file.Close() }
+
+func copyFile(w io.Writer, fsys fs.FS, path string) error {
+	fi, err := fsys.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+	_, err = io.Copy(w, fi)
+	return err
+}
+
+// scanFile reads every statement of the migration at fullpath in fsys for
+// dbt, hashing it with h unless it's nil, and returns the number of
+// statements.
+func scanFile(
+	h Hasher,
+	fsys fs.FS,
+	fullpath string,
+	dbt DBType,
+) (*fileStatements, int, error) {
+	st, err := openStatements(h, fsys, fullpath, dbt)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer st.Close()
+	var n int
+	for {
+		_, ok, err := st.next()
+		if err != nil {
+			return nil, 0, err
+		}
+		if !ok {
+			return st, n, nil
+		}
+		n++
+	}
+}
+
+// countStatements in the migration at fullpath in fsys for dbt, and its
+// directives.
+func countStatements(
+	fsys fs.FS,
+	fullpath string,
+	dbt DBType,
+) (int, fileDirectives, error) {
+	st, n, err := scanFile(nil, fsys, fullpath, dbt)
+	if err != nil {
+		return 0, fileDirectives{}, err
+	}
+	return n, st.directives, nil
+}
+
+// fileChecksum of a migration. The contents of data files and blobs loaded by
+// the migration are folded in, so changing one is detected like changing the
+// migration itself. Migrations without data files are checksummed as-is.
+func fileChecksum(
+	h Hasher,
+	fsys fs.FS,
+	fullpath string,
+	dbt DBType,
+) (string, error) {
+	st, _, err := scanFile(h, fsys, fullpath, dbt)
+	if err != nil {
+		return "", fmt.Errorf("statements: %w", err)
+	}
+	return st.checksum()
+}
+
+// fileContent of the migration at fullpath in fsys to record in the meta
+// table, or empty if it's larger than maxContentSize.
+func fileContent(fsys fs.FS, fullpath string) (string, error) {
+	info, err := fs.Stat(fsys, fullpath)
+	if err != nil {
+		return "", err
+	}
+	if info.Size() > maxContentSize {
+		return "", nil
+	}
+	byt, err := fs.ReadFile(fsys, fullpath)
+	if err != nil {
+		return "", err
+	}
+	return string(byt), nil
+}
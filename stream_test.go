@@ -0,0 +1,295 @@
+package migrate
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStatementScanner(t *testing.T) {
+	tcs := []string{
+		"CREATE TABLE users (id INTEGER);\nINSERT INTO users VALUES (1); INSERT INTO users VALUES (2);",
+		`CREATE FUNCTION touch() RETURNS trigger AS $$
+BEGIN
+	NEW.updated = now();
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+SELECT 1;
+`,
+		"INSERT INTO notes VALUES ('a;\nb;');\nCREATE PROCEDURE p() LANGUAGE sql\nBEGIN ATOMIC\n\tSELECT 1;\nEND;\n",
+		`-- migrate:as owner
+COPY users (id, name) FROM stdin;
+1	alice;
+2	bob
+\.
+-- migrate:blob logo.png
+INSERT INTO images (data) VALUES ($1);
+`,
+		`CREATE TABLE a (id INT);
+--#SET TERMINATOR @
+CREATE PROCEDURE p() BEGIN UPDATE a SET id = 0; END
+@
+--#SET TERMINATOR ;
+SELECT 1`,
+		`CREATE TABLE a (id INT);
+-- migrate:atomic begin
+INSERT INTO a VALUES (1);
+INSERT INTO a VALUES (2);
+-- migrate:atomic end
+--#SET TERMINATOR @
+-- migrate:atomic begin
+UPDATE a SET id = 3@
+-- migrate:atomic end
+SELECT 1@`,
+		`CREATE TABLE a (id INT);
+-- migrate:only postgres
+CREATE INDEX CONCURRENTLY a_id ON a (id);
+-- migrate:only end
+-- migrate:only mysql mariadb
+CREATE INDEX a_id ON a (id) ALGORITHM=INPLACE;
+-- migrate:only end
+SELECT 1;`,
+	}
+	for _, tc := range tcs {
+		want, err := parseStatements(DBTypePostgres, []byte(tc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		role, err := fileRole(tc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := newStatementScanner(strings.NewReader(tc), DBTypePostgres, role)
+		got := []statement{}
+		for {
+			stmt, ok, err := sc.next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				break
+			}
+			got = append(got, stmt)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected %+v, got %+v", want, got)
+		}
+	}
+
+	tc := "CREATE TABLE a (id INT);\nDELIMITER $$\nCREATE PROCEDURE p()\nBEGIN\n\tUPDATE a SET id = 0;\nEND $$\nDELIMITER ;\nSELECT 1;\n"
+	want, err := parseStatements(DBTypeMySQL, []byte(tc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := newStatementScanner(strings.NewReader(tc), DBTypeMySQL, "")
+	got := []statement{}
+	for {
+		stmt, ok, err := sc.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		got = append(got, stmt)
+	}
+	if len(want) != 3 || !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+
+	sc = newStatementScanner(strings.NewReader("COPY users FROM stdin;\n1\n"),
+		DBTypePostgres, "")
+	if _, _, err := sc.next(); err == nil {
+		t.Fatal("expected error for unterminated copy")
+	}
+}
+
+func TestAtomicDirectiveErrors(t *testing.T) {
+	tcs := map[string]string{
+		"nested": `-- migrate:atomic begin
+-- migrate:atomic begin
+SELECT 1;`,
+		"unterminated": `-- migrate:atomic begin
+SELECT 1;`,
+		"end without begin": `SELECT 1;
+-- migrate:atomic end`,
+		"unknown": `-- migrate:atomic start
+SELECT 1;`,
+		"blob": `-- migrate:atomic begin
+-- migrate:blob logo.png
+INSERT INTO images (data) VALUES ($1);
+-- migrate:atomic end`,
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			sc := newStatementScanner(strings.NewReader(tc),
+				DBTypePostgres, "")
+			for {
+				_, ok, err := sc.next()
+				if err != nil {
+					return
+				}
+				if !ok {
+					t.Fatal("expected error")
+				}
+			}
+		})
+	}
+}
+
+func TestBatchSeparator(t *testing.T) {
+	tc := `CREATE TABLE counts (n INT, label VARCHAR(10));
+INSERT INTO counts VALUES (1, 'ALGO');
+GO
+CREATE PROCEDURE reset_counts AS
+BEGIN
+	UPDATE counts SET n = 0;
+	SELECT 'go';
+END
+go
+-- migrate:atomic begin
+INSERT INTO counts VALUES (2, 'two');
+GO
+-- migrate:atomic end
+--#SET TERMINATOR ;
+SELECT 1;
+SELECT 2;`
+	want := []string{
+		"CREATE TABLE counts (n INT, label VARCHAR(10));\nINSERT INTO counts VALUES (1, 'ALGO');",
+		"CREATE PROCEDURE reset_counts AS\nBEGIN\n\tUPDATE counts SET n = 0;\n\tSELECT 'go';\nEND",
+		"INSERT INTO counts VALUES (2, 'two');",
+		"SELECT 1",
+		"SELECT 2",
+	}
+	parsed, err := parseStatementsFor(DBTypeSQLServer, []byte(tc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := newStatementScanner(strings.NewReader(tc), DBTypeSQLServer, "")
+	scanned := []statement{}
+	for {
+		stmt, ok, err := sc.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		scanned = append(scanned, stmt)
+	}
+	if !reflect.DeepEqual(scanned, parsed) {
+		t.Fatalf("expected %+v, got %+v", parsed, scanned)
+	}
+	got := []string{}
+	for _, stmt := range parsed {
+		got = append(got, stmt.sql)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	if parsed[2].group != 1 {
+		t.Fatalf("expected atomic group 1, got %d", parsed[2].group)
+	}
+}
+
+func TestPLSQLBlocks(t *testing.T) {
+	tc := `CREATE TABLE counts (n NUMBER, label VARCHAR2(10));
+INSERT INTO counts VALUES (1, 'a/b');
+CREATE OR REPLACE PROCEDURE reset_counts AS
+BEGIN
+	UPDATE counts SET n = 0;
+END;
+/
+-- Seed the counts.
+BEGIN
+	INSERT INTO counts VALUES (2, 'two');
+	INSERT INTO counts VALUES (3, 'three');
+END;
+/
+SELECT COUNT(*) FROM counts
+/`
+	want := []string{
+		"CREATE TABLE counts (n NUMBER, label VARCHAR2(10))",
+		"INSERT INTO counts VALUES (1, 'a/b')",
+		"CREATE OR REPLACE PROCEDURE reset_counts AS\nBEGIN\n\tUPDATE counts SET n = 0;\nEND;",
+		"BEGIN\n\tINSERT INTO counts VALUES (2, 'two');\n\tINSERT INTO counts VALUES (3, 'three');\nEND;",
+		"SELECT COUNT(*) FROM counts",
+	}
+	parsed, err := parseStatements(DBTypeOracle, []byte(tc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := newStatementScanner(strings.NewReader(tc), DBTypeOracle, "")
+	scanned := []statement{}
+	for {
+		stmt, ok, err := sc.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		scanned = append(scanned, stmt)
+	}
+	if !reflect.DeepEqual(scanned, parsed) {
+		t.Fatalf("expected %+v, got %+v", parsed, scanned)
+	}
+	got := []string{}
+	for _, stmt := range parsed {
+		got = append(got, stmt.sql)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	unterminated := "BEGIN\n\tNULL;\nEND;\n"
+	if _, err = parseStatements(DBTypeOracle, []byte(unterminated)); err == nil {
+		t.Fatal("expected error for unterminated block")
+	}
+}
+
+func TestOnlyDirective(t *testing.T) {
+	tc := `CREATE TABLE a (id INT);
+-- migrate:only postgres cockroach
+CREATE INDEX CONCURRENTLY a_id ON a (id);
+-- migrate:only end
+-- migrate:only mysql
+CREATE INDEX a_id ON a (id) ALGORITHM=INPLACE;
+-- migrate:only end
+`
+	for dbt, want := range map[DBType][]string{
+		DBTypePostgres:  {"CREATE TABLE a (id INT)", "CREATE INDEX CONCURRENTLY a_id ON a (id)"},
+		DBTypeCockroach: {"CREATE TABLE a (id INT)", "CREATE INDEX CONCURRENTLY a_id ON a (id)"},
+		DBTypeMySQL:     {"CREATE TABLE a (id INT)", "CREATE INDEX a_id ON a (id) ALGORITHM=INPLACE"},
+		DBTypeSQLite:    {"CREATE TABLE a (id INT)"},
+	} {
+		got, err := StatementsFor(dbt, []byte(tc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: expected %q, got %q", dbt, want, got)
+		}
+	}
+
+	for _, tc := range []string{
+		"-- migrate:only postgres\nSELECT 1;",
+		"SELECT 1;\n-- migrate:only end",
+		"-- migrate:only postgres\n-- migrate:only mysql\nSELECT 1;",
+		"-- migrate:only postgress\nSELECT 1;\n-- migrate:only end",
+		"-- migrate:only\nSELECT 1;",
+	} {
+		if _, err := StatementsFor(DBTypePostgres, []byte(tc)); err == nil {
+			t.Fatalf("expected %q to fail", tc)
+		}
+		sc := newStatementScanner(strings.NewReader(tc), DBTypePostgres, "")
+		var err error
+		for ok := true; ok && err == nil; {
+			_, ok, err = sc.next()
+		}
+		if err == nil {
+			t.Fatalf("expected streaming %q to fail", tc)
+		}
+	}
+}
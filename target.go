@@ -0,0 +1,55 @@
+package migrate
+
+import (
+	"fmt"
+	"strings"
+)
+
+// targetDirective executes every statement in a file on another database,
+// such as a reporting database whose schema must change in lockstep with the
+// primary one. The migration is still recorded in the primary history:
+//
+//	-- migrate:target analytics
+const targetDirective = directivePrefix + "target"
+
+// WithTarget executes files with a `-- migrate:target name` directive on s.
+// Their history, checkpoints, and failures are still tracked by the Store
+// passed to New, so a single ordered history covers every database. Objects
+// and partitions are always created on the Store passed to New.
+func WithTarget(name string, s Store) Option {
+	return func(m *Migrate) { m.targets[name] = s }
+}
+
+// fileTarget from the file's target directive, if any.
+func fileTarget(s string) (string, error) {
+	var target string
+	for _, line := range strings.Split(s, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, targetDirective+" ") {
+			continue
+		}
+		t := strings.TrimSpace(strings.TrimPrefix(trimmed, targetDirective))
+		if target != "" && t != target {
+			return "", fmt.Errorf("conflicting %s directives: %s and %s",
+				targetDirective, target, t)
+		}
+		target = t
+	}
+	return target, nil
+}
+
+// checkTargets confirms a Store was configured for the target of every file,
+// so a missing WithTarget is reported before migrating rather than partway
+// through.
+func (m *Migrate) checkTargets() error {
+	for _, fi := range m.Files {
+		if fi.target == "" {
+			continue
+		}
+		if _, ok := m.targets[fi.target]; !ok {
+			return fmt.Errorf("%s: unknown target %s: use WithTarget",
+				fi.Info.Name(), fi.target)
+		}
+	}
+	return nil
+}
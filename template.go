@@ -0,0 +1,89 @@
+package migrate
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// WithTemplateVars renders each migration file as a text/template with vars,
+// such as {{.Schema}}, so one set of files can name a different schema,
+// tablespace, or environment in each deploy. Files are rendered before they're
+// split into statements, checksummed, or recorded, so the history holds the
+// rendered SQL and checksums are stable as long as an environment's vars are.
+// Changing a var's value changes the checksum of every migrated file using it,
+// which fails with ErrChecksumMismatch like editing the file would. Referring
+// to a var which isn't in vars is an error. Data files and partition
+// templates aren't rendered, and rendered files are held in memory. Write
+// {{"{{"}} for a literal {{, such as in a Postgres array.
+func WithTemplateVars(vars map[string]string) Option {
+	return func(m *Migrate) { m.vars = vars }
+}
+
+// templateFS renders the migration files in FS with vars as they're opened.
+type templateFS struct {
+	fs.FS
+	vars map[string]string
+	exts []string
+}
+
+func (t templateFS) Open(name string) (fs.File, error) {
+	fi, err := t.FS.Open(name)
+	if err != nil || !t.rendered(name) {
+		return fi, err
+	}
+	info, err := fi.Stat()
+	if err != nil {
+		fi.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		return fi, nil
+	}
+	byt, err := io.ReadAll(fi)
+	fi.Close()
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(name).Option("missingkey=error").
+		Parse(string(byt))
+	if err != nil {
+		return nil, fmt.Errorf("template %s: %w", name, err)
+	}
+	var b bytes.Buffer
+	if err = tmpl.Execute(&b, t.vars); err != nil {
+		return nil, fmt.Errorf("template %s: %w", name, err)
+	}
+	return &renderedFile{
+		Reader: bytes.NewReader(b.Bytes()),
+		info:   renderedInfo{FileInfo: info, size: int64(b.Len())},
+	}, nil
+}
+
+// rendered reports whether the file at name is a migration to render, rather
+// than a data file or partition template.
+func (t templateFS) rendered(name string) bool {
+	return hasExtension(name, t.exts) &&
+		!strings.HasPrefix(path.Clean(name), partitionsDir+"/")
+}
+
+// renderedFile is a migration file rendered by templateFS.
+type renderedFile struct {
+	*bytes.Reader
+	info renderedInfo
+}
+
+func (f *renderedFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *renderedFile) Close() error               { return nil }
+
+// renderedInfo of a file, with the size of its rendered content.
+type renderedInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (fi renderedInfo) Size() int64 { return fi.size }
@@ -0,0 +1,44 @@
+package migrate
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// timeoutDirective caps the total time spent applying a file, overriding
+// WithFileTimeout:
+//
+//	-- migrate:timeout 10m
+const timeoutDirective = directivePrefix + "timeout"
+
+// WithFileTimeout caps the total time spent applying each migration file.
+// Once it expires, migrating stops after the current statement with
+// ErrFileTimeout. Executed statements are checkpointed, so the next run
+// resumes where this one stopped. A file's timeout directive takes
+// precedence.
+func WithFileTimeout(d time.Duration) Option {
+	return func(m *Migrate) { m.fileTimeout = d }
+}
+
+// fileTimeout from the file's timeout directive, if any.
+func fileTimeout(s string) (time.Duration, error) {
+	var timeout time.Duration
+	for _, line := range strings.Split(s, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, timeoutDirective+" ") {
+			continue
+		}
+		arg := strings.TrimSpace(strings.TrimPrefix(trimmed, timeoutDirective))
+		d, err := time.ParseDuration(arg)
+		if err != nil || d <= 0 {
+			return 0, fmt.Errorf("invalid timeout %q", arg)
+		}
+		if timeout != 0 && d != timeout {
+			return 0, fmt.Errorf("conflicting %s directives: %s and %s",
+				timeoutDirective, timeout, d)
+		}
+		timeout = d
+	}
+	return timeout, nil
+}
@@ -0,0 +1,48 @@
+package migrate
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// fileTime parses the timestamp prefix of a migration filename. The prefix may
+// be a formatted UTC timestamp (YYYYMMDDHHMMSS, YYYYMMDDHHMM, or YYYYMMDD), a
+// date followed by a two-digit sequence (YYYYMMDD##), or UNIX seconds.
+func fileTime(name string) (time.Time, error) {
+	prefix := regexNum.FindString(name)
+	switch len(prefix) {
+	case 14:
+		return parseFileTime(name, "20060102150405", prefix)
+	case 12:
+		return parseFileTime(name, "200601021504", prefix)
+	case 8:
+		return parseFileTime(name, "20060102", prefix)
+	case 10:
+		// Both YYYYMMDD## and current UNIX timestamps are 10 digits.
+		// Prefer the date, since UNIX timestamps rarely form a valid
+		// one.
+		t, err := time.Parse("20060102", prefix[:8])
+		if err == nil {
+			return t, nil
+		}
+		fallthrough
+	case 9:
+		secs, err := strconv.ParseInt(prefix, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("parse timestamp in file %s: %w",
+				name, err)
+		}
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("file %s is not prefixed by a timestamp", name)
+}
+
+func parseFileTime(name, layout, prefix string) (time.Time, error) {
+	t, err := time.Parse(layout, prefix)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parse timestamp in file %s: %w",
+			name, err)
+	}
+	return t, nil
+}
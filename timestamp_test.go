@@ -0,0 +1,28 @@
+package migrate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFileTime(t *testing.T) {
+	tcs := map[string]time.Time{
+		"20180601123045_a.sql": time.Date(2018, 6, 1, 12, 30, 45, 0, time.UTC),
+		"201806011230_a.sql":   time.Date(2018, 6, 1, 12, 30, 0, 0, time.UTC),
+		"2018060101_a.sql":     time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC),
+		"20180601_a.sql":       time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC),
+		"1700000000_a.sql":     time.Unix(1700000000, 0).UTC(),
+	}
+	for name, want := range tcs {
+		got, err := fileTime(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(want) {
+			t.Fatalf("%s: expected %s, got %s", name, want, got)
+		}
+	}
+	if _, err := fileTime("1_a.sql"); err == nil {
+		t.Fatal("expected error for sequence number")
+	}
+}
@@ -0,0 +1,408 @@
+package migrate
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// dialect describes how a database writes the string literals, quoted
+// identifiers, and comments in which semicolons don't end a statement.
+type dialect struct {
+	// backslash escapes quotes within string literals, as on MySQL.
+	backslash bool
+
+	// backticks quote identifiers, as on MySQL.
+	backticks bool
+
+	// brackets quote identifiers, as on SQLite.
+	brackets bool
+
+	// dollarQuotes, such as $$ or $body$, enclose function bodies and DO
+	// blocks on Postgres.
+	dollarQuotes bool
+
+	// escapeStrings written E'...' allow backslash escapes on Postgres.
+	escapeStrings bool
+
+	// qQuotes written q'[...]' enclose strings on Oracle.
+	qQuotes bool
+
+	// tripleQuotes, ''' or """, enclose strings spanning lines on
+	// BigQuery.
+	tripleQuotes bool
+
+	// hashComments start with # and run to the end of the line.
+	hashComments bool
+
+	// nestedComments allow /* ... */ within block comments, as on
+	// Postgres.
+	nestedComments bool
+
+	// spacedDashes require -- to be followed by whitespace to start a
+	// comment, as on MySQL, where 1--1 is arithmetic.
+	spacedDashes bool
+}
+
+// dialectFor dbt. Without a DBType, statements are split as on Postgres.
+func dialectFor(dbt DBType) dialect {
+	switch dbt {
+	case DBTypeMySQL, DBTypeMariaDB:
+		return dialect{
+			backslash:    true,
+			backticks:    true,
+			hashComments: true,
+			spacedDashes: true,
+		}
+	case DBTypeSQLite:
+		return dialect{backticks: true, brackets: true}
+	case DBTypeBigQuery:
+		return dialect{
+			backslash:    true,
+			backticks:    true,
+			tripleQuotes: true,
+			hashComments: true,
+		}
+	case DBTypeClickHouse:
+		return dialect{
+			backslash:    true,
+			backticks:    true,
+			hashComments: true,
+		}
+	case DBTypeOracle:
+		return dialect{qQuotes: true}
+	case DBTypeSQLServer:
+		return dialect{brackets: true}
+	case DBTypeDB2:
+		return dialect{}
+	default:
+		return dialect{
+			dollarQuotes:   true,
+			escapeStrings:  true,
+			nestedComments: true,
+		}
+	}
+}
+
+// regexRoutine matches the start of a statement creating a routine or
+// trigger, whose BEGIN ... END body contains semicolons, as on MySQL, SQLite,
+// Db2, and BigQuery, or with BEGIN ATOMIC on Postgres.
+var regexRoutine = regexp.MustCompile(`(?is)^create\s+` +
+	`(?:or\s+(?:replace|alter)\s+)?(?:definer\s*=\s*\S+\s+)?` +
+	`(?:(?:temp|temporary|aggregate|constraint)\s+)?` +
+	`(?:function|procedure|trigger|event)\b`)
+
+// span of text from start up to end.
+type span struct {
+	start, end int
+}
+
+// tokens of a section of a migration which matter for splitting it.
+type tokens struct {
+	// ends are the offsets of the semicolons which end statements, which
+	// excludes those within string literals, quoted identifiers,
+	// dollar-quoted bodies, comments, and the BEGIN ... END bodies of
+	// routines.
+	ends []int
+
+	// comments to strip from statements. Comments within the bodies of
+	// routines are kept, since the database stores them with the
+	// definition, as are MySQL's /*! ... */ executable comments and /*+
+	// ... */ optimizer hints.
+	comments []span
+}
+
+// tokenize s.
+func (d dialect) tokenize(s string) (tokens, error) {
+	var (
+		toks tokens
+
+		// start of the current statement's first word, or -1.
+		start = -1
+
+		// depth of BEGIN ... END and CASE ... END blocks within a
+		// routine.
+		depth int
+	)
+	for i := 0; i < len(s); {
+		c := s[i]
+		var (
+			j   int
+			err error
+		)
+		switch {
+		case c == ';':
+			if depth == 0 {
+				toks.ends = append(toks.ends, i)
+				start = -1
+			}
+			j = i + 1
+		case strings.HasPrefix(s[i:], "--") && d.isDashComment(s, i),
+			c == '#' && d.hashComments:
+			j = lineEnd(s, i)
+			if depth == 0 {
+				end := strings.TrimRight(s[:j], "\r\n")
+				toks.comments = append(toks.comments,
+					span{i, max(i, len(end))})
+			}
+		case strings.HasPrefix(s[i:], "/*"):
+			j, err = d.skipBlockComment(s, i)
+			if err == nil && depth == 0 && !isHint(s[i:]) {
+				toks.comments = append(toks.comments, span{i, j})
+			}
+		case c == '\'' || c == '"':
+			j, err = d.skipString(s, i, d.backslash)
+		case c == '`' && d.backticks:
+			j, err = skipQuoted(s, i, "`", "`", false)
+		case c == '[' && d.brackets:
+			j, err = skipQuoted(s, i, "[", "]", false)
+		case c == '$' && d.dollarQuotes:
+			j, err = skipDollarQuoted(s, i)
+		case isWordStart(c):
+			j = wordEnd(s, i)
+			if start < 0 {
+				start = i
+			}
+			word := s[i:j]
+			switch {
+			case j < len(s) && s[j] == '\'' && d.isStringPrefix(word):
+				if d.qQuotes && strings.HasSuffix(strings.ToLower(word), "q") {
+					j, err = skipQQuoted(s, j)
+				} else {
+					j, err = d.skipString(s, j, true)
+				}
+			case strings.EqualFold(word, "begin"),
+				strings.EqualFold(word, "case"):
+				if depth > 0 || regexRoutine.MatchString(s[start:i]) {
+					depth++
+				}
+			case strings.EqualFold(word, "end") && depth > 0:
+				var closes bool
+				if j, closes = endBlock(s, j); closes {
+					depth--
+				}
+			}
+		default:
+			j = i + 1
+		}
+		if err != nil {
+			return tokens{}, err
+		}
+		i = j
+	}
+	if depth > 0 {
+		return tokens{}, fmt.Errorf("unterminated BEGIN block in %q",
+			firstLine(s[start:]))
+	}
+	return toks, nil
+}
+
+// strip the comments from s[start:end], which must be tokenized by toks.
+// Block comments are replaced by a space, so the tokens around them stay
+// apart.
+func (toks tokens) strip(s string, start, end int) string {
+	var b strings.Builder
+	for _, c := range toks.comments {
+		if c.end <= start || c.start >= end {
+			continue
+		}
+		b.WriteString(s[start:c.start])
+		if s[c.start] == '/' {
+			b.WriteByte(' ')
+		}
+		start = c.end
+	}
+	b.WriteString(s[start:end])
+	return b.String()
+}
+
+// stripComments from the statement s.
+func (d dialect) stripComments(s string) (string, error) {
+	toks, err := d.tokenize(s)
+	if err != nil {
+		return "", err
+	}
+	return toks.strip(s, 0, len(s)), nil
+}
+
+// isHint reports whether the block comment starting s is a MySQL executable
+// comment or an optimizer hint, which the database interprets.
+func isHint(s string) bool {
+	return strings.HasPrefix(s, "/*!") || strings.HasPrefix(s, "/*+")
+}
+
+// endBlock after the END at s[:i], returning the offset after it and whether
+// it closes a block. END IF, END LOOP, END WHILE, END REPEAT, and END FOR close
+// statements which don't open one, while END CASE closes the CASE block.
+func endBlock(s string, i int) (int, bool) {
+	j := i
+	for j < len(s) && (s[j] == ' ' || s[j] == '\t' || s[j] == '\n' ||
+		s[j] == '\r') {
+		j++
+	}
+	if j == len(s) || !isWordStart(s[j]) {
+		return i, true
+	}
+	k := wordEnd(s, j)
+	switch strings.ToLower(s[j:k]) {
+	case "if", "loop", "while", "repeat", "for":
+		return k, false
+	case "case":
+		return k, true
+	}
+	return i, true
+}
+
+// isDashComment reports whether the -- at s[i] starts a comment.
+func (d dialect) isDashComment(s string, i int) bool {
+	if !d.spacedDashes || i+2 == len(s) {
+		return true
+	}
+	c := s[i+2]
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// isStringPrefix reports whether word directly before a quote prefixes a
+// string which needs more than the usual quoting rules.
+func (d dialect) isStringPrefix(word string) bool {
+	switch strings.ToLower(word) {
+	case "e":
+		return d.escapeStrings
+	case "q", "nq":
+		return d.qQuotes
+	}
+	return false
+}
+
+// skipBlockComment starting at s[i], returning the offset after it.
+func (d dialect) skipBlockComment(s string, i int) (int, error) {
+	depth := 0
+	for j := i; j < len(s)-1; j++ {
+		switch {
+		case s[j] == '/' && s[j+1] == '*' && (depth == 0 ||
+			d.nestedComments):
+			depth++
+			j++
+		case s[j] == '*' && s[j+1] == '/':
+			depth--
+			j++
+			if depth == 0 {
+				return j + 1, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unterminated block comment %q", firstLine(s[i:]))
+}
+
+// skipString quoted by s[i], returning the offset after it.
+func (d dialect) skipString(s string, i int, backslash bool) (int, error) {
+	q := s[i : i+1]
+	if d.tripleQuotes && strings.HasPrefix(s[i:], q+q+q) {
+		return skipQuoted(s, i, q+q+q, q+q+q, backslash)
+	}
+	return skipQuoted(s, i, q, q, backslash)
+}
+
+// skipQuoted skips the text between open at s[i] and close, returning the
+// offset after it. close may be doubled to include it in the text, and with
+// backslash, escaped.
+func skipQuoted(
+	s string,
+	i int,
+	open, close string,
+	backslash bool,
+) (int, error) {
+	for j := i + len(open); j < len(s); j++ {
+		switch {
+		case backslash && s[j] == '\\':
+			j++
+		case strings.HasPrefix(s[j:], close):
+			if len(close) == 1 && strings.HasPrefix(s[j+1:], close) {
+				j++
+				continue
+			}
+			return j + len(close), nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated %s %q", describeQuote(open),
+		firstLine(s[i:]))
+}
+
+// skipDollarQuoted skips a Postgres dollar-quoted string, such as
+// $body$ ... $body$, starting at s[i]. Other dollar signs, such as the $1
+// parameters of prepared statements, are skipped alone.
+func skipDollarQuoted(s string, i int) (int, error) {
+	j := i + 1
+	if j < len(s) && isWordStart(s[j]) {
+		j = wordEnd(s, j) // Tags can't contain $, but words can.
+		if k := strings.IndexByte(s[i+1:j], '$'); k >= 0 {
+			j = i + 1 + k
+		}
+	}
+	if j == len(s) || s[j] != '$' {
+		return i + 1, nil
+	}
+	tag := s[i : j+1]
+	k := strings.Index(s[j+1:], tag)
+	if k < 0 {
+		return 0, fmt.Errorf("unterminated dollar-quoted string %q",
+			firstLine(s[i:]))
+	}
+	return j + 1 + k + len(tag), nil
+}
+
+// skipQQuoted skips an Oracle q'[...]' string whose quote is at s[i]. The
+// character after the quote delimits the string, with brackets closed by
+// their pair.
+func skipQQuoted(s string, i int) (int, error) {
+	if i+1 >= len(s) {
+		return 0, fmt.Errorf("unterminated string %q", s[i:])
+	}
+	delim := s[i+1]
+	if k := strings.IndexByte("[({<", delim); k >= 0 {
+		delim = "])}>"[k]
+	}
+	k := strings.Index(s[i+2:], string(delim)+"'")
+	if k < 0 {
+		return 0, fmt.Errorf("unterminated string %q", firstLine(s[i:]))
+	}
+	return i + 2 + k + 2, nil
+}
+
+func describeQuote(open string) string {
+	switch open {
+	case "`", "[":
+		return "quoted identifier"
+	case `"`:
+		return "quoted identifier or string"
+	}
+	return "string"
+}
+
+func isWordStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+		c >= 0x80
+}
+
+// wordEnd returns the offset after the keyword or identifier at s[i].
+func wordEnd(s string, i int) int {
+	j := i + 1
+	for j < len(s) && (isWordStart(s[j]) || s[j] >= '0' && s[j] <= '9' ||
+		s[j] == '$') {
+		j++
+	}
+	return j
+}
+
+func lineEnd(s string, i int) int {
+	if j := strings.IndexByte(s[i:], '\n'); j >= 0 {
+		return i + j + 1
+	}
+	return len(s)
+}
+
+// firstLine of s, for errors.
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return strings.TrimSpace(line)
+}
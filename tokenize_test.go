@@ -0,0 +1,244 @@
+package migrate
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		name string
+		dbt  DBType
+		sql  string
+		want []string
+	}{{
+		name: "string literals",
+		dbt:  DBTypePostgres,
+		sql:  "INSERT INTO notes VALUES ('a;b', 'it''s; fine');\nSELECT 1;",
+		want: []string{
+			"INSERT INTO notes VALUES ('a;b', 'it''s; fine')",
+			"SELECT 1",
+		},
+	}, {
+		name: "quoted identifiers",
+		dbt:  DBTypePostgres,
+		sql:  `CREATE TABLE "a;b" (id INT); SELECT 1`,
+		want: []string{`CREATE TABLE "a;b" (id INT)`, "SELECT 1"},
+	}, {
+		name: "dollar quotes",
+		dbt:  DBTypePostgres,
+		sql: `CREATE FUNCTION add(a int, b int) RETURNS int AS $body$
+	SELECT a + b; -- $$ isn't the tag
+$body$ LANGUAGE sql;
+DO $$ BEGIN PERFORM add(1, 2); END $$;
+SELECT $1::int;`,
+		want: []string{
+			`CREATE FUNCTION add(a int, b int) RETURNS int AS $body$
+	SELECT a + b; -- $$ isn't the tag
+$body$ LANGUAGE sql`,
+			"DO $$ BEGIN PERFORM add(1, 2); END $$",
+			"SELECT $1::int",
+		},
+	}, {
+		name: "escape strings",
+		dbt:  DBTypePostgres,
+		sql:  `SELECT E'it\'s;', 'a\'; SELECT 1`,
+		want: []string{`SELECT E'it\'s;', 'a\'`, "SELECT 1"},
+	}, {
+		name: "comments",
+		dbt:  DBTypePostgres,
+		sql: `SELECT 1 /* a; /* nested; */ b; */;
+SELECT 2 -- don't; split
+;`,
+		want: []string{"SELECT 1", "SELECT 2"},
+	}, {
+		name: "begin atomic",
+		dbt:  DBTypePostgres,
+		sql: `CREATE PROCEDURE reset() LANGUAGE sql BEGIN ATOMIC
+	UPDATE counts SET n = 0;
+	UPDATE totals SET n = CASE WHEN n > 0 THEN 0 ELSE n END;
+END;
+BEGIN;
+COMMIT;`,
+		want: []string{
+			`CREATE PROCEDURE reset() LANGUAGE sql BEGIN ATOMIC
+	UPDATE counts SET n = 0;
+	UPDATE totals SET n = CASE WHEN n > 0 THEN 0 ELSE n END;
+END`,
+			"BEGIN",
+			"COMMIT",
+		},
+	}, {
+		name: "mysql procedure",
+		dbt:  DBTypeMySQL,
+		sql: "CREATE DEFINER=`admin`@`%` PROCEDURE fill(n INT)\n" +
+			"BEGIN\n" +
+			"	DECLARE i INT DEFAULT 0;\n" +
+			"	loop_label: LOOP\n" +
+			"		IF i >= n THEN LEAVE loop_label; END IF;\n" +
+			"		CASE WHEN i = 0 THEN INSERT INTO t VALUES ('a\\';');\n" +
+			"		ELSE INSERT INTO t VALUES (\"b;\"); END CASE;\n" +
+			"		SET i = i + 1;\n" +
+			"	END LOOP loop_label;\n" +
+			"END;\n" +
+			"# hash; comment\nSELECT 1--1;",
+		want: []string{
+			"CREATE DEFINER=`admin`@`%` PROCEDURE fill(n INT)\n" +
+				"BEGIN\n" +
+				"	DECLARE i INT DEFAULT 0;\n" +
+				"	loop_label: LOOP\n" +
+				"		IF i >= n THEN LEAVE loop_label; END IF;\n" +
+				"		CASE WHEN i = 0 THEN INSERT INTO t VALUES ('a\\';');\n" +
+				"		ELSE INSERT INTO t VALUES (\"b;\"); END CASE;\n" +
+				"		SET i = i + 1;\n" +
+				"	END LOOP loop_label;\n" +
+				"END",
+			"SELECT 1--1",
+		},
+	}, {
+		name: "sqlite trigger",
+		dbt:  DBTypeSQLite,
+		sql: `CREATE TRIGGER touch AFTER UPDATE ON [users;] BEGIN
+	UPDATE [users;] SET updated = 1 WHERE id = NEW.id;
+END;
+SELECT 1;`,
+		want: []string{
+			`CREATE TRIGGER touch AFTER UPDATE ON [users;] BEGIN
+	UPDATE [users;] SET updated = 1 WHERE id = NEW.id;
+END`,
+			"SELECT 1",
+		},
+	}, {
+		name: "bigquery triple quotes",
+		dbt:  DBTypeBigQuery,
+		sql:  "SELECT '''a;\n'b';'''; SELECT 1",
+		want: []string{"SELECT '''a;\n'b';'''", "SELECT 1"},
+	}, {
+		name: "oracle q quotes",
+		dbt:  DBTypeOracle,
+		sql:  "INSERT INTO t VALUES (q'[it's;]'); SELECT 1 FROM dual;",
+		want: []string{
+			"INSERT INTO t VALUES (q'[it's;]')",
+			"SELECT 1 FROM dual",
+		},
+	}}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			stmts, err := splitStatements(tc.dbt, tc.sql)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0, len(stmts))
+			for _, stmt := range stmts {
+				got = append(got, stmt.sql)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestSplitStatementsUnterminated(t *testing.T) {
+	t.Parallel()
+	tcs := map[string]string{
+		"string":        "INSERT INTO t VALUES ('a;);",
+		"dollar quotes": "DO $$ BEGIN PERFORM 1; END;",
+		"comment":       "SELECT 1; /* a;",
+		"begin":         "CREATE TRIGGER t AFTER INSERT ON a BEGIN SELECT 1;",
+	}
+	for name, sql := range tcs {
+		if _, err := splitStatements(DBTypePostgres, sql); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
+
+func TestStripComments(t *testing.T) {
+	t.Parallel()
+	stmts, err := parseStatements(DBTypeMySQL, []byte(`-- create users
+CREATE TABLE users (
+	id INT, -- note; with a semicolon
+	name TEXT /* a; b */
+);
+/*!40101 SET NAMES utf8mb4 */;
+SELECT /*+ MAX_EXECUTION_TIME(1000) */ 1;
+CREATE PROCEDURE p()
+BEGIN
+	-- kept with the definition
+	SELECT 1;
+END;
+/* trailing */`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"CREATE TABLE users (\n\tid INT, \n\tname TEXT  \n)",
+		"/*!40101 SET NAMES utf8mb4 */",
+		"SELECT /*+ MAX_EXECUTION_TIME(1000) */ 1",
+		"CREATE PROCEDURE p()\nBEGIN\n\t-- kept with the definition\n\tSELECT 1;\nEND",
+	}
+	got := make([]string, 0, len(stmts))
+	for _, stmt := range stmts {
+		got = append(got, stmt.sql)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	stmts, err = parseStatementsFor(DBTypeSQLServer, []byte(`-- counts
+CREATE TABLE counts (n INT) /* GO */
+GO
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stmts) != 1 || stmts[0].sql != "CREATE TABLE counts (n INT)" {
+		t.Fatalf("unexpected statements %+v", stmts)
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		dbt  DBType
+		sql  string
+		want string
+	}{
+		{
+			dbt:  DBTypePostgres,
+			sql:  `INSERT INTO "users" (id, email) VALUES (42, 'a@b.c'), (4.5e3, E'x\'y')`,
+			want: `INSERT INTO "users" (id, email) VALUES (?, ?), (?, ?)`,
+		},
+		{
+			dbt:  DBTypePostgres,
+			sql:  "UPDATE t2 SET v = $1 WHERE body = $$secret$$",
+			want: "UPDATE t2 SET v = $1 WHERE body = ?",
+		},
+		{
+			dbt:  DBTypeMySQL,
+			sql:  "INSERT INTO `t` VALUES (\"it\\\"s\", 0x1F) -- don't",
+			want: "INSERT INTO `t` VALUES (?, ?) -- don't",
+		},
+		{
+			dbt:  DBTypeOracle,
+			sql:  "SELECT q'[it's]' FROM dual",
+			want: "SELECT ? FROM dual",
+		},
+		{
+			dbt:  DBTypeSQLite,
+			sql:  "SELECT 'unterminated FROM t",
+			want: "SELECT ?",
+		},
+	}
+	for _, tc := range tcs {
+		got := dialectFor(tc.dbt).sanitize(tc.sql)
+		if got != tc.want {
+			t.Errorf("%s %q: expected %q, got %q", tc.dbt, tc.sql,
+				tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package migrate
+
+import (
+	"context"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies migrate's spans among an application's.
+const tracerName = "github.com/thankful-ai/migrate"
+
+// WithTracerProvider traces each run with tp, so slow migrations can be seen
+// alongside application traces. A run of Migrate, MigrateUntil, MigrateTo, or
+// MigratePhase is a span, with a child span for each file and an event for
+// each statement executed. The run's span is a child of any span in the
+// context passed to MigrateContext. Statements are sanitized by replacing their
+// string and numeric literals with ?, since they may contain personal data,
+// unless they're redacted WithRedactedLiterals or WithRedactor instead.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(m *Migrate) { m.tracer = tp.Tracer(tracerName) }
+}
+
+// spans of the current run, updated as events are emitted.
+type spans struct {
+	// ctx of the run's span, in which each file's span is started.
+	ctx  context.Context
+	run  trace.Span
+	file trace.Span
+}
+
+// beginTrace of a run of pending files, if tracing WithTracerProvider.
+func (m *Migrate) beginTrace(pending int) {
+	if m.tracer == nil {
+		return
+	}
+	m.spans.ctx, m.spans.run = m.tracer.Start(m.ctx, "migrate",
+		trace.WithAttributes(
+			attribute.String("migrate.namespace", m.namespace),
+			attribute.String("migrate.db_type", string(m.dbt)),
+			attribute.Int("migrate.pending", pending),
+		))
+}
+
+// trace e in the spans of the run.
+func (m *Migrate) trace(e Event) {
+	s := &m.spans
+	if s.run == nil {
+		return
+	}
+	switch e := e.(type) {
+	case FileStarted:
+		_, s.file = m.tracer.Start(s.ctx, e.Filename,
+			trace.WithAttributes(
+				attribute.String("migrate.file", e.Filename),
+				attribute.Int("migrate.statements", e.Statements),
+				attribute.Int("migrate.checkpoints", e.Checkpoints),
+			))
+	case StatementExecuted:
+		if s.file == nil {
+			return
+		}
+		// emit already redacted the statement if configured to, in
+		// which case it's traced as redacted. Otherwise it's sanitized,
+		// since it may contain personal data.
+		sql := e.SQL
+		if !m.redacting() {
+			sql = dialectFor(m.dbt).sanitize(sql)
+		}
+		s.file.AddEvent("statement", trace.WithAttributes(
+			attribute.Int("migrate.index", e.Index),
+			attribute.Int("migrate.statements", e.Statements),
+			attribute.String("db.statement", sql),
+			attribute.Int64("migrate.duration_ms",
+				e.Duration.Milliseconds()),
+			attribute.Int64("migrate.rows_affected", e.RowsAffected),
+		))
+	case FileApplied:
+		if s.file != nil {
+			s.file.End()
+			s.file = nil
+		}
+	case Failed:
+		if s.file != nil {
+			s.file.RecordError(e.Err)
+			s.file.SetStatus(codes.Error, e.Err.Error())
+			s.file.End()
+			s.file = nil
+		}
+	case RunFinished:
+		if e.Err != nil {
+			s.run.RecordError(e.Err)
+			s.run.SetStatus(codes.Error, e.Err.Error())
+		}
+		s.run.SetAttributes(attribute.Int("migrate.migrated",
+			len(e.Migrated)))
+		s.run.End()
+		*s = spans{}
+	}
+}
+
+// sanitize the statement s for tracing and WithRedactedLiterals by replacing
+// its string and numeric literals with ?. Unterminated literals hide the rest
+// of the statement.
+func (d dialect) sanitize(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		c := s[i]
+		var (
+			j       = i + 1
+			err     error
+			literal bool
+		)
+		switch {
+		case strings.HasPrefix(s[i:], "--") && d.isDashComment(s, i),
+			c == '#' && d.hashComments:
+			j = lineEnd(s, i)
+		case strings.HasPrefix(s[i:], "/*"):
+			j, err = d.skipBlockComment(s, i)
+		case c == '\'', c == '"' && d.backslash:
+			j, err = d.skipString(s, i, d.backslash)
+			literal = true
+		case c == '"':
+			j, err = skipQuoted(s, i, `"`, `"`, false)
+		case c == '`' && d.backticks:
+			j, err = skipQuoted(s, i, "`", "`", false)
+		case c == '[' && d.brackets:
+			j, err = skipQuoted(s, i, "[", "]", false)
+		case c == '$' && d.dollarQuotes:
+			j, err = skipDollarQuoted(s, i)
+			literal = j > i+1
+			for !literal && j < len(s) && isDigit(s[j]) {
+				j++ // Keep parameters such as $1.
+			}
+		case isWordStart(c):
+			j = wordEnd(s, i)
+			if j < len(s) && s[j] == '\'' && d.isStringPrefix(s[i:j]) {
+				if d.qQuotes && strings.HasSuffix(strings.ToLower(s[i:j]), "q") {
+					j, err = skipQQuoted(s, j)
+				} else {
+					j, err = d.skipString(s, j, true)
+				}
+				literal = true
+			}
+		case isDigit(c):
+			for j < len(s) && (isDigit(s[j]) || s[j] == '.' ||
+				isWordStart(s[j])) {
+				j++
+			}
+			literal = true
+		}
+		if err != nil {
+			b.WriteByte('?')
+			break
+		}
+		if literal {
+			b.WriteByte('?')
+		} else {
+			b.WriteString(s[i:j])
+		}
+		i = j
+	}
+	return b.String()
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
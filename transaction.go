@@ -0,0 +1,40 @@
+package migrate
+
+// noTransactionDirective runs a file statement by statement rather than in a
+// transaction, for statements which can't run in one, such as CREATE INDEX
+// CONCURRENTLY on Postgres.
+const noTransactionDirective = directivePrefix + "no-transaction"
+
+// WithoutFileTransactions executes every file statement by statement. By
+// default, each migration file is executed in one transaction on databases
+// with transactional DDL, Postgres and SQLite, so a failed file leaves no
+// trace and runs again from its start. Files are executed statement by
+// statement regardless if they have a no-transaction directive, contain COPY,
+// LOAD DATA, or blob statements, or have an as directive, or if the Store
+// isn't a Transactor. A file is held in memory while it's executed in a
+// transaction.
+func WithoutFileTransactions() Option {
+	return func(m *Migrate) { m.noFileTransactions = true }
+}
+
+// transactionalDDL reports whether dbt rolls back DDL with the rest of a
+// transaction.
+func transactionalDDL(dbt DBType) bool {
+	return dbt == DBTypePostgres || dbt == DBTypeSQLite
+}
+
+// hasTransactions reports whether dbt can execute atomic groups. BigQuery
+// and ClickHouse execute every statement on its own.
+func hasTransactions(dbt DBType) bool {
+	return dbt != DBTypeBigQuery && dbt != DBTypeClickHouse
+}
+
+// inTransaction reports whether f is executed in one transaction on the
+// current Store.
+func (m *Migrate) inTransaction(f *file) bool {
+	if m.noFileTransactions || !f.transactional || !transactionalDDL(m.dbt) {
+		return false
+	}
+	_, ok := m.db.(Transactor)
+	return ok
+}
@@ -0,0 +1,31 @@
+package migrate
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// transcript records every executed statement and its result, untruncated
+// and timestamped, independent of the Logger. See WithTranscript.
+type transcript struct {
+	w io.Writer
+
+	// err is the first write error. Failing to write the transcript
+	// never interrupts a migration, since that could leave a statement
+	// executed without its checkpoint.
+	err error
+}
+
+// record a timestamped entry in the transcript, if one is configured.
+func (m *Migrate) record(format string, vs ...interface{}) {
+	t := m.transcript
+	if t == nil || t.err != nil {
+		return
+	}
+	ts := time.Now().UTC().Format(time.RFC3339Nano)
+	_, t.err = fmt.Fprintf(t.w, ts+" "+format+"\n", vs...)
+	if t.err != nil {
+		m.warnf("failed to write transcript: %v\n", t.err)
+	}
+}
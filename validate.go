@@ -0,0 +1,60 @@
+package migrate
+
+import (
+	"fmt"
+	"io/fs"
+
+	"github.com/pkg/errors"
+)
+
+// Validator checks the syntax of a statement without a database, such as with
+// the pgparse package. It's registered with WithValidator and run by Verify.
+type Validator func(stmt string) error
+
+// WithValidator checks every statement in pending migrations with v during
+// Verify. To check migrations in CI without a database, call Verify after
+// Load, when every migration is pending.
+func WithValidator(v Validator) Option {
+	return func(m *Migrate) { m.validators = append(m.validators, v) }
+}
+
+// validate pending migrations with every Validator, logging each invalid
+// statement. It reports the number of invalid statements.
+func (m *Migrate) validate() (int, error) {
+	if len(m.validators) == 0 {
+		return 0, nil
+	}
+	var invalid int
+	for _, fi := range m.pendingFiles() {
+		if fi.up != nil {
+			continue
+		}
+		byt, err := fs.ReadFile(m.fsys, fi.fullpath)
+		if err != nil {
+			return 0, errors.Wrap(err, "read file")
+		}
+		stmts, err := parseStatementsFor(m.dbt, byt)
+		if err != nil {
+			return 0, fmt.Errorf("statements %s: %w", fi.Info.Name(), err)
+		}
+		for i, stmt := range stmts {
+			cmd := stmt.sql
+			if isCopyStatement(cmd) {
+				// Validate the query without its data.
+				cmd, _, err = parseCopyBlock(cmd)
+				if err != nil {
+					return 0, fmt.Errorf("copy %s [%d]: %w",
+						fi.Info.Name(), i, err)
+				}
+			}
+			for _, v := range m.validators {
+				if err := v(cmd); err != nil {
+					m.errorf("%s [%d]: %s\n", fi.Info.Name(), i,
+						err)
+					invalid++
+				}
+			}
+		}
+	}
+	return invalid, nil
+}
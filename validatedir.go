@@ -0,0 +1,26 @@
+package migrate
+
+import (
+	"fmt"
+	"io/fs"
+)
+
+// ValidateDir checks the migrations in fsys without a Store or database, using
+// the same logic as New: filenames must be numbered without duplicates, every
+// file must contain statements which parse, and overrides for dbt must match
+// their migrations. Validators and filename policies passed in opts are
+// checked against every file. It's meant for build tooling and pre-commit
+// hooks, so problems are caught before they're deployed.
+func ValidateDir(fsys fs.FS, dbt DBType, opts ...Option) error {
+	opts = append([]Option{WithLogger(nopLogger{}), WithDBType(dbt)}, opts...)
+	m, err := Load(nil, ".", append(opts, WithFS(fsys))...)
+	if err != nil {
+		return err
+	}
+	for _, fi := range m.Files {
+		if fi.statements == 0 {
+			return fmt.Errorf("%w: %s", ErrNoStatements, fi.Info.Name())
+		}
+	}
+	return m.Verify()
+}
@@ -0,0 +1,66 @@
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+)
+
+// Warning is a non-fatal message raised by the database while executing a
+// statement.
+type Warning struct {
+	Level   string
+	Code    string
+	Message string
+
+	// Truncation reports whether the database truncated or coerced data
+	// to fit, such as a string too long for its column.
+	Truncation bool
+}
+
+func (w Warning) String() string {
+	if w.Code == "" {
+		return fmt.Sprintf("%s: %s", w.Level, w.Message)
+	}
+	return fmt.Sprintf("%s %s: %s", w.Level, w.Code, w.Message)
+}
+
+// Warner is implemented by Stores which can report the warnings raised by a
+// statement. It's optional and only used WithWarnings.
+type Warner interface {
+	// ExecWarnings executes query like Exec, also returning the warnings
+	// it raised.
+	ExecWarnings(
+		query string,
+		args ...interface{},
+	) (sql.Result, []Warning, error)
+}
+
+// execWarnings executes cmd, logging any warnings with the file and index of
+// the statement. If failing on truncation, a truncation warning returns
+// ErrTruncation.
+func (m *Migrate) execWarnings(
+	w Warner,
+	f *file,
+	i int,
+	cmd string,
+	args []interface{},
+) (sql.Result, error) {
+	res, warnings, err := w.ExecWarnings(cmd, args...)
+	if err != nil {
+		return nil, err
+	}
+	var truncated bool
+	for _, warning := range warnings {
+		m.warnf("%s %s [%d]: %s\n", m.colorize(colorYellow, "warning"),
+			filepath.Join(f.variant, f.Info.Name()), i, warning)
+		m.record("warning %s [%d]: %s", f.Info.Name(), i, warning)
+		if warning.Truncation {
+			truncated = true
+		}
+	}
+	if truncated && m.failOnTruncation {
+		return nil, ErrTruncation
+	}
+	return res, nil
+}